@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/olivere/elastic"
+)
+
+// blockAddresses 区块中出现的地址 (交易输出的地址以及被花费的 vout 的地址)，按首次出现的顺序保存，
+// scriptTypes 为地址在区块中第一个输出的脚本类型，只作为 vin 出现的地址没有脚本类型，txids 为区块中涉及地址的交易
+type blockAddresses struct {
+	addresses   []string
+	scriptTypes map[string]string
+	txids       map[string]map[string]bool
+}
+
+func newBlockAddresses() *blockAddresses {
+	return &blockAddresses{scriptTypes: make(map[string]string), txids: make(map[string]map[string]bool)}
+}
+
+func (b *blockAddresses) addVout(vout btcjson.Vout, txid string) {
+	for _, address := range vout.ScriptPubKey.Addresses {
+		if _, seen := b.scriptTypes[address]; !seen {
+			b.addresses = append(b.addresses, address)
+		}
+		if b.scriptTypes[address] == "" {
+			b.scriptTypes[address] = vout.ScriptPubKey.Type
+		}
+		b.addTx(address, txid)
+	}
+}
+
+// addVin txid 为花费该 vout 的交易。回滚时 es 中区块交易的 vout 文档同样按 addVin 加入，只用于统计交易数
+func (b *blockAddresses) addVin(voutWithID VoutWithID, txid string) {
+	for _, address := range voutWithID.Vout.Addresses {
+		if _, seen := b.scriptTypes[address]; !seen {
+			b.addresses = append(b.addresses, address)
+			b.scriptTypes[address] = ""
+		}
+		b.addTx(address, txid)
+	}
+}
+
+func (b *blockAddresses) addTx(address, txid string) {
+	if b.txids[address] == nil {
+		b.txids[address] = make(map[string]bool)
+	}
+	b.txids[address][txid] = true
+}
+
+// addressTxCountScript 地址文档的 tx_count 加上 params.txs (回滚时为负数) 并写入 params.doc 中的字段，
+// 之前版本写入的地址文档没有 tx_count，从 0 开始计数
+const addressTxCountScript = `if (ctx._source.tx_count == null) { ctx._source.tx_count = 0 } ctx._source.tx_count += params.txs; ctx._source.putAll(params.doc)`
+
+// addressUpsertRequests address 文档的 bulk 请求：新地址插入完整的文档，已有地址只更新 last_height 和 label 并把区块中涉及地址的交易数加到 tx_count，
+// first_height 和 script_type 保留地址第一次出现时的值，label 与 balance 文档相同 (见 withBalanceLabel)。
+// 同步和回滚 (见 addressRollbackRequests) 对 tx_count 的修改对称，重新同步前必须先回滚，否则 tx_count 会重复计算
+func (b *blockAddresses) addressUpsertRequests(height int32) []elastic.BulkableRequest {
+	var requests []elastic.BulkableRequest
+	for _, address := range b.addresses {
+		doc := withBalanceLabel(map[string]interface{}{"last_height": height}, address)
+		upsert := withBalanceLabel(map[string]interface{}{
+			"address":      address,
+			"first_height": height,
+			"last_height":  height,
+			"tx_count":     len(b.txids[address]),
+		}, address)
+		if scriptType := b.scriptTypes[address]; scriptType != "" {
+			upsert["script_type"] = scriptType
+		}
+		script := elastic.NewScript(addressTxCountScript).Lang("painless").
+			Params(map[string]interface{}{"txs": len(b.txids[address]), "doc": doc})
+		requests = append(requests, elastic.NewBulkUpdateRequest().Index("address").Type("address").Id(address).Script(script).Upsert(upsert))
+	}
+	return requests
+}
+
+// addressRollbackRequests 回滚区块时从 address 文档的 tx_count 减去区块中涉及地址的交易数，last_height 不回滚
+func (b *blockAddresses) addressRollbackRequests() []elastic.BulkableRequest {
+	var requests []elastic.BulkableRequest
+	for _, address := range b.addresses {
+		script := elastic.NewScript(addressTxCountScript).Lang("painless").
+			Params(map[string]interface{}{"txs": -len(b.txids[address]), "doc": map[string]interface{}{}})
+		requests = append(requests, elastic.NewBulkUpdateRequest().Index("address").Type("address").Id(address).Script(script))
+	}
+	return requests
+}
+
+// RollbackAddressTxCounts 回滚区块时更新涉及地址的 tx_count，在 DeleteAddressesFirstSeenAt 之后执行，
+// 已经删除的地址 (在该区块第一次出现) 和没有 address 文档的地址 (由之前版本同步) 更新失败返回 404，跳过
+func (esClient *elasticClientAlias) RollbackAddressTxCounts(ctx context.Context, rolledBack *blockAddresses) error {
+	requests := rolledBack.addressRollbackRequests()
+	if len(requests) == 0 {
+		return nil
+	}
+	resp, err := esClient.bulk().Add(requests...).do(ctx, rollbackRefresh())
+	if err != nil {
+		return errors.New(strings.Join([]string{"Rollback address tx counts error:", err.Error()}, " "))
+	}
+	var failed []*elastic.BulkResponseItem
+	for _, item := range resp.Failed() {
+		if item.Status != http.StatusNotFound {
+			failed = append(failed, item)
+		}
+	}
+	failBulkItems("Rollback address tx counts", failed)
+	return nil
+}
+
+// AddressEverUsed 地址是否在已同步的区块中出现过，余额已经花完的地址同样返回 true，用于钱包按 gap limit 扫描地址。
+// 先查 address 文档，之前版本同步的地址没有 address 文档，再查 balance 文档：balance 文档花完后保留 amount 为 0，不会删除。
+// 回滚同样不删除 balance 文档，只在被回滚的区块中出现过的地址仍然返回 true，钱包最多多扫描几个地址
+func (esClient *elasticClientAlias) AddressEverUsed(ctx context.Context, address string) (bool, error) {
+	res, err := esClient.Get().Index("address").Type("address").Id(address).Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return false, errors.New(strings.Join([]string{"Get address", address, "error:", err.Error()}, " "))
+	}
+	if err == nil && res.Found {
+		return true, nil
+	}
+	balancesWithIDs, err := esClient.BulkQueryBalance(ctx, address)
+	if err != nil {
+		return false, err
+	}
+	return len(balancesWithIDs) > 0, nil
+}
+
+// DeleteAddressesFirstSeenAt 回滚区块时删除在该高度第一次出现的地址，重新同步时按新的区块重新插入
+// 其他地址的 last_height 不回滚，重新同步后会被更新
+func (esClient *elasticClientAlias) DeleteAddressesFirstSeenAt(ctx context.Context, height int32) error {
+	q := elastic.NewTermQuery("first_height", height)
+	if _, err := esClient.DeleteByQuery().Index("address").Type("address").Query(q).Refresh(rollbackRefresh()).Do(ctx); err != nil {
+		return errors.New(strings.Join([]string{"Delete addresses first seen in rollback block error:", err.Error()}, " "))
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// newAPIHandler serve 命令提供的只读 REST API，数据全部从 es 查询。GET /fees 返回最近区块的推荐手续费率，见 RecommendedFees；
+// POST /addresses/balances 批量查询地址余额，见 BalancesOf
+func newAPIHandler(esClient *elasticClientAlias) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fees", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		fees, err := esClient.RecommendedFees(r.Context())
+		switch {
+		case errors.Is(err, ErrBlockNotFound):
+			writeAPIError(w, http.StatusServiceUnavailable, errors.New("no blocks indexed yet"))
+		case err != nil:
+			sugar.Error("recommended fees error: ", err.Error())
+			writeAPIError(w, http.StatusInternalServerError, errors.New("query fees error"))
+		default:
+			writeAPIJSON(w, http.StatusOK, fees)
+		}
+	})
+	mux.HandleFunc("/addresses/balances", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+			return
+		}
+		var req balancesRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, errors.New("invalid request body"))
+			return
+		}
+		if len(req.Addresses) > maxBalancesBatch {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("too many addresses: %d, at most %d per batch", len(req.Addresses), maxBalancesBatch))
+			return
+		}
+		balances, err := esClient.BalancesOf(r.Context(), req.Addresses)
+		if err != nil {
+			sugar.Error("balances of addresses error: ", err.Error())
+			writeAPIError(w, http.StatusInternalServerError, errors.New("query balances error"))
+			return
+		}
+		writeAPIJSON(w, http.StatusOK, balances)
+	})
+	return mux
+}
+
+// balancesRequest POST /addresses/balances 的请求，{"addresses": ["1A1z...", ...]}
+type balancesRequest struct {
+	Addresses []string `json:"addresses"`
+}
+
+func writeAPIJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeAPIError 错误以 {"error": "..."} 返回，es 的错误详情只写入日志，可能包含集群地址
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIJSON(w, status, map[string]string{"error": err.Error()})
+}
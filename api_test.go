@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAPIFees(t *testing.T) {
+	recommendedFeesBlocks := config.RecommendedFeesBlocks
+	config.RecommendedFeesBlocks = 6
+	defer func() { config.RecommendedFeesBlocks = recommendedFeesBlocks }()
+
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	handler := newAPIHandler(client)
+
+	// 还没有同步区块
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fees", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	es.put("block", "1", map[string]interface{}{"hash": "b1", "height": 1})
+	es.put("tx", "tx1", map[string]interface{}{"txid": "tx1", "blockhash": "b1", "feerate": 12.3, "coinbase": false, "fee_incomplete": false})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fees", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var fees map[string]interface{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &fees))
+	assert.Equal(t, 13.0, fees["fastestFee"])
+	assert.Equal(t, 13.0, fees["economyFee"])
+	assert.Equal(t, 1.0, fees["height"])
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/fees", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
+
+func TestAPIAddressBalances(t *testing.T) {
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	handler := newAPIHandler(client)
+	es.put("balance", "balance-a", map[string]interface{}{"address": "A", "amount": 1.5})
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/addresses/balances", strings.NewReader(`{"addresses": ["A", "unknown"]}`)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var balances map[string]float64
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &balances))
+	assert.Equal(t, map[string]float64{"A": 1.5, "unknown": 0}, balances)
+
+	// 超过 maxBalancesBatch 个地址
+	body, _ := json.Marshal(balancesRequest{Addresses: make([]string, maxBalancesBatch+1)})
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/addresses/balances", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/addresses/balances", strings.NewReader("not json")))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/addresses/balances", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// esBackpressure es 写入队列已满时会以 429 拒绝 bulk 请求中的文档，此时暂停同步新的区块，按指数退避等待 es 恢复
+type esBackpressure struct {
+	mu       sync.Mutex
+	rejected int // 连续出现 429 的 bulk 请求数，没有 429 的 bulk 请求会清零
+	backoff  elastic.Backoff
+}
+
+var backpressure = newESBackpressure(time.Second, time.Minute)
+
+func newESBackpressure(minBackoff, maxBackoff time.Duration) *esBackpressure {
+	return &esBackpressure{backoff: elastic.NewExponentialBackoff(minBackoff, maxBackoff)}
+}
+
+// observe 记录一次 bulk 请求的结果
+func (b *esBackpressure) observe(response *elastic.BulkResponse) {
+	tooManyRequests := false
+	for _, item := range response.Failed() {
+		if item.Status == http.StatusTooManyRequests {
+			tooManyRequests = true
+			break
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if tooManyRequests {
+		b.rejected++
+	} else {
+		b.rejected = 0
+	}
+}
+
+// state 连续出现 429 的 bulk 请求数，为 0 表示没有背压
+func (b *esBackpressure) state() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rejected
+}
+
+// delay 同步下一个区块前需要等待的时间，连续出现 429 的次数越多等待越久，最长为 maxBackoff
+func (b *esBackpressure) delay() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.rejected == 0 {
+		return 0
+	}
+	wait, _ := b.backoff.Next(b.rejected - 1)
+	return wait
+}
+
+// wait 同步下一个区块前调用，es 拒绝写入时暂停
+func (b *esBackpressure) wait() {
+	if delay := b.delay(); delay > 0 {
+		sugar.Warn("es rejected ", b.state(), " bulk requests in a row (429), pause syncing for ", delay)
+		time.Sleep(delay)
+	}
+}
+
+// esBulk 与 elastic.BulkService 相同，另外保留添加的请求：BulkService 执行成功后会清空请求，被 es 以 429 拒绝的文档需要重新提交
+type esBulk struct {
+	*elastic.BulkService
+	client   esAPI
+	requests []elastic.BulkableRequest
+}
+
+// bulk 创建 esBulk，通过 do 执行
+func (esClient *elasticClientAlias) bulk() *esBulk {
+	return &esBulk{BulkService: esClient.Bulk(), client: esClient.esAPI}
+}
+
+func (b *esBulk) Add(requests ...elastic.BulkableRequest) *esBulk {
+	b.BulkService.Add(requests...)
+	b.requests = append(b.requests, requests...)
+	return b
+}
+
+// do 执行 bulk 请求。es 以 429 拒绝的文档没有写入，按 backpressure 的指数退避等待 (最长 maxBackoff) 后只重新提交这些文档，直到全部被接受或 ctx 结束。
+// 返回的 Items 与添加的请求一一对应，重新提交的文档为最后一次的结果，其他状态的失败由调用方处理
+func (b *esBulk) do(ctx context.Context, refresh string) (*elastic.BulkResponse, error) {
+	response, err := b.BulkService.Refresh(refresh).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	merged := &elastic.BulkResponse{Took: response.Took, Items: response.Items}
+	pending := make([]int, len(b.requests))
+	for i := range pending {
+		pending[i] = i
+	}
+	for {
+		backpressure.observe(response)
+		var rejected []int
+		for i, item := range response.Items {
+			merged.Items[pending[i]] = item
+			if bulkItemStatus(item) == http.StatusTooManyRequests {
+				rejected = append(rejected, pending[i])
+			}
+		}
+		if len(rejected) == 0 {
+			break
+		}
+
+		delay := backpressure.delay()
+		sugar.Warn("es rejected ", len(rejected), " bulk items (429), retry in ", delay)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		retry := b.client.Bulk()
+		for _, i := range rejected {
+			retry.Add(b.requests[i])
+		}
+		if response, err = retry.Refresh(refresh).Do(ctx); err != nil {
+			return nil, err
+		}
+		pending = rejected
+	}
+	merged.Errors = len(merged.Failed()) > 0
+	b.requests = nil
+	return merged, nil
+}
+
+// bulkItemStatus bulk 响应中一个文档的状态
+func bulkItemStatus(item map[string]*elastic.BulkResponseItem) int {
+	for _, result := range item {
+		return result.Status
+	}
+	return 0
+}
+
+// checkBulkResponse 有文档写入失败时退出：余额等数据已经不完整，重新启动后会回滚并重新同步该区块。
+// 429 拒绝的文档已经由 esBulk.do 重新提交，这里的失败都不是背压
+func checkBulkResponse(name string, response *elastic.BulkResponse) {
+	failBulkItems(name, response.Failed())
+}
+
+// failBulkItems 有写入失败的文档时退出
+func failBulkItems(name string, failed []*elastic.BulkResponseItem) {
+	if len(failed) == 0 {
+		return
+	}
+	reason := ""
+	if failed[0].Error != nil {
+		reason = failed[0].Error.Reason
+	}
+	sugar.Fatal(name, ": ", len(failed), " bulk items failed, first ", failed[0].Index, "/", failed[0].Id, " status ", failed[0].Status, " ", reason)
+}
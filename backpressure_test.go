@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/olivere/elastic"
+	"github.com/stretchr/testify/assert"
+)
+
+func bulkResponseWithStatus(statuses ...int) *elastic.BulkResponse {
+	response := new(elastic.BulkResponse)
+	for _, status := range statuses {
+		response.Items = append(response.Items, map[string]*elastic.BulkResponseItem{"index": {Index: "vout", Status: status}})
+	}
+	return response
+}
+
+func TestESBackpressure(t *testing.T) {
+	b := newESBackpressure(10*time.Millisecond, 40*time.Millisecond)
+	assert.Equal(t, time.Duration(0), b.delay())
+
+	// 连续出现 429 时等待时间指数增长，不超过 maxBackoff
+	b.observe(bulkResponseWithStatus(http.StatusCreated, http.StatusTooManyRequests))
+	assert.Equal(t, 1, b.state())
+	first := b.delay()
+	assert.True(t, first > 0 && first <= 40*time.Millisecond, first)
+	b.observe(bulkResponseWithStatus(http.StatusTooManyRequests))
+	b.observe(bulkResponseWithStatus(http.StatusTooManyRequests))
+	assert.Equal(t, 3, b.state())
+	assert.True(t, b.delay() <= 40*time.Millisecond)
+
+	// 其他错误不算背压，没有 429 的 bulk 请求说明 es 已经恢复
+	b.observe(bulkResponseWithStatus(http.StatusCreated, http.StatusNotFound))
+	assert.Equal(t, 0, b.state())
+	assert.Equal(t, time.Duration(0), b.delay())
+}
+
+func TestESBulkRetriesRejectedItems(t *testing.T) {
+	defer func(b *esBackpressure) { backpressure = b }(backpressure)
+	backpressure = newESBackpressure(time.Millisecond, 4*time.Millisecond)
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+
+	// 前两个文档被拒绝，只重新提交这两个
+	es.rejectBulkItems = 2
+	bulk := client.bulk()
+	for _, id := range []string{"a", "b", "c"} {
+		bulk.Add(elastic.NewBulkIndexRequest().Index("vout").Type("vout").Id(id).Doc(map[string]interface{}{"value": 1}))
+	}
+	response, err := bulk.do(context.Background(), "true")
+	assert.Nil(t, err)
+	assert.Empty(t, response.Failed())
+	assert.Len(t, response.Items, 3)
+	assert.Equal(t, "b", response.Items[1]["index"].Id)
+	assert.Len(t, es.all("vout"), 3)
+	assert.Equal(t, 0, backpressure.state())
+
+	// 其他状态的失败不重试
+	es.failBulkIndex = "vout"
+	response, err = client.bulk().Add(elastic.NewBulkIndexRequest().Index("vout").Type("vout").Id("d").Doc(map[string]interface{}{"value": 1})).do(context.Background(), "true")
+	assert.Nil(t, err)
+	assert.Len(t, response.Failed(), 1)
+}
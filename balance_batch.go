@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/olivere/elastic"
+	"github.com/shopspring/decimal"
+)
+
+// balanceDeltaScript 把余额变化加到 balance 文档上，按 satoshi 取整避免浮点误差累积，labels_file 开启时同时更新 label
+const balanceDeltaScript = `ctx._source.amount = Math.round((ctx._source.amount + params.delta) * 1e8) / 1e8; if (params.containsKey('label')) { ctx._source.label = params.label }`
+
+// balanceBatch 开启 balance_bulk_actions 时区块的余额更新，与 tx、vout 的 bulk 请求分开写入
+// 批次中同一地址的多次变化 (如找零地址同时出现在 vin 和 vout 中) 合并为一次脚本更新，
+// 地址数达到 balance_bulk_actions 或估计大小达到 balance_bulk_size_bytes 时写入一批
+type balanceBatch struct {
+	esClient  *elasticClientAlias
+	ctx       context.Context
+	block     *btcjson.GetBlockVerboseResult
+	addresses []string // 按加入顺序写入
+	pending   map[string]*pendingBalance
+	size      int
+}
+
+// pendingBalance 批次中一个地址合并后的余额变化，ID 为空表示地址还没有 balance 文档
+type pendingBalance struct {
+	ID    string
+	Delta decimal.Decimal
+	Txids []string
+	Size  int
+}
+
+func (esClient *elasticClientAlias) newBalanceBatch(ctx context.Context, block *btcjson.GetBlockVerboseResult) *balanceBatch {
+	return &balanceBatch{esClient: esClient, ctx: ctx, block: block, pending: make(map[string]*pendingBalance)}
+}
+
+// add 加入地址的余额变化，balanceWithID 为 nil 表示地址没有 balance 文档
+func (b *balanceBatch) add(address string, balanceWithID *BalanceWithID, delta decimal.Decimal, txids []string) {
+	p, ok := b.pending[address]
+	if !ok {
+		p = &pendingBalance{Delta: decimal.New(0, 0)}
+		b.pending[address] = p
+		b.addresses = append(b.addresses, address)
+	}
+	if p.ID == "" && balanceWithID != nil {
+		p.ID = balanceWithID.ID
+	}
+	p.Delta = p.Delta.Add(delta)
+	// 找零地址的 vin、vout 变化来自同一笔交易，txid 只记录一次
+txids:
+	for _, txid := range txids {
+		for _, seen := range p.Txids {
+			if seen == txid {
+				continue txids
+			}
+		}
+		p.Txids = append(p.Txids, txid)
+	}
+
+	b.size -= p.Size
+	p.Size = estimatedRequestSize(p.request(address))
+	b.size += p.Size
+	if len(b.addresses) >= config.BalanceBulkActions || config.BalanceBulkSizeBytes > 0 && b.size >= config.BalanceBulkSizeBytes {
+		b.flush()
+	}
+}
+
+// request 地址已有 balance 文档时为脚本更新，否则写入新文档
+func (p *pendingBalance) request(address string) elastic.BulkableRequest {
+	if p.ID == "" {
+		newBalance := withBalanceLabel(map[string]interface{}{"address": address, "amount": btcFloat(p.Delta)}, address)
+		return elastic.NewBulkIndexRequest().Index("balance").Type("balance").Routing(balanceRouting(address)).Doc(newBalance)
+	}
+	params := withBalanceLabel(map[string]interface{}{"delta": btcFloat(p.Delta)}, address)
+	script := elastic.NewScript(balanceDeltaScript).Lang("painless").Params(params)
+	return elastic.NewBulkUpdateRequest().Index("balance").Type("balance").Id(p.ID).Routing(balanceRouting(address)).Script(script)
+}
+
+// flush 写入批次中的余额更新，写入失败的处理与 checkBalanceBulkResponse 相同
+func (b *balanceBatch) flush() {
+	if len(b.addresses) == 0 {
+		return
+	}
+	bulkRequest := b.esClient.bulk()
+	deltas := make(balanceDeltas)
+	for _, address := range b.addresses {
+		p := b.pending[address]
+		if p.ID == "" {
+			// 新建的 balance 文档不记录到 balance_dlq，写入失败时退出 (见 checkBalanceBulkResponse)
+			bulkRequest.Add(p.request(address))
+			continue
+		}
+		delta := &balanceDelta{Address: address, Delta: btcFloat(p.Delta), Height: int32(b.block.Height), BlockHash: b.block.Hash, Txids: p.Txids}
+		deltas.add(bulkRequest, p.request(address), delta)
+	}
+	resp, err := bulkRequest.do(b.ctx, "true")
+	if err != nil {
+		sugar.Fatal("update balance error: ", err.Error())
+	}
+	b.esClient.checkBalanceBulkResponse(b.ctx, "update balance", resp, deltas)
+
+	b.addresses = nil
+	b.pending = make(map[string]*pendingBalance)
+	b.size = 0
+}
+
+// estimatedRequestSize bulk 请求中 request 占用的字节数
+func estimatedRequestSize(request elastic.BulkableRequest) int {
+	lines, err := request.Source()
+	if err != nil {
+		return 0
+	}
+	return len(strings.Join(lines, "\n")) + 2
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/olivere/elastic"
+	"github.com/shopspring/decimal"
+)
+
+// balanceDelta 区块中一个地址余额的变化，balance 文档写入失败时记录到 balance_dlq index，之后通过 replay-balance-dlq 重新应用
+// 同一区块中地址的变化已经合并，Txids 为该地址在区块中涉及的交易
+type balanceDelta struct {
+	Address   string   `json:"address"`
+	Delta     float64  `json:"delta"`
+	Height    int32    `json:"height"`
+	BlockHash string   `json:"blockhash"`
+	Txids     []string `json:"txids,omitempty"`
+}
+
+func newBalanceDelta(address string, delta decimal.Decimal, block *btcjson.GetBlockVerboseResult, txids map[string][]string) *balanceDelta {
+	return &balanceDelta{Address: address, Delta: btcFloat(delta), Height: int32(block.Height), BlockHash: block.Hash, Txids: txids[address]}
+}
+
+// addressTxids 地址涉及的交易，按出现顺序去重
+func addressTxids(addressWithAmountAndTxids []AddressWithAmountAndTxid) map[string][]string {
+	txids := make(map[string][]string)
+	for _, a := range addressWithAmountAndTxids {
+		if n := len(txids[a.Address]); n > 0 && txids[a.Address][n-1] == a.Txid {
+			continue
+		}
+		txids[a.Address] = append(txids[a.Address], a.Txid)
+	}
+	return txids
+}
+
+// balanceDeltas bulk 请求中 balance 文档的更新，key 为请求在 bulk 中的位置，与 bulk 响应的 Items 一一对应
+type balanceDeltas map[int]*balanceDelta
+
+// add 在 bulkRequest 中添加 balance 文档的更新请求，并记录其余额变化
+func (deltas balanceDeltas) add(bulkRequest *esBulk, request elastic.BulkableRequest, delta *balanceDelta) {
+	deltas[bulkRequest.NumberOfActions()] = delta
+	bulkRequest.Add(request)
+}
+
+// checkBalanceBulkResponse 与 checkBulkResponse 相同，开启 balance_dlq 时已有 balance 文档的更新失败记录到 balance_dlq 后继续同步，
+// 其他文档写入失败或 balance_dlq 写入失败时仍然退出。新建 balance 文档的请求不加入 deltas，写入失败时也退出：
+// 否则之后花费该地址的 vout 时找不到 balance 文档 (ErrBalanceNotFound)，同步会停在那个区块
+// 回滚区块时 balance_dlq 中的记录保留：回滚减去了未生效的变化，replay 时加回即可
+func (esClient *elasticClientAlias) checkBalanceBulkResponse(ctx context.Context, name string, response *elastic.BulkResponse, deltas balanceDeltas) {
+	if !config.BalanceDLQ {
+		checkBulkResponse(name, response)
+		return
+	}
+
+	var (
+		failed     []*elastic.BulkResponseItem
+		deadLetter []*balanceDelta
+	)
+	for i, item := range response.Items {
+		for _, result := range item {
+			if result.Status >= 200 && result.Status <= 299 {
+				continue
+			}
+			if delta, ok := deltas[i]; ok {
+				deadLetter = append(deadLetter, delta)
+				continue
+			}
+			failed = append(failed, result)
+		}
+	}
+	failBulkItems(name, failed)
+	if len(deadLetter) == 0 {
+		return
+	}
+
+	bulkRequest := esClient.bulk()
+	for _, delta := range deadLetter {
+		bulkRequest.Add(elastic.NewBulkIndexRequest().Index("balance_dlq").Type("balance_dlq").Doc(delta))
+	}
+	dlqResp, err := bulkRequest.do(ctx, "true")
+	if err != nil {
+		sugar.Fatal(name, ": write balance dlq error: ", err.Error())
+	}
+	checkBulkResponse(name+": write balance dlq", dlqResp)
+	sugar.Warn(name, ": ", len(deadLetter), " balance updates failed, recorded in balance_dlq")
+}
+
+// balanceDLQEntry balance_dlq 中的记录
+type balanceDLQEntry struct {
+	ID string
+	balanceDelta
+}
+
+// ReplayBalanceDLQ 按区块高度顺序把 balance_dlq 中的余额变化重新应用到 balance 文档，成功后删除记录，返回重新应用的记录数
+// balance 文档为读改写更新，需要在同步停止时执行
+func (esClient *elasticClientAlias) ReplayBalanceDLQ(ctx context.Context) (int, error) {
+	replayed := 0
+	for {
+		entries, err := esClient.queryBalanceDLQ(ctx, snapshotBatchSize)
+		if err != nil {
+			return replayed, err
+		}
+		if len(entries) == 0 {
+			return replayed, nil
+		}
+
+		// 同一地址的多条记录先累加，每个地址只读改写一次
+		var addresses []interface{}
+		sums := make(map[string]decimal.Decimal)
+		for _, entry := range entries {
+			if _, ok := sums[entry.Address]; !ok {
+				addresses = append(addresses, entry.Address)
+				sums[entry.Address] = decimal.New(0, 0)
+			}
+			sums[entry.Address] = sums[entry.Address].Add(decimal.NewFromFloat(entry.Delta))
+		}
+		balancesWithIDs, err := esClient.BulkQueryBalance(ctx, addresses...)
+		if err != nil {
+			return replayed, err
+		}
+
+		bulkRequest := esClient.Bulk()
+		for _, addressI := range addresses {
+			address := addressI.(string)
+			if balanceWithID, exists := findBalanceByAddress(balancesWithIDs, address); exists {
+				amount := btcFloat(decimal.NewFromFloat(balanceWithID.Balance.Amount).Add(sums[address]))
+				bulkRequest.Add(elastic.NewBulkUpdateRequest().Index("balance").Type("balance").Id(balanceWithID.ID).Routing(balanceRouting(address)).
+					Doc(withBalanceLabel(map[string]interface{}{"amount": amount}, address)))
+			} else {
+				newBalance := withBalanceLabel(map[string]interface{}{"address": address, "amount": btcFloat(sums[address])}, address)
+				bulkRequest.Add(elastic.NewBulkIndexRequest().Index("balance").Type("balance").Routing(balanceRouting(address)).Doc(newBalance))
+			}
+		}
+		resp, err := bulkRequest.Refresh("true").Do(ctx)
+		if err != nil {
+			return replayed, errors.New(strings.Join([]string{"Replay balance dlq error:", err.Error()}, " "))
+		}
+		if failed := resp.Failed(); len(failed) > 0 {
+			return replayed, errors.New(strings.Join([]string{"Replay balance dlq error:", strconv.Itoa(len(failed)), "balance docs failed to update"}, " "))
+		}
+
+		// 余额已经更新，删除失败时再次 replay 会重复应用，所以删除失败直接返回错误
+		deleteRequest := esClient.Bulk()
+		for _, entry := range entries {
+			deleteRequest.Add(elastic.NewBulkDeleteRequest().Index("balance_dlq").Type("balance_dlq").Id(entry.ID))
+		}
+		deleteResp, err := deleteRequest.Refresh("true").Do(ctx)
+		if err != nil {
+			return replayed, errors.New(strings.Join([]string{"Delete replayed balance dlq entries error:", err.Error()}, " "))
+		}
+		if failed := deleteResp.Failed(); len(failed) > 0 {
+			return replayed, errors.New(strings.Join([]string{"Delete replayed balance dlq entries error:", strconv.Itoa(len(failed)), "entries failed to delete"}, " "))
+		}
+		replayed += len(entries)
+	}
+}
+
+// queryBalanceDLQ 按区块高度查询 balance_dlq 中最早的 size 条记录
+func (esClient *elasticClientAlias) queryBalanceDLQ(ctx context.Context, size int) ([]*balanceDLQEntry, error) {
+	searchResult, err := esClient.Search().Index("balance_dlq").Type("balance_dlq").Query(elastic.NewMatchAllQuery()).
+		Sort("height", true).Size(size).Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.New(strings.Join([]string{"Query balance dlq error:", err.Error()}, " "))
+	}
+	var entries []*balanceDLQEntry
+	for _, hit := range searchResult.Hits.Hits {
+		entry := &balanceDLQEntry{ID: hit.Id}
+		if err := json.Unmarshal(*hit.Source, &entry.balanceDelta); err != nil {
+			return nil, errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -1,12 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
 	"github.com/shopspring/decimal"
 )
 
@@ -14,7 +29,11 @@ type bitcoinClientAlias struct {
 	*rpcclient.Client
 }
 
-func (conf *configure) bitcoinClient() *rpcclient.Client {
+// bitcoinCookieModTime 创建 rpc 客户端时读取的 btc_cookie_file 的修改时间，见 reloadIfCookieChanged
+var bitcoinCookieModTime time.Time
+
+// bitcoinConnConfig 配置了 btc_cookie_file 时用 cookie 认证，从 cookie 文件读取 User、Pass，忽略 btc_usr、btc_pass
+func (conf *configure) bitcoinConnConfig() (*rpcclient.ConnConfig, time.Time, error) {
 	connCfg := &rpcclient.ConnConfig{
 		Host:         strings.Join([]string{conf.BitcoinHost, conf.BitcoinPort}, ":"),
 		User:         conf.BitcoinUser,
@@ -22,14 +41,76 @@ func (conf *configure) bitcoinClient() *rpcclient.Client {
 		HTTPPostMode: conf.BitcoinhttpMode,
 		DisableTLS:   conf.BitcoinDisableTLS,
 	}
+	if conf.BitcoinCookieFile == "" {
+		return connCfg, time.Time{}, nil
+	}
+	user, pass, modTime, err := readBitcoinCookie(conf.BitcoinCookieFile)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	connCfg.User, connCfg.Pass = user, pass
+	return connCfg, modTime, nil
+}
 
+// readBitcoinCookie 读取 bitcoind 的 .cookie 文件，内容为 __cookie__:password
+func readBitcoinCookie(path string) (string, string, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", "", time.Time{}, errors.New(strings.Join([]string{"Read bitcoind cookie file error:", err.Error()}, " "))
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", time.Time{}, errors.New(strings.Join([]string{"Read bitcoind cookie file error:", err.Error()}, " "))
+	}
+	parts := strings.SplitN(strings.TrimSpace(string(raw)), ":", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", time.Time{}, errors.New(strings.Join([]string{"bitcoind cookie file", path, "is not in user:password format"}, " "))
+	}
+	return parts[0], parts[1], info.ModTime(), nil
+}
+
+func (conf *configure) bitcoinClient() *rpcclient.Client {
+	connCfg, modTime, err := conf.bitcoinConnConfig()
+	if err != nil {
+		sugar.Fatal(err.Error())
+	}
 	client, err := rpcclient.New(connCfg, nil)
 	if err != nil {
 		sugar.Fatal("bitcoind client err: ", err.Error())
 	}
+	bitcoinCookieModTime = modTime
 	return client
 }
 
+// reloadIfCookieChanged 配置了 btc_cookie_file 时，cookie 文件修改后 (bitcoind 重启时写入新的 cookie) 用新的 cookie 重新创建 rpc 客户端。
+// sync、tail 在每轮同步前调用；替换的是 btcClient 指向的客户端，prevouts 仍然有效
+func (btcClient *bitcoinClientAlias) reloadIfCookieChanged() {
+	if config.BitcoinCookieFile == "" {
+		return
+	}
+	info, err := os.Stat(config.BitcoinCookieFile)
+	if err != nil {
+		sugar.Error("stat bitcoind cookie file error: ", err.Error())
+		return
+	}
+	if info.ModTime().Equal(bitcoinCookieModTime) {
+		return
+	}
+	connCfg, modTime, err := config.bitcoinConnConfig()
+	if err != nil {
+		sugar.Error(err.Error())
+		return
+	}
+	client, err := rpcclient.New(connCfg, nil)
+	if err != nil {
+		sugar.Error("bitcoind client err: ", err.Error())
+		return
+	}
+	btcClient.Shutdown()
+	btcClient.Client, bitcoinCookieModTime = client, modTime
+	sugar.Info("Reloaded bitcoind cookie file: ", config.BitcoinCookieFile)
+}
+
 func (btcClient *bitcoinClientAlias) ReSetSync(hightest int32, elasticClient *elasticClientAlias) {
 	names, err := elasticClient.IndexNames()
 	ctx := context.Background()
@@ -37,12 +118,24 @@ func (btcClient *bitcoinClientAlias) ReSetSync(hightest int32, elasticClient *el
 		sugar.Fatal("ctx error: ", err.Error())
 	}
 
+	if config.TxDataStream {
+		if err := elasticClient.deleteTxDataStream(ctx); err != nil {
+			sugar.Fatal(err.Error())
+		}
+	}
 	for _, name := range names {
 		elasticClient.DeleteIndex(name).Do(ctx)
 	}
 
 	elasticClient.createIndices()
-	btcClient.dumpToES(int32(1), hightest, int(ROLLBACKHEIGHT), elasticClient)
+	// 初始同步期间 index 处于 bulk load 模式，同步到当前最高区块后恢复
+	if err := elasticClient.EnterBulkLoadMode(ctx); err != nil {
+		sugar.Fatal(err.Error())
+	}
+	btcClient.dumpToES(config.SyncFromHeight, hightest, int(ROLLBACKHEIGHT), elasticClient)
+	if err := elasticClient.ExitBulkLoadMode(ctx); err != nil {
+		sugar.Fatal(err.Error())
+	}
 }
 
 func (btcClient *bitcoinClientAlias) getBlock(height int32) (*btcjson.GetBlockVerboseResult, error) {
@@ -51,13 +144,433 @@ func (btcClient *bitcoinClientAlias) getBlock(height int32) (*btcjson.GetBlockVe
 		return nil, err
 	}
 
-	block, err := btcClient.GetBlockVerboseTxM(blockHash)
+	return btcClient.getBlockVerboseTx(blockHash.String())
+}
+
+func (btcClient *bitcoinClientAlias) getBlockByHash(hash string) (*btcjson.GetBlockVerboseResult, error) {
+	blockHash, err := chainhash.NewHashFromStr(hash)
+	if err != nil {
+		return nil, err
+	}
+	return btcClient.getBlockVerboseTx(blockHash.String())
+}
+
+// getBlockVerbosity getblock verbosity 为 2 时返回区块中所有交易的详细数据 (vin、vout、hex 等)，每个区块只需要一次 rpc 调用
+const getBlockVerbosity = 2
+
+// getBlockVerboseTx 以 verbosity 2 调用 getblock，不依赖 rpcclient 对 verbose 参数的处理 (bool 参数在不同版本的 bitcoind 中含义不同)
+func (btcClient *bitcoinClientAlias) getBlockVerboseTx(hash string) (*btcjson.GetBlockVerboseResult, error) {
+	hashParam, err := json.Marshal(hash)
+	if err != nil {
+		return nil, err
+	}
+	verbosityParam, err := json.Marshal(getBlockVerbosity)
+	if err != nil {
+		return nil, err
+	}
+
+	rawBlock, err := btcClient.RawRequest("getblock", []json.RawMessage{hashParam, verbosityParam})
 	if err != nil {
 		return nil, err
 	}
+	return decodeBlockVerboseTx(rawBlock)
+}
+
+// decodeBlockVerboseTx 解析 getblock verbosity 2 的结果，tx 字段为交易详情而不是 txid
+func decodeBlockVerboseTx(rawBlock json.RawMessage) (*btcjson.GetBlockVerboseResult, error) {
+	block := new(btcjson.GetBlockVerboseResult)
+	if err := json.Unmarshal(rawBlock, block); err != nil {
+		return nil, err
+	}
+	for _, tx := range block.Tx {
+		deriveVoutAddresses(tx.Vout)
+	}
 	return block, nil
 }
 
+// AddressDeriver 自定义的地址解析，用于节点和 txscript 都不能解析出地址的输出脚本 (非标准或实验性的脚本)。
+// 返回的地址与标准地址一样写入 vout、tx 文档并计入余额，返回空表示该脚本没有地址。
+// 同一个脚本每次必须得到相同的地址，花费和回滚使用 vout 文档中保存的地址，结果变化会导致余额错误
+type AddressDeriver func(scriptPubKey btcjson.ScriptPubKeyResult) []string
+
+// addressDerivers 按名字注册的 AddressDeriver，由 address_deriver 配置项选择
+var addressDerivers = map[string]AddressDeriver{
+	"script_hash": scriptHashAddress,
+}
+
+// RegisterAddressDeriver 注册名为 name 的 AddressDeriver，供 address_deriver 选择。在 init 中调用，名字已经注册时 panic
+func RegisterAddressDeriver(name string, deriver AddressDeriver) {
+	if _, exists := addressDerivers[name]; exists {
+		panic("address deriver " + name + " already registered")
+	}
+	addressDerivers[name] = deriver
+}
+
+// useAddressDeriver 按 address_deriver 设置 AddressDeriver，名字没有注册时返回错误，为空时不修改
+func (conf *configure) useAddressDeriver() error {
+	if conf.AddressDeriverName == "" {
+		return nil
+	}
+	deriver, ok := addressDerivers[conf.AddressDeriverName]
+	if !ok {
+		names := make([]string, 0, len(addressDerivers))
+		for name := range addressDerivers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown address_deriver %q, registered: %s", conf.AddressDeriverName, strings.Join(names, ", "))
+	}
+	conf.AddressDeriver = deriver
+	return nil
+}
+
+// scriptHashAddress 内置的 AddressDeriver script_hash：以输出脚本的 sha256 作为地址 (s- 加 hex)，相同脚本的输出计入同一个地址。
+// nulldata 输出无法花费，不给地址
+func scriptHashAddress(scriptPubKey btcjson.ScriptPubKeyResult) []string {
+	if scriptPubKey.Hex == "" || scriptPubKey.Type == txscript.NullDataTy.String() {
+		return nil
+	}
+	script, err := hex.DecodeString(scriptPubKey.Hex)
+	if err != nil {
+		return nil
+	}
+	hash := sha256.Sum256(script)
+	return []string{"s-" + hex.EncodeToString(hash[:])}
+}
+
+// deriveVoutAddresses 补全没有地址的输出: 先由 P2PK 公钥得到地址，仍然没有地址时交给 config.AddressDeriver
+func deriveVoutAddresses(vouts []btcjson.Vout) {
+	deriveP2PKAddresses(vouts)
+	if config == nil || config.AddressDeriver == nil {
+		return
+	}
+	for i := range vouts {
+		scriptPubKey := &vouts[i].ScriptPubKey
+		if len(scriptPubKey.Addresses) > 0 {
+			continue
+		}
+		if addresses := config.AddressDeriver(*scriptPubKey); len(addresses) > 0 {
+			scriptPubKey.Addresses = addresses
+		}
+	}
+}
+
+// deriveP2PKAddresses 部分节点对 pay-to-pubkey 输出不返回地址 (早期的挖矿奖励大多是 P2PK)，由公钥得到对应的 P2PKH 地址，
+// 与 blk*.dat 导入时解析的地址一致，这些输出的金额才能计入地址余额。公钥无效的输出仍然没有地址
+func deriveP2PKAddresses(vouts []btcjson.Vout) {
+	for i := range vouts {
+		scriptPubKey := &vouts[i].ScriptPubKey
+		if scriptPubKey.Type != txscript.PubKeyTy.String() || len(scriptPubKey.Addresses) > 0 {
+			continue
+		}
+		if address, ok := p2pkAddress(scriptPubKey.Hex); ok {
+			scriptPubKey.Addresses = []string{address}
+		}
+	}
+}
+
+// p2pkAddress pay-to-pubkey 输出脚本中公钥对应的 P2PKH 地址
+func p2pkAddress(scriptHex string) (string, bool) {
+	script, err := hex.DecodeString(scriptHex)
+	if err != nil {
+		return "", false
+	}
+	class, addrs, _, err := txscript.ExtractPkScriptAddrs(script, chain.Params)
+	if err != nil || class != txscript.PubKeyTy || len(addrs) != 1 {
+		return "", false
+	}
+	pubKey, ok := addrs[0].(*btcutil.AddressPubKey)
+	if !ok {
+		return "", false
+	}
+	return pubKey.AddressPubKeyHash().EncodeAddress(), true
+}
+
+// reindexBlock 重新索引单个区块：先回滚 es 中该高度已有区块的 tx, vout, balance 数据，再同步节点返回的区块
+func (btcClient *bitcoinClientAlias) reindexBlock(block *btcjson.GetBlockVerboseResult, elasticClient *elasticClientAlias) {
+	reindexTime := time.Now()
+	ctx := context.Background()
+	height := int32(block.Height)
+
+	esBlock, err := elasticClient.QueryEsBlockByHeight(ctx, height)
+	if err != nil && !errors.Is(err, ErrBlockNotFound) {
+		sugar.Fatal("Query es block error: ", err.Error())
+	}
+	refetch := config.SlimBlockDocs
+	if esBlock != nil && !refetch {
+		// oversized 交易在区块文档中的 vin、vout 不完整，按区块文档回滚会漏掉其余的输入输出
+		if refetch, err = elasticClient.IndexedBlockOversized(ctx, height); err != nil {
+			sugar.Fatal("Query es block error: ", err.Error())
+		}
+	}
+	if esBlock != nil && refetch {
+		// slim 区块文档没有交易详情，oversized 交易的详情不完整，从节点按 hash 取回已索引的区块 (分叉后的旧区块节点仍然保存)
+		esBlock, err = btcClient.getBlockByHash(esBlock.Hash)
+		if err != nil {
+			sugar.Fatal("Get indexed block from bitcoind error: ", err.Error())
+		}
+	}
+	if esBlock != nil {
+		sugar.Info("Rollback indexed block ", esBlock.Height, " ", esBlock.Hash)
+		elasticClient.RollbackTxVoutBalanceByBlock(ctx, esBlock, esBlock.Hash != block.Hash)
+	}
+
+	header, err := btcClient.getBlockHeader(block.Hash)
+	if err != nil {
+		sugar.Fatal("Get block header error: ", err.Error())
+	}
+	stats := elasticClient.syncTxVoutBalance(ctx, block)
+	btcClient.verifyBlockFees(block, stats)
+	elasticClient.RollBackAndSyncBlock(height, block, header, stats)
+	logBlockSynced("Reindex block", block, stats, time.Since(reindexTime))
+}
+
+// blockHeaderVerbose getblockheader 返回的字段中 btcjson.GetBlockVerboseResult 没有包含的部分
+type blockHeaderVerbose struct {
+	Hash       string `json:"hash"`
+	MedianTime int64  `json:"mediantime"`
+	Chainwork  string `json:"chainwork"`
+	NTx        int    `json:"nTx"`
+}
+
+func (btcClient *bitcoinClientAlias) getBlockHeader(hash string) (*blockHeaderVerbose, error) {
+	hashParam, err := json.Marshal(hash)
+	if err != nil {
+		return nil, err
+	}
+	verboseParam, err := json.Marshal(true)
+	if err != nil {
+		return nil, err
+	}
+
+	rawHeader, err := btcClient.RawRequest("getblockheader", []json.RawMessage{hashParam, verboseParam})
+	if err != nil {
+		return nil, err
+	}
+	header := new(blockHeaderVerbose)
+	if err := json.Unmarshal(rawHeader, header); err != nil {
+		return nil, err
+	}
+	return header, nil
+}
+
+// getBlockTotalFee 通过 getblockstats 查询节点统计的区块手续费总额 (不含出块奖励)
+func (btcClient *bitcoinClientAlias) getBlockTotalFee(hash string) (decimal.Decimal, error) {
+	hashParam, err := json.Marshal(hash)
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	statsParam, err := json.Marshal([]string{"totalfee"})
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+
+	rawStats, err := btcClient.RawRequest("getblockstats", []json.RawMessage{hashParam, statsParam})
+	if err != nil {
+		return decimal.Decimal{}, err
+	}
+	return decodeBlockTotalFee(rawStats)
+}
+
+// decodeBlockTotalFee 解析 getblockstats 的 totalfee，单位为 satoshi
+func decodeBlockTotalFee(rawStats json.RawMessage) (decimal.Decimal, error) {
+	stats := struct {
+		TotalFee *int64 `json:"totalfee"`
+	}{}
+	if err := json.Unmarshal(rawStats, &stats); err != nil {
+		return decimal.Decimal{}, err
+	}
+	if stats.TotalFee == nil {
+		return decimal.Decimal{}, errors.New("totalfee not found in getblockstats result")
+	}
+	return decimal.New(*stats.TotalFee, -8), nil
+}
+
+// verifyBlockFees verify_block_fees 开启时对比同步计算的手续费总额与节点统计的手续费总额，结果写入 block 文档，不一致时告警
+// 不一致通常说明有 vin 花费的 vout 没有找到 (fee_incomplete 的交易) 或金额计算有误
+func (btcClient *bitcoinClientAlias) verifyBlockFees(block *btcjson.GetBlockVerboseResult, stats *blockStats) {
+	if !config.VerifyBlockFees {
+		return
+	}
+	reportedFees, err := btcClient.getBlockTotalFee(block.Hash)
+	if err != nil {
+		sugar.Warn("Get block total fee of ", block.Hash, " error, skip fee verification: ", err.Error())
+		return
+	}
+	stats.ReportedFees = &reportedFees
+	if stats.feeMismatch() {
+		sugar.Warnw("Block fees mismatch",
+			"height", block.Height,
+			"hash", block.Hash,
+			"total_fees", btcFloat(stats.TotalFees),
+			"reported_fees", btcFloat(reportedFees))
+	}
+}
+
+// verifyAfterIndexRetries verify_after_index 发现 es 中的区块与节点不一致时重新同步的次数，仍不一致时退出
+const verifyAfterIndexRetries = 2
+
+// verifyAfterIndex verify_after_index 开启时在区块写入后重新从节点获取该高度的区块头，核对 es 中的区块 hash、tx_count 和 tx 文档数，
+// 不一致时回滚并按节点当前的区块重新同步，最多 verifyAfterIndexRetries 次。返回最终写入的区块和统计数据
+func (btcClient *bitcoinClientAlias) verifyAfterIndex(esClient *elasticClientAlias, height int32, block *btcjson.GetBlockVerboseResult,
+	stats *blockStats) (*btcjson.GetBlockVerboseResult, *blockStats) {
+	if !config.VerifyAfterIndex {
+		return block, stats
+	}
+	ctx := context.Background()
+	for attempt := 0; ; attempt++ {
+		mismatch, err := btcClient.indexedBlockMismatch(ctx, esClient, height)
+		if err != nil {
+			mismatch = err.Error()
+		}
+		if mismatch == "" {
+			return block, stats
+		}
+		if attempt == verifyAfterIndexRetries {
+			sugar.Fatal("Block ", height, " still differs from the node after ", verifyAfterIndexRetries, " resyncs: ", mismatch)
+		}
+		sugar.Warnw("Indexed block differs from the node, resync it",
+			"height", height,
+			"hash", block.Hash,
+			"mismatch", mismatch,
+			"attempt", attempt+1)
+
+		nodeBlock, err := btcClient.getBlock(height)
+		if err != nil {
+			sugar.Fatal("Get block error: ", err.Error())
+		}
+		// 节点在该高度换了区块 (同步期间发生分叉) 时先回滚写入的旧区块，同一区块由 RollBackAndSyncTx 回滚后重新同步
+		if nodeBlock.Hash != block.Hash {
+			if err := esClient.RollbackTxVoutBalanceByBlock(ctx, block, true); err != nil {
+				sugar.Fatal("Rollback block ", height, " error: ", err.Error())
+			}
+		}
+		block = nodeBlock
+		header, err := btcClient.getBlockHeader(block.Hash)
+		if err != nil {
+			sugar.Fatal("Get block header error: ", err.Error())
+		}
+		stats = esClient.RollBackAndSyncTx(height, height, 0, block)
+		btcClient.verifyBlockFees(block, stats)
+		esClient.RollBackAndSyncBlock(height, block, header, stats)
+	}
+}
+
+// indexedBlockMismatch 从节点获取 height 的区块 hash 和交易数，与 es 中的区块比较
+func (btcClient *bitcoinClientAlias) indexedBlockMismatch(ctx context.Context, esClient *elasticClientAlias, height int32) (string, error) {
+	hash, err := btcClient.GetBlockHash(int64(height))
+	if err != nil {
+		return "", err
+	}
+	header, err := btcClient.getBlockHeader(hash.String())
+	if err != nil {
+		return "", err
+	}
+	txCount := header.NTx
+	// getblockheader 在 bitcoind 0.17 之前没有 nTx，获取完整的区块计数
+	if txCount == 0 {
+		block, err := btcClient.getBlockByHash(header.Hash)
+		if err != nil {
+			return "", err
+		}
+		txCount = len(block.Tx)
+	}
+	return esClient.IndexedBlockMismatch(ctx, height, header.Hash, txCount)
+}
+
+// blockStats 同步区块交易时累计的统计数据，写入 block 文档，避免查询时再对 tx type 做聚合
+type blockStats struct {
+	TxCount          int
+	TotalFees        decimal.Decimal // coinbase 交易的 fee 为 0，不计入
+	TotalOutputValue decimal.Decimal
+	// SegwitTxCount 带有 witness 的非 coinbase 交易数，BaseSize/WitnessSize 为所有交易不含 witness 的大小和 witness 数据大小之和 (不含区块头)
+	SegwitTxCount int
+	BaseSize      int64
+	WitnessSize   int64
+	// 以下只用于同步日志，不写入 block 文档
+	VoutsCreated    int // 写入 es 的 vout 数量，包括没有地址的 vout (见 newVoutFun)
+	VinsSpent       int // 找到花费的 vout 的 vin 数量
+	BalancesTouched int // 余额有变化的地址数量
+	// ReportedFees 节点统计的手续费总额，verify_block_fees 开启且查询成功时才有
+	ReportedFees *decimal.Decimal
+	// CoinbaseHeight coinbase 中 BIP34 编码的高度的检查结果，BIP34 激活前的区块为 nil
+	CoinbaseHeight *coinbaseHeightCheck
+	// DifficultyRatio 与前一个区块的难度之比，前一个区块不在 es 中 (同步的第一个区块) 时为 nil
+	DifficultyRatio *float64
+}
+
+// addTxSizes 累计交易的 base size、witness size 和 segwit 交易数。segwit 激活后 coinbase 交易带有 witness reserved value，
+// witness 计入 WitnessSize，但 coinbase 不花费 segwit 输出，不计入 SegwitTxCount
+func (stats *blockStats) addTxSizes(tx btcjson.TxRawResult) {
+	base, witness, segwit := txSizes(tx)
+	stats.BaseSize += int64(base)
+	stats.WitnessSize += int64(witness)
+	if segwit && !isCoinbaseTx(tx.Vin) {
+		stats.SegwitTxCount++
+	}
+}
+
+// coinbaseHeightCheck coinbase 中解析出的高度，无法解析时 Height 为 nil，Mismatch 为 true
+type coinbaseHeightCheck struct {
+	Height   *int32
+	Mismatch bool
+}
+
+// checkCoinbaseHeight BIP34 激活后的区块 (v2 区块起) coinbase scriptSig 以区块高度开头，解析后与同步的区块高度比较，不一致时记录警告
+// 在 watch 模式过滤交易之前调用，coinbase 交易可能被过滤掉
+func checkCoinbaseHeight(block *btcjson.GetBlockVerboseResult) *coinbaseHeightCheck {
+	if block.Height < int64(chain.Params.BIP0034Height) || len(block.Tx) == 0 || len(block.Tx[0].Vin) == 0 {
+		return nil
+	}
+	height, err := coinbaseHeight(block.Tx[0].Vin[0].Coinbase)
+	if err != nil {
+		sugar.Warnw("Parse coinbase height error", "height", block.Height, "hash", block.Hash, "error", err.Error())
+		return &coinbaseHeightCheck{Mismatch: true}
+	}
+	check := &coinbaseHeightCheck{Height: &height, Mismatch: int64(height) != block.Height}
+	if check.Mismatch {
+		sugar.Warnw("Coinbase height mismatch", "height", block.Height, "hash", block.Hash, "coinbase_height", height)
+	}
+	return check
+}
+
+// coinbaseHeight 解析 coinbase scriptSig 开头的区块高度：OP_0、OP_1 - OP_16 或 1 - 4 字节小端有符号的脚本数字
+func coinbaseHeight(scriptSigHex string) (int32, error) {
+	scriptSig, err := hex.DecodeString(scriptSigHex)
+	if err != nil {
+		return 0, err
+	}
+	if len(scriptSig) == 0 {
+		return 0, errors.New("empty coinbase scriptSig")
+	}
+	op := scriptSig[0]
+	switch {
+	case op == txscript.OP_0:
+		return 0, nil
+	case op >= txscript.OP_1 && op <= txscript.OP_16:
+		return int32(op-txscript.OP_1) + 1, nil
+	case op >= txscript.OP_DATA_1 && op <= txscript.OP_DATA_4:
+		n := int(op)
+		if len(scriptSig) < 1+n {
+			return 0, errors.New("coinbase height push exceeds the scriptSig")
+		}
+		if scriptSig[n]&0x80 != 0 {
+			return 0, errors.New("negative coinbase height")
+		}
+		var height int32
+		for i := n; i >= 1; i-- {
+			height = height<<8 | int32(scriptSig[i])
+		}
+		return height, nil
+	}
+	return 0, fmt.Errorf("coinbase scriptSig starts with opcode %#x instead of the block height", op)
+}
+
+// feeMismatch 同步计算的手续费总额与节点统计的不一致，没有节点统计数据时为 false
+func (stats *blockStats) feeMismatch() bool {
+	return stats.ReportedFees != nil && !stats.TotalFees.Equal(*stats.ReportedFees)
+}
+
 // Balance type struct
 type Balance struct {
 	Address string  `json:"address"`
@@ -105,12 +618,28 @@ type VoutStream struct {
 	Coinbase     bool        `json:"coinbase"`
 	Addresses    []string    `json:"addresses"`
 	Used         interface{} `json:"used"`
+	// RedeemAddresses 花费该 P2SH/P2WSH vout 的 vin 中多签 redeemscript/witness script 涉及的地址
+	RedeemAddresses []string `json:"redeemaddresses,omitempty"`
+	// Unspendable 无法花费的 vout (创世区块的 coinbase 输出)，不计入地址余额
+	Unspendable bool `json:"unspendable,omitempty"`
+	// Recovered 从节点补全 (rpc_prevout_fallback) 后写入的 vout，不属于已同步的区块，回滚花费它的区块时删除
+	Recovered bool `json:"recovered,omitempty"`
+	// Time 创建该 vout 的交易时间
+	Time int64 `json:"time,omitempty"`
+	// Height 创建该 vout 的区块高度，从节点补全的 vout 没有高度
+	Height int32 `json:"height,omitempty"`
+	// ScriptType 输出脚本类型 (pubkeyhash、scripthash、nulldata、nonstandard 等)
+	ScriptType string `json:"script_type,omitempty"`
 }
 
 // AddressWithValueInTx 交易中地输入输出的地址和余额
 type AddressWithValueInTx struct {
-	Address string  `json:"address"`
+	Address string  `json:"address,omitempty"`
 	Value   float64 `json:"value"`
+	// Outpoint 输入花费的 txid:vout，只有 tx 文档的 vins 中有
+	Outpoint string `json:"outpoint,omitempty"`
+	// Unresolved 输入花费的 vout 没有找到，地址和金额未知
+	Unresolved bool `json:"unresolved,omitempty"`
 }
 
 // IndexUTXO vout 索引
@@ -121,22 +650,98 @@ type IndexUTXO struct {
 
 // TxStream type struct
 type esTx struct {
-	Txid      string                 `json:"txid"`
-	Fee       float64                `json:"fee"`
-	BlockHash string                 `json:"blockhash"`
-	Time      int64                  `json:"time"`
-	Vins      []AddressWithValueInTx `json:"vins"`
-	Vouts     []AddressWithValueInTx `json:"vouts"`
+	Txid          string                 `json:"txid"`
+	Fee           float64                `json:"fee"`
+	FeeRate       float64                `json:"feerate"`        // 手续费率 (sat/vB)，coinbase 和 fee_incomplete 的交易为 0
+	FeeIncomplete bool                   `json:"fee_incomplete"` // 有 vin 在 es vout type 中找不到，fee 未知
+	BlockHash     string                 `json:"blockhash"`
+	Time          int64                  `json:"time"`
+	Coinbase      bool                   `json:"coinbase"`
+	OutputValue   float64                `json:"output_value"` // 所有 vout 的金额之和，包括没有地址的 vout
+	Size          int32                  `json:"size"`
+	Vsize         int32                  `json:"vsize"`
+	Weight        int32                  `json:"weight"`
+	Vins          []AddressWithValueInTx `json:"vins,omitempty"`      // lean_tx_docs 开启时为空
+	Vouts         []AddressWithValueInTx `json:"vouts,omitempty"`     // lean_tx_docs 开启时为空
+	Oversized     bool                   `json:"oversized,omitempty"` // vins 和 vouts 只保留了前 max_tx_inputs_outputs 个
+	Scripts       []txVinScript          `json:"scripts,omitempty"`   // include_scripts 开启时为输入的 scriptSig 和 witness
+	SigTypes      *txSigTypes            `json:"sig_types,omitempty"` // include_scripts 开启时为各签名算法的输入数
+	// IsTimelocked locktime 不为 0，HasRelativeTimelock 有输入的 sequence 按 BIP68 编码了相对时间锁
+	IsTimelocked        bool `json:"is_timelocked"`
+	HasRelativeTimelock bool `json:"has_relative_timelock"`
+	// HasInBlockParent 有输入花费同一区块中的交易，HasInBlockChild 有输出被同一区块中的交易花费，见 inBlockRelations
+	HasInBlockParent bool `json:"has_in_block_parent"`
+	HasInBlockChild  bool `json:"has_in_block_child"`
+}
+
+// txVinScript 交易输入的 scriptSig 和 witness，用于脚本研究
+type txVinScript struct {
+	Txid    string   `json:"txid"`
+	Vout    uint32   `json:"vout"`
+	Asm     string   `json:"asm,omitempty"`
+	Hex     string   `json:"hex,omitempty"`
+	Witness []string `json:"witness,omitempty"`
+}
+
+// txVinScripts 交易输入的脚本，coinbase 输入没有 scriptSig 不包含在内
+func txVinScripts(tx btcjson.TxRawResult) []txVinScript {
+	var scripts []txVinScript
+	for _, vin := range tx.Vin {
+		if len(vin.Coinbase) != 0 && len(vin.Txid) == 0 {
+			continue
+		}
+		script := txVinScript{Txid: vin.Txid, Vout: vin.Vout, Witness: vin.Witness}
+		if vin.ScriptSig != nil {
+			script.Asm, script.Hex = vin.ScriptSig.Asm, vin.ScriptSig.Hex
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts
 }
 
 type voutUsed struct {
-	Txid     string `json:"txid"`     // 所在交易的 id
-	VinIndex uint32 `json:"vinindex"` // 作为 vin 被使用时，vin 的 vout 字段
+	Txid     string `json:"txid"`           // 所在交易的 id
+	VinIndex uint32 `json:"vinindex"`       // 作为 vin 被使用时，vin 的 vout 字段
+	Height   int32  `json:"height"`         // 花费该 vout 的交易所在区块高度
+	Time     int64  `json:"time,omitempty"` // 花费该 vout 的区块时间
+	// CoinDays 花费时销毁的币天数 (金额 × 持有天数)，vout 没有创建时间时为空
+	CoinDays float64 `json:"coindays,omitempty"`
+}
+
+// spentBy vout 的 used.txid，未花费时为空字符串
+func (vout *VoutStream) spentBy() string {
+	used, ok := vout.Used.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	txid, _ := used["txid"].(string)
+	return txid
+}
+
+// newVoutUsed vout 被区块中的交易花费，持有时间按 vout 的创建时间到区块时间计算，区块时间可能早于前面的区块，持有时间最小为 0
+func newVoutUsed(txid string, vout *VoutStream, block *btcjson.GetBlockVerboseResult) voutUsed {
+	used := voutUsed{Txid: txid, VinIndex: vout.Voutindex, Height: int32(block.Height), Time: block.Time}
+	if vout.Time > 0 && block.Time > vout.Time {
+		days := decimal.New(block.Time-vout.Time, 0).Div(decimal.New(86400, 0))
+		used.CoinDays = btcFloat(decimal.NewFromFloat(vout.Value).Mul(days))
+	}
+	return used
+}
+
+// blockTarget bits 对应的 target，转换为 double 后可以排序和范围查询，精度损失不影响比较
+func blockTarget(bits string) (float64, error) {
+	compact, err := strconv.ParseUint(bits, 16, 32)
+	if err != nil {
+		return 0, err
+	}
+	target, _ := new(big.Float).SetInt(compactToBig(uint32(compact))).Float64()
+	return target, nil
 }
 
 // BTCBlockWithTxDetail elasticsearch 中 block Type 数据
-func blockWithTxDetail(block *btcjson.GetBlockVerboseResult) interface{} {
-	txs := blockTx(block.Tx)
+func blockWithTxDetail(block *btcjson.GetBlockVerboseResult, header *blockHeaderVerbose, stats *blockStats) map[string]interface{} {
+	totalFees := btcFloat(stats.TotalFees)
+	totalOutputValue := btcFloat(stats.TotalOutputValue)
 	blockWithTx := map[string]interface{}{
 		"hash":         block.Hash,
 		"strippedsize": block.StrippedSize,
@@ -146,16 +751,82 @@ func blockWithTxDetail(block *btcjson.GetBlockVerboseResult) interface{} {
 		"versionHex":   block.VersionHex,
 		"merkleroot":   block.MerkleRoot,
 		"time":         block.Time,
+		"mediantime":   header.MedianTime,
 		"nonce":        block.Nonce,
 		"bits":         block.Bits,
 		"difficulty":   block.Difficulty,
+		"chainwork":    header.Chainwork,
 		"previoushash": block.PreviousHash,
 		"nexthash":     block.NextHash,
-		"tx":           txs,
+
+		// 区块统计数据
+		"tx_count":           stats.TxCount,
+		"total_fees":         totalFees,
+		"total_output_value": totalOutputValue,
+		"subsidy":            btcFloat(chain.subsidy(int32(block.Height))),
+		"segwit_tx_count":    stats.SegwitTxCount,
+		"base_size":          stats.BaseSize,
+		"witness_size":       stats.WitnessSize,
+	}
+	// bits 无法解析时不写入 target
+	if target, err := blockTarget(block.Bits); err == nil {
+		blockWithTx["target"] = target
+	}
+	// slim_block_docs 开启时只保存 txids，交易详情与 tx、vout index 重复
+	if config.SlimBlockDocs {
+		var txids []string
+		for _, tx := range block.Tx {
+			txids = append(txids, tx.Txid)
+		}
+		blockWithTx["txids"] = txids
+	} else {
+		blockWithTx["tx"] = blockTx(block.Tx)
+	}
+	if pools != nil {
+		blockWithTx["pool"] = pools.identify(block)
+	}
+	if stats.ReportedFees != nil {
+		blockWithTx["reported_fees"] = btcFloat(*stats.ReportedFees)
+		blockWithTx["fee_mismatch"] = stats.feeMismatch()
+	}
+	if stats.CoinbaseHeight != nil {
+		if stats.CoinbaseHeight.Height != nil {
+			blockWithTx["coinbase_height"] = *stats.CoinbaseHeight.Height
+		}
+		blockWithTx["coinbase_height_mismatch"] = stats.CoinbaseHeight.Mismatch
+	}
+	if stats.DifficultyRatio != nil {
+		blockWithTx["difficulty_ratio"] = *stats.DifficultyRatio
+	}
+	digest, err := blockDigest(blockWithTx)
+	if err != nil {
+		sugar.Fatal("Compute block digest error: ", err.Error())
 	}
+	blockWithTx["digest"] = digest
 	return blockWithTx
 }
 
+// blockDigest block 文档内容的 sha256，不包括 digest 本身和 nexthash (下一个区块同步后才会写入)
+// 文档先经过一次 json 编解码再按 key 排序编码，与从 es 读出的 _source 重新计算的结果一致
+func blockDigest(doc map[string]interface{}) (string, error) {
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return "", err
+	}
+	canonical := make(map[string]interface{})
+	if err := json.Unmarshal(raw, &canonical); err != nil {
+		return "", err
+	}
+	delete(canonical, "digest")
+	delete(canonical, "nexthash")
+	raw, err = json.Marshal(canonical)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
+
 func blockTx(txs []btcjson.TxRawResult) []map[string]interface{} {
 	var rawTxs []map[string]interface{}
 	for _, tx := range txs {
@@ -166,7 +837,7 @@ func blockTx(txs []btcjson.TxRawResult) []map[string]interface{} {
 		}
 		vouts := txVouts(tx)
 		vins := txVins(tx)
-		rawTxs = append(rawTxs, map[string]interface{}{
+		rawTx := map[string]interface{}{
 			"txid":     tx.Txid,
 			"hash":     tx.Hash,
 			"version":  txVersion,
@@ -175,7 +846,13 @@ func blockTx(txs []btcjson.TxRawResult) []map[string]interface{} {
 			"locktime": tx.LockTime,
 			"vout":     vouts,
 			"vin":      vins,
-		})
+		}
+		if oversizedTx(tx) {
+			rawTx["vout"] = vouts[:minInt(len(vouts), config.MaxTxInputsOutputs)]
+			rawTx["vin"] = vins[:minInt(len(vins), config.MaxTxInputsOutputs)]
+			rawTx["oversized"] = true
+		}
+		rawTxs = append(rawTxs, rawTx)
 	}
 	return rawTxs
 }
@@ -200,7 +877,7 @@ func txVouts(tx btcjson.TxRawResult) []map[string]interface{} {
 func txVins(tx btcjson.TxRawResult) []map[string]interface{} {
 	var vins []map[string]interface{}
 	for _, vin := range tx.Vin {
-		if len(tx.Vin) == 1 && len(vin.Coinbase) != 0 && len(vin.Txid) == 0 {
+		if isCoinbaseTx(tx.Vin) {
 			vins = append(vins, map[string]interface{}{
 				"coinbase": vin.Coinbase,
 				"sequence": vin.Sequence,
@@ -219,40 +896,26 @@ func txVins(tx btcjson.TxRawResult) []map[string]interface{} {
 	return vins
 }
 
-// get addresses in bitcoin vout
-func voutAddressFun(vout btcjson.Vout) (*[]string, error) {
-	var addresses []string
-	if len(vout.ScriptPubKey.Addresses) > 0 {
-		addresses = vout.ScriptPubKey.Addresses
-		return &addresses, nil
-	}
-	if len(addresses) == 0 {
-		return nil, errors.New("Unable to decode output address")
-	}
-	return nil, errors.New("address not fount in vout")
-}
-
 // VoutStream elasticsearch 中 voutstream Type 数据
-func newVoutFun(vout btcjson.Vout, vins []btcjson.Vin, TxID string) (*VoutStream, error) {
-	coinbase := false
-	if len(vins[0].Coinbase) != 0 && len(vins[0].Txid) == 0 {
-		coinbase = true
-	}
-
-	addresses, err := voutAddressFun(vout)
-	if err != nil {
-		return nil, err
+// 没有地址的输出 (nonstandard、没有地址的 pubkey、bare multisig、nulldata) 同样写入，addresses 为空数组，
+// 金额仍在 utxo 集合中，只是不计入任何地址的余额；nulldata (OP_RETURN) 输出无法花费，标记 unspendable
+func newVoutFun(vout btcjson.Vout, vins []btcjson.Vin, TxID string) *VoutStream {
+	addresses := vout.ScriptPubKey.Addresses
+	if addresses == nil {
+		addresses = []string{}
 	}
 
 	v := &VoutStream{
 		TxIDBelongTo: TxID,
 		Value:        vout.Value,
 		Voutindex:    vout.N,
-		Coinbase:     coinbase,
-		Addresses:    *addresses,
+		Coinbase:     isCoinbaseTx(vins),
+		Addresses:    addresses,
 		Used:         nil,
+		ScriptType:   vout.ScriptPubKey.Type,
+		Unspendable:  vout.ScriptPubKey.Type == txscript.NullDataTy.String(),
 	}
-	return v, nil
+	return v
 }
 
 func newBalanceJournalFun(address, ope, txid string, amount float64) BalanceJournal {
@@ -265,23 +928,162 @@ func newBalanceJournalFun(address, ope, txid string, amount float64) BalanceJour
 	return balancejournal
 }
 
+// txTimeFun 交易时间，getblock 返回的交易 (以及部分版本节点的 getrawtransaction) 没有 time 字段，使用区块时间
+func txTimeFun(tx btcjson.TxRawResult, blockTime int64) int64 {
+	if tx.Time != 0 {
+		return tx.Time
+	}
+	return blockTime
+}
+
 //  elasticsearch 中 txstream Type 数据
-func esTxFun(txid, blockHash string, fee float64, time int64, simpleVins, simpleVouts []AddressWithValueInTx) *esTx {
+func esTxFun(tx btcjson.TxRawResult, block *btcjson.GetBlockVerboseResult, fee float64, feeIncomplete bool, simpleVins, simpleVouts []AddressWithValueInTx) *esTx {
+	txTime := txTimeFun(tx, block.Time)
+	outputValue := decimal.NewFromFloat(0)
+	for _, vout := range tx.Vout {
+		outputValue = outputValue.Add(decimal.NewFromFloat(vout.Value))
+	}
+	// lean tx 文档不包含输入输出地址，输入输出明细通过 vout type 查询 (txidbelongto 为输出，used.txid 为输入)
+	if config.LeanTxDocs {
+		simpleVins, simpleVouts = nil, nil
+	}
+	var (
+		scripts  []txVinScript
+		sigTypes *txSigTypes
+	)
+	if config.IncludeScripts {
+		scripts = txVinScripts(tx)
+		sigTypes = txSigTypesFun(tx)
+	}
+	if oversizedTx(tx) {
+		sugar.Warn("tx ", tx.Txid, " has ", len(tx.Vin), " vins and ", len(tx.Vout), " vouts, more than max_tx_inputs_outputs ",
+			config.MaxTxInputsOutputs, ", store the first ", config.MaxTxInputsOutputs, " of each in tx and block docs")
+		simpleVins = simpleVins[:minInt(len(simpleVins), config.MaxTxInputsOutputs)]
+		simpleVouts = simpleVouts[:minInt(len(simpleVouts), config.MaxTxInputsOutputs)]
+		scripts = scripts[:minInt(len(scripts), config.MaxTxInputsOutputs)]
+	}
 	result := &esTx{
-		Txid:      txid,
-		Fee:       fee,
-		BlockHash: blockHash,
-		Time:      time, // TODO: time field is nil, need to fix
-		Vins:      simpleVins,
-		Vouts:     simpleVouts,
+		Oversized:     oversizedTx(tx),
+		Txid:          tx.Txid,
+		Fee:           fee,
+		FeeRate:       txFeeRate(fee, tx.Vsize),
+		FeeIncomplete: feeIncomplete,
+		BlockHash:     block.Hash,
+		Time:          txTime,
+		Coinbase:      isCoinbaseTx(tx.Vin),
+		OutputValue:   btcFloat(outputValue),
+		Size:          tx.Size,
+		Vsize:         tx.Vsize,
+		Weight:        txWeight(tx),
+		Vins:          simpleVins,
+		Vouts:         simpleVouts,
+		Scripts:       scripts,
+		SigTypes:      sigTypes,
+
+		IsTimelocked:        tx.LockTime != 0,
+		HasRelativeTimelock: hasRelativeTimelock(tx),
 	}
 	return result
 }
 
+// isCoinbaseTx coinbase 交易只有一个输入，该输入有 coinbase 字段 (scriptSig) 而没有花费的 txid。tx 和 vout 文档的 coinbase 字段由此计算，
+// 查询时按 coinbase 字段过滤即可，不需要检查 vins
+func isCoinbaseTx(vins []btcjson.Vin) bool {
+	return len(vins) == 1 && len(vins[0].Coinbase) != 0 && len(vins[0].Txid) == 0
+}
+
+// txFee 交易的手续费为输入金额减去输出金额，coinbase 交易为 0，vin 未全部找到时 fee 未知，同样置为 0 并标记 fee_incomplete
+func txFee(tx btcjson.TxRawResult, vinAmount, voutAmount decimal.Decimal, feeIncomplete bool) decimal.Decimal {
+	if isCoinbaseTx(tx.Vin) || vinAmount.Equal(voutAmount) || feeIncomplete {
+		return decimal.NewFromFloat(0)
+	}
+	return vinAmount.Sub(voutAmount)
+}
+
+// txFeeRate 手续费 (BTC) 换算为 sat/vB，保留 3 位小数，vsize 未知时为 0
+func txFeeRate(fee float64, vsize int32) float64 {
+	if vsize <= 0 {
+		return 0
+	}
+	rate, _ := decimal.NewFromFloat(fee).Shift(BTCDecimalPlaces).Div(decimal.New(int64(vsize), 0)).Round(3).Float64()
+	return rate
+}
+
+// hasRelativeTimelock BIP68 只对 version 2 及以上的交易生效，非 coinbase 输入的 sequence 没有设置 disable 位 (1 << 31) 时表示相对时间锁
+func hasRelativeTimelock(tx btcjson.TxRawResult) bool {
+	if tx.Version < 2 {
+		return false
+	}
+	for _, vin := range tx.Vin {
+		if len(vin.Coinbase) != 0 && len(vin.Txid) == 0 {
+			continue
+		}
+		if vin.Sequence&wire.SequenceLockTimeDisabled == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// oversizedTx 交易的输入或输出数量超过 max_tx_inputs_outputs，这类交易的 tx 和 block 文档只保留前 max_tx_inputs_outputs 个输入输出，
+// 避免 nested 文档数超过 es 的 index.mapping.nested_objects.limit 或 bulk 请求过大被拒绝
+func oversizedTx(tx btcjson.TxRawResult) bool {
+	return config.MaxTxInputsOutputs > 0 && (len(tx.Vin) > config.MaxTxInputsOutputs || len(tx.Vout) > config.MaxTxInputsOutputs)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// witnessScaleFactor BIP141 中 witness 数据的折扣系数
+const witnessScaleFactor = 4
+
+// txWeight 交易的 weight (BIP141)，getblock 返回的交易没有 weight 字段，由交易 hex 计算:
+// 不含 witness 的大小 * 3 + 含 witness 的大小。hex 无法解析时用 vsize * 4 近似 (segwit 交易最多比实际大 3)
+func txWeight(tx btcjson.TxRawResult) int32 {
+	serializedTx, err := hex.DecodeString(tx.Hex)
+	if err == nil {
+		msgTx := wire.NewMsgTx(wire.TxVersion)
+		if err = msgTx.Deserialize(bytes.NewReader(serializedTx)); err == nil {
+			return int32(msgTx.SerializeSizeStripped()*(witnessScaleFactor-1) + msgTx.SerializeSize())
+		}
+	}
+	return tx.Vsize * witnessScaleFactor
+}
+
+// txSizes 交易不含 witness 的大小 (base size)、witness 数据的大小 (包括 segwit marker 和 flag) 以及交易是否带有 witness，由交易 hex 计算。
+// hex 无法解析时由 size、vsize 和 vin 的 witness 估算，vsize 向上取整，segwit 交易的 base size 最多偏大 1
+func txSizes(tx btcjson.TxRawResult) (int32, int32, bool) {
+	serializedTx, err := hex.DecodeString(tx.Hex)
+	if err == nil {
+		msgTx := wire.NewMsgTx(wire.TxVersion)
+		if err = msgTx.Deserialize(bytes.NewReader(serializedTx)); err == nil {
+			base := int32(msgTx.SerializeSizeStripped())
+			return base, int32(msgTx.SerializeSize()) - base, msgTx.HasWitness()
+		}
+	}
+	for _, vin := range tx.Vin {
+		if len(vin.Witness) > 0 {
+			base := (tx.Vsize*witnessScaleFactor - tx.Size) / (witnessScaleFactor - 1)
+			return base, tx.Size - base, true
+		}
+	}
+	return tx.Size, 0, false
+}
+
 // return value:
 // *[]*AddressWithValueInTx for elasticsearch tx Type vouts field
 // *[]interface{} all addresses related to the vout
 // *[]*Balance all addresses related to the vout with value amount
+// skipBalance 开启 skip_zero_value_balances 时金额为 0 的输出 (OP_RETURN、部分 dust) 不计入地址余额，
+// 创建和花费时都不查询、不写入余额文档和余额流水，vout 和 tx 文档照常写入
+func skipBalance(value float64) bool {
+	return config.SkipZeroValueBalances && value == 0
+}
+
 func parseTxVout(vout btcjson.Vout, txid string) ([]AddressWithValueInTx, []interface{}, []Balance, []AddressWithAmountAndTxid) {
 	var (
 		txVoutsField                      []AddressWithValueInTx
@@ -295,6 +1097,9 @@ func parseTxVout(vout btcjson.Vout, txid string) ([]AddressWithValueInTx, []inte
 			Address: address,
 			Value:   vout.Value,
 		})
+		if skipBalance(vout.Value) {
+			continue
+		}
 
 		// vout addresses slice
 		voutAddresses = append(voutAddresses, address)
@@ -320,16 +1125,33 @@ func parseESVout(voutWithID VoutWithID, txid string) ([]AddressWithValueInTx, []
 		vinAddressWithAmountAndTxidSlice []AddressWithAmountAndTxid
 	)
 
+	// 多签等多地址输出的每个地址都记录一条，没有地址的输出记录一条空地址，tx 文档的 vins 覆盖所有输入
+	outpoint := outpointStrings([]IndexUTXO{{voutWithID.Vout.TxIDBelongTo, voutWithID.Vout.Voutindex}})[0]
+	if len(voutWithID.Vout.Addresses) == 0 {
+		txTypeVinsField = append(txTypeVinsField, AddressWithValueInTx{Value: voutWithID.Vout.Value, Outpoint: outpoint})
+	}
 	for _, address := range voutWithID.Vout.Addresses {
+		txTypeVinsField = append(txTypeVinsField, AddressWithValueInTx{Address: address, Value: voutWithID.Vout.Value, Outpoint: outpoint})
+		if skipBalance(voutWithID.Vout.Value) {
+			continue
+		}
 		vinAddresses = append(vinAddresses, address)
 		vinAddressWithAmountSlice = append(vinAddressWithAmountSlice, Balance{address, voutWithID.Vout.Value})
-		txTypeVinsField = append(txTypeVinsField, AddressWithValueInTx{address, voutWithID.Vout.Value})
 		vinAddressWithAmountAndTxidSlice = append(vinAddressWithAmountAndTxidSlice, AddressWithAmountAndTxid{
 			Address: address, Amount: voutWithID.Vout.Value, Txid: txid})
 	}
 	return txTypeVinsField, vinAddresses, vinAddressWithAmountSlice, vinAddressWithAmountAndTxidSlice
 }
 
+// unresolvedVins 花费的 vout 没有找到的输入在 tx 文档 vins 中的记录，只有 outpoint，标记 unresolved
+func unresolvedVins(missing []IndexUTXO) []AddressWithValueInTx {
+	var vins []AddressWithValueInTx
+	for _, outpoint := range outpointStrings(missing) {
+		vins = append(vins, AddressWithValueInTx{Outpoint: outpoint, Unresolved: true})
+	}
+	return vins
+}
+
 func indexedVinsFun(vins []btcjson.Vin) []IndexUTXO {
 	var IndexUTXOs []IndexUTXO
 	for _, vin := range vins {
@@ -339,6 +1161,80 @@ func indexedVinsFun(vins []btcjson.Vin) []IndexUTXO {
 	return IndexUTXOs
 }
 
+// missingVinOutpoints 返回在 es vout type 中没有找到的 vin (coinbase vin 除外)
+func missingVinOutpoints(vins []btcjson.Vin, voutWithIDs []VoutWithID) []IndexUTXO {
+	resolved := make(map[IndexUTXO]bool)
+	for _, voutWithID := range voutWithIDs {
+		resolved[IndexUTXO{voutWithID.Vout.TxIDBelongTo, voutWithID.Vout.Voutindex}] = true
+	}
+
+	var missing []IndexUTXO
+	for _, vin := range vins {
+		if len(vin.Txid) == 0 {
+			continue
+		}
+		if outpoint := (IndexUTXO{vin.Txid, vin.Vout}); !resolved[outpoint] {
+			missing = append(missing, outpoint)
+		}
+	}
+	return missing
+}
+
+// prevoutSource 查询 vin 花费的 vout，用于补全 es 中找不到的 vout (如同步起始高度之前的交易)
+type prevoutSource interface {
+	prevout(outpoint IndexUTXO) (*VoutStream, error)
+}
+
+// prevouts 开启 rpc_prevout_fallback 时为节点 rpc 客户端，为 nil 表示不补全
+var prevouts prevoutSource
+
+// prevout 通过 getrawtransaction 查询 outpoint 对应的 vout，节点需要开启 txindex
+func (btcClient *bitcoinClientAlias) prevout(outpoint IndexUTXO) (*VoutStream, error) {
+	txHash, err := chainhash.NewHashFromStr(outpoint.Txid)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := btcClient.GetRawTransactionVerbose(txHash)
+	if err != nil {
+		return nil, err
+	}
+	deriveVoutAddresses(tx.Vout)
+	for _, vout := range tx.Vout {
+		if vout.N == outpoint.Index {
+			v := newVoutFun(vout, tx.Vin, tx.Txid)
+			v.Time = txTimeFun(*tx, tx.Blocktime)
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("outpoint %s: %w", outpointStrings([]IndexUTXO{outpoint})[0], ErrVoutNotFound)
+}
+
+// fetchMissingPrevouts 通过 prevouts 补全 es 中找不到的 vin 花费的 vout，返回的 VoutWithID.ID 为空 (不在 es 中)，
+// 查询失败的 vin 以及 skip 中的 vin 仍然视为缺失
+func fetchMissingPrevouts(vins []btcjson.Vin, voutWithIDs []VoutWithID, skip map[IndexUTXO]bool) []VoutWithID {
+	var recovered []VoutWithID
+	for _, outpoint := range missingVinOutpoints(vins, voutWithIDs) {
+		if skip[outpoint] {
+			continue
+		}
+		vout, err := prevouts.prevout(outpoint)
+		if err != nil {
+			sugar.Warn("fetch prevout ", outpoint.Txid, ":", strconv.Itoa(int(outpoint.Index)), " from bitcoind error: ", err.Error())
+			continue
+		}
+		recovered = append(recovered, VoutWithID{"", vout})
+	}
+	return recovered
+}
+
+func outpointStrings(outpoints []IndexUTXO) []string {
+	var result []string
+	for _, outpoint := range outpoints {
+		result = append(result, strings.Join([]string{outpoint.Txid, strconv.FormatUint(uint64(outpoint.Index), 10)}, ":"))
+	}
+	return result
+}
+
 func indexedVoutsFun(vouts []btcjson.Vout, txid string) []IndexUTXO {
 	var IndexUTXOs []IndexUTXO
 	for _, vout := range vouts {
@@ -346,3 +1242,133 @@ func indexedVoutsFun(vouts []btcjson.Vout, txid string) []IndexUTXO {
 	}
 	return IndexUTXOs
 }
+
+// vinRedeemAddresses 找到花费 voutWithID 的 vin，解析其 scriptSig 中的多签 redeemscript 涉及的地址
+func vinRedeemAddresses(vins []btcjson.Vin, voutWithID VoutWithID) []string {
+	for _, vin := range vins {
+		if vin.Txid != voutWithID.Vout.TxIDBelongTo || vin.Vout != voutWithID.Vout.Voutindex || vin.ScriptSig == nil {
+			continue
+		}
+		for _, address := range voutWithID.Vout.Addresses {
+			addresses, err := redeemScriptAddresses(vin.ScriptSig.Hex, address)
+			if err != nil {
+				sugar.Warn("decode redeemscript of vin ", vin.Txid, ":", strconv.Itoa(int(vin.Vout)), " error: ", err.Error())
+				continue
+			}
+			if len(addresses) > 0 {
+				return addresses
+			}
+		}
+	}
+	return nil
+}
+
+// redeemScriptAddresses 解析 scriptSig 最后一个 push 的 redeemscript，校验其 hash 与 P2SH 地址一致，
+// redeemscript 为多签脚本时返回涉及的地址，非 P2SH 地址或非多签 redeemscript (如 P2SH-P2WPKH) 返回 nil
+func redeemScriptAddresses(scriptSigHex, p2shAddress string) ([]string, error) {
+	params := chain.Params
+	scriptHashAddress, err := btcutil.DecodeAddress(p2shAddress, params)
+	if err != nil || !scriptHashAddress.IsForNet(params) {
+		return nil, nil
+	}
+	if _, ok := scriptHashAddress.(*btcutil.AddressScriptHash); !ok {
+		return nil, nil
+	}
+
+	scriptSig, err := hex.DecodeString(scriptSigHex)
+	if err != nil {
+		return nil, err
+	}
+	pushes, err := txscript.PushedData(scriptSig)
+	if err != nil {
+		return nil, err
+	}
+	if len(pushes) == 0 {
+		return nil, errors.New("redeemscript not found in scriptSig")
+	}
+	redeemScript := pushes[len(pushes)-1]
+
+	redeemScriptHashAddress, err := btcutil.NewAddressScriptHash(redeemScript, params)
+	if err != nil {
+		return nil, err
+	}
+	if redeemScriptHashAddress.EncodeAddress() != p2shAddress {
+		return nil, errors.New(strings.Join([]string{"redeemscript hash mismatch with", p2shAddress}, " "))
+	}
+
+	class, addrs, _, err := txscript.ExtractPkScriptAddrs(redeemScript, params)
+	if err != nil {
+		return nil, err
+	}
+	if class != txscript.MultiSigTy {
+		return nil, nil
+	}
+	var addresses []string
+	for _, addr := range addrs {
+		addresses = append(addresses, addr.EncodeAddress())
+	}
+	return addresses, nil
+}
+
+// vinWitnessScriptAddresses 找到花费 voutWithID 的 vin，解析其 witness 中的多签 witness script 涉及的地址
+func vinWitnessScriptAddresses(vins []btcjson.Vin, voutWithID VoutWithID) []string {
+	for _, vin := range vins {
+		if vin.Txid != voutWithID.Vout.TxIDBelongTo || vin.Vout != voutWithID.Vout.Voutindex || len(vin.Witness) == 0 {
+			continue
+		}
+		for _, address := range voutWithID.Vout.Addresses {
+			addresses, err := witnessScriptAddresses(vin.Witness, address)
+			if err != nil {
+				sugar.Warn("decode witness script of vin ", vin.Txid, ":", strconv.Itoa(int(vin.Vout)), " error: ", err.Error())
+				continue
+			}
+			if len(addresses) > 0 {
+				return addresses
+			}
+		}
+	}
+	return nil
+}
+
+// witnessScriptAddresses 解析 witness 最后一项的 witness script，校验其 sha256 与 P2WSH 地址的 witness program 一致，
+// witness script 为多签脚本时返回涉及的地址，非 P2WSH 地址或非多签 witness script 返回 nil
+func witnessScriptAddresses(witness []string, p2wshAddress string) ([]string, error) {
+	params := chain.Params
+	scriptHashAddress, err := btcutil.DecodeAddress(p2wshAddress, params)
+	if err != nil || !scriptHashAddress.IsForNet(params) {
+		return nil, nil
+	}
+	if _, ok := scriptHashAddress.(*btcutil.AddressWitnessScriptHash); !ok {
+		return nil, nil
+	}
+
+	if len(witness) == 0 {
+		return nil, errors.New("witness script not found in witness")
+	}
+	witnessScript, err := hex.DecodeString(witness[len(witness)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	witnessProgram := sha256.Sum256(witnessScript)
+	witnessScriptHashAddress, err := btcutil.NewAddressWitnessScriptHash(witnessProgram[:], params)
+	if err != nil {
+		return nil, err
+	}
+	if witnessScriptHashAddress.EncodeAddress() != p2wshAddress {
+		return nil, errors.New(strings.Join([]string{"witness script hash mismatch with", p2wshAddress}, " "))
+	}
+
+	class, addrs, _, err := txscript.ExtractPkScriptAddrs(witnessScript, params)
+	if err != nil {
+		return nil, err
+	}
+	if class != txscript.MultiSigTy {
+		return nil, nil
+	}
+	var addresses []string
+	for _, addr := range addrs {
+		addresses = append(addresses, addr.EncodeAddress())
+	}
+	return addresses, nil
+}
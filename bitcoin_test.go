@@ -0,0 +1,466 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedeemScriptAddresses(t *testing.T) {
+	// 私钥 1 和 2 对应的压缩公钥
+	pubKey1, _ := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	pubKey2, _ := hex.DecodeString("02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5")
+	addr1, _ := btcutil.NewAddressPubKey(pubKey1, &chaincfg.MainNetParams)
+	addr2, _ := btcutil.NewAddressPubKey(pubKey2, &chaincfg.MainNetParams)
+
+	redeemScript, err := txscript.MultiSigScript([]*btcutil.AddressPubKey{addr1, addr2}, 1)
+	assert.Nil(t, err)
+	p2sh, _ := btcutil.NewAddressScriptHash(redeemScript, &chaincfg.MainNetParams)
+	scriptSig, _ := txscript.NewScriptBuilder().AddOp(txscript.OP_0).AddData([]byte{0x30, 0x01}).AddData(redeemScript).Script()
+
+	addresses, err := redeemScriptAddresses(hex.EncodeToString(scriptSig), p2sh.EncodeAddress())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", "1cMh228HTCiwS8ZsaakH8A8wze1JR5ZsP"}, addresses)
+
+	// redeemscript 与 P2SH 地址不匹配
+	_, err = redeemScriptAddresses(hex.EncodeToString(scriptSig), "3J98t1WpEZ73CNmQviecrnyiWrnqRhWNLy")
+	assert.NotNil(t, err)
+
+	// 非 P2SH 地址不解析
+	addresses, err = redeemScriptAddresses(hex.EncodeToString(scriptSig), "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH")
+	assert.Nil(t, err)
+	assert.Nil(t, addresses)
+}
+
+func TestWitnessScriptAddresses(t *testing.T) {
+	pubKey1, _ := hex.DecodeString("0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	pubKey2, _ := hex.DecodeString("02c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5")
+	addr1, _ := btcutil.NewAddressPubKey(pubKey1, &chaincfg.MainNetParams)
+	addr2, _ := btcutil.NewAddressPubKey(pubKey2, &chaincfg.MainNetParams)
+
+	witnessScript, err := txscript.MultiSigScript([]*btcutil.AddressPubKey{addr1, addr2}, 1)
+	assert.Nil(t, err)
+	witnessProgram := sha256.Sum256(witnessScript)
+	p2wsh, _ := btcutil.NewAddressWitnessScriptHash(witnessProgram[:], &chaincfg.MainNetParams)
+	witness := []string{"", "3001", hex.EncodeToString(witnessScript)}
+
+	addresses, err := witnessScriptAddresses(witness, p2wsh.EncodeAddress())
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", "1cMh228HTCiwS8ZsaakH8A8wze1JR5ZsP"}, addresses)
+
+	// witness script 与 P2WSH 地址不匹配
+	_, err = witnessScriptAddresses(witness, "bc1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3qccfmv3")
+	assert.NotNil(t, err)
+
+	// 非 P2WSH 地址 (P2WPKH) 不解析
+	addresses, err = witnessScriptAddresses(witness, "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4")
+	assert.Nil(t, err)
+	assert.Nil(t, addresses)
+
+	vins := []btcjson.Vin{{Txid: "prev", Vout: 1, Witness: witness}}
+	voutWithID := VoutWithID{Vout: &VoutStream{TxIDBelongTo: "prev", Voutindex: 1, Addresses: []string{p2wsh.EncodeAddress()}}}
+	assert.Equal(t, []string{"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH", "1cMh228HTCiwS8ZsaakH8A8wze1JR5ZsP"}, vinWitnessScriptAddresses(vins, voutWithID))
+}
+
+func TestNewVoutWithoutAddress(t *testing.T) {
+	vins := []btcjson.Vin{{Txid: "tx1", Vout: 0}}
+	for _, scriptType := range []string{"pubkey", "nonstandard", "multisig"} {
+		vout := newVoutFun(btcjson.Vout{Value: 1, N: 0, ScriptPubKey: btcjson.ScriptPubKeyResult{Type: scriptType}}, vins, "tx2")
+		assert.Equal(t, []string{}, vout.Addresses, scriptType)
+		assert.Equal(t, scriptType, vout.ScriptType)
+		assert.False(t, vout.Unspendable, scriptType)
+	}
+
+	// OP_RETURN 输出无法花费，不在 utxo 集合中
+	nulldata := newVoutFun(btcjson.Vout{N: 1, ScriptPubKey: btcjson.ScriptPubKeyResult{Type: "nulldata"}}, vins, "tx2")
+	assert.True(t, nulldata.Unspendable)
+	raw, err := json.Marshal(nulldata)
+	assert.Nil(t, err)
+	assert.Contains(t, string(raw), `"addresses":[]`)
+}
+
+func TestTxWeight(t *testing.T) {
+	// 1 个 vin 1 个 P2WPKH vout，witness 为一个 2 字节的 item
+	msgTx := wire.NewMsgTx(wire.TxVersion)
+	msgTx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 0}, nil, wire.TxWitness{{0x01, 0x02}}))
+	msgTx.AddTxOut(wire.NewTxOut(1000, append([]byte{txscript.OP_0, 0x14}, make([]byte, 20)...)))
+	var buf bytes.Buffer
+	assert.Nil(t, msgTx.Serialize(&buf))
+
+	// 不含 witness 82 字节，含 witness (marker/flag 2 + 条目数 1 + 长度 1 + 数据 2) 88 字节
+	assert.EqualValues(t, 82*3+88, txWeight(btcjson.TxRawResult{Hex: hex.EncodeToString(buf.Bytes()), Vsize: 84}))
+	// 没有 hex 时由 vsize 近似
+	assert.EqualValues(t, 84*4, txWeight(btcjson.TxRawResult{Vsize: 84}))
+}
+
+func TestBlockStatsTxSizes(t *testing.T) {
+	msgTx := wire.NewMsgTx(wire.TxVersion)
+	msgTx.AddTxIn(wire.NewTxIn(&wire.OutPoint{Index: 0}, nil, wire.TxWitness{{0x01, 0x02}}))
+	msgTx.AddTxOut(wire.NewTxOut(1000, append([]byte{txscript.OP_0, 0x14}, make([]byte, 20)...)))
+	var buf bytes.Buffer
+	assert.Nil(t, msgTx.Serialize(&buf))
+	segwitTx := btcjson.TxRawResult{Txid: "segwit", Hex: hex.EncodeToString(buf.Bytes()), Vin: []btcjson.Vin{{Txid: "tx1"}}}
+
+	base, witness, segwit := txSizes(segwitTx)
+	assert.EqualValues(t, 82, base)
+	assert.EqualValues(t, 6, witness)
+	assert.True(t, segwit)
+
+	// 没有 hex 时由 size、vsize 估算，没有 witness 的交易全部是 base size
+	base, witness, segwit = txSizes(btcjson.TxRawResult{Size: 88, Vsize: 84, Vin: []btcjson.Vin{{Txid: "tx1", Witness: []string{"0102"}}}})
+	assert.EqualValues(t, 82, base)
+	assert.EqualValues(t, 6, witness)
+	assert.True(t, segwit)
+	base, witness, segwit = txSizes(btcjson.TxRawResult{Size: 191, Vsize: 191, Vin: []btcjson.Vin{{Txid: "tx1"}}})
+	assert.EqualValues(t, 191, base)
+	assert.EqualValues(t, 0, witness)
+	assert.False(t, segwit)
+
+	// 带 witness reserved value 的 coinbase 不计入 segwit 交易数
+	coinbase := btcjson.TxRawResult{Txid: "coinbase", Size: 120, Vsize: 93, Vin: []btcjson.Vin{{Coinbase: "03a0bb0d", Witness: []string{strings.Repeat("00", 32)}}}}
+	stats := new(blockStats)
+	for _, tx := range []btcjson.TxRawResult{coinbase, segwitTx, {Txid: "legacy", Size: 191, Vsize: 191, Vin: []btcjson.Vin{{Txid: "tx2"}}}} {
+		stats.addTxSizes(tx)
+	}
+	assert.Equal(t, 1, stats.SegwitTxCount)
+	assert.EqualValues(t, 84+82+191, stats.BaseSize)
+	assert.EqualValues(t, 36+6, stats.WitnessSize)
+}
+
+func TestEsTxFun(t *testing.T) {
+	block := testSyncBlock()
+	block.Time = 1231006505
+
+	coinbase := esTxFun(block.Tx[0], block, 0, false, nil, nil)
+	assert.True(t, coinbase.Coinbase)
+	assert.Equal(t, 50.0, coinbase.OutputValue)
+	// getblock 的交易没有 time，使用区块时间
+	assert.EqualValues(t, 1231006505, coinbase.Time)
+
+	tx := esTxFun(block.Tx[1], block, 0.1, false, nil, nil)
+	assert.False(t, tx.Coinbase)
+	assert.Equal(t, 9.9, tx.OutputValue)
+	assert.Equal(t, "block2", tx.BlockHash)
+}
+
+func TestTxTimelocks(t *testing.T) {
+	block := testSyncBlock()
+	tx := block.Tx[1]
+	tx.Vin[0].Sequence = wire.MaxTxInSequenceNum
+	assert.False(t, esTxFun(tx, block, 0, false, nil, nil).IsTimelocked)
+
+	tx.LockTime = 500000
+	assert.True(t, esTxFun(tx, block, 0, false, nil, nil).IsTimelocked)
+
+	// sequence 10 在 version 1 的交易中没有含义
+	tx.Vin[0].Sequence = 10
+	tx.Version = 1
+	assert.False(t, esTxFun(tx, block, 0, false, nil, nil).HasRelativeTimelock)
+	tx.Version = 2
+	assert.True(t, esTxFun(tx, block, 0, false, nil, nil).HasRelativeTimelock)
+	// 设置了 disable 位
+	tx.Vin[0].Sequence = wire.SequenceLockTimeDisabled | 10
+	assert.False(t, esTxFun(tx, block, 0, false, nil, nil).HasRelativeTimelock)
+
+	coinbase := block.Tx[0]
+	coinbase.Version = 2
+	assert.False(t, esTxFun(coinbase, block, 0, false, nil, nil).HasRelativeTimelock)
+}
+
+func TestTxFeeRate(t *testing.T) {
+	assert.Equal(t, 10.0, txFeeRate(0.00001410, 141))
+	assert.Equal(t, 3.333, txFeeRate(0.00000010, 3))
+	assert.Equal(t, 0.0, txFeeRate(0.0001, 0))
+
+	block := testSyncBlock()
+	block.Tx[1].Vsize = 200
+	assert.Equal(t, 50000.0, esTxFun(block.Tx[1], block, 0.1, false, nil, nil).FeeRate)
+}
+
+func TestIsCoinbaseTx(t *testing.T) {
+	assert.True(t, isCoinbaseTx([]btcjson.Vin{{Coinbase: "04ffff001d0102"}}))
+	assert.False(t, isCoinbaseTx([]btcjson.Vin{{Txid: "tx1", Vout: 0}}))
+	assert.False(t, isCoinbaseTx([]btcjson.Vin{{Coinbase: "04ffff001d0102"}, {Txid: "tx1", Vout: 0}}))
+	assert.False(t, isCoinbaseTx(nil))
+
+	block := testSyncBlock()
+	assert.True(t, newVoutFun(block.Tx[0].Vout[0], block.Tx[0].Vin, "coinbase2").Coinbase)
+	assert.False(t, newVoutFun(block.Tx[1].Vout[0], block.Tx[1].Vin, "tx2").Coinbase)
+}
+
+func TestEsTxFunOversized(t *testing.T) {
+	maxTxInputsOutputs := config.MaxTxInputsOutputs
+	config.MaxTxInputsOutputs = 2
+	defer func() { config.MaxTxInputsOutputs = maxTxInputsOutputs }()
+
+	block := testSyncBlock()
+	block.Tx[1].Vout = append(block.Tx[1].Vout, testVout(2, 0.1, "D"))
+	vouts := []AddressWithValueInTx{{Address: "C", Value: 4}, {Address: "B", Value: 5.9}, {Address: "D", Value: 0.1}}
+
+	tx := esTxFun(block.Tx[1], block, 0, false, nil, vouts)
+	assert.True(t, tx.Oversized)
+	assert.Equal(t, vouts[:2], tx.Vouts)
+	// 输出总额仍按所有 vout 计算
+	assert.Equal(t, 10.0, tx.OutputValue)
+
+	rawTxs := blockTx(block.Tx)
+	assert.Nil(t, rawTxs[0]["oversized"])
+	assert.Equal(t, true, rawTxs[1]["oversized"])
+	assert.Len(t, rawTxs[1]["vout"], 2)
+
+	assert.False(t, esTxFun(block.Tx[0], block, 0, false, nil, nil).Oversized)
+}
+
+func TestEsTxFunLean(t *testing.T) {
+	config.LeanTxDocs = true
+	defer func() { config.LeanTxDocs = false }()
+
+	block := testSyncBlock()
+	tx := esTxFun(block.Tx[1], block, 0.1, false, []AddressWithValueInTx{{Address: "B", Value: 10}}, []AddressWithValueInTx{{Address: "C", Value: 4}, {Address: "B", Value: 5.9}})
+	assert.Nil(t, tx.Vins)
+	assert.Nil(t, tx.Vouts)
+	assert.Equal(t, 0.1, tx.Fee)
+	assert.Equal(t, 9.9, tx.OutputValue)
+}
+
+func TestBitcoinConnConfig(t *testing.T) {
+	conf := configure{BitcoinHost: "127.0.0.1", BitcoinPort: "8332", BitcoinUser: "user", BitcoinPass: "pass", BitcoinhttpMode: true}
+	connCfg, _, err := conf.bitcoinConnConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:8332", connCfg.Host)
+	assert.Equal(t, "user", connCfg.User)
+
+	f, err := ioutil.TempFile("", "cookie")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	assert.Nil(t, ioutil.WriteFile(f.Name(), []byte("__cookie__:a1b2c3\n"), 0600))
+	conf.BitcoinCookieFile = f.Name()
+	connCfg, _, err = conf.bitcoinConnConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, "__cookie__", connCfg.User)
+	assert.Equal(t, "a1b2c3", connCfg.Pass)
+
+	assert.Nil(t, ioutil.WriteFile(f.Name(), []byte("a1b2c3"), 0600))
+	_, _, err = conf.bitcoinConnConfig()
+	assert.NotNil(t, err)
+}
+
+func TestReloadIfCookieChanged(t *testing.T) {
+	f, err := ioutil.TempFile("", "cookie")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	assert.Nil(t, ioutil.WriteFile(f.Name(), []byte("__cookie__:first"), 0600))
+	defer func(saved *configure) { config = saved }(config)
+	config = &configure{BitcoinHost: "127.0.0.1", BitcoinPort: "8332", BitcoinhttpMode: true, BitcoinCookieFile: f.Name()}
+
+	btcClient := bitcoinClientAlias{config.bitcoinClient()}
+	client := btcClient.Client
+	btcClient.reloadIfCookieChanged()
+	assert.Equal(t, client, btcClient.Client)
+
+	// bitcoind 重启后写入新的 cookie
+	assert.Nil(t, ioutil.WriteFile(f.Name(), []byte("__cookie__:second"), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(f.Name(), later, later))
+	btcClient.reloadIfCookieChanged()
+	assert.NotEqual(t, client, btcClient.Client)
+	assert.True(t, bitcoinCookieModTime.Equal(later))
+	btcClient.Shutdown()
+}
+
+func TestSlimBlockDoc(t *testing.T) {
+	block := testSyncBlock()
+	stats := &blockStats{TxCount: 2}
+	doc := blockWithTxDetail(block, &blockHeaderVerbose{}, stats)
+	assert.NotNil(t, doc["tx"])
+	assert.Nil(t, doc["txids"])
+
+	config.SlimBlockDocs = true
+	defer func() { config.SlimBlockDocs = false }()
+	doc = blockWithTxDetail(block, &blockHeaderVerbose{}, stats)
+	assert.Nil(t, doc["tx"])
+	assert.Equal(t, []string{block.Tx[0].Txid, block.Tx[1].Txid}, doc["txids"])
+	assert.Equal(t, block.Hash, doc["hash"])
+}
+
+func TestBlockFeeVerification(t *testing.T) {
+	reported, err := decodeBlockTotalFee(json.RawMessage(`{"totalfee": 10000000}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "0.1", reported.String())
+	_, err = decodeBlockTotalFee(json.RawMessage(`{}`))
+	assert.NotNil(t, err)
+
+	block := testSyncBlock()
+	stats := &blockStats{TxCount: 2, TotalFees: decimal.NewFromFloat(0.1)}
+	doc := blockWithTxDetail(block, &blockHeaderVerbose{}, stats)
+	assert.Nil(t, doc["reported_fees"])
+	assert.Nil(t, doc["fee_mismatch"])
+
+	stats.ReportedFees = &reported
+	doc = blockWithTxDetail(block, &blockHeaderVerbose{}, stats)
+	assert.Equal(t, 0.1, doc["reported_fees"])
+	assert.Equal(t, false, doc["fee_mismatch"])
+
+	// 有 vin 没有找到时计算的手续费偏小
+	stats.TotalFees = decimal.NewFromFloat(0.05)
+	doc = blockWithTxDetail(block, &blockHeaderVerbose{}, stats)
+	assert.Equal(t, true, doc["fee_mismatch"])
+}
+
+func TestCoinbaseHeight(t *testing.T) {
+	for script, want := range map[string]int32{"0320a1070004": 500000, "028000": 128, "51": 1, "60": 16, "00": 0} {
+		height, err := coinbaseHeight(script)
+		assert.Nil(t, err, script)
+		assert.Equal(t, want, height, script)
+	}
+	for _, script := range []string{"", "0320a1", "03ffffff", "050000000000", "6a"} {
+		_, err := coinbaseHeight(script)
+		assert.NotNil(t, err, script)
+	}
+
+	// BIP34 激活前不检查
+	block := testSyncBlock()
+	assert.Nil(t, checkCoinbaseHeight(block))
+
+	block.Height = 500000
+	block.Tx[0].Vin[0].Coinbase = "0320a1070004"
+	check := checkCoinbaseHeight(block)
+	assert.Equal(t, int32(500000), *check.Height)
+	assert.False(t, check.Mismatch)
+	doc := blockWithTxDetail(block, &blockHeaderVerbose{}, &blockStats{CoinbaseHeight: check})
+	assert.Equal(t, int32(500000), doc["coinbase_height"])
+	assert.Equal(t, false, doc["coinbase_height_mismatch"])
+
+	block.Height = 500001
+	assert.True(t, checkCoinbaseHeight(block).Mismatch)
+	block.Tx[0].Vin[0].Coinbase = "04ffff001d0102"
+	check = checkCoinbaseHeight(block)
+	assert.True(t, check.Mismatch)
+	block.Tx[0].Vin[0].Coinbase = "6a"
+	check = checkCoinbaseHeight(block)
+	assert.Nil(t, check.Height)
+	assert.True(t, check.Mismatch)
+	doc = blockWithTxDetail(block, &blockHeaderVerbose{}, &blockStats{CoinbaseHeight: check})
+	assert.Nil(t, doc["coinbase_height"])
+	assert.Equal(t, true, doc["coinbase_height_mismatch"])
+}
+
+func TestDecodeBlockVerboseTx(t *testing.T) {
+	// getblock <hash> 2 的返回值 (节选)
+	raw := json.RawMessage(`{
+  "hash": "00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048",
+  "height": 1,
+  "time": 1231469665,
+  "previousblockhash": "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+  "tx": [{
+    "txid": "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098",
+    "hash": "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098",
+    "version": 1,
+    "size": 134,
+    "vsize": 134,
+    "vin": [{"coinbase": "04ffff001d0104", "sequence": 4294967295}],
+    "vout": [{"value": 50.00000000, "n": 0, "scriptPubKey": {"type": "pubkey", "addresses": ["12c6DSiU4Rq3P4ZxziKxzrGqZNqEiNqJCw"]}}]
+  }]
+}`)
+	block, err := decodeBlockVerboseTx(raw)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, block.Height)
+	assert.Len(t, block.Tx, 1)
+	assert.Equal(t, "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098", block.Tx[0].Txid)
+	assert.Equal(t, "04ffff001d0104", block.Tx[0].Vin[0].Coinbase)
+	assert.Equal(t, []string{"12c6DSiU4Rq3P4ZxziKxzrGqZNqEiNqJCw"}, block.Tx[0].Vout[0].ScriptPubKey.Addresses)
+}
+
+func TestDeriveP2PKAddresses(t *testing.T) {
+	// 区块 1 coinbase 的 P2PK 输出，节点没有返回地址
+	raw := json.RawMessage(`{
+  "hash": "00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048",
+  "height": 1,
+  "tx": [{
+    "txid": "0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098",
+    "vin": [{"coinbase": "04ffff001d0104", "sequence": 4294967295}],
+    "vout": [{"value": 50.00000000, "n": 0, "scriptPubKey": {
+      "asm": "0496b538e853519c726a2c91e61ec11600ae1390813a627c66fb8be7947be63c52da7589379515d4e0a604f8141781e62294721166bf621e73a82cbf2342c858ee OP_CHECKSIG",
+      "hex": "410496b538e853519c726a2c91e61ec11600ae1390813a627c66fb8be7947be63c52da7589379515d4e0a604f8141781e62294721166bf621e73a82cbf2342c858eeac",
+      "type": "pubkey"}}]
+  }]
+}`)
+	block, err := decodeBlockVerboseTx(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"12c6DSiU4Rq3P4ZxziKxzrGqZNqEiNqJCw"}, block.Tx[0].Vout[0].ScriptPubKey.Addresses)
+
+	// 不是有效公钥的 P2PK 脚本没有地址
+	vouts := []btcjson.Vout{{ScriptPubKey: btcjson.ScriptPubKeyResult{Type: "pubkey", Hex: "2105" + strings.Repeat("00", 32) + "ac"}}}
+	deriveP2PKAddresses(vouts)
+	assert.Empty(t, vouts[0].ScriptPubKey.Addresses)
+}
+
+func TestDeriveVoutAddressesCustomDeriver(t *testing.T) {
+	p2pk := btcjson.ScriptPubKeyResult{
+		Type: "pubkey",
+		Hex:  "410496b538e853519c726a2c91e61ec11600ae1390813a627c66fb8be7947be63c52da7589379515d4e0a604f8141781e62294721166bf621e73a82cbf2342c858eeac",
+	}
+	custom := btcjson.ScriptPubKeyResult{Type: "nonstandard", Hex: "51"}
+	standard := btcjson.ScriptPubKeyResult{Type: "pubkeyhash", Addresses: []string{"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"}}
+
+	// 没有自定义解析时非标准脚本仍然没有地址
+	vouts := []btcjson.Vout{{ScriptPubKey: custom}}
+	deriveVoutAddresses(vouts)
+	assert.Empty(t, vouts[0].ScriptPubKey.Addresses)
+
+	var derived []string
+	config.AddressDeriver = func(scriptPubKey btcjson.ScriptPubKeyResult) []string {
+		derived = append(derived, scriptPubKey.Hex)
+		if scriptPubKey.Hex == "51" {
+			return []string{"custom-51"}
+		}
+		return nil
+	}
+	defer func() { config.AddressDeriver = nil }()
+
+	vouts = []btcjson.Vout{{ScriptPubKey: p2pk}, {ScriptPubKey: custom}, {ScriptPubKey: standard}, {ScriptPubKey: btcjson.ScriptPubKeyResult{Type: "nulldata", Hex: "6a"}}}
+	deriveVoutAddresses(vouts)
+	assert.Equal(t, []string{"12c6DSiU4Rq3P4ZxziKxzrGqZNqEiNqJCw"}, vouts[0].ScriptPubKey.Addresses)
+	assert.Equal(t, []string{"custom-51"}, vouts[1].ScriptPubKey.Addresses)
+	assert.Equal(t, []string{"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"}, vouts[2].ScriptPubKey.Addresses)
+	assert.Empty(t, vouts[3].ScriptPubKey.Addresses)
+	// 只有标准解析之后仍然没有地址的输出交给自定义解析
+	assert.Equal(t, []string{"51", "6a"}, derived)
+}
+
+func TestUseAddressDeriver(t *testing.T) {
+	defer func() { config.AddressDeriverName, config.AddressDeriver = "", nil }()
+
+	config.AddressDeriverName = "unknown"
+	assert.NotNil(t, config.useAddressDeriver())
+	assert.Nil(t, config.AddressDeriver)
+
+	config.AddressDeriverName = "script_hash"
+	assert.Nil(t, config.useAddressDeriver())
+	vouts := []btcjson.Vout{
+		{ScriptPubKey: btcjson.ScriptPubKeyResult{Type: "nonstandard", Hex: "51"}},
+		{ScriptPubKey: btcjson.ScriptPubKeyResult{Type: "nonstandard", Hex: "51"}},
+		{ScriptPubKey: btcjson.ScriptPubKeyResult{Type: "nulldata", Hex: "6a"}},
+	}
+	deriveVoutAddresses(vouts)
+	// sha256(0x51)
+	assert.Equal(t, []string{"s-4ae81572f06e1b88fd5ced7a1a000945432e83e1551e6f721ee9c00b8cc33260"}, vouts[0].ScriptPubKey.Addresses)
+	assert.Equal(t, vouts[0].ScriptPubKey.Addresses, vouts[1].ScriptPubKey.Addresses)
+	assert.Empty(t, vouts[2].ScriptPubKey.Addresses)
+
+	assert.Panics(t, func() { RegisterAddressDeriver("script_hash", scriptHashAddress) })
+}
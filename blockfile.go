@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+// medianTimeBlocks mediantime 为区块及其前 10 个区块时间的中位数
+const medianTimeBlocks = 11
+
+// blockFileEntry 区块头及区块在 blk*.dat 文件中的位置
+type blockFileEntry struct {
+	header wire.BlockHeader
+	file   string
+	offset int64 // 区块数据 (magic 和长度之后) 在文件中的偏移
+	size   uint32
+}
+
+// blockFileSource 直接读取 Bitcoin Core blocks 目录下的 blk*.dat 文件，用于首次同步时避免逐个区块 RPC 请求
+// 文件中的区块不按高度排列且包含孤块，扫描所有区块头后从创世区块开始选出累计工作量最大的链
+type blockFileSource struct {
+	params    *chaincfg.Params
+	xorKey    []byte // Bitcoin Core 28 起 blocks 目录中的文件用 xor.dat 中的 key 混淆
+	entries   map[chainhash.Hash]*blockFileEntry
+	chain     []chainhash.Hash // 按高度排列的最长链
+	chainwork []*big.Int
+	files     map[string]*os.File
+}
+
+func newBlockFileSource(dir string) (*blockFileSource, error) {
+	source := &blockFileSource{
+		entries: make(map[chainhash.Hash]*blockFileEntry),
+		files:   make(map[string]*os.File),
+	}
+	xorKey, err := ioutil.ReadFile(filepath.Join(dir, "xor.dat"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(xorKey) > 0 && !bytes.Equal(xorKey, make([]byte, len(xorKey))) {
+		source.xorKey = xorKey
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "blk*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, errors.New(strings.Join([]string{"no blk*.dat files in", dir}, " "))
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		if err := source.scanFile(file); err != nil {
+			return nil, err
+		}
+	}
+	if err := source.selectBestChain(); err != nil {
+		source.Close()
+		return nil, err
+	}
+	return source, nil
+}
+
+// Close 关闭打开的 blk*.dat 文件
+func (source *blockFileSource) Close() {
+	for _, f := range source.files {
+		f.Close()
+	}
+}
+
+// tipHeight 最长链的最大高度
+func (source *blockFileSource) tipHeight() int32 {
+	return int32(len(source.chain) - 1)
+}
+
+func (source *blockFileSource) open(file string) (*os.File, error) {
+	if f, ok := source.files[file]; ok {
+		return f, nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	source.files[file] = f
+	return f, nil
+}
+
+// readAt 读取文件 offset 处的数据，并还原 xor 混淆
+func (source *blockFileSource) readAt(f *os.File, buf []byte, offset int64) error {
+	if _, err := f.ReadAt(buf, offset); err != nil {
+		return err
+	}
+	if len(source.xorKey) > 0 {
+		for i := range buf {
+			buf[i] ^= source.xorKey[(offset+int64(i))%int64(len(source.xorKey))]
+		}
+	}
+	return nil
+}
+
+// scanFile 读取文件中所有区块头，每条记录为 magic (4 字节) + 区块长度 (4 字节) + 区块数据
+func (source *blockFileSource) scanFile(file string) error {
+	f, err := source.open(file)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	preamble := make([]byte, 8)
+	headerBytes := make([]byte, wire.MaxBlockHeaderPayload)
+	for offset := int64(0); offset+int64(len(preamble)) <= info.Size(); {
+		if err := source.readAt(f, preamble, offset); err != nil {
+			return err
+		}
+		magic := wire.BitcoinNet(binary.LittleEndian.Uint32(preamble[:4]))
+		// 文件末尾预分配的空间全部为 0
+		if magic == 0 {
+			break
+		}
+		// blk*.dat 文件中每个区块前的 magic 必须与配置的链一致
+		if magic != chain.Params.Net {
+			return errors.New(strings.Join([]string{"unexpected magic", magic.String(), "in", file, "at offset", strconv.FormatInt(offset, 10), "for chain", chain.Name}, " "))
+		}
+		source.params = chain.Params
+
+		size := binary.LittleEndian.Uint32(preamble[4:])
+		if offset+int64(len(preamble))+int64(size) > info.Size() {
+			// 节点写入中的区块
+			break
+		}
+		if err := source.readAt(f, headerBytes, offset+int64(len(preamble))); err != nil {
+			return err
+		}
+		entry := &blockFileEntry{file: file, offset: offset + int64(len(preamble)), size: size}
+		if err := entry.header.Deserialize(bytes.NewReader(headerBytes)); err != nil {
+			return err
+		}
+		source.entries[entry.header.BlockHash()] = entry
+		offset += int64(len(preamble)) + int64(size)
+	}
+	return nil
+}
+
+// selectBestChain 从创世区块开始计算每个区块的累计工作量，选出工作量最大的链
+func (source *blockFileSource) selectBestChain() error {
+	if source.params == nil {
+		return errors.New("no blocks found in blk*.dat files")
+	}
+	genesis := *source.params.GenesisHash
+	if _, ok := source.entries[genesis]; !ok {
+		return errors.New(strings.Join([]string{"genesis block", genesis.String(), "not found in blk*.dat files"}, " "))
+	}
+
+	children := make(map[chainhash.Hash][]chainhash.Hash)
+	for hash, entry := range source.entries {
+		children[entry.header.PrevBlock] = append(children[entry.header.PrevBlock], hash)
+	}
+
+	work := map[chainhash.Hash]*big.Int{genesis: blockWork(source.entries[genesis].header.Bits)}
+	tip := genesis
+	for pending := []chainhash.Hash{genesis}; len(pending) > 0; {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		for _, child := range children[hash] {
+			work[child] = new(big.Int).Add(work[hash], blockWork(source.entries[child].header.Bits))
+			if work[child].Cmp(work[tip]) > 0 {
+				tip = child
+			}
+			pending = append(pending, child)
+		}
+	}
+
+	for hash := tip; ; hash = source.entries[hash].header.PrevBlock {
+		source.chain = append(source.chain, hash)
+		source.chainwork = append(source.chainwork, work[hash])
+		if hash == genesis {
+			break
+		}
+	}
+	for i, j := 0, len(source.chain)-1; i < j; i, j = i+1, j-1 {
+		source.chain[i], source.chain[j] = source.chain[j], source.chain[i]
+		source.chainwork[i], source.chainwork[j] = source.chainwork[j], source.chainwork[i]
+	}
+	return nil
+}
+
+// blockWork 区块的工作量 2^256 / (target + 1)
+func blockWork(bits uint32) *big.Int {
+	target := compactToBig(bits)
+	if target.Sign() <= 0 {
+		return big.NewInt(0)
+	}
+	denominator := new(big.Int).Add(target, big.NewInt(1))
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
+
+// compactToBig 把区块头中的 bits 转换为 target
+func compactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	isNegative := compact&0x00800000 != 0
+	exponent := uint(compact >> 24)
+
+	var target *big.Int
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target = big.NewInt(int64(mantissa))
+	} else {
+		target = big.NewInt(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+	if isNegative {
+		target = target.Neg(target)
+	}
+	return target
+}
+
+// difficulty 与 bitcoind 相同，所有网络都以 bits 0x1d00ffff 的 target 为 1
+func difficulty(bits uint32) float64 {
+	target := compactToBig(bits)
+	if target.Sign() <= 0 {
+		return 0
+	}
+	d, _ := new(big.Float).Quo(new(big.Float).SetInt(compactToBig(0x1d00ffff)), new(big.Float).SetInt(target)).Float64()
+	return d
+}
+
+// block 读取最长链上 height 高度的区块，转换为与 getblock (verbosity 2) 和 getblockheader 相同的结构
+func (source *blockFileSource) block(height int32) (*btcjson.GetBlockVerboseResult, *blockHeaderVerbose, error) {
+	if height < 0 || height > source.tipHeight() {
+		return nil, nil, fmt.Errorf("block %d: %w", height, ErrBlockNotFound)
+	}
+	entry := source.entries[source.chain[height]]
+	f, err := source.open(entry.file)
+	if err != nil {
+		return nil, nil, err
+	}
+	raw := make([]byte, entry.size)
+	if err := source.readAt(f, raw, entry.offset); err != nil {
+		return nil, nil, err
+	}
+	msgBlock := new(wire.MsgBlock)
+	if err := msgBlock.Deserialize(bytes.NewReader(raw)); err != nil {
+		return nil, nil, err
+	}
+
+	nextHash := ""
+	if height < source.tipHeight() {
+		nextHash = source.chain[height+1].String()
+	}
+	block, err := blockVerboseFromMsgBlock(msgBlock, int64(height), nextHash, source.params)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var times []int64
+	for h := height; h >= 0 && h > height-medianTimeBlocks; h-- {
+		times = append(times, source.entries[source.chain[h]].header.Timestamp.Unix())
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	header := &blockHeaderVerbose{
+		Hash:       block.Hash,
+		MedianTime: times[len(times)/2],
+		Chainwork:  fmt.Sprintf("%064x", source.chainwork[height]),
+	}
+	return block, header, nil
+}
+
+// blockVerboseFromMsgBlock 原始区块转换为 getblock (verbosity 2) 返回的结构
+func blockVerboseFromMsgBlock(msgBlock *wire.MsgBlock, height int64, nextHash string, params *chaincfg.Params) (*btcjson.GetBlockVerboseResult, error) {
+	blockHash := msgBlock.BlockHash().String()
+	header := msgBlock.Header
+	block := &btcjson.GetBlockVerboseResult{
+		Hash:         blockHash,
+		StrippedSize: int32(msgBlock.SerializeSizeStripped()),
+		Size:         int32(msgBlock.SerializeSize()),
+		Weight:       int32(msgBlock.SerializeSizeStripped()*(witnessScaleFactor-1) + msgBlock.SerializeSize()),
+		Height:       height,
+		Version:      header.Version,
+		VersionHex:   fmt.Sprintf("%08x", uint32(header.Version)),
+		MerkleRoot:   header.MerkleRoot.String(),
+		Time:         header.Timestamp.Unix(),
+		Nonce:        header.Nonce,
+		Bits:         fmt.Sprintf("%08x", header.Bits),
+		Difficulty:   difficulty(header.Bits),
+		NextHash:     nextHash,
+	}
+	if height > 0 {
+		block.PreviousHash = header.PrevBlock.String()
+	}
+	for _, msgTx := range msgBlock.Transactions {
+		tx, err := txRawResultFromMsgTx(msgTx, blockHash, params)
+		if err != nil {
+			return nil, err
+		}
+		block.Tx = append(block.Tx, tx)
+	}
+	return block, nil
+}
+
+// txRawResultFromMsgTx 原始交易转换为 getblock (verbosity 2) 中交易的结构，地址由 vout 脚本解析
+func txRawResultFromMsgTx(msgTx *wire.MsgTx, blockHash string, params *chaincfg.Params) (btcjson.TxRawResult, error) {
+	var buf bytes.Buffer
+	if err := msgTx.Serialize(&buf); err != nil {
+		return btcjson.TxRawResult{}, err
+	}
+	weight := msgTx.SerializeSizeStripped()*(witnessScaleFactor-1) + msgTx.SerializeSize()
+	tx := btcjson.TxRawResult{
+		Hex:       hex.EncodeToString(buf.Bytes()),
+		Txid:      msgTx.TxHash().String(),
+		Hash:      msgTx.WitnessHash().String(),
+		Size:      int32(msgTx.SerializeSize()),
+		Vsize:     int32((weight + witnessScaleFactor - 1) / witnessScaleFactor),
+		Version:   msgTx.Version,
+		LockTime:  msgTx.LockTime,
+		BlockHash: blockHash,
+	}
+
+	isCoinbase := len(msgTx.TxIn) == 1 && msgTx.TxIn[0].PreviousOutPoint.Index == wire.MaxPrevOutIndex &&
+		msgTx.TxIn[0].PreviousOutPoint.Hash == chainhash.Hash{}
+	for _, txIn := range msgTx.TxIn {
+		vin := btcjson.Vin{Sequence: txIn.Sequence}
+		for _, item := range txIn.Witness {
+			vin.Witness = append(vin.Witness, hex.EncodeToString(item))
+		}
+		if isCoinbase {
+			vin.Coinbase = hex.EncodeToString(txIn.SignatureScript)
+		} else {
+			asm, _ := txscript.DisasmString(txIn.SignatureScript)
+			vin.Txid = txIn.PreviousOutPoint.Hash.String()
+			vin.Vout = txIn.PreviousOutPoint.Index
+			vin.ScriptSig = &btcjson.ScriptSig{Asm: asm, Hex: hex.EncodeToString(txIn.SignatureScript)}
+		}
+		tx.Vin = append(tx.Vin, vin)
+	}
+
+	for n, txOut := range msgTx.TxOut {
+		asm, _ := txscript.DisasmString(txOut.PkScript)
+		class, addrs, reqSigs, _ := txscript.ExtractPkScriptAddrs(txOut.PkScript, params)
+		var addresses []string
+		for _, addr := range addrs {
+			addresses = append(addresses, addr.EncodeAddress())
+		}
+		tx.Vout = append(tx.Vout, btcjson.Vout{
+			Value: btcutil.Amount(txOut.Value).ToBTC(),
+			N:     uint32(n),
+			ScriptPubKey: btcjson.ScriptPubKeyResult{
+				Asm:       asm,
+				Hex:       hex.EncodeToString(txOut.PkScript),
+				ReqSigs:   int32(reqSigs),
+				Type:      class.String(),
+				Addresses: addresses,
+			},
+		})
+	}
+	deriveVoutAddresses(tx.Vout)
+	return tx, nil
+}
+
+// importBlockFiles 从 blk*.dat 文件同步 [from, to] 高度的区块，resume 为 true 时先回滚 from 开始的 ROLLBACKHEIGHT 个区块可能写入的数据
+// (sync state 之后已写入的区块，见 ResolveStartHeight)，没有写入的区块回滚时没有需要更新的文档
+func (esClient *elasticClientAlias) importBlockFiles(source *blockFileSource, from, to int32, resume bool) {
+	ctx := context.Background()
+	for height := from; height <= to; height++ {
+		backpressure.wait()
+		dumpBlockTime := time.Now()
+		block, header, err := source.block(height)
+		if err != nil {
+			sugar.Fatal("Read block from blk*.dat error: ", err.Error())
+		}
+		if resume && height < from+ROLLBACKHEIGHT {
+			esClient.RollbackTxVoutBalanceByBlock(ctx, block, false)
+		}
+		labels.reloadIfChanged()
+		stats := esClient.syncTxVoutBalance(ctx, block)
+		esClient.RollBackAndSyncBlock(height, block, header, stats)
+		if err := esClient.commitSyncState(ctx, height, block.Hash); err != nil {
+			sugar.Fatal(err.Error())
+		}
+		logBlockSynced("Import block", block, stats, time.Since(dumpBlockTime))
+	}
+}
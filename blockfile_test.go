@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeBlockFile 按 blk*.dat 的格式 (magic + 长度 + 区块) 写入区块，xorKey 不为空时混淆
+func writeBlockFile(t *testing.T, path string, xorKey []byte, blocks ...*wire.MsgBlock) {
+	var buf bytes.Buffer
+	for _, block := range blocks {
+		var raw bytes.Buffer
+		assert.Nil(t, block.Serialize(&raw))
+		binary.Write(&buf, binary.LittleEndian, uint32(wire.MainNet))
+		binary.Write(&buf, binary.LittleEndian, uint32(raw.Len()))
+		buf.Write(raw.Bytes())
+	}
+	// 预分配的空间
+	buf.Write(make([]byte, 16))
+	data := buf.Bytes()
+	for i := range data {
+		if len(xorKey) > 0 {
+			data[i] ^= xorKey[i%len(xorKey)]
+		}
+	}
+	assert.Nil(t, ioutil.WriteFile(path, data, 0644))
+}
+
+// testChildBlock prev 之后的区块，coinbase 支付 50 BTC 给私钥 1 对应的地址
+func testChildBlock(prev *wire.MsgBlock, nonce uint32) *wire.MsgBlock {
+	pubKey, _ := btcutil.NewAddressPubKey([]byte{0x02, 0x79, 0xbe, 0x66, 0x7e, 0xf9, 0xdc, 0xbb, 0xac, 0x55, 0xa0, 0x62, 0x95, 0xce, 0x87, 0x0b, 0x07,
+		0x02, 0x9b, 0xfc, 0xdb, 0x2d, 0xce, 0x28, 0xd9, 0x59, 0xf2, 0x81, 0x5b, 0x16, 0xf8, 0x17, 0x98}, &chaincfg.MainNetParams)
+	pkScript, _ := txscript.PayToAddrScript(pubKey.AddressPubKeyHash())
+
+	coinbase := wire.NewMsgTx(wire.TxVersion)
+	coinbase.AddTxIn(wire.NewTxIn(wire.NewOutPoint(&chainhash.Hash{}, wire.MaxPrevOutIndex), []byte{0x51, byte(nonce)}, nil))
+	coinbase.AddTxOut(wire.NewTxOut(50*btcutil.SatoshiPerBitcoin, pkScript))
+
+	prevHash := prev.Header.BlockHash()
+	header := wire.NewBlockHeader(1, &prevHash, &chainhash.Hash{}, prev.Header.Bits, nonce)
+	header.Timestamp = prev.Header.Timestamp.Add(10 * time.Minute)
+	header.MerkleRoot = coinbase.TxHash()
+	block := wire.NewMsgBlock(header)
+	block.AddTransaction(coinbase)
+	return block
+}
+
+func TestBlockFileSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blocks")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	genesis := chaincfg.MainNetParams.GenesisBlock
+	block1 := testChildBlock(genesis, 1)
+	block2 := testChildBlock(block1, 2)
+	stale := testChildBlock(genesis, 3)
+
+	xorKey := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "xor.dat"), xorKey, 0644))
+	// 区块不按高度排列，并包含一个孤块
+	writeBlockFile(t, filepath.Join(dir, "blk00000.dat"), xorKey, genesis, block2, stale)
+	writeBlockFile(t, filepath.Join(dir, "blk00001.dat"), xorKey, block1)
+
+	source, err := newBlockFileSource(dir)
+	assert.Nil(t, err)
+	defer source.Close()
+	assert.EqualValues(t, 2, source.tipHeight())
+
+	block, header, err := source.block(1)
+	assert.Nil(t, err)
+	assert.Equal(t, block1.BlockHash().String(), block.Hash)
+	assert.Equal(t, genesis.BlockHash().String(), block.PreviousHash)
+	assert.Equal(t, block2.BlockHash().String(), block.NextHash)
+	assert.Equal(t, "1d00ffff", block.Bits)
+	assert.Equal(t, 1.0, block.Difficulty)
+	assert.Equal(t, "0000000000000000000000000000000000000000000000000000000200020002", header.Chainwork)
+	// 与 bitcoind 相同，偶数个区块时取中间偏后的一个
+	assert.Equal(t, block1.Header.Timestamp.Unix(), header.MedianTime)
+
+	assert.Len(t, block.Tx, 1)
+	coinbase := block.Tx[0]
+	assert.Equal(t, "5101", coinbase.Vin[0].Coinbase)
+	assert.Equal(t, 50.0, coinbase.Vout[0].Value)
+	assert.Equal(t, "pubkeyhash", coinbase.Vout[0].ScriptPubKey.Type)
+	assert.Equal(t, []string{"1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH"}, coinbase.Vout[0].ScriptPubKey.Addresses)
+
+	genesisBlock, genesisHeader, err := source.block(0)
+	assert.Nil(t, err)
+	assert.Equal(t, "", genesisBlock.PreviousHash)
+	assert.Equal(t, "0000000000000000000000000000000000000000000000000000000100010001", genesisHeader.Chainwork)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/shopspring/decimal"
+)
+
+// chainConfig 链相关的参数，同一个程序可以同步 bitcoin 及地址前缀、出块奖励不同的分叉链
+// Params 用于解析地址 (blk*.dat 文件中的输出脚本、P2SH/P2WSH 的 redeemscript 和 witness script)
+// 以及识别 blk*.dat 文件的 magic，减半间隔为 Params.SubsidyReductionInterval
+type chainConfig struct {
+	Name   string
+	Params *chaincfg.Params
+	// InitialSubsidy 第一次减半前每个区块的出块奖励
+	InitialSubsidy btcutil.Amount
+}
+
+// chainConfigs 按 chain 配置的名称选择，分叉链在这里添加对应的参数
+var chainConfigs = map[string]*chainConfig{
+	"mainnet":  {Name: "mainnet", Params: &chaincfg.MainNetParams, InitialSubsidy: 50 * btcutil.SatoshiPerBitcoin},
+	"testnet3": {Name: "testnet3", Params: &chaincfg.TestNet3Params, InitialSubsidy: 50 * btcutil.SatoshiPerBitcoin},
+	"regtest":  {Name: "regtest", Params: &chaincfg.RegressionNetParams, InitialSubsidy: 50 * btcutil.SatoshiPerBitcoin},
+	"simnet":   {Name: "simnet", Params: &chaincfg.SimNetParams, InitialSubsidy: 50 * btcutil.SatoshiPerBitcoin},
+}
+
+// chain 配置的链，默认 bitcoin 主网
+var chain = chainConfigs["mainnet"]
+
+// subsidy 区块高度对应的出块奖励 (不含手续费)，每 SubsidyReductionInterval 个区块减半，减半 64 次后为 0
+func (c *chainConfig) subsidy(height int32) decimal.Decimal {
+	if c.Params.SubsidyReductionInterval == 0 {
+		return decimal.New(int64(c.InitialSubsidy), -8)
+	}
+	halvings := uint(height / c.Params.SubsidyReductionInterval)
+	if halvings >= 64 {
+		return decimal.New(0, 0)
+	}
+	return decimal.New(int64(c.InitialSubsidy>>halvings), -8)
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChainSubsidy(t *testing.T) {
+	mainnet := chainConfigs["mainnet"]
+	assert.Equal(t, "50", mainnet.subsidy(0).String())
+	assert.Equal(t, "50", mainnet.subsidy(209999).String())
+	assert.Equal(t, "25", mainnet.subsidy(210000).String())
+	assert.Equal(t, "3.125", mainnet.subsidy(840000).String())
+	assert.Equal(t, "0", mainnet.subsidy(64*210000).String())
+
+	// regtest 每 150 个区块减半
+	assert.Equal(t, "25", chainConfigs["regtest"].subsidy(150).String())
+}
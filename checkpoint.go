@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// exportCheckpoint 导出的断点，每页写出后保存到 <out>.checkpoint，--resume 时从断点之后继续。
+// 导出都用 search_after 翻页，After 为最后写出的文档的 sort 值，没有 scroll 上下文，中断多久都可以继续
+type exportCheckpoint struct {
+	Args     string        `json:"args"`            // 导出命令的参数，恢复时必须相同
+	Phase    string        `json:"phase,omitempty"` // 分多次遍历的导出 (export-tx-graph 的 spend、output) 当前的遍历
+	After    []interface{} `json:"after,omitempty"`
+	Exported int           `json:"exported"`
+	// Offset 保存断点时输出文件的长度，恢复时截断到这个长度，去掉断点之后写出的部分
+	Offset int64 `json:"offset"`
+}
+
+func checkpointPath(out string) string {
+	return out + ".checkpoint"
+}
+
+// openExportFile 打开导出文件。resume 为 false 时创建新文件并删除旧的断点；为 true 时读取断点，
+// 断点的参数必须是 args，把已有文件截断到断点的位置后返回，没有断点时与 resume 为 false 相同
+func openExportFile(out, args string, resume bool) (*os.File, *exportCheckpoint, error) {
+	if resume {
+		cp, err := readCheckpoint(checkpointPath(out))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, nil, err
+		}
+		if cp != nil {
+			if cp.Args != args {
+				return nil, nil, errors.New(strings.Join([]string{"checkpoint of", out, "is for", cp.Args, "not", args}, " "))
+			}
+			f, err := os.OpenFile(out, os.O_RDWR, 0644)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := f.Truncate(cp.Offset); err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+			if _, err := f.Seek(cp.Offset, io.SeekStart); err != nil {
+				f.Close()
+				return nil, nil, err
+			}
+			return f, cp, nil
+		}
+	}
+	if err := os.Remove(checkpointPath(out)); err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	f, err := os.Create(out)
+	return f, nil, err
+}
+
+func readCheckpoint(path string) (*exportCheckpoint, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cp := new(exportCheckpoint)
+	if err := json.Unmarshal(raw, cp); err != nil {
+		return nil, errors.New(strings.Join([]string{"invalid checkpoint", path, err.Error()}, " "))
+	}
+	return cp, nil
+}
+
+// exportCheckpointer 返回保存断点的函数，断点写入后输出文件的内容已经 flush 到 f，Offset 取 f 当前的位置。
+// 先写临时文件再 rename，中断时不会留下写了一半的断点
+func exportCheckpointer(f *os.File, out string) func(cp *exportCheckpoint) error {
+	return func(cp *exportCheckpoint) error {
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		cp.Offset = offset
+		raw, err := json.Marshal(cp)
+		if err != nil {
+			return err
+		}
+		tmp := checkpointPath(out) + ".tmp"
+		if err := ioutil.WriteFile(tmp, raw, 0644); err != nil {
+			return err
+		}
+		return os.Rename(tmp, checkpointPath(out))
+	}
+}
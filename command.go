@@ -1,6 +1,16 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
@@ -13,8 +23,112 @@ type configure struct {
 	BitcoinPass       string
 	BitcoinhttpMode   bool
 	BitcoinDisableTLS bool
-	ElasticURL        string
-	ElasticSniff      bool
+	// BitcoinCookieFile bitcoind datadir 下的 .cookie 文件，配置后代替 BitcoinUser、BitcoinPass
+	BitcoinCookieFile string
+	// ElasticURLs es 节点地址，配置多个时任一节点不可用仍可以继续同步
+	ElasticURLs []string
+	// ElasticUser/ElasticPass es basic auth 用户名和密码，ElasticAPIKey es API key (base64 编码的 id:api_key)，与 basic auth 二选一
+	// 可以通过环境变量 ELASTIC_USER、ELASTIC_PASS、ELASTIC_API_KEY 配置，不写入配置文件
+	ElasticUser   string
+	ElasticPass   string
+	ElasticAPIKey string
+	ElasticSniff  bool
+	// ElasticSnifferInterval 开启 sniff 时重新发现集群节点的间隔
+	ElasticSnifferInterval time.Duration
+	ElasticGzip            bool
+	// ElasticHealthcheckInterval es 节点健康检查间隔
+	ElasticHealthcheckInterval time.Duration
+	// ElasticMaxRetries 请求失败后最多重试次数，0 表示不重试
+	ElasticMaxRetries int
+	// ElasticRetryBackoffMin 指数退避重试的初始等待时间，ElasticRetryBackoffMax 等待时间达到该值时放弃重试
+	ElasticRetryBackoffMin time.Duration
+	ElasticRetryBackoffMax time.Duration
+	// ElasticHTTPTimeout 单个 es 请求 (包括读取响应) 的超时时间，0 表示不超时，避免半开连接让同步一直卡住
+	ElasticHTTPTimeout time.Duration
+	// ElasticMaxIdleConnsPerHost/ElasticIdleConnTimeout 每个 es 节点保持的空闲 keep-alive 连接数及空闲连接关闭前的时间
+	ElasticMaxIdleConnsPerHost int
+	ElasticIdleConnTimeout     time.Duration
+	// SyncFromHeight block index 为空时开始同步的区块高度
+	SyncFromHeight int32
+	// P2SHDecodeRedeemScript 花费 P2SH vout 时解析 vin scriptSig 中的多签 redeemscript，记录其涉及的地址
+	P2SHDecodeRedeemScript bool
+	// P2WSHDecodeWitnessScript 花费 P2WSH vout 时解析 vin witness 中的多签 witness script，记录其涉及的地址
+	P2WSHDecodeWitnessScript bool
+	// ElasticBalanceRouting balance 文档按地址路由，同一地址的读写只落在一个分片
+	ElasticBalanceRouting bool
+	// ElasticBulkActions/ElasticBulkSizeBytes/ElasticBulkFlushInterval bulk processor 按文档数、字节数、时间间隔 flush，-1 或 0 表示不按该条件 flush
+	ElasticBulkActions       int
+	ElasticBulkSizeBytes     int
+	ElasticBulkFlushInterval time.Duration
+	// BalanceBulkActions/BalanceBulkSizeBytes 大于 0 时余额更新与 tx、vout 分开，按地址数、字节数分批写入，BalanceBulkActions 为 0 时余额更新随区块的 bulk 请求写入
+	BalanceBulkActions   int
+	BalanceBulkSizeBytes int
+	// RollbackRefreshOnce 回滚区块时各个写入请求不等待 refresh，回滚结束后 refresh 一次
+	RollbackRefreshOnce bool
+	// LabelsFile 地址标签 csv 文件 (address,label)，为空表示不给 balance 文档加标签
+	LabelsFile string
+	// PoolTagsFile 矿池识别规则 json 文件 (coinbase_tags/payout_addresses)，为空表示不识别矿池
+	PoolTagsFile string
+	// RollbackBatchSize 回滚区块时每次查询 vouts 的 outpoint 数量，不能超过 es index.max_result_window
+	RollbackBatchSize int
+	// ElasticRefreshInterval/ElasticNumberOfReplicas 初始同步结束后使用的 index 设置，初始同步时 refresh 关闭、副本数为 0。
+	// 为空 / -1 时恢复进入 bulk load 模式前 index 原来的设置
+	ElasticRefreshInterval  string
+	ElasticNumberOfReplicas int
+	// RPCPrevoutFallback vin 花费的 vout 不在 es 中时通过 getrawtransaction 从节点查询，节点需要开启 txindex
+	RPCPrevoutFallback bool
+	// MaxTxInputsOutputs 交易的输入或输出数量超过该值时 tx 和 block 文档只保留前 MaxTxInputsOutputs 个，0 表示不限制
+	MaxTxInputsOutputs int
+	// LeanTxDocs tx 文档不写入 vins、vouts 地址明细，只保留 txid、blockhash、fee、time 等字段
+	LeanTxDocs bool
+	// ElasticForcemergeMaxSegments forcemerge 命令合并后每个分片最多保留的 segment 数
+	ElasticForcemergeMaxSegments int
+	// ChainName 同步的链，对应 chainConfigs 中的名称
+	ChainName string
+	// BalanceDLQ balance 文档写入失败时记录到 balance_dlq index 后继续同步，不开启时退出
+	BalanceDLQ bool
+	// IncludeScripts tx 文档带上输入的 scriptSig (asm/hex) 和 witness
+	IncludeScripts bool
+	// VerifyBlockFees 每个区块同步后通过 getblockstats 核对手续费总额
+	VerifyBlockFees bool
+	// FlushBeforeSyncState 每个区块同步后先 flush 写入的 index，成功后才更新 sync state
+	FlushBeforeSyncState bool
+	// VinDocs 同步时为每个被花费的 vout 写入 vin index 的文档
+	VinDocs bool
+	// AddressNgram balance index 的 address 增加 edge ngram 子字段，用于地址前缀补全
+	AddressNgram bool
+	// WatchedAddresses watch 模式只同步涉及这些地址的交易，为 nil 表示同步所有交易
+	WatchedAddresses map[string]bool
+	// SlimBlockDocs block 文档只保存区块头字段和 txids，不保存交易详情
+	SlimBlockDocs bool
+	// VinQueryBatchSize/VinQueryConcurrency 同步时每次查询交易输入花费的 vout 的 outpoint 数量，以及一笔交易最多同时查询的批次数
+	VinQueryBatchSize   int
+	VinQueryConcurrency int
+	// RecommendedFeesBlocks /fees 接口统计的最近区块数
+	RecommendedFeesBlocks int
+	// VerifyAfterIndex 每个区块写入后重新从节点获取区块，核对 es 中的 hash 和交易数
+	VerifyAfterIndex bool
+	// ElasticIndexCodecs 创建 index 时的 index.codec，index 名 -> codec，没有配置的 index 使用 es 默认的 LZ4
+	ElasticIndexCodecs map[string]string
+	// RPCMaxConcurrency 同时进行的 bitcoind rpc 调用数上限，0 表示不限制，应小于节点的 -rpcworkqueue
+	RPCMaxConcurrency int
+	// FinalizeForcemerge 同步区间结束时 FinalizeSync 把同步的 index 合并到 ElasticForcemergeMaxSegments 个 segment
+	FinalizeForcemerge bool
+	// SoftDeleteVouts 回滚时不删除区块创建的 vout，标记为 orphaned 并记录 reorg_height，由 prune-spent-vouts 删除
+	SoftDeleteVouts bool
+	// MonthlyTxIndices tx 文档按区块时间写入 tx-YYYY-MM index，查询通过别名 tx 读取所有月份
+	MonthlyTxIndices bool
+	// SkipZeroValueBalances 金额为 0 的输出不更新地址余额，见 skipBalance
+	SkipZeroValueBalances bool
+	// TxDataStream tx 文档写入 ES 7.9+ 的 data stream tx，由 ILM policy 按 TxILM* rollover 和删除，见 createTxDataStream
+	TxDataStream         bool
+	TxILMRolloverMaxAge  string
+	TxILMRolloverMaxSize string
+	TxILMDeleteAfter     string
+	// AddressDeriverName address_deriver 选择的 AddressDeriver，为 RegisterAddressDeriver 注册的名字，为空时不使用
+	AddressDeriverName string
+	// AddressDeriver 标准脚本之外的输出脚本的地址，由 loadEnrichmentFiles 按 AddressDeriverName 设置，为 nil 时这些输出没有地址
+	AddressDeriver AddressDeriver
 }
 
 // rootCmd represents the base command when called without any subcommands
@@ -30,6 +144,11 @@ var accountCmd = &cobra.Command{
 	},
 }
 
+var (
+	syncLimit int32
+	syncTo    int32
+)
+
 var syncCmd = &cobra.Command{
 	Use:   "sync",
 	Short: "Parse bitcoin chaindata to elasticsearch",
@@ -41,20 +160,805 @@ var syncCmd = &cobra.Command{
 
 		esClient.createIndices()
 
+		loadEnrichmentFiles()
+
 		c := config.bitcoinClient()
 		btcClient := bitcoinClientAlias{c}
+		if config.RPCPrevoutFallback || config.WatchedAddresses != nil {
+			prevouts = &btcClient
+		}
+
+		start, resume, warnings, err := esClient.ResolveStartHeight(context.Background(), config.SyncFromHeight)
+		if err != nil {
+			sugar.Fatal("resolve start height error: ", err.Error())
+		}
+		for _, warning := range warnings {
+			sugar.Warn(warning)
+		}
+		syncStopAt = syncStopHeight(start, syncLimit, syncTo)
+		if syncStopAt >= 0 {
+			sugar.Info("Stop syncing after block ", syncStopAt)
+			// 同步区间时 balance journal 跨区块分批写入，区间结束时由 FinalizeSync 写入剩余的文档
+			if err := esClient.StartBalanceJournal(context.Background()); err != nil {
+				sugar.Fatal(err.Error())
+			}
+		}
+		if resume {
+			// Sync 从 es 中已同步的最大高度回滚最近的区块后继续同步，ResolveStartHeight 保证 sync state 之后写入的区块都在回滚范围内
+			sugar.Info("Resume syncing from block ", start)
+			// 上次初始同步中途退出时恢复进入 bulk load 模式前的 index 设置
+			if err := esClient.ExitBulkLoadMode(context.Background()); err != nil {
+				sugar.Fatal(err.Error())
+			}
+		}
 
 		for {
+			btcClient.reloadIfCookieChanged()
 			isContinue := esClient.Sync(btcClient)
 			if !isContinue {
+				sugar.Error("break syncing")
+				if err := esClient.closeBalanceJournal(); err != nil {
+					sugar.Error(err.Error())
+				}
+				break
+			}
+			if syncStopAt >= 0 {
+				height, found, err := esClient.LastSyncedHeight(context.Background())
+				if err != nil {
+					sugar.Fatal("Query last synced height error: ", err.Error())
+				}
+				if found && height >= syncStopAt {
+					sugar.Info("Reached block ", height, ", stop syncing")
+					var merger *elasticClientAlias
+					if config.FinalizeForcemerge {
+						if merger, err = config.forcemergeClient(); err != nil {
+							sugar.Fatal("es client error: ", err.Error())
+						}
+					}
+					if err := esClient.FinalizeSync(context.Background(), merger); err != nil {
+						sugar.Fatal(err.Error())
+					}
+					break
+				}
+			}
+		}
+	},
+}
+
+var tailInterval time.Duration
+
+var tailCmd = &cobra.Command{
+	Use:   "tail",
+	Short: "Follow the chain tip and print a summary line per newly indexed block",
+	Run: func(cmd *cobra.Command, args []string) {
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+		// block index 为空时 Sync 会删除所有 index 重新同步，tail 只跟随已有的同步
+		height, found, err := esClient.LastSyncedHeight(context.Background())
+		if err != nil {
+			sugar.Fatal("Query last synced height error: ", err.Error())
+		}
+		if !found {
+			sugar.Fatal("block index is empty, run sync first")
+		}
+		loadEnrichmentFiles()
+
+		btcClient := bitcoinClientAlias{config.bitcoinClient()}
+		if config.RPCPrevoutFallback || config.WatchedAddresses != nil {
+			prevouts = &btcClient
+		}
+		onBlockSynced = newBlockTail(os.Stdout, int64(height)).blockSynced
+
+		for {
+			btcClient.reloadIfCookieChanged()
+			if !esClient.Sync(btcClient) {
 				sugar.Error("break syncing")
 				break
 			}
 			esClient.Flush()
+			time.Sleep(tailInterval)
+		}
+	},
+}
+
+var (
+	verifyFrom int32
+	verifyTo   int32
+)
+
+var verifyChainworkCmd = &cobra.Command{
+	Use:   "verify-chainwork",
+	Short: "Verify previoushash linkage and chainwork of indexed blocks",
+	Run: func(cmd *cobra.Command, args []string) {
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+
+		if err := esClient.VerifyChainwork(context.Background(), verifyFrom, verifyTo); err != nil {
+			sugar.Fatal("verify chainwork error: ", err.Error())
+		}
+		sugar.Info("chainwork verified from ", verifyFrom, " to ", verifyTo)
+	},
+}
+
+var verifyDigestsCmd = &cobra.Command{
+	Use:   "verify-digests",
+	Short: "Verify indexed block docs against the digest computed when they were indexed",
+	Run: func(cmd *cobra.Command, args []string) {
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+
+		mismatched, err := esClient.VerifyBlockDigests(context.Background(), verifyFrom, verifyTo)
+		if err != nil {
+			sugar.Fatal("verify block digests error: ", err.Error())
+		}
+		if len(mismatched) > 0 {
+			sugar.Fatal("block docs modified after indexing: ", mismatched)
+		}
+		sugar.Info("block digests verified from ", verifyFrom, " to ", verifyTo)
+	},
+}
+
+var (
+	indexBlockHash   string
+	indexBlockHeight int32
+)
+
+var indexBlockCmd = &cobra.Command{
+	Use:   "index-block",
+	Short: "Reindex a single block by hash or height",
+	Run: func(cmd *cobra.Command, args []string) {
+		if indexBlockHash == "" && indexBlockHeight <= 0 {
+			sugar.Fatal("index-block requires --hash or --height")
+		}
+
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+		esClient.createIndices()
+		loadEnrichmentFiles()
+
+		c := config.bitcoinClient()
+		btcClient := bitcoinClientAlias{c}
+		if config.RPCPrevoutFallback || config.WatchedAddresses != nil {
+			prevouts = &btcClient
+		}
+
+		var block *btcjson.GetBlockVerboseResult
+		if indexBlockHash != "" {
+			block, err = btcClient.getBlockByHash(indexBlockHash)
+		} else {
+			block, err = btcClient.getBlock(indexBlockHeight)
+		}
+		if err != nil {
+			sugar.Fatal("Get block error: ", err.Error())
+		}
+		btcClient.reindexBlock(block, esClient)
+	},
+}
+
+var (
+	pruneBefore int32
+	pruneDryRun bool
+)
+
+var pruneSpentVoutsCmd = &cobra.Command{
+	Use:   "prune-spent-vouts",
+	Short: "Delete vouts spent or orphaned before a block height",
+	Run: func(cmd *cobra.Command, args []string) {
+		if pruneBefore <= 0 {
+			sugar.Fatal("prune-spent-vouts requires --before")
+		}
+
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+
+		ctx := context.Background()
+		count, err := esClient.CountSpentVouts(ctx, pruneBefore)
+		if err != nil {
+			sugar.Fatal(err.Error())
+		}
+		sugar.Info(count, " vouts spent or orphaned before height ", pruneBefore)
+		if pruneDryRun {
+			return
+		}
+
+		deleted, err := esClient.PruneSpentVouts(ctx, pruneBefore)
+		if err != nil {
+			sugar.Fatal(err.Error())
+		}
+		sugar.Info("pruned ", deleted, " spent or orphaned vouts")
+	},
+}
+
+var (
+	reconcileFrom   int32
+	reconcileTo     int32
+	reconcileDryRun bool
+)
+
+var reconcileBalancesCmd = &cobra.Command{
+	Use:   "reconcile-balances",
+	Short: "Recompute the balances of addresses touched by a block range from unspent vouts",
+	Run: func(cmd *cobra.Command, args []string) {
+		if reconcileFrom <= 0 || reconcileTo < reconcileFrom {
+			sugar.Fatal("reconcile-balances requires --from and --to, with --to not below --from")
+		}
+
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+		loadEnrichmentFiles()
+
+		corrections, err := esClient.ReconcileBalances(context.Background(), reconcileFrom, reconcileTo, reconcileDryRun)
+		if err != nil {
+			sugar.Fatal("reconcile balances error: ", err.Error())
+		}
+		for _, correction := range corrections {
+			if correction.Found {
+				sugar.Info("balance of ", correction.Address, ": ", correction.Old, " -> ", correction.New)
+			} else {
+				sugar.Info("balance of ", correction.Address, ": missing -> ", correction.New)
+			}
+		}
+		if reconcileDryRun {
+			sugar.Info(len(corrections), " balances would be corrected")
+			return
+		}
+		sugar.Info("corrected ", len(corrections), " balances")
+	},
+}
+
+var (
+	repairFrom   int32
+	repairTo     int32
+	repairDryRun bool
+)
+
+var repairUTXOCmd = &cobra.Command{
+	Use:   "repair-utxo",
+	Short: "Reconcile vout.used of a block range with the spends in the node's blocks",
+	Run: func(cmd *cobra.Command, args []string) {
+		if repairFrom <= 0 || repairTo < repairFrom {
+			sugar.Fatal("repair-utxo requires --from and --to, with --to not below --from")
+		}
+
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+		loadEnrichmentFiles()
+		btcClient := bitcoinClientAlias{config.bitcoinClient()}
+
+		repairs, err := esClient.RepairUTXOConsistency(context.Background(), repairFrom, repairTo, btcClient.getBlock, repairDryRun)
+		for _, repair := range repairs {
+			sugar.Info("vout ", repair.Txid, ":", repair.Vout, " at height ", repair.Height, ": spent by '", repair.SpentBy, "' -> '", repair.Now, "'")
+		}
+		if err != nil {
+			sugar.Fatal("repair utxo error: ", err.Error())
+		}
+		if repairDryRun {
+			sugar.Info(len(repairs), " vouts would be repaired")
+			return
+		}
+		sugar.Info("repaired ", len(repairs), " vouts")
+	},
+}
+
+var (
+	recomputeFeesFrom   int32
+	recomputeFeesTo     int32
+	recomputeFeesDryRun bool
+)
+
+var recomputeFeesCmd = &cobra.Command{
+	Use:   "recompute-fees",
+	Short: "Recompute fee, feerate and fee_incomplete of the txs in a block range from the vout index",
+	Run: func(cmd *cobra.Command, args []string) {
+		if recomputeFeesFrom <= 0 || recomputeFeesTo < recomputeFeesFrom {
+			sugar.Fatal("recompute-fees requires --from and --to, with --to not below --from")
+		}
+
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+		btcClient := bitcoinClientAlias{config.bitcoinClient()}
+		if config.RPCPrevoutFallback || config.WatchedAddresses != nil {
+			prevouts = &btcClient
+		}
+
+		repairs, err := esClient.RecomputeFees(context.Background(), recomputeFeesFrom, recomputeFeesTo, btcClient.getBlock, recomputeFeesDryRun)
+		for _, repair := range repairs {
+			sugar.Info("tx ", repair.Txid, " at height ", repair.Height, ": fee ", repair.Fee, " -> ", repair.Now,
+				", fee_incomplete ", repair.FeeIncomplete, " -> ", repair.NowIncomplete)
+		}
+		if err != nil {
+			sugar.Fatal("recompute fees error: ", err.Error())
+		}
+		if recomputeFeesDryRun {
+			sugar.Info(len(repairs), " txs would be repaired")
+			return
+		}
+		sugar.Info("repaired ", len(repairs), " txs")
+	},
+}
+
+var (
+	compareBalancesFile      string
+	compareBalancesTolerance float64
+)
+
+var compareBalancesCmd = &cobra.Command{
+	Use:   "compare-balances",
+	Short: "Compare indexed balances against an address,amount snapshot file",
+	Run: func(cmd *cobra.Command, args []string) {
+		if compareBalancesFile == "" {
+			sugar.Fatal("compare-balances requires --file")
+		}
+
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+
+		comparison, err := esClient.CompareBalancesAgainstFile(context.Background(), compareBalancesFile, compareBalancesTolerance, func(m *balanceMismatch) {
+			switch {
+			case !m.InIndex:
+				sugar.Warn("balance of ", m.Address, ": missing in index, snapshot ", m.Snapshot)
+			case !m.InSnapshot:
+				sugar.Warn("balance of ", m.Address, ": indexed ", m.Indexed, ", missing in snapshot")
+			default:
+				sugar.Warn("balance of ", m.Address, ": indexed ", m.Indexed, ", snapshot ", m.Snapshot)
+			}
+		})
+		if err != nil {
+			sugar.Fatal("compare balances error: ", err.Error())
+		}
+		if comparison.Mismatched > 0 {
+			sugar.Fatal(comparison.Mismatched, " balances differ from the snapshot of ", comparison.Compared, " addresses")
+		}
+		sugar.Info("balances match the snapshot of ", comparison.Compared, " addresses")
+	},
+}
+
+var (
+	coinDaysFrom int32
+	coinDaysTo   int32
+)
+
+var coinDaysDestroyedCmd = &cobra.Command{
+	Use:   "coin-days-destroyed",
+	Short: "Print the coin days destroyed by each block in a range",
+	Run: func(cmd *cobra.Command, args []string) {
+		if coinDaysFrom <= 0 || coinDaysTo < coinDaysFrom {
+			sugar.Fatal("coin-days-destroyed requires --from and --to, with --to not below --from")
+		}
+
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+		for height := coinDaysFrom; height <= coinDaysTo; height++ {
+			coinDays, err := esClient.CoinDaysDestroyed(context.Background(), height)
+			if err != nil {
+				sugar.Fatal("coin days destroyed error: ", err.Error())
+			}
+			sugar.Info("block ", height, ": ", coinDays, " coin days destroyed")
+		}
+	},
+}
+
+var (
+	cpfpFrom int32
+	cpfpTo   int32
+)
+
+var cpfpClustersCmd = &cobra.Command{
+	Use:   "cpfp-clusters",
+	Short: "Print the groups of txs linked by spends within the same block, with their package feerate",
+	Run: func(cmd *cobra.Command, args []string) {
+		if cpfpFrom <= 0 || cpfpTo < cpfpFrom {
+			sugar.Fatal("cpfp-clusters requires --from and --to, with --to not below --from")
+		}
+
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+		btcClient := bitcoinClientAlias{config.bitcoinClient()}
+		for height := cpfpFrom; height <= cpfpTo; height++ {
+			block, err := btcClient.getBlock(height)
+			if err != nil {
+				sugar.Fatal("Get block ", height, " error: ", err.Error())
+			}
+			clusters, err := esClient.CPFPClusters(context.Background(), block)
+			if err != nil {
+				sugar.Fatal("cpfp clusters error: ", err.Error())
+			}
+			for _, cluster := range clusters {
+				sugar.Info("block ", height, ": ", strings.Join(cluster.Txids, ","), " fee ", cluster.Fee, " vsize ", cluster.Vsize,
+					" feerate ", cluster.FeeRate, ", fee_incomplete ", cluster.FeeIncomplete)
+			}
+		}
+	},
+}
+
+var (
+	reuseFrom int32
+	reuseTo   int32
+)
+
+var addressReuseCmd = &cobra.Command{
+	Use:   "address-reuse",
+	Short: "Print how many addresses received more than one output in a range, and how many outputs they received",
+	Run: func(cmd *cobra.Command, args []string) {
+		if reuseFrom <= 0 || reuseTo < reuseFrom {
+			sugar.Fatal("address-reuse requires --from and --to, with --to not below --from")
+		}
+
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+		stats, err := esClient.AddressReuse(context.Background(), reuseFrom, reuseTo)
+		if err != nil {
+			sugar.Fatal("address reuse error: ", err.Error())
+		}
+		sugar.Info("blocks ", stats.From, "-", stats.To, ": ", stats.Reused, " of about ", stats.Addresses, " addresses received more than one output")
+		receipts := make([]int64, 0, len(stats.Distribution))
+		for n := range stats.Distribution {
+			receipts = append(receipts, n)
+		}
+		sort.Slice(receipts, func(i, j int) bool { return receipts[i] < receipts[j] })
+		for _, n := range receipts {
+			sugar.Info(stats.Distribution[n], " addresses received ", n, " outputs")
+		}
+	},
+}
+
+var (
+	exportHeight int32
+	exportOut    string
+	exportResume bool
+)
+
+var exportBalancesCmd = &cobra.Command{
+	Use:   "export-balances",
+	Short: "Export all balances as address,amount csv, the index must be synced to exactly --height",
+	Run: func(cmd *cobra.Command, args []string) {
+		if exportHeight <= 0 || exportOut == "" {
+			sugar.Fatal("export-balances requires --height and --out")
+		}
+
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+
+		runArgs := fmt.Sprintf("export-balances --height %d", exportHeight)
+		f, resume, err := openExportFile(exportOut, runArgs, exportResume)
+		if err != nil {
+			sugar.Fatal("open export file error: ", err.Error())
+		}
+		if resume != nil {
+			sugar.Info("resume exporting after ", resume.Exported, " balances")
+		}
+		exported, err := esClient.ExportBalancesAtHeight(context.Background(), exportHeight, f, resume, exportCheckpointer(f, exportOut))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			sugar.Fatal("export balances error: ", err.Error(), ", run again with --resume to continue from the last checkpoint")
+		}
+		os.Remove(checkpointPath(exportOut))
+		sugar.Info("exported ", exported, " balances at height ", exportHeight, " to ", exportOut)
+	},
+}
+
+var (
+	graphFrom   int32
+	graphTo     int32
+	graphOut    string
+	graphFormat string
+	graphResume bool
+)
+
+var exportTxGraphCmd = &cobra.Command{
+	Use:   "export-tx-graph",
+	Short: "Export the spend and output edges of a block range as csv or json lines",
+	Run: func(cmd *cobra.Command, args []string) {
+		if graphFrom < 0 || graphTo < graphFrom || graphOut == "" {
+			sugar.Fatal("export-tx-graph requires --from, --to and --out, with --to not below --from")
+		}
+
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+
+		if graphFormat != "csv" && graphFormat != "jsonl" {
+			sugar.Fatal("unknown --format ", graphFormat, ", use csv or jsonl")
+		}
+		runArgs := fmt.Sprintf("export-tx-graph --from %d --to %d --format %s", graphFrom, graphTo, graphFormat)
+		f, resume, err := openExportFile(graphOut, runArgs, graphResume)
+		if err != nil {
+			sugar.Fatal("open export file error: ", err.Error())
+		}
+		var w txGraphWriter = newTxGraphJSONWriter(f)
+		if graphFormat == "csv" {
+			// 恢复时文件中已经有表头
+			csvWriter := newTxGraphCSVWriter(f)
+			csvWriter.wroteHeader = resume != nil && resume.Offset > 0
+			w = csvWriter
+		}
+		if resume != nil {
+			sugar.Info("resume exporting after ", resume.Exported, " edges")
+		}
+		exported, err := esClient.ExportTxGraph(context.Background(), graphFrom, graphTo, w, resume, exportCheckpointer(f, graphOut))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			sugar.Fatal("export tx graph error: ", err.Error(), ", run again with --resume to continue from the last checkpoint")
+		}
+		os.Remove(checkpointPath(graphOut))
+		sugar.Info("exported ", exported, " edges from ", graphFrom, " to ", graphTo, " to ", graphOut)
+	},
+}
+
+var (
+	sinkFrom   int32
+	sinkTo     int32
+	sinkName   string
+	sinkResync bool
+)
+
+var syncSinkCmd = &cobra.Command{
+	Use:   "sync-sink",
+	Short: "Sync a block range through a pluggable sink (stdout)",
+	Run: func(cmd *cobra.Command, args []string) {
+		if sinkFrom < 0 || sinkTo < sinkFrom {
+			sugar.Fatal("sync-sink requires --from and --to, with --to not below --from")
+		}
+		sink, err := newSink(sinkName, os.Stdout)
+		if err != nil {
+			sugar.Fatal("sink error: ", err.Error())
+		}
+		loadEnrichmentFiles()
+
+		btcClient := bitcoinClientAlias{config.bitcoinClient()}
+		if config.RPCPrevoutFallback {
+			prevouts = &btcClient
+		}
+		if err := btcClient.SyncToSink(context.Background(), sink, sinkFrom, sinkTo, sinkResync); err != nil {
+			sugar.Fatal("sync to sink error: ", err.Error())
+		}
+	},
+}
+
+var serveListen string
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serve the REST API (GET /fees) on the indexed data",
+	Run: func(cmd *cobra.Command, args []string) {
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+		sugar.Info("REST API listening on ", serveListen)
+		if err := http.ListenAndServe(serveListen, newAPIHandler(esClient)); err != nil {
+			sugar.Fatal("serve error: ", err.Error())
+		}
+	},
+}
+
+var statsCmd = &cobra.Command{
+	Use:   "stats",
+	Short: "Print the doc counts, synced height range and utxo supply of the indices",
+	Run: func(cmd *cobra.Command, args []string) {
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+		stats, err := esClient.IndexStats(context.Background())
+		if err != nil {
+			sugar.Fatal("index stats error: ", err.Error())
+		}
+		if stats.MinHeight == nil || stats.MaxHeight == nil {
+			sugar.Info("blocks: 0")
+		} else {
+			sugar.Info("blocks: ", stats.Blocks, ", height ", int32(*stats.MinHeight), " - ", int32(*stats.MaxHeight))
+		}
+		sugar.Info("txs: ", stats.Txs)
+		sugar.Info("vouts: ", stats.Vouts, ", unspent: ", stats.UnspentVouts)
+		sugar.Info("balances: ", stats.Balances)
+		sugar.Info("supply: ", stats.Supply)
+	},
+}
+
+var replayBalanceDLQCmd = &cobra.Command{
+	Use:   "replay-balance-dlq",
+	Short: "Re-apply the balance updates recorded in balance_dlq, run while sync is stopped",
+	Run: func(cmd *cobra.Command, args []string) {
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+		loadEnrichmentFiles()
+
+		replayed, err := esClient.ReplayBalanceDLQ(context.Background())
+		if err != nil {
+			sugar.Fatal("replay balance dlq error after ", replayed, " entries: ", err.Error())
+		}
+		sugar.Info("replayed ", replayed, " balance dlq entries")
+	},
+}
+
+var forcemergeMaxSegments int
+
+var forcemergeCmd = &cobra.Command{
+	Use:   "forcemerge",
+	Short: "Force merge the synced indices into fewer segments after a historical sync",
+	Run: func(cmd *cobra.Command, args []string) {
+		if forcemergeMaxSegments <= 0 {
+			forcemergeMaxSegments = config.ElasticForcemergeMaxSegments
+		}
+
+		esClient, err := config.forcemergeClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+
+		start := time.Now()
+		sugar.Info("force merging ", bulkLoadIndices, " to ", forcemergeMaxSegments, " segments")
+		if err := esClient.ForceMerge(context.Background(), forcemergeMaxSegments); err != nil {
+			sugar.Fatal(err.Error())
+		}
+		sugar.Info("force merge done in ", time.Since(start))
+	},
+}
+
+var (
+	importBlocksDir string
+	importTo        int32
+)
+
+var importBlockFilesCmd = &cobra.Command{
+	Use:   "import-blockfiles",
+	Short: "Sync blocks from Bitcoin Core blk*.dat files instead of RPC",
+	Run: func(cmd *cobra.Command, args []string) {
+		if importBlocksDir == "" {
+			sugar.Fatal("import-blockfiles requires --dir")
+		}
+
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+		esClient.createIndices()
+
+		loadEnrichmentFiles()
+
+		source, err := newBlockFileSource(importBlocksDir)
+		if err != nil {
+			sugar.Fatal("read blk*.dat files error: ", err.Error())
+		}
+		defer source.Close()
+
+		start, resume, warnings, err := esClient.ResolveStartHeight(context.Background(), config.SyncFromHeight)
+		if err != nil {
+			sugar.Fatal("resolve start height error: ", err.Error())
+		}
+		for _, warning := range warnings {
+			sugar.Warn(warning)
+		}
+		end := source.tipHeight()
+		if importTo > 0 && importTo < end {
+			end = importTo
+		}
+		sugar.Info("Import blocks ", start, " to ", end, " from ", importBlocksDir)
+		if !resume {
+			if err := esClient.EnterBulkLoadMode(context.Background()); err != nil {
+				sugar.Fatal(err.Error())
+			}
+		}
+		esClient.importBlockFiles(source, start, end, resume)
+		// resume 时恢复上次中途退出的初始导入留下的 bulk load 模式，没有记录时不做修改
+		if err := esClient.ExitBulkLoadMode(context.Background()); err != nil {
+			sugar.Fatal(err.Error())
+		}
+	},
+}
+
+var selfTestKeep bool
+
+var selfTestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Mine known blocks on a fresh regtest node, sync them into an empty Elasticsearch and check the indexed docs",
+	Run: func(cmd *cobra.Command, args []string) {
+		if chain.Name != "regtest" {
+			sugar.Fatal("selftest requires chain: regtest")
+		}
+		if config.WatchedAddresses != nil {
+			sugar.Fatal("selftest can't run with watched_addresses")
+		}
+
+		esClient, err := config.elasticClient()
+		if err != nil {
+			sugar.Fatal("es client error: ", err.Error())
+		}
+		// index 名是固定的，selftest 只在没有同步 index 的 es 中运行，结束时删除它创建的 index
+		existing, err := esClient.selfTestIndices()
+		if err != nil {
+			sugar.Fatal("list indices error: ", err.Error())
+		}
+		if len(existing) > 0 {
+			sugar.Fatal("selftest needs an Elasticsearch without the indexer's indices, found ", strings.Join(existing, ","))
+		}
+
+		btcClient := bitcoinClientAlias{config.bitcoinClient()}
+		scenario, err := btcClient.prepareSelfTest()
+		if err != nil {
+			sugar.Fatal("prepare selftest blocks error: ", err.Error())
+		}
+		sugar.Info("selftest mined ", scenario.Height, " blocks, spend tx ", scenario.Spend)
+
+		esClient.createIndices()
+		btcClient.dumpToES(1, scenario.Height+1, int(ROLLBACKHEIGHT), esClient)
+		failures, err := esClient.checkSelfTest(context.Background(), scenario)
+
+		if !selfTestKeep {
+			created, listErr := esClient.selfTestIndices()
+			if listErr == nil && len(created) > 0 {
+				_, listErr = esClient.DeleteIndex(created...).Do(context.Background())
+			}
+			if listErr != nil {
+				sugar.Error("delete selftest indices error: ", listErr.Error())
+			}
+		}
+		if err != nil {
+			sugar.Fatal("selftest error: ", err.Error())
 		}
+		for _, failure := range failures {
+			sugar.Error("selftest: ", failure)
+		}
+		if len(failures) > 0 {
+			sugar.Fatal("selftest failed: ", len(failures), " checks")
+		}
+		sugar.Info("selftest passed")
 	},
 }
 
+// loadEnrichmentFiles 加载配置的地址标签和矿池识别规则文件
+func loadEnrichmentFiles() {
+	if config.LabelsFile != "" {
+		if err := labels.load(config.LabelsFile); err != nil {
+			sugar.Fatal("load labels file error: ", err.Error())
+		}
+	}
+	if config.PoolTagsFile != "" {
+		p, err := loadPoolTags(config.PoolTagsFile)
+		if err != nil {
+			sugar.Fatal("load pool tags file error: ", err.Error())
+		}
+		pools = p
+	}
+	if err := config.useAddressDeriver(); err != nil {
+		sugar.Fatal(err.Error())
+	}
+}
+
 // Execute 命令行入口
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
@@ -67,7 +971,94 @@ func init() {
 	defer sugar.Sync()
 	config = new(configure)
 	config.InitConfig()
+	syncCmd.Flags().Int32Var(&syncLimit, "limit", 0, "stop after syncing this many blocks, 0 means no limit")
+	syncCmd.Flags().Int32Var(&syncTo, "to", -1, "stop after syncing the block at this height, -1 means no limit")
 	rootCmd.AddCommand(syncCmd)
+
+	tailCmd.Flags().DurationVar(&tailInterval, "interval", 10*time.Second, "how often to poll the node for new blocks")
+	rootCmd.AddCommand(tailCmd)
+
+	verifyChainworkCmd.Flags().Int32Var(&verifyFrom, "from", 1, "begin block height")
+	verifyChainworkCmd.Flags().Int32Var(&verifyTo, "to", 1, "end block height")
+	rootCmd.AddCommand(verifyChainworkCmd)
+
+	verifyDigestsCmd.Flags().Int32Var(&verifyFrom, "from", 1, "begin block height")
+	verifyDigestsCmd.Flags().Int32Var(&verifyTo, "to", 1, "end block height")
+	rootCmd.AddCommand(verifyDigestsCmd)
+
+	indexBlockCmd.Flags().StringVar(&indexBlockHash, "hash", "", "block hash to reindex")
+	indexBlockCmd.Flags().Int32Var(&indexBlockHeight, "height", 0, "block height to reindex, ignored when --hash is set")
+	rootCmd.AddCommand(indexBlockCmd)
+
+	pruneSpentVoutsCmd.Flags().Int32Var(&pruneBefore, "before", 0, "prune vouts spent in blocks below this height")
+	pruneSpentVoutsCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "only count the vouts that would be pruned")
+	rootCmd.AddCommand(pruneSpentVoutsCmd)
+
+	reconcileBalancesCmd.Flags().Int32Var(&reconcileFrom, "from", 0, "begin block height")
+	reconcileBalancesCmd.Flags().Int32Var(&reconcileTo, "to", 0, "end block height")
+	reconcileBalancesCmd.Flags().BoolVar(&reconcileDryRun, "dry-run", false, "only report the balances that would be corrected")
+	rootCmd.AddCommand(reconcileBalancesCmd)
+
+	repairUTXOCmd.Flags().Int32Var(&repairFrom, "from", 0, "begin block height")
+	repairUTXOCmd.Flags().Int32Var(&repairTo, "to", 0, "end block height")
+	repairUTXOCmd.Flags().BoolVar(&repairDryRun, "dry-run", false, "only report the vouts that would be repaired")
+	rootCmd.AddCommand(repairUTXOCmd)
+
+	recomputeFeesCmd.Flags().Int32Var(&recomputeFeesFrom, "from", 0, "begin block height")
+	recomputeFeesCmd.Flags().Int32Var(&recomputeFeesTo, "to", 0, "end block height")
+	recomputeFeesCmd.Flags().BoolVar(&recomputeFeesDryRun, "dry-run", false, "only report the txs that would be repaired")
+	rootCmd.AddCommand(recomputeFeesCmd)
+
+	compareBalancesCmd.Flags().StringVar(&compareBalancesFile, "file", "", "csv snapshot file of address,amount")
+	compareBalancesCmd.Flags().Float64Var(&compareBalancesTolerance, "tolerance", 0, "max allowed difference per address")
+	rootCmd.AddCommand(compareBalancesCmd)
+
+	rootCmd.AddCommand(replayBalanceDLQCmd)
+
+	rootCmd.AddCommand(statsCmd)
+
+	coinDaysDestroyedCmd.Flags().Int32Var(&coinDaysFrom, "from", 0, "begin block height")
+	coinDaysDestroyedCmd.Flags().Int32Var(&coinDaysTo, "to", 0, "end block height")
+	rootCmd.AddCommand(coinDaysDestroyedCmd)
+
+	cpfpClustersCmd.Flags().Int32Var(&cpfpFrom, "from", 0, "begin block height")
+	cpfpClustersCmd.Flags().Int32Var(&cpfpTo, "to", 0, "end block height")
+	rootCmd.AddCommand(cpfpClustersCmd)
+
+	addressReuseCmd.Flags().Int32Var(&reuseFrom, "from", 0, "begin block height")
+	addressReuseCmd.Flags().Int32Var(&reuseTo, "to", 0, "end block height")
+	rootCmd.AddCommand(addressReuseCmd)
+
+	exportBalancesCmd.Flags().Int32Var(&exportHeight, "height", 0, "synced block height the export is taken at")
+	exportBalancesCmd.Flags().StringVar(&exportOut, "out", "", "csv file to write")
+	exportBalancesCmd.Flags().BoolVar(&exportResume, "resume", false, "continue an interrupted export from its checkpoint file")
+	rootCmd.AddCommand(exportBalancesCmd)
+
+	exportTxGraphCmd.Flags().Int32Var(&graphFrom, "from", 0, "begin block height")
+	exportTxGraphCmd.Flags().Int32Var(&graphTo, "to", 0, "end block height")
+	exportTxGraphCmd.Flags().StringVar(&graphOut, "out", "", "file to write")
+	exportTxGraphCmd.Flags().StringVar(&graphFormat, "format", "csv", "csv or jsonl")
+	exportTxGraphCmd.Flags().BoolVar(&graphResume, "resume", false, "continue an interrupted export from its checkpoint file")
+	rootCmd.AddCommand(exportTxGraphCmd)
+
+	syncSinkCmd.Flags().Int32Var(&sinkFrom, "from", 0, "begin block height")
+	syncSinkCmd.Flags().Int32Var(&sinkTo, "to", 0, "end block height")
+	syncSinkCmd.Flags().StringVar(&sinkName, "sink", "stdout", "sink to write to, stdout")
+	syncSinkCmd.Flags().BoolVar(&sinkResync, "resync", false, "delete what each block wrote to the sink before syncing it again")
+	rootCmd.AddCommand(syncSinkCmd)
+
+	serveCmd.Flags().StringVar(&serveListen, "listen", ":8080", "address the REST API listens on")
+	rootCmd.AddCommand(serveCmd)
+
+	forcemergeCmd.Flags().IntVar(&forcemergeMaxSegments, "max-segments", 0, "max segments per shard, defaults to elastic_forcemerge_max_segments")
+	rootCmd.AddCommand(forcemergeCmd)
+
+	importBlockFilesCmd.Flags().StringVar(&importBlocksDir, "dir", "", "Bitcoin Core blocks directory containing blk*.dat files")
+	importBlockFilesCmd.Flags().Int32Var(&importTo, "to", 0, "last block height to import, defaults to the tip found in the files")
+	rootCmd.AddCommand(importBlockFilesCmd)
+
+	selfTestCmd.Flags().BoolVar(&selfTestKeep, "keep", false, "keep the synced indices for inspection instead of deleting them")
+	rootCmd.AddCommand(selfTestCmd)
 }
 
 func (conf *configure) InitConfig() {
@@ -75,6 +1066,38 @@ func (conf *configure) InitConfig() {
 	viper.AddConfigPath(HomeDir())
 	viper.SetConfigName("btc-chaindata-2es")
 	viper.AutomaticEnv() // read in environment variables that match
+	// AllSettings 只包含配置文件和默认值中出现的 key，只在环境变量中配置的凭据需要显式绑定
+	for _, key := range []string{"elastic_user", "elastic_pass", "elastic_api_key"} {
+		viper.BindEnv(key)
+	}
+
+	// 滚动重启的多节点集群下，请求失败后按指数退避重试
+	viper.SetDefault("elastic_healthcheck_interval", "60s")
+	viper.SetDefault("elastic_max_retries", 5)
+	viper.SetDefault("elastic_retry_backoff_min", "100ms")
+	viper.SetDefault("elastic_retry_backoff_max", "10s")
+	viper.SetDefault("elastic_http_timeout", "5m")
+	viper.SetDefault("elastic_max_idle_conns_per_host", 10)
+	viper.SetDefault("elastic_idle_conn_timeout", "90s")
+	viper.SetDefault("sync_from_height", 1)
+	viper.SetDefault("elastic_bulk_actions", 40000)
+	viper.SetDefault("elastic_bulk_size_bytes", 5<<20)
+	viper.SetDefault("elastic_bulk_flush_interval", "0s")
+	viper.SetDefault("balance_bulk_actions", 0)
+	viper.SetDefault("balance_bulk_size_bytes", 5<<20)
+	viper.SetDefault("rollback_batch_size", 500)
+	viper.SetDefault("elastic_number_of_replicas", -1)
+	viper.SetDefault("max_tx_inputs_outputs", 5000)
+	viper.SetDefault("elastic_sniffer_interval", "15m")
+	viper.SetDefault("elastic_forcemerge_max_segments", 1)
+	viper.SetDefault("chain", "mainnet")
+	viper.SetDefault("vin_query_batch_size", 500)
+	viper.SetDefault("vin_query_concurrency", 1)
+	viper.SetDefault("recommended_fees_blocks", 6)
+	viper.SetDefault("rpc_max_concurrency", 4)
+	viper.SetDefault("skip_zero_value_balances", true)
+	viper.SetDefault("tx_ilm_rollover_max_age", "30d")
+	viper.SetDefault("tx_ilm_rollover_max_size", "50gb")
 
 	// If a config file is found, read it in.
 	err := viper.ReadInConfig()
@@ -98,11 +1121,284 @@ func (conf *configure) InitConfig() {
 			conf.BitcoinhttpMode = value.(bool)
 		case "btc_disable_tls":
 			conf.BitcoinDisableTLS = value.(bool)
+		case "btc_cookie_file":
+			conf.BitcoinCookieFile = value.(string)
 		case "elastic_url":
-			conf.ElasticURL = value.(string)
+			conf.ElasticURLs = parseURLs(key, value)
+		case "elastic_user":
+			conf.ElasticUser = value.(string)
+		case "elastic_pass":
+			conf.ElasticPass = value.(string)
+		case "elastic_api_key":
+			conf.ElasticAPIKey = value.(string)
 		case "elastic_sniff":
 			conf.ElasticSniff = value.(bool)
+		case "elastic_sniffer_interval":
+			conf.ElasticSnifferInterval = parseDuration(key, value)
+		case "elastic_forcemerge_max_segments":
+			conf.ElasticForcemergeMaxSegments = value.(int)
+		case "elastic_gzip":
+			conf.ElasticGzip = value.(bool)
+		case "elastic_healthcheck_interval":
+			conf.ElasticHealthcheckInterval = parseDuration(key, value)
+		case "elastic_max_retries":
+			conf.ElasticMaxRetries = value.(int)
+		case "elastic_retry_backoff_min":
+			conf.ElasticRetryBackoffMin = parseDuration(key, value)
+		case "elastic_retry_backoff_max":
+			conf.ElasticRetryBackoffMax = parseDuration(key, value)
+		case "elastic_http_timeout":
+			conf.ElasticHTTPTimeout = parseDuration(key, value)
+		case "elastic_max_idle_conns_per_host":
+			conf.ElasticMaxIdleConnsPerHost = value.(int)
+		case "elastic_idle_conn_timeout":
+			conf.ElasticIdleConnTimeout = parseDuration(key, value)
+		case "sync_from_height":
+			conf.SyncFromHeight = int32(value.(int))
+		case "p2sh_decode_redeemscript":
+			conf.P2SHDecodeRedeemScript = value.(bool)
+		case "p2wsh_decode_witnessscript":
+			conf.P2WSHDecodeWitnessScript = value.(bool)
+		case "elastic_balance_routing":
+			conf.ElasticBalanceRouting = value.(bool)
+		case "elastic_bulk_actions":
+			conf.ElasticBulkActions = value.(int)
+		case "elastic_bulk_size_bytes":
+			conf.ElasticBulkSizeBytes = value.(int)
+		case "elastic_bulk_flush_interval":
+			conf.ElasticBulkFlushInterval = parseDuration(key, value)
+		case "balance_bulk_actions":
+			conf.BalanceBulkActions = value.(int)
+		case "balance_bulk_size_bytes":
+			conf.BalanceBulkSizeBytes = value.(int)
+		case "rollback_refresh_once":
+			conf.RollbackRefreshOnce = value.(bool)
+		case "labels_file":
+			conf.LabelsFile = value.(string)
+		case "pool_tags_file":
+			conf.PoolTagsFile = value.(string)
+		case "rollback_batch_size":
+			conf.RollbackBatchSize = value.(int)
+		case "elastic_refresh_interval":
+			conf.ElasticRefreshInterval = value.(string)
+		case "elastic_number_of_replicas":
+			conf.ElasticNumberOfReplicas = value.(int)
+		case "rpc_prevout_fallback":
+			conf.RPCPrevoutFallback = value.(bool)
+		case "max_tx_inputs_outputs":
+			conf.MaxTxInputsOutputs = value.(int)
+		case "lean_tx_docs":
+			conf.LeanTxDocs = value.(bool)
+		case "chain":
+			conf.ChainName = value.(string)
+		case "balance_dlq":
+			conf.BalanceDLQ = value.(bool)
+		case "include_scripts":
+			conf.IncludeScripts = value.(bool)
+		case "verify_block_fees":
+			conf.VerifyBlockFees = value.(bool)
+		case "flush_before_sync_state":
+			conf.FlushBeforeSyncState = value.(bool)
+		case "vin_docs":
+			conf.VinDocs = value.(bool)
+		case "address_ngram":
+			conf.AddressNgram = value.(bool)
+		case "watched_addresses":
+			conf.WatchedAddresses = parseAddressSet(key, value)
+		case "slim_block_docs":
+			conf.SlimBlockDocs = value.(bool)
+		case "vin_query_batch_size":
+			conf.VinQueryBatchSize = value.(int)
+		case "vin_query_concurrency":
+			conf.VinQueryConcurrency = value.(int)
+		case "recommended_fees_blocks":
+			conf.RecommendedFeesBlocks = value.(int)
+		case "verify_after_index":
+			conf.VerifyAfterIndex = value.(bool)
+		case "elastic_index_codec":
+			conf.ElasticIndexCodecs = parseIndexCodecs(key, value)
+		case "rpc_max_concurrency":
+			conf.RPCMaxConcurrency = value.(int)
+		case "finalize_forcemerge":
+			conf.FinalizeForcemerge = value.(bool)
+		case "soft_delete_vouts":
+			conf.SoftDeleteVouts = value.(bool)
+		case "monthly_tx_indices":
+			conf.MonthlyTxIndices = value.(bool)
+		case "skip_zero_value_balances":
+			conf.SkipZeroValueBalances = value.(bool)
+		case "tx_data_stream":
+			conf.TxDataStream = value.(bool)
+		case "tx_ilm_rollover_max_age":
+			conf.TxILMRolloverMaxAge = value.(string)
+		case "tx_ilm_rollover_max_size":
+			conf.TxILMRolloverMaxSize = value.(string)
+		case "tx_ilm_delete_after":
+			conf.TxILMDeleteAfter = value.(string)
+		case "address_deriver":
+			conf.AddressDeriverName = value.(string)
+
+		}
+	}
+
+	c, ok := chainConfigs[conf.ChainName]
+	if !ok {
+		sugar.Fatal("Error: unknown chain ", conf.ChainName)
+	}
+	chain = c
+	rpcLimit = newRPCLimiter(conf.RPCMaxConcurrency, rpcRetryBackoffMin, rpcRetryBackoffMax)
+}
+
+func parseDuration(key string, value interface{}) time.Duration {
+	d, err := time.ParseDuration(value.(string))
+	if err != nil {
+		sugar.Fatal("Error: invalid duration for ", key, ": ", err.Error())
+	}
+	return d
+}
 
+// parseAddressSet 地址列表可以是 yaml 列表，也可以是逗号分隔的字符串，为空时返回 nil
+func parseAddressSet(key string, value interface{}) map[string]bool {
+	var addresses []string
+	switch v := value.(type) {
+	case string:
+		addresses = strings.Split(v, ",")
+	case []interface{}:
+		for _, address := range v {
+			addresses = append(addresses, fmt.Sprint(address))
+		}
+	default:
+		sugar.Fatal("Error: invalid addresses for ", key, ": ", value)
+	}
+	var set map[string]bool
+	for _, address := range addresses {
+		if address = strings.TrimSpace(address); address != "" {
+			if set == nil {
+				set = make(map[string]bool)
+			}
+			set[address] = true
+		}
+	}
+	return set
+}
+
+// indexCodecs index.codec 可以配置的值
+var indexCodecs = map[string]bool{"default": true, "best_compression": true}
+
+// parseIndexCodecs index 的 codec 可以是 yaml map，也可以是逗号分隔的 index:codec (方便用环境变量配置)
+func parseIndexCodecs(key string, value interface{}) map[string]string {
+	codecs := make(map[string]string)
+	switch v := value.(type) {
+	case string:
+		for _, pair := range strings.Split(v, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+			parts := strings.SplitN(pair, ":", 2)
+			if len(parts) != 2 {
+				sugar.Fatal("Error: invalid ", key, " entry ", pair, ", use index:codec")
+			}
+			codecs[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		}
+	case map[string]interface{}:
+		for index, codec := range v {
+			codecs[index] = fmt.Sprint(codec)
+		}
+	default:
+		sugar.Fatal("Error: invalid ", key, ": ", value)
+	}
+	known := make(map[string]bool)
+	for _, index := range syncIndices {
+		known[index] = true
+	}
+	for index, codec := range codecs {
+		if !known[index] {
+			sugar.Fatal("Error: unknown index ", index, " in ", key)
 		}
+		if !indexCodecs[codec] {
+			sugar.Fatal("Error: unknown codec ", codec, " for index ", index, " in ", key, ", use default or best_compression")
+		}
+	}
+	return codecs
+}
+
+// parseURLs 地址可以是 yaml 列表，也可以是逗号分隔的字符串 (方便用环境变量配置)
+func parseURLs(key string, value interface{}) []string {
+	var urls []string
+	switch v := value.(type) {
+	case string:
+		for _, url := range strings.Split(v, ",") {
+			if url = strings.TrimSpace(url); url != "" {
+				urls = append(urls, url)
+			}
+		}
+	case []interface{}:
+		for _, url := range v {
+			urls = append(urls, strings.TrimSpace(fmt.Sprint(url)))
+		}
+	default:
+		sugar.Fatal("Error: invalid urls for ", key, ": ", value)
+	}
+	if len(urls) == 0 {
+		sugar.Fatal("Error: no url configured for ", key)
+	}
+	return urls
+}
+
+// redactedSecret 配置和错误信息中代替密码、API key 的字符串
+const redactedSecret = "xxxxx"
+
+// String 打印配置时隐藏密码、API key 和 es 地址中的密码，避免凭据出现在日志中
+func (conf configure) String() string {
+	masked := conf
+	masked.BitcoinPass = maskSecret(conf.BitcoinPass)
+	masked.ElasticPass = maskSecret(conf.ElasticPass)
+	masked.ElasticAPIKey = maskSecret(conf.ElasticAPIKey)
+	masked.ElasticURLs = nil
+	for _, rawURL := range conf.ElasticURLs {
+		masked.ElasticURLs = append(masked.ElasticURLs, redactURL(rawURL))
+	}
+	// 转换为没有 String 方法的类型，避免 fmt 递归调用
+	type plain configure
+	return fmt.Sprintf("%+v", plain(masked))
+}
+
+// redact 把 s 中出现的已配置的密码、API key 替换为 redactedSecret，用于可能带上凭据的错误信息
+func (conf configure) redact(s string) string {
+	secrets := []string{conf.BitcoinPass, conf.ElasticPass, conf.ElasticAPIKey}
+	for _, rawURL := range conf.ElasticURLs {
+		if u, err := url.Parse(rawURL); err == nil && u.User != nil {
+			if password, ok := u.User.Password(); ok {
+				secrets = append(secrets, password)
+			}
+		}
+	}
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.Replace(s, secret, redactedSecret, -1)
+		}
+	}
+	return s
+}
+
+func maskSecret(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return redactedSecret
+}
+
+// redactURL 隐藏地址中 user:password@ 的密码，无法解析的地址整个隐藏
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return redactedSecret
+	}
+	if u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedSecret)
 	}
+	return u.String()
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"sort"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/shopspring/decimal"
+)
+
+// inBlockRelations 区块内交易之间的花费关系: parents 为交易花费的同一区块中的交易，children 为有输出被同一区块中交易花费的 txid
+type inBlockRelations struct {
+	parents  map[string][]string
+	children map[string]bool
+}
+
+// newInBlockRelations 由区块中的 txid 集合得到区块内的花费关系，应传入完整的区块 (watch 模式过滤之前)，
+// 否则未关注的交易之间的关系会丢失
+func newInBlockRelations(block *btcjson.GetBlockVerboseResult) *inBlockRelations {
+	txids := make(map[string]bool, len(block.Tx))
+	for _, tx := range block.Tx {
+		txids[tx.Txid] = true
+	}
+	relations := &inBlockRelations{parents: make(map[string][]string), children: make(map[string]bool)}
+	for _, tx := range block.Tx {
+		if isCoinbaseTx(tx.Vin) {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			if txids[vin.Txid] {
+				relations.parents[tx.Txid] = append(relations.parents[tx.Txid], vin.Txid)
+				relations.children[vin.Txid] = true
+			}
+		}
+	}
+	return relations
+}
+
+// setFlags 设置 tx 文档的 has_in_block_parent、has_in_block_child
+func (r *inBlockRelations) setFlags(doc *esTx) {
+	doc.HasInBlockParent = len(r.parents[doc.Txid]) > 0
+	doc.HasInBlockChild = r.children[doc.Txid]
+}
+
+// clusters 通过区块内的花费连在一起的交易分组，每组至少两个交易，组内按 txid 排序
+func (r *inBlockRelations) clusters() [][]string {
+	root := make(map[string]string)
+	var find func(txid string) string
+	find = func(txid string) string {
+		if root[txid] == txid {
+			return txid
+		}
+		root[txid] = find(root[txid])
+		return root[txid]
+	}
+	for child, parents := range r.parents {
+		for _, parent := range append([]string{child}, parents...) {
+			if _, ok := root[parent]; !ok {
+				root[parent] = parent
+			}
+		}
+		for _, parent := range parents {
+			if a, b := find(child), find(parent); a != b {
+				root[b] = a
+			}
+		}
+	}
+	members := make(map[string][]string)
+	for txid := range root {
+		members[find(txid)] = append(members[find(txid)], txid)
+	}
+	clusters := make([][]string, 0, len(members))
+	for _, txids := range members {
+		sort.Strings(txids)
+		clusters = append(clusters, txids)
+	}
+	return clusters
+}
+
+// cpfpCluster 区块中通过区块内的花费连在一起的一组交易 (CPFP 的父交易和子交易)，FeeRate 为整组的手续费率 (sat/vB)
+type cpfpCluster struct {
+	Txids         []string `json:"txids"`
+	Fee           float64  `json:"fee"`
+	Vsize         int32    `json:"vsize"`
+	FeeRate       float64  `json:"feerate"`
+	FeeIncomplete bool     `json:"fee_incomplete"`
+}
+
+// CPFPClusters 节点返回的区块 block 中的 CPFP cluster，按手续费率从高到低排序。分组由区块中的交易得到，
+// 手续费和 vsize 取自 es 中该区块的 tx 文档，有交易没有 tx 文档或 fee_incomplete 时 cluster 的 FeeIncomplete 为 true
+func (esClient *elasticClientAlias) CPFPClusters(ctx context.Context, block *btcjson.GetBlockVerboseResult) ([]*cpfpCluster, error) {
+	groups := newInBlockRelations(block).clusters()
+	var txids []string
+	for _, group := range groups {
+		txids = append(txids, group...)
+	}
+	docs, err := esClient.blockTxDocs(ctx, block.Hash, txids, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := make([]*cpfpCluster, 0, len(groups))
+	for _, group := range groups {
+		cluster := &cpfpCluster{Txids: group}
+		fee := decimal.NewFromFloat(0)
+		for _, txid := range group {
+			doc, found := docs[txid]
+			if !found {
+				cluster.FeeIncomplete = true
+				continue
+			}
+			fee = fee.Add(decimal.NewFromFloat(doc.Tx.Fee))
+			cluster.Vsize += doc.Tx.Vsize
+			cluster.FeeIncomplete = cluster.FeeIncomplete || doc.Tx.FeeIncomplete
+		}
+		cluster.Fee = btcFloat(fee)
+		cluster.FeeRate = txFeeRate(cluster.Fee, cluster.Vsize)
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].FeeRate != clusters[j].FeeRate {
+			return clusters[i].FeeRate > clusters[j].FeeRate
+		}
+		return clusters[i].Txids[0] < clusters[j].Txids[0]
+	})
+	return clusters, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCPFPBlock 区块 3: tx3 花费 tx2 (不在区块中)，tx4 花费 tx3，tx5 同时花费 tx4 和 tx6 (tx6 花费 tx2:1)，tx7 与区块内的交易无关
+func testCPFPBlock() *btcjson.GetBlockVerboseResult {
+	return &btcjson.GetBlockVerboseResult{
+		Hash:   "block3",
+		Height: 3,
+		Tx: []btcjson.TxRawResult{
+			{Txid: "coinbase3", Vin: []btcjson.Vin{{Coinbase: "04ffff001d0103"}}, Vout: []btcjson.Vout{testVout(0, 50, "A")}},
+			{Txid: "tx3", Vin: []btcjson.Vin{{Txid: "tx2", Vout: 0}}, Vout: []btcjson.Vout{testVout(0, 3.9, "D")}},
+			{Txid: "tx4", Vin: []btcjson.Vin{{Txid: "tx3", Vout: 0}}, Vout: []btcjson.Vout{testVout(0, 3.5, "E")}},
+			{Txid: "tx6", Vin: []btcjson.Vin{{Txid: "tx2", Vout: 1}}, Vout: []btcjson.Vout{testVout(0, 5.8, "F")}},
+			{Txid: "tx5", Vin: []btcjson.Vin{{Txid: "tx4", Vout: 0}, {Txid: "tx6", Vout: 0}}, Vout: []btcjson.Vout{testVout(0, 9, "G")}},
+			{Txid: "tx7", Vin: []btcjson.Vin{{Txid: "tx1", Vout: 0}}, Vout: []btcjson.Vout{testVout(0, 9.9, "H")}},
+		},
+	}
+}
+
+func TestInBlockRelations(t *testing.T) {
+	relations := newInBlockRelations(testCPFPBlock())
+	flags := make(map[string][2]bool)
+	for _, txid := range []string{"coinbase3", "tx3", "tx4", "tx5", "tx6", "tx7"} {
+		doc := &esTx{Txid: txid}
+		relations.setFlags(doc)
+		flags[txid] = [2]bool{doc.HasInBlockParent, doc.HasInBlockChild}
+	}
+	assert.Equal(t, map[string][2]bool{
+		"coinbase3": {false, false},
+		"tx3":       {false, true},
+		"tx4":       {true, true},
+		"tx5":       {true, false},
+		"tx6":       {false, true},
+		"tx7":       {false, false},
+	}, flags)
+	assert.Equal(t, [][]string{{"tx3", "tx4", "tx5", "tx6"}}, relations.clusters())
+}
+
+func TestBTCSyncTxInBlockFlags(t *testing.T) {
+	var out bytes.Buffer
+	sink := newStdoutSink(&out)
+	sink.vouts[IndexUTXO{"tx1", 0}] = &VoutStream{TxIDBelongTo: "tx1", Voutindex: 0, Value: 10, Addresses: []string{"B"}}
+	ctx := context.Background()
+
+	block := testSyncBlock()
+	block.Tx = append(block.Tx, btcjson.TxRawResult{
+		Txid: "tx3",
+		Vin:  []btcjson.Vin{{Txid: "tx2", Vout: 0}},
+		Vout: []btcjson.Vout{testVout(0, 3.9, "D")},
+	})
+	_, err := BTCSyncTx(ctx, sink, block)
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Flush(ctx))
+
+	flags := make(map[string][2]bool)
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		record := new(sinkRecord)
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), record))
+		if record.Op != "tx" {
+			continue
+		}
+		doc := record.Doc.(map[string]interface{})
+		flags[doc["txid"].(string)] = [2]bool{doc["has_in_block_parent"].(bool), doc["has_in_block_child"].(bool)}
+	}
+	assert.Equal(t, map[string][2]bool{"coinbase2": {false, false}, "tx2": {false, true}, "tx3": {true, false}}, flags)
+}
+
+func TestCPFPClusters(t *testing.T) {
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+
+	block := testCPFPBlock()
+	block.Tx = append(block.Tx, btcjson.TxRawResult{Txid: "tx8", Vin: []btcjson.Vin{{Txid: "tx7", Vout: 0}}})
+	es.put("tx", "tx3", map[string]interface{}{"txid": "tx3", "blockhash": "block3", "fee": 0.00000100, "vsize": 100})
+	es.put("tx", "tx4", map[string]interface{}{"txid": "tx4", "blockhash": "block3", "fee": 0.00000100, "vsize": 100})
+	es.put("tx", "tx5", map[string]interface{}{"txid": "tx5", "blockhash": "block3", "fee": 0.00005000, "vsize": 200})
+	es.put("tx", "tx6", map[string]interface{}{"txid": "tx6", "blockhash": "block3", "fee": 0.00000100, "vsize": 100})
+	es.put("tx", "tx7", map[string]interface{}{"txid": "tx7", "blockhash": "block3", "fee": 0.00000500, "vsize": 100})
+	// 其他区块中 txid 相同的 tx 文档不计入
+	es.put("tx", "tx7-stale", map[string]interface{}{"txid": "tx7", "blockhash": "stale3", "fee": 1, "vsize": 100})
+
+	clusters, err := client.CPFPClusters(context.Background(), block)
+	assert.Nil(t, err)
+	assert.Equal(t, []*cpfpCluster{
+		{Txids: []string{"tx3", "tx4", "tx5", "tx6"}, Fee: 0.000053, Vsize: 500, FeeRate: 10.6},
+		// tx8 没有 tx 文档，手续费不完整
+		{Txids: []string{"tx7", "tx8"}, Fee: 0.000005, Vsize: 100, FeeRate: 5, FeeIncomplete: true},
+	}, clusters)
+}
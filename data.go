@@ -1,5 +1,9 @@
 package main
 
+// mappingVersion 创建 index 时写入 mapping 的 _meta.mapping_version，修改下面任意一个 mapping 后需要加 1，
+// 启动时已有 index 的版本不一致会尝试 put mapping 更新，见 createIndices
+const mappingVersion = 9
+
 const blockMapping = `
 {
   "settings": {
@@ -50,13 +54,16 @@ const blockMapping = `
             "locktime": {
               "type": "long"
             },
+            "oversized": {
+              "type": "boolean"
+            },
             "vin": {
               "properties": {
                 "txid": {
                   "type": "keyword"
                 },
                 "vout": {
-                  "type": "short"
+                  "type": "integer"
                 },
                 "scriptSig": {
                   "properties": {
@@ -79,7 +86,7 @@ const blockMapping = `
                   "type": "double"
                 },
                 "n": {
-                  "type": "short"
+                  "type": "integer"
                 },
                 "scriptPubKey": {
                   "properties": {
@@ -116,6 +123,12 @@ const blockMapping = `
         "difficulty": {
           "type": "double"
         },
+        "target": {
+          "type": "double"
+        },
+        "difficulty_ratio": {
+          "type": "double"
+        },
         "chainwork": {
           "type": "text"
         },
@@ -124,6 +137,153 @@ const blockMapping = `
         },
         "nexthash": {
           "type": "keyword"
+        },
+        "tx_count": {
+          "type": "integer"
+        },
+        "total_fees": {
+          "type": "double"
+        },
+        "total_output_value": {
+          "type": "double"
+        },
+        "subsidy": {
+          "type": "double"
+        },
+        "segwit_tx_count": {
+          "type": "integer"
+        },
+        "base_size": {
+          "type": "long"
+        },
+        "witness_size": {
+          "type": "long"
+        },
+        "reported_fees": {
+          "type": "double"
+        },
+        "fee_mismatch": {
+          "type": "boolean"
+        },
+        "coinbase_height": {
+          "type": "integer"
+        },
+        "coinbase_height_mismatch": {
+          "type": "boolean"
+        },
+        "pool": {
+          "type": "keyword"
+        },
+        "digest": {
+          "type": "keyword"
+        }
+      }
+    }
+  }
+}`
+
+// slimBlockMapping slim_block_docs 开启时的 block mapping，区块文档只有区块头字段和 txids，交易详情在 tx、vout index 中
+const slimBlockMapping = `
+{
+  "settings": {
+    "number_of_shards": 1,
+    "number_of_replicas": 0
+  },
+  "mappings": {
+    "block": {
+      "properties": {
+        "hash": {
+          "type": "keyword"
+        },
+        "strippedsize": {
+          "type": "integer"
+        },
+        "size": {
+          "type": "integer"
+        },
+        "weight": {
+          "type": "integer"
+        },
+        "height": {
+          "type": "integer"
+        },
+        "versionHex": {
+          "type": "text"
+        },
+        "merkleroot": {
+          "type": "text"
+        },
+        "txids": {
+          "type": "keyword"
+        },
+        "time": {
+          "type": "long"
+        },
+        "mediantime": {
+          "type": "long"
+        },
+        "nonce": {
+          "type": "long"
+        },
+        "bits": {
+          "type": "text"
+        },
+        "difficulty": {
+          "type": "double"
+        },
+        "target": {
+          "type": "double"
+        },
+        "difficulty_ratio": {
+          "type": "double"
+        },
+        "chainwork": {
+          "type": "text"
+        },
+        "previoushash": {
+          "type": "keyword"
+        },
+        "nexthash": {
+          "type": "keyword"
+        },
+        "tx_count": {
+          "type": "integer"
+        },
+        "total_fees": {
+          "type": "double"
+        },
+        "total_output_value": {
+          "type": "double"
+        },
+        "subsidy": {
+          "type": "double"
+        },
+        "segwit_tx_count": {
+          "type": "integer"
+        },
+        "base_size": {
+          "type": "long"
+        },
+        "witness_size": {
+          "type": "long"
+        },
+        "reported_fees": {
+          "type": "double"
+        },
+        "fee_mismatch": {
+          "type": "boolean"
+        },
+        "coinbase_height": {
+          "type": "integer"
+        },
+        "coinbase_height_mismatch": {
+          "type": "boolean"
+        },
+        "pool": {
+          "type": "keyword"
+        },
+        "digest": {
+          "type": "keyword"
         }
       }
     }
@@ -145,9 +305,81 @@ const txMapping = `
         "fee": {
           "type": "double"
         },
+        "feerate": {
+          "type": "double"
+        },
+        "fee_incomplete": {
+          "type": "boolean"
+        },
+        "oversized": {
+          "type": "boolean"
+        },
+        "coinbase": {
+          "type": "boolean"
+        },
+        "is_timelocked": {
+          "type": "boolean"
+        },
+        "has_relative_timelock": {
+          "type": "boolean"
+        },
+        "has_in_block_parent": {
+          "type": "boolean"
+        },
+        "has_in_block_child": {
+          "type": "boolean"
+        },
+        "output_value": {
+          "type": "double"
+        },
+        "size": {
+          "type": "integer"
+        },
+        "vsize": {
+          "type": "integer"
+        },
+        "weight": {
+          "type": "integer"
+        },
         "blockhash": {
           "type": "keyword"
         },
+        "sig_types": {
+          "properties": {
+            "ecdsa": {
+              "type": "integer"
+            },
+            "schnorr": {
+              "type": "integer"
+            },
+            "unknown": {
+              "type": "integer"
+            }
+          }
+        },
+        "scripts": {
+          "properties": {
+            "txid": {
+              "type": "keyword"
+            },
+            "vout": {
+              "type": "integer"
+            },
+            "asm": {
+              "type": "text"
+            },
+            "hex": {
+              "type": "keyword",
+              "index": false,
+              "doc_values": false
+            },
+            "witness": {
+              "type": "keyword",
+              "index": false,
+              "doc_values": false
+            }
+          }
+        },
         "vins": {
           "type": "nested",
           "properties": {
@@ -156,6 +388,12 @@ const txMapping = `
             },
             "value": {
               "type": "double"
+            },
+            "outpoint": {
+              "type": "keyword"
+            },
+            "unresolved": {
+              "type": "boolean"
             }
           }
         },
@@ -178,6 +416,105 @@ const txMapping = `
   }
 }`
 
+// leanTxMapping lean_tx_docs 开启时的 tx mapping，没有 vins、vouts 两个 nested 字段
+const leanTxMapping = `
+{
+  "settings": {
+    "number_of_shards": 1,
+    "number_of_replicas": 0
+  },
+  "mappings": {
+		"tx": {
+      "properties": {
+        "txid": {
+          "type": "keyword"
+        },
+        "fee": {
+          "type": "double"
+        },
+        "feerate": {
+          "type": "double"
+        },
+        "fee_incomplete": {
+          "type": "boolean"
+        },
+        "oversized": {
+          "type": "boolean"
+        },
+        "coinbase": {
+          "type": "boolean"
+        },
+        "is_timelocked": {
+          "type": "boolean"
+        },
+        "has_relative_timelock": {
+          "type": "boolean"
+        },
+        "has_in_block_parent": {
+          "type": "boolean"
+        },
+        "has_in_block_child": {
+          "type": "boolean"
+        },
+        "output_value": {
+          "type": "double"
+        },
+        "size": {
+          "type": "integer"
+        },
+        "vsize": {
+          "type": "integer"
+        },
+        "weight": {
+          "type": "integer"
+        },
+        "blockhash": {
+          "type": "keyword"
+        },
+        "sig_types": {
+          "properties": {
+            "ecdsa": {
+              "type": "integer"
+            },
+            "schnorr": {
+              "type": "integer"
+            },
+            "unknown": {
+              "type": "integer"
+            }
+          }
+        },
+        "scripts": {
+          "properties": {
+            "txid": {
+              "type": "keyword"
+            },
+            "vout": {
+              "type": "integer"
+            },
+            "asm": {
+              "type": "text"
+            },
+            "hex": {
+              "type": "keyword",
+              "index": false,
+              "doc_values": false
+            },
+            "witness": {
+              "type": "keyword",
+              "index": false,
+              "doc_values": false
+            }
+          }
+        },
+        "time": {
+          "type": "long"
+        }
+      }
+    }
+  }
+}`
+
 const voutMapping = `
 {
   "settings": {
@@ -194,7 +531,7 @@ const voutMapping = `
           "type": "double"
         },
         "voutindex": {
-          "type": "keyword"
+          "type": "integer"
         },
         "coinbase": {
           "type": "boolean"
@@ -202,16 +539,46 @@ const voutMapping = `
         "addresses": {
           "type":"keyword"
         },
+        "redeemaddresses": {
+          "type":"keyword"
+        },
+        "unspendable": {
+          "type": "boolean"
+        },
+        "recovered": {
+          "type": "boolean"
+        },
         "time": {
           "type": "long"
         },
+        "height": {
+          "type": "integer"
+        },
+        "script_type": {
+          "type": "keyword"
+        },
+        "orphaned": {
+          "type": "boolean"
+        },
+        "reorg_height": {
+          "type": "integer"
+        },
         "used": {
           "properties": {
             "txid": {
               "type": "keyword"
             },
             "vinindex": {
-              "type": "short"
+              "type": "integer"
+            },
+            "height": {
+              "type": "integer"
+            },
+            "time": {
+              "type": "long"
+            },
+            "coindays": {
+              "type": "double"
             }
           }
         }
@@ -220,6 +587,45 @@ const voutMapping = `
   }
 }`
 
+// vinMapping 被花费的 vout 对应的交易输入，开启 vin_docs 时写入
+const vinMapping = `
+{
+  "settings": {
+    "number_of_shards": 1,
+    "number_of_replicas": 0
+  },
+  "mappings": {
+    "vin": {
+      "properties": {
+        "txid": {
+          "type": "keyword"
+        },
+        "vinindex": {
+          "type": "integer"
+        },
+        "prev_txid": {
+          "type": "keyword"
+        },
+        "prev_vout": {
+          "type": "integer"
+        },
+        "value": {
+          "type": "double"
+        },
+        "addresses": {
+          "type":"keyword"
+        },
+        "height": {
+          "type": "integer"
+        },
+        "time": {
+          "type": "long"
+        }
+      }
+    }
+  }
+}`
+
 const balanceMapping = `
 {
   "settings": {
@@ -232,6 +638,62 @@ const balanceMapping = `
         "address": {
           "type":"keyword"
         },
+        "label": {
+          "type":"keyword"
+        },
+        "amount": {
+          "type": "double"
+        }
+      }
+    }
+  }
+}`
+
+// addressNgramMinGram/addressNgramMaxGram address_ngram 开启时 address.prefix 子字段索引的前缀长度，
+// 更短或更长的前缀用 prefix query 查询 (见 SearchAddressPrefix)
+const (
+	addressNgramMinGram = 4
+	addressNgramMaxGram = 20
+)
+
+// balanceNgramMapping address_ngram 开启时的 balance mapping，address 多一个 edge ngram 的 prefix 子字段用于地址补全
+const balanceNgramMapping = `
+{
+  "settings": {
+    "number_of_shards": 1,
+    "number_of_replicas": 0,
+    "analysis": {
+      "tokenizer": {
+        "address_prefix": {
+          "type": "edge_ngram",
+          "min_gram": 4,
+          "max_gram": 20
+        }
+      },
+      "analyzer": {
+        "address_prefix": {
+          "type": "custom",
+          "tokenizer": "address_prefix"
+        }
+      }
+    }
+  },
+  "mappings": {
+    "balance": {
+      "properties": {
+        "address": {
+          "type":"keyword",
+          "fields": {
+            "prefix": {
+              "type": "text",
+              "analyzer": "address_prefix",
+              "search_analyzer": "keyword"
+            }
+          }
+        },
+        "label": {
+          "type":"keyword"
+        },
         "amount": {
           "type": "double"
         }
@@ -240,6 +702,39 @@ const balanceMapping = `
   }
 }`
 
+// addressMapping 地址元数据，文档 id 为地址
+const addressMapping = `
+{
+  "settings": {
+    "number_of_shards": 1,
+    "number_of_replicas": 0
+  },
+  "mappings": {
+    "address": {
+      "properties": {
+        "address": {
+          "type":"keyword"
+        },
+        "script_type": {
+          "type":"keyword"
+        },
+        "label": {
+          "type":"keyword"
+        },
+        "first_height": {
+          "type": "integer"
+        },
+        "last_height": {
+          "type": "integer"
+        },
+        "tx_count": {
+          "type": "integer"
+        }
+      }
+    }
+  }
+}`
+
 const balanceJournalMapping = `
 {
   "settings": {
@@ -257,7 +752,7 @@ const balanceJournalMapping = `
         },
         "txid": {
           "type": "keyword"
-        }
+        },
         "operate": {
           "type": "text"
         }
@@ -265,3 +760,56 @@ const balanceJournalMapping = `
     }
   }
 }`
+
+const balanceDLQMapping = `
+{
+  "settings": {
+    "number_of_shards": 1,
+    "number_of_replicas": 0
+  },
+  "mappings": {
+    "balance_dlq": {
+      "properties": {
+        "address": {
+          "type":"keyword"
+        },
+        "delta": {
+          "type": "double"
+        },
+        "height": {
+          "type": "integer"
+        },
+        "blockhash": {
+          "type": "keyword"
+        },
+        "txids": {
+          "type": "keyword"
+        }
+      }
+    }
+  }
+}`
+
+const syncStateMapping = `
+{
+  "settings": {
+    "number_of_shards": 1,
+    "number_of_replicas": 0
+  },
+  "mappings": {
+    "syncstate": {
+      "properties": {
+        "height": {
+          "type": "integer"
+        },
+        "hash": {
+          "type": "keyword"
+        },
+        "bulk_load_settings": {
+          "type": "object",
+          "enabled": false
+        }
+      }
+    }
+  }
+}`
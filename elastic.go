@@ -4,57 +4,411 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/btcsuite/btcd/btcjson"
 	"github.com/olivere/elastic"
 	"github.com/shopspring/decimal"
 )
 
+// esAPI elasticClientAlias 使用到的 es 操作，*elastic.Client 实现了该接口，测试时可以注入指向假 es 服务的客户端
+type esAPI interface {
+	Search(indices ...string) *elastic.SearchService
+	Get() *elastic.GetService
+	Index() *elastic.IndexService
+	Update() *elastic.UpdateService
+	Delete() *elastic.DeleteService
+	DeleteByQuery(indices ...string) *elastic.DeleteByQueryService
+	Bulk() *elastic.BulkService
+	BulkProcessor() *elastic.BulkProcessorService
+	CreateIndex(name string) *elastic.IndicesCreateService
+	GetMapping() *elastic.IndicesGetMappingService
+	PutMapping() *elastic.IndicesPutMappingService
+	IndexPutTemplate(name string) *elastic.IndicesPutTemplateService
+	DeleteIndex(indices ...string) *elastic.IndicesDeleteService
+	IndexNames() ([]string, error)
+	Flush(indices ...string) *elastic.IndicesFlushService
+	Refresh(indices ...string) *elastic.RefreshService
+	IndexPutSettings(indices ...string) *elastic.IndicesPutSettingsService
+	IndexGetSettings(indices ...string) *elastic.IndicesGetSettingsService
+	Forcemerge(indices ...string) *elastic.IndicesForcemergeService
+	IsRunning() bool
+	PerformRequest(ctx context.Context, opt elastic.PerformRequestOptions) (*elastic.Response, error)
+}
+
 type elasticClientAlias struct {
-	*elastic.Client
+	esAPI
+	// journal StartBalanceJournal 创建的 balance journal bulk processor，同步一个区间时跨区块复用，由 FinalizeSync 关闭。
+	// 为 nil 时每次写入 balance journal 创建一个 bulk processor，写入结束时 flush
+	journal *elastic.BulkProcessor
 }
 
 func (conf configure) elasticClient() (*elasticClientAlias, error) {
-	client, err := elastic.NewClient(
-		elastic.SetURL(conf.ElasticURL),
+	scheme, err := elasticScheme(conf.ElasticURLs)
+	if err != nil {
+		return nil, errors.New(conf.redact(err.Error()))
+	}
+	if conf.ElasticAPIKey != "" && (conf.ElasticUser != "" || conf.ElasticPass != "") {
+		return nil, errors.New("elastic_api_key and elastic_user/elastic_pass can't be used together")
+	}
+	options := []elastic.ClientOptionFunc{
+		elastic.SetURL(conf.ElasticURLs...),
+		elastic.SetHttpClient(conf.elasticHTTPClient()),
 		// elastic.SetErrorLog(log.New(os.Stderr, "ELASTIC ", log.LstdFlags)),
 		// elastic.SetInfoLog(log.New(os.Stdout, "", log.LstdFlags)),
-		elastic.SetSniff(conf.ElasticSniff))
+		// sniff 发现的节点只有 host:port，按 scheme 拼接地址，否则 https 集群的节点会被当作 http 访问
+		elastic.SetScheme(scheme),
+		elastic.SetSniff(conf.ElasticSniff),
+		elastic.SetSnifferInterval(conf.ElasticSnifferInterval),
+		// gzip 压缩请求体，es 与服务不在同一网络时可以明显减少 bulk 请求的带宽
+		elastic.SetGzip(conf.ElasticGzip),
+		elastic.SetHealthcheckInterval(conf.ElasticHealthcheckInterval),
+		elastic.SetRetrier(newMaxRetriesRetrier(conf.ElasticMaxRetries, conf.ElasticRetryBackoffMin, conf.ElasticRetryBackoffMax)),
+	}
+	if conf.ElasticUser != "" {
+		options = append(options, elastic.SetBasicAuth(conf.ElasticUser, conf.ElasticPass))
+	}
+	client, err := elastic.NewClient(options...)
 	if err != nil {
-		return nil, err
+		// 节点地址中可能带有 user:password@
+		return nil, errors.New(conf.redact(err.Error()))
 	}
-	elasticClient := elasticClientAlias{client}
+	elasticClient := elasticClientAlias{esAPI: client}
 	return &elasticClient, nil
 }
 
+// forcemergeClient forcemerge 请求在合并结束后才返回，大 index 需要几个小时，不使用 elastic_http_timeout
+func (conf configure) forcemergeClient() (*elasticClientAlias, error) {
+	conf.ElasticHTTPTimeout = 0
+	return conf.elasticClient()
+}
+
+// elasticHTTPClient es 请求使用的 http client，默认的 http.Client 没有超时，连接半开时请求会一直等待
+// bulk processor 的 worker 和同步请求共用连接，空闲连接数按并发请求数配置，避免每次请求重新建立连接
+func (conf configure) elasticHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = conf.ElasticMaxIdleConnsPerHost
+	transport.IdleConnTimeout = conf.ElasticIdleConnTimeout
+	var roundTripper http.RoundTripper = transport
+	if conf.TxDataStream {
+		roundTripper = &es7Transport{roundTripper}
+	}
+	if conf.ElasticAPIKey != "" {
+		roundTripper = &apiKeyTransport{conf.ElasticAPIKey, roundTripper}
+	}
+	return &http.Client{Timeout: conf.ElasticHTTPTimeout, Transport: roundTripper}
+}
+
+// apiKeyTransport 给每个 es 请求加上 API key 认证头，elastic v6 的客户端只支持 basic auth
+type apiKeyTransport struct {
+	apiKey string
+	base   http.RoundTripper
+}
+
+func (t *apiKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTripper 不能修改传入的请求
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "ApiKey "+t.apiKey)
+	return t.base.RoundTrip(req)
+}
+
+// elasticScheme es 节点地址的 scheme (http/https)，所有地址的 scheme 必须一致
+func elasticScheme(urls []string) (string, error) {
+	scheme := ""
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return "", err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return "", errors.New(strings.Join([]string{"unsupported scheme in elastic url", rawURL}, " "))
+		}
+		if scheme != "" && u.Scheme != scheme {
+			return "", errors.New("elastic urls must use the same scheme")
+		}
+		scheme = u.Scheme
+	}
+	if scheme == "" {
+		return "", errors.New("no elastic url configured")
+	}
+	return scheme, nil
+}
+
+// maxRetriesRetrier 指数退避重试，最多重试 maxRetries 次
+// elastic.SetMaxRetries 与 elastic.SetRetrier 会互相覆盖，所以在同一个 Retrier 里同时限制次数和退避时间
+type maxRetriesRetrier struct {
+	backoff    elastic.Backoff
+	maxRetries int
+}
+
+func newMaxRetriesRetrier(maxRetries int, minBackoff, maxBackoff time.Duration) *maxRetriesRetrier {
+	return &maxRetriesRetrier{
+		backoff:    elastic.NewExponentialBackoff(minBackoff, maxBackoff),
+		maxRetries: maxRetries,
+	}
+}
+
+func (r *maxRetriesRetrier) Retry(ctx context.Context, retry int, req *http.Request, resp *http.Response, err error) (time.Duration, bool, error) {
+	if retry > r.maxRetries {
+		return 0, false, nil
+	}
+	wait, goahead := r.backoff.Next(retry)
+	return wait, goahead, nil
+}
+
+// syncIndices createIndices 创建的 index，index 名与 mapping type 名相同
+var syncIndices = []string{"block", "tx", "vout", "vin", "balance", "address", "balancejournal", "balance_dlq", "syncstate"}
+
+// createIndices 创建不存在的 index。已经存在的 index 比较 mapping 中的 _meta.mapping_version 与 mappingVersion，
+// 不一致时用当前的 mapping put mapping：新增字段可以直接更新，修改已有字段的类型等不兼容的变化会被 es 拒绝，此时只输出警告，需要重新同步到新的 index。
+// 创建之前先用 checkDocMappings 检查文档结构体与 mapping 是否一致，不一致时退出
 func (esClient *elasticClientAlias) createIndices() {
+	if err := checkDocMappings(); err != nil {
+		sugar.Fatal(err.Error())
+	}
+	if config.MonthlyTxIndices && config.TxDataStream {
+		sugar.Fatal("monthly_tx_indices and tx_data_stream can't be used together")
+	}
 	ctx := context.Background()
-	for _, index := range []string{"block", "tx", "vout", "balance", "balancejournal"} {
-		var mapping string
-		switch index {
-		case "block":
-			mapping = blockMapping
-		case "tx":
-			mapping = txMapping
-		case "vout":
-			mapping = voutMapping
-		case "balance":
-			mapping = balanceMapping
-		case "balancejournal":
-			mapping = balanceJournalMapping
-		}
-		result, err := esClient.CreateIndex(index).BodyString(mapping).Do(ctx)
+	for _, index := range syncIndices {
+		if index == "tx" && config.TxDataStream {
+			if err := esClient.createTxDataStream(ctx); err != nil {
+				sugar.Fatal(err.Error())
+			}
+			continue
+		}
+		if index == "tx" && config.MonthlyTxIndices {
+			if err := esClient.createMonthlyTxIndices(ctx); err != nil {
+				sugar.Fatal(err.Error())
+			}
+			continue
+		}
+		body, typeMapping, err := versionedMapping(index, indexMapping(index))
 		if err != nil {
+			sugar.Fatal("Parse ", index, " mapping error: ", err.Error())
+		}
+		withIndexCodec(body, config.ElasticIndexCodecs[index])
+		result, err := esClient.CreateIndex(index).BodyJson(body).Do(ctx)
+		if err == nil {
+			if result.Acknowledged {
+				sugar.Info(strings.Join([]string{"Create index:", result.Index}, ""))
+			}
 			continue
 		}
-		if result.Acknowledged {
-			sugar.Info(strings.Join([]string{"Create index:", result.Index}, ""))
+		if err := esClient.checkIndexMapping(ctx, index, typeMapping); err != nil {
+			sugar.Warn(err.Error())
 		}
 	}
 }
 
+// indexMapping 按配置选择 index 的 mapping
+func indexMapping(index string) string {
+	switch index {
+	case "block":
+		if config.SlimBlockDocs {
+			return slimBlockMapping
+		}
+		return blockMapping
+	case "tx":
+		if config.LeanTxDocs {
+			return leanTxMapping
+		}
+		return txMapping
+	case "vout":
+		return voutMapping
+	case "vin":
+		return vinMapping
+	case "balance":
+		if config.AddressNgram {
+			return balanceNgramMapping
+		}
+		return balanceMapping
+	case "address":
+		return addressMapping
+	case "balancejournal":
+		return balanceJournalMapping
+	case "balance_dlq":
+		return balanceDLQMapping
+	case "syncstate":
+		return syncStateMapping
+	}
+	return ""
+}
+
+// versionedMapping 在 mapping 的 type 中加入 _meta.mapping_version，返回创建 index 的 body 以及 put mapping 使用的 type mapping
+func versionedMapping(index, mapping string) (map[string]interface{}, map[string]interface{}, error) {
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(mapping), &body); err != nil {
+		return nil, nil, err
+	}
+	mappings, _ := body["mappings"].(map[string]interface{})
+	typeMapping, ok := mappings[index].(map[string]interface{})
+	if !ok {
+		return nil, nil, errors.New(strings.Join([]string{"no", index, "type in mapping"}, " "))
+	}
+	typeMapping["_meta"] = map[string]interface{}{"mapping_version": mappingVersion}
+	return body, typeMapping, nil
+}
+
+// withIndexCodec elastic_index_codec 为 index 配置了 codec 时写入创建 index 的 settings。index.codec 是静态配置，只在创建 index 时生效
+func withIndexCodec(body map[string]interface{}, codec string) {
+	if codec == "" {
+		return
+	}
+	settings, ok := body["settings"].(map[string]interface{})
+	if !ok {
+		settings = make(map[string]interface{})
+		body["settings"] = settings
+	}
+	settings["codec"] = codec
+}
+
+// checkIndexMapping 已有 index 的 mapping 版本与 mappingVersion 不一致时 put mapping，更新失败说明需要重新同步
+func (esClient *elasticClientAlias) checkIndexMapping(ctx context.Context, index string, typeMapping map[string]interface{}) error {
+	resp, err := esClient.GetMapping().Index(index).Type(index).Do(ctx)
+	if err != nil {
+		return errors.New(strings.Join([]string{"Get", index, "mapping error:", err.Error()}, " "))
+	}
+	return esClient.updateIndexMapping(ctx, index, index, storedMappingVersion(resp, index, index), typeMapping)
+}
+
+// updateIndexMapping mapping 版本 version 与 mappingVersion 不一致时 put mapping
+func (esClient *elasticClientAlias) updateIndexMapping(ctx context.Context, index, typeName string, version int, typeMapping map[string]interface{}) error {
+	if version == mappingVersion {
+		return nil
+	}
+	if _, err := esClient.PutMapping().Index(index).Type(typeName).BodyJson(typeMapping).Do(ctx); err != nil {
+		return fmt.Errorf("index %s has mapping version %d, expected %d, and the mapping can't be updated in place (%s): "+
+			"reindex required, sync into new indices", index, version, mappingVersion, err.Error())
+	}
+	sugar.Info("Update index ", index, " mapping from version ", version, " to ", mappingVersion)
+	return nil
+}
+
+// storedMappingVersion get mapping 响应中的 _meta.mapping_version，引入版本之前创建的 index 没有 _meta，版本为 0
+func storedMappingVersion(resp map[string]interface{}, index, typeName string) int {
+	indexMappings, _ := resp[index].(map[string]interface{})
+	mappings, _ := indexMappings["mappings"].(map[string]interface{})
+	typeMapping, _ := mappings[typeName].(map[string]interface{})
+	meta, _ := typeMapping["_meta"].(map[string]interface{})
+	version, _ := meta["mapping_version"].(float64)
+	return int(version)
+}
+
+// bulkLoadIndices 初始同步时大量写入的 index
+var bulkLoadIndices = []string{"block", "tx", "vout", "vin", "balance", "address", "balancejournal"}
+
+// bulkLoadSettingNames bulk load 模式修改的 index 设置
+var bulkLoadSettingNames = []string{"index.refresh_interval", "index.number_of_replicas", "index.translog.durability"}
+
+// bulkLoadStateID syncstate type 中记录进入 bulk load 模式前 index 设置的文档
+const bulkLoadStateID = "bulkload"
+
+// bulkLoadState 进入 bulk load 模式前 bulkLoadIndices 对应的 index (按实际的 index 名，别名和 data stream 展开后) 的 bulkLoadSettingNames 设置，
+// 值为 nil 表示 index 没有设置，使用 es 的默认值
+type bulkLoadState struct {
+	Settings map[string]map[string]interface{} `json:"bulk_load_settings"`
+}
+
+// EnterBulkLoadMode 初始同步前关闭 bulkLoadIndices 的定时 refresh 和副本，translog 改为异步刷盘
+// 同步时需要立即读到的写入都带有 refresh=true，不依赖定时 refresh。
+// 修改之前把原来的设置写入 syncstate，同步中途退出 (包括 Fatal) 后由下次启动时的 ExitBulkLoadMode 恢复；
+// 已经有记录时说明上次没有退出 bulk load 模式，保留原来的记录
+func (esClient *elasticClientAlias) EnterBulkLoadMode(ctx context.Context) error {
+	_, found, err := esClient.queryBulkLoadState(ctx)
+	if err != nil {
+		return err
+	}
+	if !found {
+		resp, err := esClient.IndexGetSettings(bulkLoadIndices...).FlatSettings(true).Do(ctx)
+		if err != nil {
+			return errors.New(strings.Join([]string{"Get index settings error:", err.Error()}, " "))
+		}
+		state := bulkLoadState{Settings: make(map[string]map[string]interface{})}
+		for index, indexSettings := range resp {
+			settings := make(map[string]interface{})
+			for _, name := range bulkLoadSettingNames {
+				settings[name] = indexSettings.Settings[name]
+			}
+			state.Settings[index] = settings
+		}
+		if _, err := esClient.Index().Index("syncstate").Type("syncstate").Id(bulkLoadStateID).
+			BodyJson(state).Refresh("true").Do(ctx); err != nil {
+			return errors.New(strings.Join([]string{"Save index settings error:", err.Error()}, " "))
+		}
+	}
+	return esClient.putIndexSettings(ctx, map[string]interface{}{
+		"index.refresh_interval":    "-1",
+		"index.number_of_replicas":  0,
+		"index.translog.durability": "async",
+	}, bulkLoadIndices...)
+}
+
+// ExitBulkLoadMode 初始同步结束后恢复 EnterBulkLoadMode 记录的 index 设置，配置了 elastic_refresh_interval/elastic_number_of_replicas 时
+// 使用配置的值。没有记录 (没有进入 bulk load 模式或已经恢复) 时不做修改，启动时可以直接调用以恢复上次中途退出的同步
+func (esClient *elasticClientAlias) ExitBulkLoadMode(ctx context.Context) error {
+	state, found, err := esClient.queryBulkLoadState(ctx)
+	if err != nil || !found {
+		return err
+	}
+	for index, settings := range state.Settings {
+		if config.ElasticRefreshInterval != "" {
+			settings["index.refresh_interval"] = config.ElasticRefreshInterval
+		}
+		if config.ElasticNumberOfReplicas >= 0 {
+			settings["index.number_of_replicas"] = config.ElasticNumberOfReplicas
+		}
+		if err := esClient.putIndexSettings(ctx, settings, index); err != nil {
+			return err
+		}
+	}
+	if _, err := esClient.Delete().Index("syncstate").Type("syncstate").Id(bulkLoadStateID).Refresh("true").Do(ctx); err != nil {
+		return errors.New(strings.Join([]string{"Delete saved index settings error:", err.Error()}, " "))
+	}
+	return nil
+}
+
+// queryBulkLoadState 查询 EnterBulkLoadMode 记录的 index 设置，found 为 false 表示没有记录
+func (esClient *elasticClientAlias) queryBulkLoadState(ctx context.Context) (*bulkLoadState, bool, error) {
+	res, err := esClient.Get().Index("syncstate").Type("syncstate").Id(bulkLoadStateID).Do(ctx)
+	if elastic.IsNotFound(err) || err == nil && !res.Found {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, errors.New(strings.Join([]string{"Query saved index settings error:", err.Error()}, " "))
+	}
+	state := new(bulkLoadState)
+	if err := json.Unmarshal(*res.Source, state); err != nil {
+		return nil, false, errors.New(strings.Join([]string{"unmarshal saved index settings error:", err.Error()}, " "))
+	}
+	return state, true, nil
+}
+
+func (esClient *elasticClientAlias) putIndexSettings(ctx context.Context, settings map[string]interface{}, indices ...string) error {
+	if _, err := esClient.IndexPutSettings(indices...).BodyJson(settings).Do(ctx); err != nil {
+		return errors.New(strings.Join([]string{"Put index settings error:", err.Error()}, " "))
+	}
+	return nil
+}
+
+// ForceMerge 历史数据同步结束后把 bulkLoadIndices 的 segment 合并到最多 maxSegments 个，减少查询时需要搜索的 segment
+// 合并会占用大量 IO 并阻塞到完成，只适合在同步结束后执行一次，之后继续写入的 index 会重新产生新的 segment
+func (esClient *elasticClientAlias) ForceMerge(ctx context.Context, maxSegments int) error {
+	if _, err := esClient.Forcemerge(bulkLoadIndices...).MaxNumSegments(maxSegments).Do(ctx); err != nil {
+		return errors.New(strings.Join([]string{"Force merge error:", err.Error()}, " "))
+	}
+	return nil
+}
+
+// MaxAgg 查询 index 中 field 的最大值，index 中没有文档时返回 nil, nil
 func (esClient *elasticClientAlias) MaxAgg(field, index, typeName string) (*float64, error) {
 	ctx := context.Background()
 	hightestAgg := elastic.NewMaxAggregation().Field(field)
@@ -71,33 +425,116 @@ func (esClient *elasticClientAlias) MaxAgg(field, index, typeName string) (*floa
 		return nil, err
 	}
 	maxAggRes, found := searchResult.Aggregations.Max(aggKey)
-	if !found || maxAggRes.Value == nil {
+	if !found {
 		return nil, errors.New("query max agg error")
 	}
 	return maxAggRes.Value, nil
 }
 
+// MinAgg 查询 index 中 field 的最小值，index 中没有文档时返回 nil, nil
+func (esClient *elasticClientAlias) MinAgg(field, index, typeName string) (*float64, error) {
+	aggKey := strings.Join([]string{"min", field}, "_")
+	searchResult, err := esClient.Search().
+		Index(index).Type(typeName).
+		Query(elastic.NewMatchAllQuery()).
+		Aggregation(aggKey, elastic.NewMinAggregation().Field(field)).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	minAggRes, found := searchResult.Aggregations.Min(aggKey)
+	if !found {
+		return nil, errors.New("query min agg error")
+	}
+	return minAggRes.Value, nil
+}
+
+// LastSyncedHeight es 中已同步的最大区块高度，found 为 false 表示 block index 为空 (首次运行)
+func (esClient *elasticClientAlias) LastSyncedHeight(ctx context.Context) (int32, bool, error) {
+	agg, err := esClient.MaxAgg("height", "block", "block")
+	if err != nil {
+		return 0, false, err
+	}
+	if agg == nil {
+		return 0, false, nil
+	}
+	return int32(*agg), true, nil
+}
+
+// QueryVoutWithVinsOrVoutsUnlimitSize 按 vin_query_batch_size 分批、最多 vin_query_concurrency 个批次同时查询交易输入花费的 vouts
 func (esClient *elasticClientAlias) QueryVoutWithVinsOrVoutsUnlimitSize(ctx context.Context, IndexUTXOs []IndexUTXO) []VoutWithID {
+	voutWithIDs, err := esClient.QueryVoutWithVinsOrVoutsConcurrently(ctx, IndexUTXOs, config.VinQueryBatchSize, config.VinQueryConcurrency)
+	if err != nil {
+		sugar.Fatal("Chunks IndexUTXOs error")
+	}
+	return voutWithIDs
+}
+
+// QueryVoutWithVinsOrVoutsInBatches 每 batchSize 个 IndexUTXO 查询一次 vouts，batchSize 小于 1 时按 500 个一批
+func (esClient *elasticClientAlias) QueryVoutWithVinsOrVoutsInBatches(ctx context.Context, IndexUTXOs []IndexUTXO, batchSize int) ([]VoutWithID, error) {
 	var (
 		voutWithIDs  []VoutWithID
 		IndexUTXOTmp []IndexUTXO
 	)
-	for len(IndexUTXOs) >= 500 {
-		IndexUTXOTmp, IndexUTXOs = IndexUTXOs[:500], IndexUTXOs[500:]
+	if batchSize < 1 {
+		batchSize = 500
+	}
+	for len(IndexUTXOs) > 0 {
+		if len(IndexUTXOs) > batchSize {
+			IndexUTXOTmp, IndexUTXOs = IndexUTXOs[:batchSize], IndexUTXOs[batchSize:]
+		} else {
+			IndexUTXOTmp, IndexUTXOs = IndexUTXOs, nil
+		}
 		voutWithIDsTmp, err := esClient.QueryVoutWithVinsOrVouts(ctx, IndexUTXOTmp)
 		if err != nil {
-			sugar.Fatal("Chunks IndexUTXOs error")
+			return nil, err
 		}
 		voutWithIDs = append(voutWithIDs, voutWithIDsTmp...)
 	}
-	if len(IndexUTXOs) > 0 {
-		voutWithIDsTmp, err := esClient.QueryVoutWithVinsOrVouts(ctx, IndexUTXOs)
-		if err != nil {
-			sugar.Fatalf("Chunks IndexUTXOs error")
+	return voutWithIDs, nil
+}
+
+// QueryVoutWithVinsOrVoutsConcurrently 与 QueryVoutWithVinsOrVoutsInBatches 相同，但最多 concurrency 个批次同时查询，
+// 结果按批次顺序合并，与逐批查询的顺序一致。concurrency 不大于 1 或只有一批时逐批查询
+func (esClient *elasticClientAlias) QueryVoutWithVinsOrVoutsConcurrently(ctx context.Context, IndexUTXOs []IndexUTXO, batchSize, concurrency int) ([]VoutWithID, error) {
+	if batchSize < 1 {
+		batchSize = 500
+	}
+	if concurrency <= 1 || len(IndexUTXOs) <= batchSize {
+		return esClient.QueryVoutWithVinsOrVoutsInBatches(ctx, IndexUTXOs, batchSize)
+	}
+	var batches [][]IndexUTXO
+	for len(IndexUTXOs) > batchSize {
+		batches = append(batches, IndexUTXOs[:batchSize])
+		IndexUTXOs = IndexUTXOs[batchSize:]
+	}
+	batches = append(batches, IndexUTXOs)
+
+	var (
+		wg      sync.WaitGroup
+		results = make([][]VoutWithID, len(batches))
+		errs    = make([]error, len(batches))
+		sem     = make(chan struct{}, concurrency)
+	)
+	for i, batch := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, batch []IndexUTXO) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i], errs[i] = esClient.QueryVoutWithVinsOrVouts(ctx, batch)
+		}(i, batch)
+	}
+	wg.Wait()
+
+	var voutWithIDs []VoutWithID
+	for i := range batches {
+		if errs[i] != nil {
+			return nil, errs[i]
 		}
-		voutWithIDs = append(voutWithIDs, voutWithIDsTmp...)
+		voutWithIDs = append(voutWithIDs, results[i]...)
 	}
-	return voutWithIDs
+	return voutWithIDs, nil
 }
 
 func (esClient *elasticClientAlias) QueryVoutWithVinsOrVouts(ctx context.Context, IndexUTXOs []IndexUTXO) ([]VoutWithID, error) {
@@ -108,7 +545,7 @@ func (esClient *elasticClientAlias) QueryVoutWithVinsOrVouts(ctx context.Context
 		bq.Must(elastic.NewTermQuery("voutindex", vin.Index))
 		q.Should(bq)
 	}
-	searchResult, err := esClient.Search().Index("vout").Type("vout").Size(len(IndexUTXOs)).Query(q).Do(ctx)
+	searchResult, err := esClient.Search().Index("vout").Type("vout").Size(len(IndexUTXOs)).Query(liveVoutsQuery(q)).Do(ctx)
 	if err != nil {
 		return nil, errors.New(strings.Join([]string{"query vouts error:", err.Error()}, ""))
 	}
@@ -127,12 +564,12 @@ func (esClient *elasticClientAlias) QueryVoutWithVinsOrVouts(ctx context.Context
 func (esClient *elasticClientAlias) QueryEsBlockByHeight(ctx context.Context, height int32) (*btcjson.GetBlockVerboseResult, error) {
 	blockHeightStr := strconv.FormatInt(int64(height), 10)
 	res, err := esClient.Get().Index("block").Type("block").Id(blockHeightStr).Refresh("true").Do(ctx)
+	if elastic.IsNotFound(err) || err == nil && !res.Found {
+		return nil, fmt.Errorf("block %s: %w", blockHeightStr, ErrBlockNotFound)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if !res.Found {
-		return nil, errors.New(strings.Join([]string{"block:", blockHeightStr, "not fount in es when update txstream"}, ""))
-	}
 	NewBlock := new(btcjson.GetBlockVerboseResult)
 	err = json.Unmarshal(*res.Source, NewBlock)
 	if err != nil {
@@ -141,29 +578,240 @@ func (esClient *elasticClientAlias) QueryEsBlockByHeight(ctx context.Context, he
 	return NewBlock, nil
 }
 
+// IndexedBlockOversized es 中 height 的区块文档是否有 oversized 的交易，这些交易在区块文档中只保留了前 max_tx_inputs_outputs 个输入输出
+func (esClient *elasticClientAlias) IndexedBlockOversized(ctx context.Context, height int32) (bool, error) {
+	res, err := esClient.Get().Index("block").Type("block").Id(strconv.FormatInt(int64(height), 10)).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("tx.oversized")).Do(ctx)
+	if elastic.IsNotFound(err) || err == nil && !res.Found {
+		return false, fmt.Errorf("block %d: %w", height, ErrBlockNotFound)
+	}
+	if err != nil {
+		return false, err
+	}
+	var block struct {
+		Tx []struct {
+			Oversized bool `json:"oversized"`
+		} `json:"tx"`
+	}
+	if err := json.Unmarshal(*res.Source, &block); err != nil {
+		return false, errors.New(strings.Join([]string{"unmarshal block error:", err.Error()}, " "))
+	}
+	for _, tx := range block.Tx {
+		if tx.Oversized {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// IndexedBlockMismatch 比较 es 中 height 的区块与节点的区块 hash 和交易数，返回不一致的描述，一致时返回空字符串。
+// 交易数同时核对区块文档的 tx_count 和该区块的 tx 文档数；watch 模式只写入部分交易，不核对交易数
+func (esClient *elasticClientAlias) IndexedBlockMismatch(ctx context.Context, height int32, nodeHash string, nodeTxCount int) (string, error) {
+	res, err := esClient.Get().Index("block").Type("block").Id(strconv.FormatInt(int64(height), 10)).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("hash", "tx_count")).Do(ctx)
+	if elastic.IsNotFound(err) || err == nil && !res.Found {
+		return "", fmt.Errorf("block %d: %w", height, ErrBlockNotFound)
+	}
+	if err != nil {
+		return "", err
+	}
+	var block struct {
+		Hash    string `json:"hash"`
+		TxCount int    `json:"tx_count"`
+	}
+	if err := json.Unmarshal(*res.Source, &block); err != nil {
+		return "", err
+	}
+	if block.Hash != nodeHash {
+		return fmt.Sprintf("hash %s, node has %s", block.Hash, nodeHash), nil
+	}
+	if config.WatchedAddresses != nil {
+		return "", nil
+	}
+
+	var mismatches []string
+	if block.TxCount != nodeTxCount {
+		mismatches = append(mismatches, fmt.Sprintf("tx_count %d, node has %d txs", block.TxCount, nodeTxCount))
+	}
+	searchResult, err := esClient.Search().Index("tx").Query(elastic.NewTermQuery("blockhash", nodeHash)).Size(0).Do(ctx)
+	if err != nil {
+		return "", errors.New(strings.Join([]string{"Count txs of block error:", err.Error()}, " "))
+	}
+	if searchResult.Hits.TotalHits != int64(nodeTxCount) {
+		mismatches = append(mismatches, fmt.Sprintf("%d tx docs, node has %d txs", searchResult.Hits.TotalHits, nodeTxCount))
+	}
+	return strings.Join(mismatches, "; "), nil
+}
+
+// blockDifficulty es 中 height 区块的难度，只读取 difficulty 字段
+func (esClient *elasticClientAlias) blockDifficulty(ctx context.Context, height int32) (float64, error) {
+	res, err := esClient.Get().Index("block").Type("block").Id(strconv.FormatInt(int64(height), 10)).
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("difficulty")).Do(ctx)
+	if elastic.IsNotFound(err) || err == nil && !res.Found {
+		return 0, fmt.Errorf("block %d: %w", height, ErrBlockNotFound)
+	}
+	if err != nil {
+		return 0, err
+	}
+	var block struct {
+		Difficulty float64 `json:"difficulty"`
+	}
+	if err := json.Unmarshal(*res.Source, &block); err != nil {
+		return 0, errors.New(strings.Join([]string{"unmarshal block error:", err.Error()}, " "))
+	}
+	return block.Difficulty, nil
+}
+
+// esBlockHeader es block type 中校验链结构需要的字段
+type esBlockHeader struct {
+	Hash         string `json:"hash"`
+	Height       int32  `json:"height"`
+	PreviousHash string `json:"previoushash"`
+	Chainwork    string `json:"chainwork"`
+}
+
+// VerifyChainwork 按高度遍历 es 中 [from, to] 的区块，校验 previoushash 与前一个区块的 hash 一致且 chainwork 严格递增，
+// 返回第一个不一致的地方
+func (esClient *elasticClientAlias) VerifyChainwork(ctx context.Context, from, to int32) error {
+	var (
+		prev          *esBlockHeader
+		prevChainwork *big.Int
+	)
+	fetchSource := elastic.NewFetchSourceContext(true).Include("hash", "height", "previoushash", "chainwork")
+	for begin := from; begin <= to; begin += 500 {
+		end := begin + 499
+		if end > to {
+			end = to
+		}
+		q := elastic.NewRangeQuery("height").Gte(begin).Lte(end)
+		searchResult, err := esClient.Search().Index("block").Type("block").Query(q).
+			FetchSourceContext(fetchSource).Sort("height", true).Size(int(end-begin) + 1).Do(ctx)
+		if err != nil {
+			return errors.New(strings.Join([]string{"query blocks error:", err.Error()}, " "))
+		}
+
+		expectHeight := begin
+		for _, hit := range searchResult.Hits.Hits {
+			header := new(esBlockHeader)
+			if err := json.Unmarshal(*hit.Source, header); err != nil {
+				return errors.New(strings.Join([]string{"unmarshal block error:", err.Error()}, " "))
+			}
+			heightStr := strconv.FormatInt(int64(header.Height), 10)
+			if header.Height != expectHeight {
+				return fmt.Errorf("block %d: %w", expectHeight, ErrBlockNotFound)
+			}
+			chainwork, ok := new(big.Int).SetString(header.Chainwork, 16)
+			if !ok {
+				return errors.New(strings.Join([]string{"block", heightStr, "chainwork is invalid:", header.Chainwork}, " "))
+			}
+			if prev != nil {
+				if header.PreviousHash != prev.Hash {
+					return errors.New(strings.Join([]string{"block", heightStr, "previoushash", header.PreviousHash, "not equal to prior block hash", prev.Hash}, " "))
+				}
+				if chainwork.Cmp(prevChainwork) <= 0 {
+					return errors.New(strings.Join([]string{"block", heightStr, "chainwork", header.Chainwork, "not greater than prior block chainwork", prev.Chainwork}, " "))
+				}
+			}
+			prev, prevChainwork = header, chainwork
+			expectHeight++
+		}
+		if expectHeight <= end {
+			return fmt.Errorf("block %d: %w", expectHeight, ErrBlockNotFound)
+		}
+	}
+	return nil
+}
+
+// VerifyBlockDigests 按高度遍历 es 中 [from, to] 的区块，重新计算文档内容的 digest 并与同步时写入的 digest 字段比较，
+// 返回不一致 (同步后被修改过) 的区块高度，没有 digest 字段的区块不校验
+func (esClient *elasticClientAlias) VerifyBlockDigests(ctx context.Context, from, to int32) ([]int32, error) {
+	var mismatched []int32
+	// block 文档包含所有交易，每次只查询 50 个区块
+	for begin := from; begin <= to; begin += 50 {
+		end := begin + 49
+		if end > to {
+			end = to
+		}
+		q := elastic.NewRangeQuery("height").Gte(begin).Lte(end)
+		searchResult, err := esClient.Search().Index("block").Type("block").Query(q).
+			Sort("height", true).Size(int(end-begin) + 1).Do(ctx)
+		if err != nil {
+			return nil, errors.New(strings.Join([]string{"query blocks error:", err.Error()}, " "))
+		}
+
+		for _, hit := range searchResult.Hits.Hits {
+			doc := make(map[string]interface{})
+			if err := json.Unmarshal(*hit.Source, &doc); err != nil {
+				return nil, errors.New(strings.Join([]string{"unmarshal block error:", err.Error()}, " "))
+			}
+			digest, ok := doc["digest"].(string)
+			if !ok {
+				continue
+			}
+			recomputed, err := blockDigest(doc)
+			if err != nil {
+				return nil, err
+			}
+			if recomputed != digest {
+				height, _ := doc["height"].(float64)
+				mismatched = append(mismatched, int32(height))
+			}
+		}
+	}
+	return mismatched, nil
+}
+
 // FindVoutsByUsedFieldAndBelongTxID 根据 vins 的 used object 和所在交易 ID 在 voutStream type 中查找 vouts ids
 func (esClient *elasticClientAlias) QueryVoutsByUsedFieldAndBelongTxID(ctx context.Context, vins []btcjson.Vin, txBelongto string) ([]VoutWithID, error) {
-	if len(vins) == 1 && len(vins[0].Coinbase) != 0 && len(vins[0].Txid) == 0 {
-		return nil, errors.New("coinbase tx, vin is new and not exist in es vout Type")
+	if isCoinbaseTx(vins) {
+		return nil, fmt.Errorf("coinbase tx %s, vin is new: %w", txBelongto, ErrVoutNotFound)
+	}
+	voutWithIDs, err := esClient.QueryVoutsUsedBy(ctx, spentOutpointsFun(vins, txBelongto))
+	if err != nil {
+		return nil, err
 	}
-	var esVoutIDS []string
+	if len(voutWithIDs) < 1 {
+		return nil, fmt.Errorf("vouts used by tx %s: %w", txBelongto, ErrVoutNotFound)
+	}
+	return voutWithIDs, nil
+}
 
-	q := elastic.NewBoolQuery()
+// spentOutpoint vin 花费的 vout，SpentBy 为 vin 所在的交易 ID
+type spentOutpoint struct {
+	IndexUTXO
+	SpentBy string
+}
+
+// spentOutpointsFun 交易 txBelongto 的 vins 花费的 vouts
+func spentOutpointsFun(vins []btcjson.Vin, txBelongto string) []spentOutpoint {
+	var outpoints []spentOutpoint
 	for _, vin := range vins {
+		if len(vin.Coinbase) != 0 && len(vin.Txid) == 0 {
+			continue
+		}
+		outpoints = append(outpoints, spentOutpoint{IndexUTXO{vin.Txid, vin.Vout}, txBelongto})
+	}
+	return outpoints
+}
+
+// QueryVoutsUsedBy 查询 used 字段指向 outpoints 中 vin 的 vouts，一次查询所有 outpoints，查不到时返回空
+func (esClient *elasticClientAlias) QueryVoutsUsedBy(ctx context.Context, outpoints []spentOutpoint) ([]VoutWithID, error) {
+	if len(outpoints) == 0 {
+		return nil, nil
+	}
+	q := elastic.NewBoolQuery()
+	for _, outpoint := range outpoints {
 		bq := elastic.NewBoolQuery()
-		bq = bq.Must(elastic.NewTermQuery("txidbelongto", vin.Txid))  // voutStream 所在的交易 ID 属于 vin 的 TxID 字段
-		bq = bq.Must(elastic.NewTermQuery("used.txid", txBelongto))   // vin 所在的交易 ID 属于 voutStream used object 中的 txid 字段
-		bq = bq.Must(elastic.NewTermQuery("used.vinindex", vin.Vout)) // vin 所在的交易输入索引属于 voutStream used object 中的 vinindex 字段
+		bq = bq.Must(elastic.NewTermQuery("txidbelongto", outpoint.Txid))   // voutStream 所在的交易 ID 属于 vin 的 TxID 字段
+		bq = bq.Must(elastic.NewTermQuery("used.txid", outpoint.SpentBy))   // vin 所在的交易 ID 属于 voutStream used object 中的 txid 字段
+		bq = bq.Must(elastic.NewTermQuery("used.vinindex", outpoint.Index)) // vin 所在的交易输入索引属于 voutStream used object 中的 vinindex 字段
 		q.Should(bq)
 	}
 
-	searchResult, err := esClient.Search().Index("vout").Type("vout").Size(len(vins)).Query(q).Do(ctx)
+	searchResult, err := esClient.Search().Index("vout").Type("vout").Size(len(outpoints)).Query(q).Do(ctx)
 	if err != nil {
 		return nil, err
 	}
-	if len(searchResult.Hits.Hits) < 1 {
-		return nil, errors.New("vout not found by the condition")
-	}
 
 	var voutWithIDs []VoutWithID
 	for _, rawHit := range searchResult.Hits.Hits {
@@ -171,24 +819,104 @@ func (esClient *elasticClientAlias) QueryVoutsByUsedFieldAndBelongTxID(ctx conte
 		if err := json.Unmarshal(*rawHit.Source, newVout); err != nil {
 			sugar.Fatal("rallback: unmarshal es vout error", err.Error())
 		}
-		esVoutIDS = append(esVoutIDS, rawHit.Id)
 		voutWithIDs = append(voutWithIDs, VoutWithID{rawHit.Id, newVout})
 	}
 	return voutWithIDs, nil
 }
 
+// QueryVoutsUsedByInBatches 每 batchSize 个 outpoint 查询一次 QueryVoutsUsedBy，batchSize 小于 1 时按 500 个一批
+func (esClient *elasticClientAlias) QueryVoutsUsedByInBatches(ctx context.Context, outpoints []spentOutpoint, batchSize int) ([]VoutWithID, error) {
+	var (
+		voutWithIDs  []VoutWithID
+		outpointsTmp []spentOutpoint
+	)
+	if batchSize < 1 {
+		batchSize = 500
+	}
+	for len(outpoints) > 0 {
+		if len(outpoints) > batchSize {
+			outpointsTmp, outpoints = outpoints[:batchSize], outpoints[batchSize:]
+		} else {
+			outpointsTmp, outpoints = outpoints, nil
+		}
+		voutWithIDsTmp, err := esClient.QueryVoutsUsedBy(ctx, outpointsTmp)
+		if err != nil {
+			return nil, err
+		}
+		voutWithIDs = append(voutWithIDs, voutWithIDsTmp...)
+	}
+	return voutWithIDs, nil
+}
+
+// spentVoutsBeforeQuery 花费高度小于 beforeHeight 的 vout，没有记录花费高度 (used.height) 的 vout 不会匹配；
+// 以及 soft_delete_vouts 回滚时标记为 orphaned、回滚的区块高度小于 beforeHeight 的 vout
+func spentVoutsBeforeQuery(beforeHeight int32) elastic.Query {
+	spent := elastic.NewBoolQuery().
+		Filter(elastic.NewExistsQuery("used.txid")).
+		Filter(elastic.NewRangeQuery("used.height").Lt(beforeHeight))
+	orphaned := elastic.NewBoolQuery().
+		Filter(orphanedVoutQuery()).
+		Filter(elastic.NewRangeQuery("reorg_height").Lt(beforeHeight))
+	return elastic.NewBoolQuery().Should(spent, orphaned)
+}
+
+// orphanedVoutQuery 开启 soft_delete_vouts 时回滚的区块创建的 vout 不删除，标记为 orphaned 并记录 reorg_height (回滚的区块高度)，
+// 重新同步时写入新的 vout 文档。查询区块中创建的 vout、UTXO 和余额时用 liveVoutsQuery 排除 orphaned 的 vout
+func orphanedVoutQuery() elastic.Query {
+	return elastic.NewTermQuery("orphaned", true)
+}
+
+// liveVoutsQuery 匹配 q 且没有被标记为 orphaned 的 vout
+func liveVoutsQuery(q elastic.Query) *elastic.BoolQuery {
+	return elastic.NewBoolQuery().Filter(q).MustNot(orphanedVoutQuery())
+}
+
+// rollbackVoutRequest 回滚区块时删除该区块创建的 vout，开启 soft_delete_vouts 且回滚的是分叉的区块 (reorg) 时标记为 orphaned
+// 保留用于排查重组。例行重新同步最近的区块时区块没有变化，直接删除，避免每次同步都留下一份 orphaned 的 vout
+func rollbackVoutRequest(id string, height int32, reorg bool) elastic.BulkableRequest {
+	if config.SoftDeleteVouts && reorg {
+		return elastic.NewBulkUpdateRequest().Index("vout").Type("vout").Id(id).
+			Doc(map[string]interface{}{"orphaned": true, "reorg_height": height})
+	}
+	return elastic.NewBulkDeleteRequest().Index("vout").Type("vout").Id(id)
+}
+
+// CountSpentVouts 统计花费高度 (或 orphaned 的回滚高度) 小于 beforeHeight 的 vout 数量
+func (esClient *elasticClientAlias) CountSpentVouts(ctx context.Context, beforeHeight int32) (int64, error) {
+	searchResult, err := esClient.Search().Index("vout").Type("vout").Query(spentVoutsBeforeQuery(beforeHeight)).Size(0).Do(ctx)
+	if err != nil {
+		return 0, errors.New(strings.Join([]string{"Count spent vouts error:", err.Error()}, " "))
+	}
+	return searchResult.Hits.TotalHits, nil
+}
+
+// PruneSpentVouts 删除花费高度 (或 orphaned 的回滚高度) 小于 beforeHeight 的 vout，返回删除的数量
+// 删除后无法回滚花费这些 vout 的区块，beforeHeight 需要远低于可能发生重组的高度
+func (esClient *elasticClientAlias) PruneSpentVouts(ctx context.Context, beforeHeight int32) (int64, error) {
+	res, err := esClient.DeleteByQuery().Index("vout").Type("vout").Query(spentVoutsBeforeQuery(beforeHeight)).Refresh("true").Do(ctx)
+	if err != nil {
+		return 0, errors.New(strings.Join([]string{"Prune spent vouts error:", err.Error()}, " "))
+	}
+	return res.Deleted, nil
+}
+
 func (esClient *elasticClientAlias) DeleteEsTxsByBlockHash(ctx context.Context, blockHash string) error {
 	q := elastic.NewTermQuery("blockhash", blockHash)
-	if _, err := esClient.DeleteByQuery().Index("tx").Type("tx").Query(q).Refresh("true").Do(ctx); err != nil {
+	if _, err := esClient.DeleteByQuery().Index("tx").Query(q).Refresh(rollbackRefresh()).Do(ctx); err != nil {
 		return errors.New(strings.Join([]string{"Delete", blockHash, "'s all transactions from es tx type fail"}, ""))
 	}
 	return nil
 }
 
 func (esClient *elasticClientAlias) BulkInsertBalanceJournal(ctx context.Context, balancesWithID []AddressWithAmountAndTxid, ope string) {
-	p, err := esClient.BulkProcessor().Name("BulkInsertBalanceJournal").Workers(5).BulkActions(40000).Do(ctx)
-	if err != nil {
-		sugar.Fatal("es BulkProcessor error: ", err.Error())
+	p := esClient.journal
+	if p == nil {
+		var err error
+		p, err = esClient.bulkProcessor(ctx, "BulkInsertBalanceJournal")
+		if err != nil {
+			sugar.Fatal("es BulkProcessor error: ", err.Error())
+		}
+		defer p.Close()
 	}
 
 	for _, balanceID := range balancesWithID {
@@ -196,7 +924,71 @@ func (esClient *elasticClientAlias) BulkInsertBalanceJournal(ctx context.Context
 		insertBalanceJournal := elastic.NewBulkIndexRequest().Index("balancejournal").Type("balancejournal").Doc(newBalanceJournal)
 		p.Add(insertBalanceJournal)
 	}
-	defer p.Close()
+}
+
+// StartBalanceJournal 同步一个区间前调用，之后的 balance journal 文档由同一个 bulk processor 按 elastic_bulk_* 的条件分批写入，
+// 一个区块的 sync+、sync- 等文档合并写入，记录 sync state 前由 commitSyncState flush，区间结束时由 FinalizeSync 关闭
+func (esClient *elasticClientAlias) StartBalanceJournal(ctx context.Context) error {
+	p, err := esClient.bulkProcessor(ctx, "BulkInsertBalanceJournal")
+	if err != nil {
+		return errors.New(strings.Join([]string{"es BulkProcessor error:", err.Error()}, " "))
+	}
+	esClient.journal = p
+	return nil
+}
+
+// flushBalanceJournal 写入 StartBalanceJournal 的 bulk processor 中还没有写入的文档
+func (esClient *elasticClientAlias) flushBalanceJournal() error {
+	if esClient.journal == nil {
+		return nil
+	}
+	if err := esClient.journal.Flush(); err != nil {
+		return errors.New(strings.Join([]string{"Flush balance journal error:", err.Error()}, " "))
+	}
+	return nil
+}
+
+// closeBalanceJournal 写入剩余的文档并关闭 StartBalanceJournal 的 bulk processor，之后的 balance journal 恢复每次写入时 flush
+func (esClient *elasticClientAlias) closeBalanceJournal() error {
+	if esClient.journal == nil {
+		return nil
+	}
+	err := esClient.journal.Close()
+	esClient.journal = nil
+	if err != nil {
+		return errors.New(strings.Join([]string{"Close balance journal error:", err.Error()}, " "))
+	}
+	return nil
+}
+
+// bulkProcessor 按配置的文档数、字节数、时间间隔 flush 的 bulk processor
+func (esClient *elasticClientAlias) bulkProcessor(ctx context.Context, name string) (*elastic.BulkProcessor, error) {
+	return esClient.BulkProcessor().Name(name).Workers(5).
+		BulkActions(config.ElasticBulkActions).
+		BulkSize(config.ElasticBulkSizeBytes).
+		FlushInterval(config.ElasticBulkFlushInterval).
+		After(bulkProcessorAfter(name)).
+		Do(ctx)
+}
+
+// bulkProcessorAfter 每次 flush 之后检查结果，请求失败时退出，部分文档写入失败时记录错误
+func bulkProcessorAfter(name string) elastic.BulkAfterFunc {
+	return func(executionID int64, requests []elastic.BulkableRequest, response *elastic.BulkResponse, err error) {
+		if err != nil {
+			sugar.Fatal(name, " bulk processor flush error: ", err.Error())
+		}
+		if response == nil {
+			return
+		}
+		backpressure.observe(response)
+		for _, item := range response.Failed() {
+			reason := ""
+			if item.Error != nil {
+				reason = item.Error.Reason
+			}
+			sugar.Error(name, " bulk processor item failed: ", item.Index, "/", item.Id, " ", reason)
+		}
+	}
 }
 
 // BulkQueryBalanceUnlimitSize fixed query more than 1k
@@ -243,10 +1035,18 @@ func (esClient *elasticClientAlias) BulkQueryBalance(ctx context.Context, addres
 	}
 
 	q := elastic.NewTermsQuery("address", qAddresses...)
-	searchResult, err := esClient.Search().Index("balance").Type("balance").Size(len(qAddresses)).Query(q).Do(ctx)
+	search := esClient.Search().Index("balance").Type("balance").Size(len(qAddresses)).Query(q)
+	if config.ElasticBalanceRouting {
+		search = search.Routing(uniqueAddresses...)
+	}
+	searchResult, err := search.Do(ctx)
 	if err != nil {
 		return nil, errors.New(strings.Join([]string{"Get balances error:", err.Error()}, " "))
 	}
+	// 部分分片失败时返回的结果不完整，调用方会把漏掉的地址当作新地址
+	if searchResult.Shards != nil && searchResult.Shards.Failed > 0 {
+		return nil, errors.New(strings.Join([]string{"Get balances error:", strconv.Itoa(searchResult.Shards.Failed), "shards failed"}, " "))
+	}
 
 	for _, balance := range searchResult.Hits.Hits {
 		b := new(Balance)
@@ -258,6 +1058,536 @@ func (esClient *elasticClientAlias) BulkQueryBalance(ctx context.Context, addres
 	return balancesWithIDs, nil
 }
 
+// maxBalancesBatch BalancesOf 一次最多查询的地址数
+const maxBalancesBatch = 500
+
+// BalancesOf 一次 terms 查询多个地址的余额，返回 address -> amount，没有余额文档的地址为 0
+// 供前端批量查询地址余额使用，地址数超过 maxBalancesBatch 时返回错误
+func (esClient *elasticClientAlias) BalancesOf(ctx context.Context, addresses []string) (map[string]float64, error) {
+	if len(addresses) > maxBalancesBatch {
+		return nil, fmt.Errorf("too many addresses: %d, at most %d per batch", len(addresses), maxBalancesBatch)
+	}
+	balances := make(map[string]float64)
+	if len(addresses) == 0 {
+		return balances, nil
+	}
+	var addressesI []interface{}
+	for _, address := range addresses {
+		addressesI = append(addressesI, address)
+		balances[address] = 0
+	}
+	balancesWithIDs, err := esClient.BulkQueryBalance(ctx, addressesI...)
+	if err != nil {
+		return nil, err
+	}
+	for _, balanceWithID := range balancesWithIDs {
+		balances[balanceWithID.Balance.Address] = balanceWithID.Balance.Amount
+	}
+	return balances, nil
+}
+
+// balanceCorrection ReconcileBalances 修正的地址余额，Found 为 false 表示 es 中原来没有该地址的余额文档
+type balanceCorrection struct {
+	Address string
+	Found   bool
+	Old     float64
+	New     float64
+}
+
+// esBlockOutputAddresses block 文档中交易输出的地址
+type esBlockOutputAddresses struct {
+	Tx []struct {
+		Vout []struct {
+			ScriptPubKey struct {
+				Addresses []string `json:"addresses"`
+			} `json:"scriptPubKey"`
+		} `json:"vout"`
+	} `json:"tx"`
+}
+
+// BlockRangeAddresses [from, to] 区块中余额发生变化的地址: block 文档中交易输出的地址，以及在这些区块中被花费的 vout 的地址
+// 只能找到记录了花费高度 (used.height) 的 vout；开启 slim_block_docs 时输出的地址从 vout index 按创建高度 (height) 查询
+func (esClient *elasticClientAlias) BlockRangeAddresses(ctx context.Context, from, to int32) ([]string, error) {
+	var addresses []interface{}
+	fetchSource := elastic.NewFetchSourceContext(true).Include("tx.vout.scriptPubKey.addresses")
+	for height := from; height <= to; height++ {
+		res, err := esClient.Get().Index("block").Type("block").Id(strconv.FormatInt(int64(height), 10)).
+			FetchSourceContext(fetchSource).Do(ctx)
+		if elastic.IsNotFound(err) || err == nil && !res.Found {
+			return nil, fmt.Errorf("block %d: %w", height, ErrBlockNotFound)
+		}
+		if err != nil {
+			return nil, err
+		}
+		block := new(esBlockOutputAddresses)
+		if err := json.Unmarshal(*res.Source, block); err != nil {
+			return nil, errors.New(strings.Join([]string{"unmarshal block error:", err.Error()}, " "))
+		}
+		for _, tx := range block.Tx {
+			for _, vout := range tx.Vout {
+				for _, address := range vout.ScriptPubKey.Addresses {
+					addresses = append(addresses, address)
+				}
+			}
+		}
+		if config.SlimBlockDocs {
+			// slim 区块文档没有交易详情，输出的地址从 vout index 按创建高度查询
+			created, err := esClient.blockVoutAddresses(ctx, height, "height", "created")
+			if err != nil {
+				return nil, err
+			}
+			addresses = append(addresses, created...)
+		}
+
+		spent, err := esClient.blockVoutAddresses(ctx, height, "used.height", "spent")
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, spent...)
+	}
+	return removeDuplicatesForSlice(addresses...), nil
+}
+
+// blockVoutAddresses vout index 中 field 等于 height 的 vout 的地址，用 scanVouts 翻页读取区块的全部 vout，action 用于错误信息
+func (esClient *elasticClientAlias) blockVoutAddresses(ctx context.Context, height int32, field, action string) ([]interface{}, error) {
+	var addresses []interface{}
+	err := esClient.scanVouts(ctx, elastic.NewTermQuery(field, height), field, nil, func(vout *VoutStream) error {
+		for _, address := range vout.Addresses {
+			addresses = append(addresses, address)
+		}
+		return nil
+	}, func([]interface{}) error { return nil })
+	if err != nil {
+		return nil, errors.New(strings.Join([]string{"query vouts", action, "in block error:", err.Error()}, " "))
+	}
+	return addresses, nil
+}
+
+// CoinDaysDestroyed 区块中被花费的 vout 销毁的币天数之和 (coin-days-destroyed)，由花费时记录的 used.coindays 聚合得到，
+// 没有创建时间的 vout (创建时间字段加入之前同步的 vout) 不计入
+func (esClient *elasticClientAlias) CoinDaysDestroyed(ctx context.Context, height int32) (float64, error) {
+	q := elastic.NewTermQuery("used.height", height)
+	searchResult, err := esClient.Search().Index("vout").Type("vout").Query(q).Size(0).
+		Aggregation("coindays", elastic.NewSumAggregation().Field("used.coindays")).Do(ctx)
+	if err != nil {
+		return 0, errors.New(strings.Join([]string{"Query coin days destroyed error:", err.Error()}, " "))
+	}
+	sum, found := searchResult.Aggregations.Sum("coindays")
+	if !found || sum.Value == nil {
+		return 0, nil
+	}
+	return btcFloat(decimal.NewFromFloat(*sum.Value)), nil
+}
+
+// unspentVoutsQuery 未花费且不是 unspendable 的 vout，不包括 orphaned 的 vout
+func unspentVoutsQuery() *elastic.BoolQuery {
+	return elastic.NewBoolQuery().
+		MustNot(elastic.NewExistsQuery("used.txid")).
+		MustNot(elastic.NewTermQuery("unspendable", true)).
+		MustNot(orphanedVoutQuery())
+}
+
+// UTXOBalance 由 vout type 中未花费的 vout 计算地址余额，不包括 unspendable 的 vout
+func (esClient *elasticClientAlias) UTXOBalance(ctx context.Context, address string) (float64, error) {
+	q := unspentVoutsQuery().Filter(elastic.NewTermQuery("addresses", address))
+	searchResult, err := esClient.Search().Index("vout").Type("vout").Query(q).Size(0).
+		Aggregation("balance", elastic.NewSumAggregation().Field("value")).Do(ctx)
+	if err != nil {
+		return 0, errors.New(strings.Join([]string{"Query utxo balance error:", err.Error()}, " "))
+	}
+	sum, found := searchResult.Aggregations.Sum("balance")
+	if !found || sum.Value == nil {
+		return 0, nil
+	}
+	return btcFloat(decimal.NewFromFloat(*sum.Value)), nil
+}
+
+// ReconcileBalances 重新计算 [from, to] 区块中余额发生变化的地址的余额 (未花费的 vout 之和)，与 balance 文档不一致时修正，
+// 返回修正的地址，dryRun 为 true 时只返回不修正
+func (esClient *elasticClientAlias) ReconcileBalances(ctx context.Context, from, to int32, dryRun bool) ([]*balanceCorrection, error) {
+	addresses, err := esClient.BlockRangeAddresses(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	var addressesI []interface{}
+	for _, address := range addresses {
+		addressesI = append(addressesI, address)
+	}
+	balancesWithIDs, err := esClient.BulkQueryBalanceUnlimitSize(ctx, addressesI...)
+	if err != nil {
+		return nil, err
+	}
+
+	var corrections []*balanceCorrection
+	bulkRequest := esClient.Bulk()
+	for _, address := range addresses {
+		amount, err := esClient.UTXOBalance(ctx, address)
+		if err != nil {
+			return nil, err
+		}
+		balanceWithID, exists := findBalanceByAddress(balancesWithIDs, address)
+		switch {
+		case exists && balanceWithID.Balance.Amount != amount:
+			corrections = append(corrections, &balanceCorrection{address, true, balanceWithID.Balance.Amount, amount})
+			updateBalance := elastic.NewBulkUpdateRequest().Index("balance").Type("balance").Id(balanceWithID.ID).Routing(balanceRouting(address)).
+				Doc(withBalanceLabel(map[string]interface{}{"amount": amount}, address))
+			bulkRequest.Add(updateBalance)
+		case !exists && skipBalance(amount):
+			// 只收到过金额为 0 的输出的地址没有余额文档
+		case !exists:
+			corrections = append(corrections, &balanceCorrection{address, false, 0, amount})
+			newBalance := withBalanceLabel(map[string]interface{}{"address": address, "amount": amount}, address)
+			insertBalance := elastic.NewBulkIndexRequest().Index("balance").Type("balance").Routing(balanceRouting(address)).Doc(newBalance)
+			bulkRequest.Add(insertBalance)
+		}
+	}
+	if dryRun || bulkRequest.NumberOfActions() == 0 {
+		return corrections, nil
+	}
+
+	bulkResp, err := bulkRequest.Refresh("true").Do(ctx)
+	if err != nil {
+		return nil, errors.New(strings.Join([]string{"Reconcile balances error:", err.Error()}, " "))
+	}
+	if failed := bulkResp.Failed(); len(failed) > 0 {
+		return nil, errors.New(strings.Join([]string{"Reconcile balances error:", strconv.Itoa(len(failed)), "balance docs failed to update"}, " "))
+	}
+	return corrections, nil
+}
+
+// syncStateID syncstate type 中只有一个文档，记录最近一次同步完成的区块
+const syncStateID = "chaindata"
+
+type syncState struct {
+	Height int32  `json:"height"`
+	Hash   string `json:"hash"`
+}
+
+// UpdateSyncState 记录最近一次同步完成的区块
+func (esClient *elasticClientAlias) UpdateSyncState(ctx context.Context, height int32, hash string) {
+	_, err := esClient.Index().Index("syncstate").Type("syncstate").Id(syncStateID).
+		BodyJson(syncState{Height: height, Hash: hash}).Do(ctx)
+	if err != nil {
+		sugar.Fatal("Update sync state error: ", err.Error())
+	}
+}
+
+// QuerySyncState 查询 sync state 文档，found 为 false 表示还没有记录
+func (esClient *elasticClientAlias) QuerySyncState(ctx context.Context) (*syncState, bool, error) {
+	res, err := esClient.Get().Index("syncstate").Type("syncstate").Id(syncStateID).Do(ctx)
+	if err != nil {
+		if elastic.IsNotFound(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	if !res.Found {
+		return nil, false, nil
+	}
+	state := new(syncState)
+	if err := json.Unmarshal(*res.Source, state); err != nil {
+		return nil, false, err
+	}
+	return state, true, nil
+}
+
+// findBalanceByAddress 在 BulkQueryBalance 的结果中查找地址的余额，exists 为 false 表示 es 中没有该地址的余额文档
+func findBalanceByAddress(balancesWithIDs []*BalanceWithID, address string) (*BalanceWithID, bool) {
+	for _, balanceWithID := range balancesWithIDs {
+		if balanceWithID.Balance.Address == address {
+			return balanceWithID, true
+		}
+	}
+	return nil, false
+}
+
+// FindAddressesByBalanceRange 查询余额在 [min, max] 范围内的地址，按余额从大到小分页返回，min 或 max 为 nil 表示不限
+// 返回值 int64 为满足条件的地址总数
+func (esClient *elasticClientAlias) FindAddressesByBalanceRange(ctx context.Context, min, max *float64, from, size int) ([]*BalanceWithID, int64, error) {
+	q := elastic.NewRangeQuery("amount")
+	if min != nil {
+		q = q.Gte(*min)
+	}
+	if max != nil {
+		q = q.Lte(*max)
+	}
+
+	searchResult, err := esClient.Search().Index("balance").Type("balance").Query(q).
+		Sort("amount", false).From(from).Size(size).Do(ctx)
+	if err != nil {
+		return nil, 0, errors.New(strings.Join([]string{"Get balances by range error:", err.Error()}, " "))
+	}
+
+	var balancesWithIDs []*BalanceWithID
+	for _, balance := range searchResult.Hits.Hits {
+		b := new(Balance)
+		if err := json.Unmarshal(*balance.Source, b); err != nil {
+			return nil, 0, errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+		}
+		balancesWithIDs = append(balancesWithIDs, &BalanceWithID{balance.Id, *b})
+	}
+	return balancesWithIDs, searchResult.Hits.TotalHits, nil
+}
+
+// FindBalancesByLabel 查询带有 label 标签的地址余额，按余额从大到小分页返回
+// 返回值 int64 为该标签下的地址总数
+func (esClient *elasticClientAlias) FindBalancesByLabel(ctx context.Context, label string, from, size int) ([]*BalanceWithID, int64, error) {
+	q := elastic.NewTermQuery("label", label)
+	searchResult, err := esClient.Search().Index("balance").Type("balance").Query(q).
+		Sort("amount", false).From(from).Size(size).Do(ctx)
+	if err != nil {
+		return nil, 0, errors.New(strings.Join([]string{"Get balances by label error:", err.Error()}, " "))
+	}
+
+	var balancesWithIDs []*BalanceWithID
+	for _, balance := range searchResult.Hits.Hits {
+		b := new(Balance)
+		if err := json.Unmarshal(*balance.Source, b); err != nil {
+			return nil, 0, errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+		}
+		balancesWithIDs = append(balancesWithIDs, &BalanceWithID{balance.Id, *b})
+	}
+	return balancesWithIDs, searchResult.Hits.TotalHits, nil
+}
+
+// FindTxsByScriptAsm 按输入 scriptSig 的 asm 短语 (如 OP_CHECKMULTISIG) 查询交易，按时间从新到旧分页返回，需要开启 include_scripts
+// 返回值 int64 为匹配的交易总数
+func (esClient *elasticClientAlias) FindTxsByScriptAsm(ctx context.Context, asm string, from, size int) ([]*esTx, int64, error) {
+	q := elastic.NewMatchPhraseQuery("scripts.asm", asm)
+	searchResult, err := esClient.Search().Index("tx").Query(q).
+		Sort("time", false).From(from).Size(size).Do(ctx)
+	if err != nil {
+		return nil, 0, errors.New(strings.Join([]string{"Get txs by script asm error:", err.Error()}, " "))
+	}
+
+	var txs []*esTx
+	for _, hit := range searchResult.Hits.Hits {
+		tx := new(esTx)
+		if err := json.Unmarshal(*hit.Source, tx); err != nil {
+			return nil, 0, errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+		}
+		txs = append(txs, tx)
+	}
+	return txs, searchResult.Hits.TotalHits, nil
+}
+
+// SearchAddressPrefix balance index 中以 prefix 开头的地址，按地址排序返回前 size 个，用于地址补全
+// 开启 address_ngram 且 prefix 长度在 address.prefix 子字段的范围内时查询子字段，否则用 address 的 prefix query
+func (esClient *elasticClientAlias) SearchAddressPrefix(ctx context.Context, prefix string, size int) ([]string, error) {
+	var q elastic.Query = elastic.NewPrefixQuery("address", prefix)
+	if config.AddressNgram && len(prefix) >= addressNgramMinGram && len(prefix) <= addressNgramMaxGram {
+		q = elastic.NewMatchQuery("address.prefix", prefix)
+	}
+	fetchSource := elastic.NewFetchSourceContext(true).Include("address")
+	searchResult, err := esClient.Search().Index("balance").Type("balance").Query(q).
+		FetchSourceContext(fetchSource).Sort("address", true).Size(size).Do(ctx)
+	if err != nil {
+		return nil, errors.New(strings.Join([]string{"Search address prefix error:", err.Error()}, " "))
+	}
+
+	var addresses []string
+	for _, hit := range searchResult.Hits.Hits {
+		balance := new(Balance)
+		if err := json.Unmarshal(*hit.Source, balance); err != nil {
+			return nil, errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+		}
+		addresses = append(addresses, balance.Address)
+	}
+	return addresses, nil
+}
+
+// FindTxsByFeeRange 查询手续费在 [minSat, maxSat] 聪之间的交易，按手续费从低到高分页返回，minSat 或 maxSat 小于 0 表示不限制该端
+// tx type 的 fee 以 BTC 保存，按聪换算后查询；excludeCoinbase 为 true 时不返回 coinbase 交易 (fee 为 0)
+// 返回值 int64 为匹配的交易总数
+func (esClient *elasticClientAlias) FindTxsByFeeRange(ctx context.Context, minSat, maxSat int64, from, size int, excludeCoinbase bool) ([]*esTx, int64, error) {
+	feeRange := elastic.NewRangeQuery("fee")
+	if minSat >= 0 {
+		feeRange = feeRange.Gte(btcFloat(decimal.New(minSat, -8)))
+	}
+	if maxSat >= 0 {
+		feeRange = feeRange.Lte(btcFloat(decimal.New(maxSat, -8)))
+	}
+	q := elastic.NewBoolQuery().Filter(feeRange)
+	if excludeCoinbase {
+		q = q.MustNot(elastic.NewTermQuery("coinbase", true))
+	}
+	searchResult, err := esClient.Search().Index("tx").Query(q).
+		Sort("fee", true).From(from).Size(size).Do(ctx)
+	if err != nil {
+		return nil, 0, errors.New(strings.Join([]string{"Get txs by fee range error:", err.Error()}, " "))
+	}
+
+	var txs []*esTx
+	for _, hit := range searchResult.Hits.Hits {
+		tx := new(esTx)
+		if err := json.Unmarshal(*hit.Source, tx); err != nil {
+			return nil, 0, errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+		}
+		txs = append(txs, tx)
+	}
+	return txs, searchResult.Hits.TotalHits, nil
+}
+
+// FindTimelockedTxs 查询 [from, to) 内带有时间锁 (is_timelocked 或 has_relative_timelock) 的交易，按时间从早到晚分页返回
+// relativeOnly 为 true 时只返回带有 BIP68 相对时间锁的交易。返回值 int64 为匹配的交易总数，之前版本写入的 tx 文档没有这两个字段，不会被返回
+func (esClient *elasticClientAlias) FindTimelockedTxs(ctx context.Context, from, to time.Time, relativeOnly bool, offset, size int) ([]*esTx, int64, error) {
+	q := elastic.NewBoolQuery().Filter(elastic.NewRangeQuery("time").Gte(from.Unix()).Lt(to.Unix()))
+	if relativeOnly {
+		q = q.Filter(elastic.NewTermQuery("has_relative_timelock", true))
+	} else {
+		q = q.Filter(elastic.NewBoolQuery().
+			Should(elastic.NewTermQuery("is_timelocked", true), elastic.NewTermQuery("has_relative_timelock", true)).
+			MinimumNumberShouldMatch(1))
+	}
+	searchResult, err := esClient.Search().Index("tx").Query(q).
+		Sort("time", true).From(offset).Size(size).Do(ctx)
+	if err != nil {
+		return nil, 0, errors.New(strings.Join([]string{"Get timelocked txs error:", err.Error()}, " "))
+	}
+
+	var txs []*esTx
+	for _, hit := range searchResult.Hits.Hits {
+		tx := new(esTx)
+		if err := json.Unmarshal(*hit.Source, tx); err != nil {
+			return nil, 0, errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+		}
+		txs = append(txs, tx)
+	}
+	return txs, searchResult.Hits.TotalHits, nil
+}
+
+// FindAddressSpends 查询 vins 中包含 address 的交易 (花费过该地址的 vout)，按时间从早到晚分页返回，返回值 int64 为匹配的交易总数。
+// 多签等多地址输出被花费时每个地址都会匹配；lean_tx_docs 开启时 tx 文档没有 vins，需要按 vout 的 used.txid 查询
+func (esClient *elasticClientAlias) FindAddressSpends(ctx context.Context, address string, offset, size int) ([]*esTx, int64, error) {
+	q := elastic.NewNestedQuery("vins", elastic.NewTermQuery("vins.address", address))
+	searchResult, err := esClient.Search().Index("tx").Query(q).
+		Sort("time", true).From(offset).Size(size).Do(ctx)
+	if err != nil {
+		return nil, 0, errors.New(strings.Join([]string{"Get address spends error:", err.Error()}, " "))
+	}
+
+	var txs []*esTx
+	for _, hit := range searchResult.Hits.Hits {
+		tx := new(esTx)
+		if err := json.Unmarshal(*hit.Source, tx); err != nil {
+			return nil, 0, errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+		}
+		txs = append(txs, tx)
+	}
+	return txs, searchResult.Hits.TotalHits, nil
+}
+
+// recommendedFees 按最近区块中已确认交易的手续费率估算的推荐费率 (sat/vB)，字段名与常见区块浏览器的 /fees 接口一致
+type recommendedFees struct {
+	FastestFee  float64 `json:"fastestFee"`
+	HalfHourFee float64 `json:"halfHourFee"`
+	HourFee     float64 `json:"hourFee"`
+	EconomyFee  float64 `json:"economyFee"`
+	Height      int32   `json:"height"` // 统计的最新区块高度
+	Blocks      int     `json:"blocks"` // 统计的区块数
+}
+
+// recommendedFeePercentiles fastest、halfHour、hour、economy 分别取最近区块交易费率的百分位
+var recommendedFeePercentiles = []float64{75, 50, 25, 10}
+
+// RecommendedFees 统计最近 recommended_fees_blocks 个区块中交易的 feerate 百分位，向上取整为整数 sat/vB，最低 1 sat/vB。
+// coinbase 和 fee_incomplete 的交易不参与统计，之前版本写入的 tx 文档没有 feerate，也不参与统计
+func (esClient *elasticClientAlias) RecommendedFees(ctx context.Context) (*recommendedFees, error) {
+	blockResult, err := esClient.Search().Index("block").Type("block").
+		FetchSourceContext(elastic.NewFetchSourceContext(true).Include("hash", "height")).
+		Sort("height", false).Size(config.RecommendedFeesBlocks).Do(ctx)
+	if err != nil {
+		return nil, errors.New(strings.Join([]string{"Query recent blocks error:", err.Error()}, " "))
+	}
+	if len(blockResult.Hits.Hits) == 0 {
+		return nil, ErrBlockNotFound
+	}
+	fees := &recommendedFees{Blocks: len(blockResult.Hits.Hits)}
+	var hashes []interface{}
+	for i, hit := range blockResult.Hits.Hits {
+		block := new(esBlockHeader)
+		if err := json.Unmarshal(*hit.Source, block); err != nil {
+			return nil, errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+		}
+		if i == 0 {
+			fees.Height = block.Height
+		}
+		hashes = append(hashes, block.Hash)
+	}
+
+	q := elastic.NewBoolQuery().Filter(elastic.NewTermsQuery("blockhash", hashes...)).
+		MustNot(elastic.NewTermQuery("coinbase", true), elastic.NewTermQuery("fee_incomplete", true))
+	agg := elastic.NewPercentilesAggregation().Field("feerate").Percentiles(recommendedFeePercentiles...)
+	searchResult, err := esClient.Search().Index("tx").Query(q).Size(0).
+		Aggregation("feerates", agg).Do(ctx)
+	if err != nil {
+		return nil, errors.New(strings.Join([]string{"Query recent feerates error:", err.Error()}, " "))
+	}
+	percentiles, found := searchResult.Aggregations.Percentiles("feerates")
+	if !found {
+		return nil, errors.New("Query recent feerates error: no feerates aggregation")
+	}
+	rate := func(percent float64) float64 {
+		return math.Max(1, math.Ceil(percentiles.Values[strconv.FormatFloat(percent, 'f', 1, 64)]))
+	}
+	fees.FastestFee = rate(recommendedFeePercentiles[0])
+	fees.HalfHourFee = rate(recommendedFeePercentiles[1])
+	fees.HourFee = rate(recommendedFeePercentiles[2])
+	fees.EconomyFee = rate(recommendedFeePercentiles[3])
+	return fees, nil
+}
+
+// dailyTxVolume 一天 (UTC) 的交易数和交易输出总额
+type dailyTxVolume struct {
+	Day         time.Time
+	TxCount     int64
+	OutputValue float64
+}
+
+// DailyTxVolume 按天统计 [from, to) 内的交易数和输出总额，excludeCoinbase 为 true 时不统计 coinbase 交易
+// tx type 的 time 字段为 unix 秒，date_histogram 按毫秒解析，所以用脚本换算为毫秒
+func (esClient *elasticClientAlias) DailyTxVolume(ctx context.Context, from, to time.Time, excludeCoinbase bool) ([]*dailyTxVolume, error) {
+	q := elastic.NewBoolQuery().Filter(elastic.NewRangeQuery("time").Gte(from.Unix()).Lt(to.Unix()))
+	if excludeCoinbase {
+		q = q.MustNot(elastic.NewTermQuery("coinbase", true))
+	}
+	dailyAgg := elastic.NewDateHistogramAggregation().
+		Script(elastic.NewScript("doc['time'].value * 1000").Lang("painless")).
+		Interval("day").
+		SubAggregation("output_value", elastic.NewSumAggregation().Field("output_value"))
+
+	searchResult, err := esClient.Search().Index("tx").Query(q).Size(0).
+		Aggregation("daily", dailyAgg).Do(ctx)
+	if err != nil {
+		return nil, errors.New(strings.Join([]string{"Query daily tx volume error:", err.Error()}, " "))
+	}
+	daily, found := searchResult.Aggregations.DateHistogram("daily")
+	if !found {
+		return nil, errors.New("query daily tx volume agg error")
+	}
+
+	var volumes []*dailyTxVolume
+	for _, bucket := range daily.Buckets {
+		volume := &dailyTxVolume{
+			Day:     time.Unix(int64(bucket.Key)/1000, 0).UTC(),
+			TxCount: bucket.DocCount,
+		}
+		if sum, found := bucket.Sum("output_value"); found && sum.Value != nil {
+			volume.OutputValue = btcFloat(decimal.NewFromFloat(*sum.Value))
+		}
+		volumes = append(volumes, volume)
+	}
+	return volumes, nil
+}
+
+// balanceRouting 开启 elastic_balance_routing 时返回 balance 文档的路由 (地址)，否则返回空字符串 (不路由)
+func balanceRouting(address string) string {
+	if config.ElasticBalanceRouting {
+		return address
+	}
+	return ""
+}
+
 // 统计块中的所有 vout 涉及到去重后的所有地址对应充值额度
 func calculateUniqueAddressWithSumForVinOrVout(addresses []interface{}, AddressWithAmountSlice []Balance) []*AddressWithAmount {
 	var UniqueAddressesWithSum []*AddressWithAmount
@@ -0,0 +1,15 @@
+package main
+
+import "errors"
+
+// 查询结果为空时返回的错误，调用方用 errors.Is 区分 "不存在" 与 es 请求失败
+var (
+	// ErrBlockNotFound es block type 中没有对应高度的区块
+	ErrBlockNotFound = errors.New("block not found in es")
+	// ErrTxNotFound es tx type 中没有对应 txid 的交易
+	ErrTxNotFound = errors.New("tx not found in es")
+	// ErrVoutNotFound es vout type 中没有满足条件的 vout
+	ErrVoutNotFound = errors.New("vout not found in es")
+	// ErrBalanceNotFound es balance type 中没有地址对应的余额文档
+	ErrBalanceNotFound = errors.New("balance not found in es")
+)
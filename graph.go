@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/olivere/elastic"
+)
+
+// txGraphPageSize 导出交易图时每次从 es 查询的 vout 数
+const txGraphPageSize = 1000
+
+// txGraphEdge 交易图的一条边
+// spend: 被花费的 outpoint (txid:vout) -> 花费它的交易，Addresses 为 outpoint 的地址，Height 为花费所在区块
+// output: 交易 -> 输出地址，每个地址一条边，Height 为交易所在区块
+type txGraphEdge struct {
+	Type      string   `json:"type"`
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Value     float64  `json:"value"`
+	Height    int32    `json:"height"`
+	Addresses []string `json:"addresses,omitempty"`
+}
+
+// txGraphWriter 按 csv 或 json lines 格式写出交易图的边
+type txGraphWriter interface {
+	writeEdge(edge *txGraphEdge) error
+	flush() error
+}
+
+type txGraphCSVWriter struct {
+	w           *csv.Writer
+	wroteHeader bool
+}
+
+func newTxGraphCSVWriter(w io.Writer) *txGraphCSVWriter {
+	return &txGraphCSVWriter{w: csv.NewWriter(w)}
+}
+
+func (t *txGraphCSVWriter) writeEdge(edge *txGraphEdge) error {
+	if !t.wroteHeader {
+		if err := t.w.Write([]string{"type", "from", "to", "value", "height", "addresses"}); err != nil {
+			return err
+		}
+		t.wroteHeader = true
+	}
+	return t.w.Write([]string{edge.Type, edge.From, edge.To, strconv.FormatFloat(edge.Value, 'f', -1, 64),
+		strconv.FormatInt(int64(edge.Height), 10), strings.Join(edge.Addresses, ";")})
+}
+
+func (t *txGraphCSVWriter) flush() error {
+	t.w.Flush()
+	return t.w.Error()
+}
+
+type txGraphJSONWriter struct {
+	enc *json.Encoder
+}
+
+func newTxGraphJSONWriter(w io.Writer) *txGraphJSONWriter {
+	return &txGraphJSONWriter{enc: json.NewEncoder(w)}
+}
+
+func (t *txGraphJSONWriter) writeEdge(edge *txGraphEdge) error {
+	return t.enc.Encode(edge)
+}
+
+func (t *txGraphJSONWriter) flush() error {
+	return nil
+}
+
+// ExportTxGraph 把 [from, to] 区块的交易图写入 w，返回写入的边数。数据全部来自 vout index:
+// 先按 used.height 遍历范围内被花费的 vout 写出 spend 边，再按 height 遍历范围内创建的 vout 写出 output 边，
+// 两次遍历都用 search_after 翻页，每页写出后再查询下一页，不在内存中保存整个范围。
+// 每页写出并 flush 后调用 checkpoint 保存断点 (为 nil 时不保存)，resume 不为 nil 时从断点之后继续。
+// 被 prune-spent-vouts 删除的 vout 没有 spend 边，没有地址的输出没有 output 边，没有记录 height/used.height 的旧 vout 不会导出
+func (esClient *elasticClientAlias) ExportTxGraph(ctx context.Context, from, to int32, w txGraphWriter,
+	resume *exportCheckpoint, checkpoint func(*exportCheckpoint) error) (int, error) {
+	cp := &exportCheckpoint{Phase: "spend"}
+	if resume != nil {
+		cp = resume
+	}
+	pageDone := func(after []interface{}) error {
+		if err := w.flush(); err != nil {
+			return err
+		}
+		if checkpoint == nil {
+			return nil
+		}
+		cp.After = after
+		return checkpoint(cp)
+	}
+
+	if cp.Phase == "spend" {
+		err := esClient.scanVouts(ctx, elastic.NewRangeQuery("used.height").Gte(from).Lte(to), "used.height", cp.After, func(vout *VoutStream) error {
+			edge := &txGraphEdge{
+				Type:      "spend",
+				From:      strings.Join([]string{vout.TxIDBelongTo, strconv.FormatUint(uint64(vout.Voutindex), 10)}, ":"),
+				To:        vout.spentBy(),
+				Value:     vout.Value,
+				Height:    usedHeight(vout),
+				Addresses: vout.Addresses,
+			}
+			cp.Exported++
+			return w.writeEdge(edge)
+		}, pageDone)
+		if err != nil {
+			return cp.Exported, err
+		}
+		cp.Phase, cp.After = "output", nil
+	}
+
+	err := esClient.scanVouts(ctx, elastic.NewRangeQuery("height").Gte(from).Lte(to), "height", cp.After, func(vout *VoutStream) error {
+		for _, address := range vout.Addresses {
+			if err := w.writeEdge(&txGraphEdge{Type: "output", From: vout.TxIDBelongTo, To: address, Value: vout.Value, Height: vout.Height}); err != nil {
+				return err
+			}
+			cp.Exported++
+		}
+		return nil
+	}, pageDone)
+	return cp.Exported, err
+}
+
+// scanVouts 按 heightField、txidbelongto、voutindex 排序遍历匹配 q 的 vout，用 search_after 翻页，after 不为 nil 时从该 sort 值之后开始，
+// 每页处理完后以最后一个 vout 的 sort 值调用 pageDone
+func (esClient *elasticClientAlias) scanVouts(ctx context.Context, q elastic.Query, heightField string, after []interface{},
+	fn func(*VoutStream) error, pageDone func(after []interface{}) error) error {
+	for {
+		search := esClient.Search().Index("vout").Type("vout").Query(liveVoutsQuery(q)).
+			Sort(heightField, true).Sort("txidbelongto", true).Sort("voutindex", true).Size(txGraphPageSize)
+		if after != nil {
+			search = search.SearchAfter(after...)
+		}
+		searchResult, err := search.Do(ctx)
+		if err != nil {
+			return errors.New(strings.Join([]string{"Scan vouts error:", err.Error()}, " "))
+		}
+		if searchResult.Shards != nil && searchResult.Shards.Failed > 0 {
+			return errors.New(strings.Join([]string{"Scan vouts error:", strconv.Itoa(searchResult.Shards.Failed), "shards failed"}, " "))
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			vout := new(VoutStream)
+			if err := json.Unmarshal(*hit.Source, vout); err != nil {
+				return errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+			}
+			if err := fn(vout); err != nil {
+				return err
+			}
+			after = hit.Sort
+		}
+		if err := pageDone(after); err != nil {
+			return err
+		}
+		if len(searchResult.Hits.Hits) < txGraphPageSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportTxGraph(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+
+	var out bytes.Buffer
+	w := newTxGraphCSVWriter(&out)
+	exported, err := client.ExportTxGraph(ctx, 2, 2, w, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, exported)
+	assert.Equal(t, "type,from,to,value,height,addresses\n"+
+		"spend,tx1:0,tx2,10,2,B\n"+
+		"output,coinbase2,A,50,2,\n"+
+		"output,tx2,C,4,2,\n"+
+		"output,tx2,B,5.9,2,\n", out.String())
+
+	// 范围外没有边
+	out.Reset()
+	exported, err = client.ExportTxGraph(ctx, 3, 10, newTxGraphCSVWriter(&out), nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, exported)
+	assert.Equal(t, "", out.String())
+}
+
+func TestExportTxGraphPages(t *testing.T) {
+	es, block := newTestLargeBlockES(txGraphPageSize + 200)
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+	client.syncTxVoutBalance(ctx, block)
+
+	var out bytes.Buffer
+	exported, err := client.ExportTxGraph(ctx, 3, 3, newTxGraphJSONWriter(&out), nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2*(txGraphPageSize+200), exported)
+
+	// 翻页不重复、不遗漏
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		edge := new(txGraphEdge)
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), edge))
+		key := edge.Type + " " + edge.From + " " + edge.To
+		assert.False(t, seen[key], key)
+		seen[key] = true
+	}
+	assert.Len(t, seen, exported)
+}
+
+func TestExportTxGraphResume(t *testing.T) {
+	es, block := newTestLargeBlockES(txGraphPageSize + 200)
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+	client.syncTxVoutBalance(ctx, block)
+
+	var full bytes.Buffer
+	total, err := client.ExportTxGraph(ctx, 3, 3, newTxGraphCSVWriter(&full), nil, nil)
+	assert.Nil(t, err)
+
+	dir, err := ioutil.TempDir("", "export")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "graph.csv")
+	args := "export-tx-graph --from 3 --to 3 --format csv"
+
+	// 第二页写出后、保存断点前中断，恢复时去掉第二页已经写出的部分
+	f, resume, err := openExportFile(out, args, false)
+	assert.Nil(t, err)
+	assert.Nil(t, resume)
+	save := exportCheckpointer(f, out)
+	errInterrupted := errors.New("interrupted")
+	pages := 0
+	_, err = client.ExportTxGraph(ctx, 3, 3, newTxGraphCSVWriter(f), nil, func(cp *exportCheckpoint) error {
+		pages++
+		if pages == 2 {
+			return errInterrupted
+		}
+		return save(cp)
+	})
+	assert.Equal(t, errInterrupted, err)
+	f.Close()
+
+	f, resume, err = openExportFile(out, args, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "spend", resume.Phase)
+	assert.Equal(t, txGraphPageSize, resume.Exported)
+	w := newTxGraphCSVWriter(f)
+	w.wroteHeader = resume.Offset > 0
+	exported, err := client.ExportTxGraph(ctx, 3, 3, w, resume, exportCheckpointer(f, out))
+	assert.Nil(t, err)
+	f.Close()
+	assert.Equal(t, total, exported)
+	content, err := ioutil.ReadFile(out)
+	assert.Nil(t, err)
+	assert.Equal(t, full.String(), string(content))
+
+	// 参数不同的断点不能恢复，不恢复时删除断点重新导出
+	_, _, err = openExportFile(out, "export-tx-graph --from 1 --to 3 --format csv", true)
+	assert.NotNil(t, err)
+	f, resume, err = openExportFile(out, args, false)
+	assert.Nil(t, err)
+	assert.Nil(t, resume)
+	f.Close()
+	_, err = os.Stat(checkpointPath(out))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// addressLabels 外部维护的地址标签 (交易所、服务等)，labels_file 修改后在下一个区块同步前重新加载
+// 文件为 csv 格式，每行 address,label，第一列为 address 的行视为表头
+type addressLabels struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	labels  map[string]string
+}
+
+var labels = new(addressLabels)
+
+// load 从 path 加载标签，出错时保留已加载的标签
+func (l *addressLabels) load(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	newLabels := make(map[string]string)
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.New(strings.Join([]string{"parse labels file", path, "error:", err.Error()}, " "))
+		}
+		if len(record) < 2 || record[0] == "address" {
+			continue
+		}
+		newLabels[strings.TrimSpace(record[0])] = strings.TrimSpace(record[1])
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.path, l.modTime, l.labels = path, info.ModTime(), newLabels
+	return nil
+}
+
+// reloadIfChanged 文件修改时间变化时重新加载
+func (l *addressLabels) reloadIfChanged() {
+	l.mu.RLock()
+	path, modTime := l.path, l.modTime
+	l.mu.RUnlock()
+	if path == "" {
+		return
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		sugar.Error("stat labels file error: ", err.Error())
+		return
+	}
+	if info.ModTime().Equal(modTime) {
+		return
+	}
+	if err := l.load(path); err != nil {
+		sugar.Error("reload labels file error: ", err.Error())
+		return
+	}
+	sugar.Info("Reloaded labels file: ", path)
+}
+
+// label 返回地址的标签，未知地址返回空字符串
+func (l *addressLabels) label(address string) string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.labels[address]
+}
+
+// withBalanceLabel 配置了 labels_file 时给 balance 文档加上 label 字段，地址不在标签文件中时清除旧的 label
+func withBalanceLabel(doc map[string]interface{}, address string) map[string]interface{} {
+	if config.LabelsFile == "" {
+		return doc
+	}
+	if label := labels.label(address); label != "" {
+		doc["label"] = label
+	} else {
+		doc["label"] = nil
+	}
+	return doc
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddressLabelsReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "labels")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	assert.Nil(t, ioutil.WriteFile(f.Name(), []byte("address,label\nA, exchange-a\nB,service-b\n"), 0644))
+
+	l := new(addressLabels)
+	assert.Nil(t, l.load(f.Name()))
+	assert.Equal(t, "exchange-a", l.label("A"))
+	assert.Equal(t, "service-b", l.label("B"))
+	assert.Equal(t, "", l.label("address"))
+
+	// 文件修改后重新加载
+	assert.Nil(t, ioutil.WriteFile(f.Name(), []byte("B,service-b2\n"), 0644))
+	later := time.Now().Add(time.Minute)
+	assert.Nil(t, os.Chtimes(f.Name(), later, later))
+	l.reloadIfChanged()
+	assert.Equal(t, "", l.label("A"))
+	assert.Equal(t, "service-b2", l.label("B"))
+}
+
+func TestSyncTxVoutBalanceLabels(t *testing.T) {
+	f, err := ioutil.TempFile("", "labels")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	assert.Nil(t, ioutil.WriteFile(f.Name(), []byte("B,exchange-b\nC,exchange-c\n"), 0644))
+
+	labelsFile := config.LabelsFile
+	config.LabelsFile = f.Name()
+	defer func() { config.LabelsFile = labelsFile }()
+	assert.Nil(t, labels.load(f.Name()))
+	defer func() { labels = new(addressLabels) }()
+
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+
+	byLabel := make(map[string]interface{})
+	for _, doc := range es.all("balance") {
+		byLabel[doc["address"].(string)] = doc["label"]
+	}
+	assert.Equal(t, map[string]interface{}{"A": nil, "B": "exchange-b", "C": "exchange-c"}, byLabel)
+
+	balances, total, err := client.FindBalancesByLabel(ctx, "exchange-c", 0, 10)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, total)
+	assert.Equal(t, "C", balances[0].Balance.Address)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/olivere/elastic"
+	"github.com/shopspring/decimal"
+)
+
+// ledgerEntry AddressLedger 的一行: 一笔交易对地址余额的净变化 (收入为正，支出为负) 以及变化后的余额
+type ledgerEntry struct {
+	Height  int32   `json:"height"`
+	Txid    string  `json:"txid"`
+	Delta   float64 `json:"delta"`
+	Balance float64 `json:"balance"`
+}
+
+// AddressLedger 地址在 [from, to] 区块中的收支明细，按高度排序，同一区块内按 txid 排序 (vout 文档不记录交易在区块中的位置)。
+// 收入为 height 在范围内、支付给地址的 vout，支出为 used.height 在范围内、地址被花费的 vout，同一交易中的收入和支出合并为一行 (如找零)。
+// Balance 从 from 之前的余额 (见 AddressBalanceAt) 开始累加，每个区块最后一行的余额与该区块结束时的余额一致。
+// 没有记录 height/used.height 的旧 vout 和被 prune-spent-vouts 删除的 vout 不在明细中，unspendable 的 vout 不计入余额
+func (esClient *elasticClientAlias) AddressLedger(ctx context.Context, address string, from, to int32) ([]*ledgerEntry, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid height range: from %d > to %d", from, to)
+	}
+	opening, err := esClient.AddressBalanceAt(ctx, address, from-1)
+	if err != nil {
+		return nil, err
+	}
+
+	type entryKey struct {
+		height int32
+		txid   string
+	}
+	deltas := make(map[entryKey]decimal.Decimal)
+	addressVouts := func(heightField string) *elastic.BoolQuery {
+		return elastic.NewBoolQuery().
+			Filter(elastic.NewTermQuery("addresses", address)).
+			Filter(elastic.NewRangeQuery(heightField).Gte(from).Lte(to)).
+			MustNot(elastic.NewTermQuery("unspendable", true))
+	}
+	pageDone := func(after []interface{}) error { return nil }
+
+	err = esClient.scanVouts(ctx, addressVouts("height"), "height", nil, func(vout *VoutStream) error {
+		key := entryKey{vout.Height, vout.TxIDBelongTo}
+		deltas[key] = deltas[key].Add(decimal.NewFromFloat(vout.Value))
+		return nil
+	}, pageDone)
+	if err != nil {
+		return nil, err
+	}
+	err = esClient.scanVouts(ctx, addressVouts("used.height"), "used.height", nil, func(vout *VoutStream) error {
+		key := entryKey{usedHeight(vout), vout.spentBy()}
+		deltas[key] = deltas[key].Sub(decimal.NewFromFloat(vout.Value))
+		return nil
+	}, pageDone)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]entryKey, 0, len(deltas))
+	for key := range deltas {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].height != keys[j].height {
+			return keys[i].height < keys[j].height
+		}
+		return keys[i].txid < keys[j].txid
+	})
+
+	entries := make([]*ledgerEntry, 0, len(keys))
+	balance := decimal.NewFromFloat(opening)
+	for _, key := range keys {
+		balance = balance.Add(deltas[key])
+		entries = append(entries, &ledgerEntry{Height: key.height, Txid: key.txid, Delta: btcFloat(deltas[key]), Balance: btcFloat(balance)})
+	}
+	return entries, nil
+}
+
+// AddressBalanceAt 地址在 height 区块结束时的余额: height 及之前创建、在 height 之后才被花费 (或未花费) 的 vout 之和，
+// 同样依赖 vout 文档的 height 和 used.height
+func (esClient *elasticClientAlias) AddressBalanceAt(ctx context.Context, address string, height int32) (float64, error) {
+	q := elastic.NewBoolQuery().
+		Filter(elastic.NewTermQuery("addresses", address)).
+		Filter(elastic.NewRangeQuery("height").Lte(height)).
+		MustNot(elastic.NewRangeQuery("used.height").Lte(height)).
+		MustNot(elastic.NewTermQuery("unspendable", true)).
+		MustNot(orphanedVoutQuery())
+	searchResult, err := esClient.Search().Index("vout").Type("vout").Query(q).Size(0).
+		Aggregation("balance", elastic.NewSumAggregation().Field("value")).Do(ctx)
+	if err != nil {
+		return 0, errors.New(strings.Join([]string{"Query address balance at height error:", err.Error()}, " "))
+	}
+	sum, found := searchResult.Aggregations.Sum("balance")
+	if !found || sum.Value == nil {
+		return 0, nil
+	}
+	return btcFloat(decimal.NewFromFloat(*sum.Value)), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddressLedger(t *testing.T) {
+	es := newTestSyncES()
+	es.put("vout", "vout-tx1-0", map[string]interface{}{"txidbelongto": "tx1", "voutindex": 0, "value": 10, "coinbase": false, "addresses": []string{"B"}, "used": nil, "height": 1})
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+	// 区块 3: tx3 花费 B 在 tx2:1 的 5.9，支付 C 2，找零 B 3.8
+	client.syncTxVoutBalance(ctx, &btcjson.GetBlockVerboseResult{
+		Hash:   "block3",
+		Height: 3,
+		Tx: []btcjson.TxRawResult{
+			{Txid: "coinbase3", Vin: []btcjson.Vin{{Coinbase: "04ffff001d0103"}}, Vout: []btcjson.Vout{testVout(0, 50, "D")}},
+			{Txid: "tx3", Vin: []btcjson.Vin{{Txid: "tx2", Vout: 1}}, Vout: []btcjson.Vout{testVout(0, 2, "C"), testVout(1, 3.8, "B")}},
+		},
+	})
+
+	// 同一交易中的支出和找零合并为一行
+	entries, err := client.AddressLedger(ctx, "B", 1, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []*ledgerEntry{
+		{Height: 1, Txid: "tx1", Delta: 10, Balance: 10},
+		{Height: 2, Txid: "tx2", Delta: -4.1, Balance: 5.9},
+		{Height: 3, Txid: "tx3", Delta: -2.1, Balance: 3.8},
+	}, entries)
+	assert.Equal(t, 3.8, balancesByAddress(es)["B"])
+
+	// 余额从 from 之前的余额开始累加
+	entries, err = client.AddressLedger(ctx, "B", 3, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, []*ledgerEntry{{Height: 3, Txid: "tx3", Delta: -2.1, Balance: 3.8}}, entries)
+
+	entries, err = client.AddressLedger(ctx, "C", 1, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []*ledgerEntry{{Height: 2, Txid: "tx2", Delta: 4, Balance: 4}}, entries)
+
+	entries, err = client.AddressLedger(ctx, "B", 4, 10)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+
+	_, err = client.AddressLedger(ctx, "B", 3, 2)
+	assert.NotNil(t, err)
+}
+
+func TestAddressBalanceAt(t *testing.T) {
+	es := newTestSyncES()
+	es.put("vout", "vout-tx1-0", map[string]interface{}{"txidbelongto": "tx1", "voutindex": 0, "value": 10, "coinbase": false, "addresses": []string{"B"}, "used": nil, "height": 1})
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+
+	for height, want := range map[int32]float64{0: 0, 1: 10, 2: 5.9} {
+		balance, err := client.AddressBalanceAt(ctx, "B", height)
+		assert.Nil(t, err)
+		assert.Equal(t, want, balance, height)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+)
+
+// docMapping 写入 index 的文档结构体及其 mapping。path 不为空时结构体对应 mapping 中该 object 字段的 properties，
+// omit 为结构体中有、但在这个 mapping 下不会写入的字段 (按完整路径)
+type docMapping struct {
+	index   string
+	mapping string
+	path    string
+	doc     interface{}
+	omit    []string
+}
+
+// docMappings 启动时由 checkDocMappings 检查的文档结构体。balance、address 和 block 文档中用 map 写入的字段不在检查范围内
+var docMappings = []docMapping{
+	// tx 文档 vouts 中的地址没有 outpoint 和 unresolved，只有 vins 中有
+	{index: "tx", mapping: txMapping, doc: esTx{}, omit: []string{"vouts.outpoint", "vouts.unresolved"}},
+	{index: "tx", mapping: leanTxMapping, doc: esTx{}, omit: []string{"vins", "vouts"}},
+	{index: "vout", mapping: voutMapping, doc: VoutStream{}},
+	{index: "vout", mapping: voutMapping, path: "used", doc: voutUsed{}},
+	{index: "vin", mapping: vinMapping, doc: vinDoc{}},
+	{index: "balance", mapping: balanceMapping, doc: Balance{}},
+	{index: "balance", mapping: balanceNgramMapping, doc: Balance{}},
+	{index: "balancejournal", mapping: balanceJournalMapping, doc: BalanceJournal{}},
+	{index: "balance_dlq", mapping: balanceDLQMapping, doc: balanceDelta{}},
+	{index: "syncstate", mapping: syncStateMapping, doc: syncState{}},
+	{index: "syncstate", mapping: syncStateMapping, doc: bulkLoadState{}},
+}
+
+// checkDocMappings 检查文档结构体的 json 字段都在 index mapping 中。mapping 中没有的字段写入时由 es 按 dynamic mapping 推断类型，
+// 不会报错，结构体和 mapping 的字段名不一致 (如 txidbelongto 写成 txid_belong_to) 只能在查询不到数据时才发现
+func checkDocMappings() error {
+	var unmapped []string
+	for _, m := range docMappings {
+		_, typeMapping, err := versionedMapping(m.index, m.mapping)
+		if err != nil {
+			return errors.New(strings.Join([]string{"Parse", m.index, "mapping error:", err.Error()}, " "))
+		}
+		properties, _ := typeMapping["properties"].(map[string]interface{})
+		if m.path != "" {
+			properties = subProperties(properties[m.path])
+		}
+		omit := make(map[string]bool)
+		for _, field := range m.omit {
+			omit[field] = true
+		}
+		for _, field := range unmappedFields(reflect.TypeOf(m.doc), properties, m.path, omit) {
+			unmapped = append(unmapped, strings.Join([]string{m.index, field}, "/"))
+		}
+	}
+	if len(unmapped) > 0 {
+		return errors.New(strings.Join([]string{"json fields missing from index mappings:", strings.Join(unmapped, ", ")}, " "))
+	}
+	return nil
+}
+
+// unmappedFields 结构体 t 中不在 properties 里的 json 字段，结构体类型 (以及结构体的指针、切片) 的字段递归检查其 properties
+func unmappedFields(t reflect.Type, properties map[string]interface{}, prefix string, omit map[string]bool) []string {
+	var unmapped []string
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				unmapped = append(unmapped, unmappedFields(field.Type, properties, prefix, omit)...)
+				continue
+			}
+			name = field.Name
+		}
+		path := name
+		if prefix != "" {
+			path = strings.Join([]string{prefix, name}, ".")
+		}
+		if omit[path] {
+			continue
+		}
+		property, ok := properties[name]
+		if !ok {
+			unmapped = append(unmapped, path)
+			continue
+		}
+		elem := field.Type
+		for elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Slice || elem.Kind() == reflect.Array {
+			elem = elem.Elem()
+		}
+		if elem.Kind() == reflect.Struct {
+			unmapped = append(unmapped, unmappedFields(elem, subProperties(property), path, omit)...)
+		}
+	}
+	return unmapped
+}
+
+// subProperties object 或 nested 字段的 properties，其他类型的字段返回 nil
+func subProperties(property interface{}) map[string]interface{} {
+	p, _ := property.(map[string]interface{})
+	properties, _ := p["properties"].(map[string]interface{})
+	return properties
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDocMappings(t *testing.T) {
+	assert.Nil(t, checkDocMappings())
+}
+
+func TestUnmappedFields(t *testing.T) {
+	_, typeMapping, err := versionedMapping("vout", voutMapping)
+	assert.Nil(t, err)
+	properties := typeMapping["properties"].(map[string]interface{})
+
+	type driftedUsed struct {
+		Txid     string `json:"txid"`
+		VinIndex uint32 `json:"vin_index"`
+	}
+	type driftedVout struct {
+		TxIDBelongTo string       `json:"txid_belong_to"`
+		Value        float64      `json:"value,omitempty"`
+		Used         *driftedUsed `json:"used"`
+		Internal     string       `json:"-"`
+		Addresses    []string     `json:"addresses"`
+		Label        string       `json:"label"`
+		private      int
+	}
+	assert.Equal(t, []string{"txid_belong_to", "used.vin_index", "label"},
+		unmappedFields(reflect.TypeOf(driftedVout{}), properties, "", nil))
+	assert.Equal(t, []string{"txid_belong_to", "used.vin_index"},
+		unmappedFields(reflect.TypeOf(driftedVout{}), properties, "", map[string]bool{"label": true}))
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+// unknownPool 没有匹配到矿池时 block 文档的 pool 字段
+const unknownPool = "unknown"
+
+// poolInfo 矿池信息
+type poolInfo struct {
+	Name string `json:"name"`
+	Link string `json:"link"`
+}
+
+// poolTags 矿池识别规则，与常见的 pools.json 格式相同:
+// coinbase_tags 为 coinbase scriptSig 中的标签，payout_addresses 为矿池 coinbase 的收款地址
+type poolTags struct {
+	CoinbaseTags    map[string]poolInfo `json:"coinbase_tags"`
+	PayoutAddresses map[string]poolInfo `json:"payout_addresses"`
+	sortedTags      []string
+}
+
+// pools 配置了 pool_tags_file 时加载，为 nil 表示不识别矿池
+var pools *poolTags
+
+func loadPoolTags(path string) (*poolTags, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p := new(poolTags)
+	if err := json.Unmarshal(raw, p); err != nil {
+		return nil, err
+	}
+	// 多个标签同时匹配时优先使用更长的标签，结果与 map 的遍历顺序无关
+	for tag := range p.CoinbaseTags {
+		p.sortedTags = append(p.sortedTags, tag)
+	}
+	sort.Slice(p.sortedTags, func(i, j int) bool {
+		if len(p.sortedTags[i]) != len(p.sortedTags[j]) {
+			return len(p.sortedTags[i]) > len(p.sortedTags[j])
+		}
+		return p.sortedTags[i] < p.sortedTags[j]
+	})
+	return p, nil
+}
+
+// identify 识别出块的矿池，先匹配 coinbase 收款地址，再匹配 coinbase scriptSig 中的标签
+func (p *poolTags) identify(block *btcjson.GetBlockVerboseResult) string {
+	if len(block.Tx) == 0 || len(block.Tx[0].Vin) == 0 {
+		return unknownPool
+	}
+	coinbase := block.Tx[0]
+	for _, vout := range coinbase.Vout {
+		for _, address := range vout.ScriptPubKey.Addresses {
+			if pool, ok := p.PayoutAddresses[address]; ok {
+				return pool.Name
+			}
+		}
+	}
+
+	scriptSig, err := hex.DecodeString(coinbase.Vin[0].Coinbase)
+	if err != nil {
+		return unknownPool
+	}
+	for _, tag := range p.sortedTags {
+		if strings.Contains(string(scriptSig), tag) {
+			return p.CoinbaseTags[tag].Name
+		}
+	}
+	return unknownPool
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPoolTagsIdentify(t *testing.T) {
+	f, err := ioutil.TempFile("", "pools")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	assert.Nil(t, ioutil.WriteFile(f.Name(), []byte(`{
+  "coinbase_tags": {"/F2Pool/": {"name": "F2Pool"}, "Pool": {"name": "Generic"}},
+  "payout_addresses": {"1PayoutAddress": {"name": "AddressPool"}}
+}`), 0644))
+	p, err := loadPoolTags(f.Name())
+	assert.Nil(t, err)
+
+	coinbaseBlock := func(scriptSig string, addresses ...string) *btcjson.GetBlockVerboseResult {
+		return &btcjson.GetBlockVerboseResult{Tx: []btcjson.TxRawResult{{
+			Vin:  []btcjson.Vin{{Coinbase: hex.EncodeToString([]byte(scriptSig))}},
+			Vout: []btcjson.Vout{testVout(0, 12.5, addresses...)},
+		}}}
+	}
+
+	// 多个标签匹配时使用更长的标签
+	assert.Equal(t, "F2Pool", p.identify(coinbaseBlock("\x03\x01\x02\x03/F2Pool/", "1Other")))
+	// 收款地址优先于标签
+	assert.Equal(t, "AddressPool", p.identify(coinbaseBlock("/F2Pool/", "1PayoutAddress")))
+	assert.Equal(t, unknownPool, p.identify(coinbaseBlock("/mined by someone/", "1Other")))
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/olivere/elastic"
+	"github.com/shopspring/decimal"
+)
+
+// utxoRepair RepairUTXOConsistency 修正的 vout，SpentBy 为修正前 es 中的 used.txid，Now 为修正后的，空字符串表示未花费
+type utxoRepair struct {
+	Height  int32
+	Txid    string
+	Vout    uint32
+	SpentBy string
+	Now     string
+}
+
+// RepairUTXOConsistency 按 getBlock 返回的区块重新计算 [from, to] 区块花费的 vout 的 used 字段，修正与 es 不一致的 vout 并调整地址余额，
+// 返回修正的 vout，dryRun 为 true 时只返回不修正。tx 文档不记录输入花费的 outpoint，花费关系以节点的区块为准:
+// 1. 区块中交易花费的 vout 在 es 中未花费时标记为被该交易花费并减去余额，被其他交易或在其他高度花费时只修正 used
+// 2. es 中记录在该区块花费 (used.height) 但区块中没有交易花费的 vout 标记为未花费并加回余额
+// es 中没有的 vout (被 prune-spent-vouts 删除或在同步范围之前创建) 无法修正，vin index 和 balance journal 不修正。需要在同步停止时执行
+func (esClient *elasticClientAlias) RepairUTXOConsistency(ctx context.Context, from, to int32, getBlock func(int32) (*btcjson.GetBlockVerboseResult, error), dryRun bool) ([]*utxoRepair, error) {
+	var repairs []*utxoRepair
+	for height := from; height <= to; height++ {
+		block, err := getBlock(height)
+		if err != nil {
+			return repairs, err
+		}
+		blockRepairs, err := esClient.repairBlockSpends(ctx, block, dryRun)
+		if err != nil {
+			return repairs, err
+		}
+		repairs = append(repairs, blockRepairs...)
+	}
+	return repairs, nil
+}
+
+// repairBlockSpends 修正一个区块花费的 vout，同一区块的 vout 和余额在一次 bulk 请求中写入
+func (esClient *elasticClientAlias) repairBlockSpends(ctx context.Context, block *btcjson.GetBlockVerboseResult, dryRun bool) ([]*utxoRepair, error) {
+	height := int32(block.Height)
+	var outpoints []IndexUTXO
+	spentBy := make(map[IndexUTXO]string)
+	for _, tx := range block.Tx {
+		for _, outpoint := range spentOutpointsFun(tx.Vin, tx.Txid) {
+			outpoints = append(outpoints, outpoint.IndexUTXO)
+			spentBy[outpoint.IndexUTXO] = outpoint.SpentBy
+		}
+	}
+	spent, err := esClient.QueryVoutWithVinsOrVoutsInBatches(ctx, outpoints, config.RollbackBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	spentAt, err := esClient.voutsSpentAt(ctx, height)
+	if err != nil {
+		return nil, err
+	}
+
+	var repairs []*utxoRepair
+	bulkRequest := esClient.Bulk()
+	deltas := make(map[string]decimal.Decimal)
+	addDelta := func(vout *VoutStream, amount decimal.Decimal) {
+		if vout.Unspendable {
+			return
+		}
+		for _, address := range vout.Addresses {
+			if _, ok := deltas[address]; !ok {
+				deltas[address] = decimal.New(0, 0)
+			}
+			deltas[address] = deltas[address].Add(amount)
+		}
+	}
+
+	for _, voutWithID := range spent {
+		vout := voutWithID.Vout
+		spender := spentBy[IndexUTXO{vout.TxIDBelongTo, vout.Voutindex}]
+		was := vout.spentBy()
+		if was == spender && usedHeight(vout) == height {
+			continue
+		}
+		repairs = append(repairs, &utxoRepair{height, vout.TxIDBelongTo, vout.Voutindex, was, spender})
+		bulkRequest.Add(elastic.NewBulkUpdateRequest().Index("vout").Type("vout").Id(voutWithID.ID).
+			Doc(map[string]interface{}{"used": newVoutUsed(spender, vout, block)}))
+		if was == "" {
+			addDelta(vout, decimal.NewFromFloat(vout.Value).Neg())
+		}
+	}
+	for _, voutWithID := range spentAt {
+		vout := voutWithID.Vout
+		if _, ok := spentBy[IndexUTXO{vout.TxIDBelongTo, vout.Voutindex}]; ok {
+			continue
+		}
+		repairs = append(repairs, &utxoRepair{height, vout.TxIDBelongTo, vout.Voutindex, vout.spentBy(), ""})
+		bulkRequest.Add(elastic.NewBulkUpdateRequest().Index("vout").Type("vout").Id(voutWithID.ID).
+			Doc(map[string]interface{}{"used": nil, "redeemaddresses": nil}))
+		addDelta(vout, decimal.NewFromFloat(vout.Value))
+	}
+	if dryRun || bulkRequest.NumberOfActions() == 0 {
+		return repairs, nil
+	}
+
+	var addresses []interface{}
+	for address := range deltas {
+		addresses = append(addresses, address)
+	}
+	balancesWithIDs, err := esClient.BulkQueryBalanceUnlimitSize(ctx, addresses...)
+	if err != nil {
+		return nil, err
+	}
+	for address, delta := range deltas {
+		if balanceWithID, exists := findBalanceByAddress(balancesWithIDs, address); exists {
+			amount := btcFloat(decimal.NewFromFloat(balanceWithID.Balance.Amount).Add(delta))
+			bulkRequest.Add(elastic.NewBulkUpdateRequest().Index("balance").Type("balance").Id(balanceWithID.ID).Routing(balanceRouting(address)).
+				Doc(withBalanceLabel(map[string]interface{}{"amount": amount}, address)))
+		} else {
+			newBalance := withBalanceLabel(map[string]interface{}{"address": address, "amount": btcFloat(delta)}, address)
+			bulkRequest.Add(elastic.NewBulkIndexRequest().Index("balance").Type("balance").Routing(balanceRouting(address)).Doc(newBalance))
+		}
+	}
+	bulkResp, err := bulkRequest.Refresh("true").Do(ctx)
+	if err != nil {
+		return nil, errors.New(strings.Join([]string{"Repair utxo consistency error:", err.Error()}, " "))
+	}
+	if failed := bulkResp.Failed(); len(failed) > 0 {
+		return nil, errors.New(strings.Join([]string{"Repair utxo consistency error:", strconv.Itoa(len(failed)), "docs failed to update at height", strconv.Itoa(int(height))}, " "))
+	}
+	return repairs, nil
+}
+
+// voutsSpentAt es 中记录在 height 区块花费的 vout，按 txidbelongto、voutindex 排序用 search_after 翻页读取全部，
+// orphaned 的 vout 可能与重新同步的 vout 有相同的 outpoint，_id 保证排序值唯一
+func (esClient *elasticClientAlias) voutsSpentAt(ctx context.Context, height int32) ([]VoutWithID, error) {
+	q := elastic.NewTermQuery("used.height", height)
+	var (
+		vouts []VoutWithID
+		after []interface{}
+	)
+	for {
+		search := esClient.Search().Index("vout").Type("vout").Query(q).
+			Sort("txidbelongto", true).Sort("voutindex", true).Sort("_id", true).Size(txGraphPageSize)
+		if after != nil {
+			search = search.SearchAfter(after...)
+		}
+		searchResult, err := search.Do(ctx)
+		if err != nil {
+			return nil, errors.New(strings.Join([]string{"query vouts spent in block error:", err.Error()}, " "))
+		}
+		if searchResult.Shards != nil && searchResult.Shards.Failed > 0 {
+			return nil, errors.New(strings.Join([]string{"query vouts spent in block error:", strconv.Itoa(searchResult.Shards.Failed), "shards failed"}, " "))
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			vout := new(VoutStream)
+			if err := json.Unmarshal(*hit.Source, vout); err != nil {
+				return nil, errors.New(strings.Join([]string{"unmarshal vout error:", err.Error()}, " "))
+			}
+			vouts = append(vouts, VoutWithID{hit.Id, vout})
+			after = hit.Sort
+		}
+		if len(searchResult.Hits.Hits) < txGraphPageSize {
+			return vouts, nil
+		}
+	}
+}
+
+// usedHeight vout 的 used.height，未花费或没有记录花费高度时为 -1
+func usedHeight(vout *VoutStream) int32 {
+	used, ok := vout.Used.(map[string]interface{})
+	if !ok {
+		return -1
+	}
+	height, ok := used["height"].(float64)
+	if !ok {
+		return -1
+	}
+	return int32(height)
+}
+
+// feeRepair RecomputeFees 修正的 tx，Fee 和 FeeIncomplete 为修正前 es 中的值，Now 和 NowIncomplete 为重新计算的
+type feeRepair struct {
+	Height        int32
+	Txid          string
+	Fee           float64
+	Now           float64
+	FeeIncomplete bool
+	NowIncomplete bool
+}
+
+// RecomputeFees 按 getBlock 返回的区块重新从 vout index 查找 [from, to] 区块中每笔交易花费的 vout，按与同步相同的规则 (见 txFee) 重新计算
+// fee、feerate 和 fee_incomplete，与 tx 文档不一致时更新 tx 文档 (lean_tx_docs 关闭时同时更新 vins) 和 block 文档的 total_fees、fee_mismatch，
+// 返回修正的 tx，dryRun 为 true 时只返回不修正。只修正 tx 和 block 文档，vout 和余额不变，es 中没有 tx 文档的交易 (watch 模式下未关注的交易) 跳过。
+// 花费的 vout 被 prune-spent-vouts 删除的交易会变为 fee_incomplete，需要在同步停止时执行
+func (esClient *elasticClientAlias) RecomputeFees(ctx context.Context, from, to int32, getBlock func(int32) (*btcjson.GetBlockVerboseResult, error), dryRun bool) ([]*feeRepair, error) {
+	var repairs []*feeRepair
+	for height := from; height <= to; height++ {
+		block, err := getBlock(height)
+		if err != nil {
+			return repairs, err
+		}
+		blockRepairs, err := esClient.recomputeBlockFees(ctx, block, dryRun)
+		if err != nil {
+			return repairs, err
+		}
+		repairs = append(repairs, blockRepairs...)
+	}
+	return repairs, nil
+}
+
+// recomputeBlockFees 重新计算一个区块中交易的手续费，同一区块的 tx 文档在一次 bulk 请求中更新
+func (esClient *elasticClientAlias) recomputeBlockFees(ctx context.Context, block *btcjson.GetBlockVerboseResult, dryRun bool) ([]*feeRepair, error) {
+	height := int32(block.Height)
+	var outpoints []IndexUTXO
+	var txids []string
+	for _, tx := range block.Tx {
+		for _, outpoint := range spentOutpointsFun(tx.Vin, tx.Txid) {
+			outpoints = append(outpoints, outpoint.IndexUTXO)
+		}
+		txids = append(txids, tx.Txid)
+	}
+	spent, err := esClient.QueryVoutWithVinsOrVoutsInBatches(ctx, outpoints, config.RollbackBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	vouts := make(map[IndexUTXO]VoutWithID)
+	for _, voutWithID := range spent {
+		vouts[IndexUTXO{voutWithID.Vout.TxIDBelongTo, voutWithID.Vout.Voutindex}] = voutWithID
+	}
+	txDocs, err := esClient.blockTxDocs(ctx, block.Hash, txids, config.RollbackBatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var repairs []*feeRepair
+	totalFees := decimal.New(0, 0)
+	bulkRequest := esClient.Bulk()
+	for _, tx := range block.Tx {
+		var (
+			vinAmount       decimal.Decimal
+			voutAmount      decimal.Decimal
+			voutWithIDs     []VoutWithID
+			txTypeVinsField []AddressWithValueInTx
+		)
+		for _, vout := range tx.Vout {
+			voutAmount = voutAmount.Add(decimal.NewFromFloat(vout.Value))
+		}
+		for _, outpoint := range spentOutpointsFun(tx.Vin, tx.Txid) {
+			if voutWithID, found := vouts[outpoint.IndexUTXO]; found {
+				voutWithIDs = append(voutWithIDs, voutWithID)
+			}
+		}
+		// 与同步时相同，开启 rpc_prevout_fallback 时从节点补全 es 中找不到的 vout (watch 模式下未关注地址的 vout 不在 es 中)
+		if prevouts != nil {
+			voutWithIDs = append(voutWithIDs, fetchMissingPrevouts(tx.Vin, voutWithIDs, nil)...)
+		}
+		for _, voutWithID := range voutWithIDs {
+			vinAmount = vinAmount.Add(decimal.NewFromFloat(voutWithID.Vout.Value))
+			txTypeVinsFieldTmp, _, _, _ := parseESVout(voutWithID, tx.Txid)
+			txTypeVinsField = append(txTypeVinsField, txTypeVinsFieldTmp...)
+		}
+		missingOutpoints := missingVinOutpoints(tx.Vin, voutWithIDs)
+		feeIncomplete := len(missingOutpoints) > 0
+		txTypeVinsField = append(txTypeVinsField, unresolvedVins(missingOutpoints)...)
+		fee := txFee(tx, vinAmount, voutAmount, feeIncomplete)
+		totalFees = totalFees.Add(fee)
+
+		txDoc, found := txDocs[tx.Txid]
+		if !found {
+			continue
+		}
+		esFee := btcFloat(fee)
+		recomputed := esTxFun(tx, block, esFee, feeIncomplete, txTypeVinsField, nil)
+		if txDoc.Tx.Fee == recomputed.Fee && txDoc.Tx.FeeRate == recomputed.FeeRate && txDoc.Tx.FeeIncomplete == recomputed.FeeIncomplete {
+			continue
+		}
+		repairs = append(repairs, &feeRepair{height, tx.Txid, txDoc.Tx.Fee, recomputed.Fee, txDoc.Tx.FeeIncomplete, recomputed.FeeIncomplete})
+		doc := map[string]interface{}{"fee": recomputed.Fee, "feerate": recomputed.FeeRate, "fee_incomplete": recomputed.FeeIncomplete}
+		if !config.LeanTxDocs {
+			doc["vins"] = recomputed.Vins
+		}
+		bulkRequest.Add(elastic.NewBulkUpdateRequest().Index(txDoc.Index).Type(txDocType()).Id(txDoc.ID).Doc(doc))
+	}
+	if dryRun || bulkRequest.NumberOfActions() == 0 {
+		return repairs, nil
+	}
+
+	bulkResp, err := bulkRequest.Refresh("true").Do(ctx)
+	if err != nil {
+		return nil, errors.New(strings.Join([]string{"Recompute fees error:", err.Error()}, " "))
+	}
+	if failed := bulkResp.Failed(); len(failed) > 0 {
+		return nil, errors.New(strings.Join([]string{"Recompute fees error:", strconv.Itoa(len(failed)), "tx docs failed to update at height", strconv.Itoa(int(height))}, " "))
+	}
+	// watch 模式下 block 文档的 total_fees 只包括关注的交易，不修正
+	if config.WatchedAddresses != nil {
+		return repairs, nil
+	}
+	if err := esClient.updateBlockTotalFees(ctx, height, totalFees); err != nil {
+		return nil, err
+	}
+	return repairs, nil
+}
+
+// txDocWithID tx 文档及其 _id，tx 文档由 es 生成 id
+// txDocWithID Index 为文档所在的具体 index，开启 monthly_tx_indices 时按 id 更新不能使用别名 tx
+type txDocWithID struct {
+	ID    string
+	Index string
+	Tx    *esTx
+}
+
+// blockTxDocs 按 txid 每 batchSize 个查询一次区块 blockHash 中的 tx 文档，batchSize 小于 1 时按 500 个一批
+func (esClient *elasticClientAlias) blockTxDocs(ctx context.Context, blockHash string, txids []string, batchSize int) (map[string]txDocWithID, error) {
+	if batchSize < 1 {
+		batchSize = 500
+	}
+	docs := make(map[string]txDocWithID)
+	for len(txids) > 0 {
+		batch := txids
+		if len(batch) > batchSize {
+			batch = txids[:batchSize]
+		}
+		txids = txids[len(batch):]
+		var terms []interface{}
+		for _, txid := range batch {
+			terms = append(terms, txid)
+		}
+		q := elastic.NewBoolQuery().Filter(elastic.NewTermQuery("blockhash", blockHash), elastic.NewTermsQuery("txid", terms...))
+		searchResult, err := esClient.Search().Index("tx").Query(q).Size(len(batch)).Do(ctx)
+		if err != nil {
+			return nil, errors.New(strings.Join([]string{"query tx docs of block", blockHash, "error:", err.Error()}, " "))
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			tx := new(esTx)
+			if err := json.Unmarshal(*hit.Source, tx); err != nil {
+				return nil, errors.New(strings.Join([]string{"unmarshal tx error:", err.Error()}, " "))
+			}
+			docs[tx.Txid] = txDocWithID{hit.Id, hit.Index, tx}
+		}
+	}
+	return docs, nil
+}
+
+// updateBlockTotalFees 更新 block 文档的 total_fees，记录了节点统计的手续费 (verify_block_fees) 时同时更新 fee_mismatch，
+// 并按更新后的文档重新计算 digest，verify-digests 不会把修正过的区块当作被修改
+func (esClient *elasticClientAlias) updateBlockTotalFees(ctx context.Context, height int32, totalFees decimal.Decimal) error {
+	id := strconv.FormatInt(int64(height), 10)
+	result, err := esClient.Get().Index("block").Type("block").Id(id).Do(ctx)
+	if elastic.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.New(strings.Join([]string{"Get block", id, "error:", err.Error()}, " "))
+	}
+	blockDoc := struct {
+		ReportedFees *float64 `json:"reported_fees"`
+	}{}
+	if err := json.Unmarshal(*result.Source, &blockDoc); err != nil {
+		return errors.New(strings.Join([]string{"unmarshal block error:", err.Error()}, " "))
+	}
+	var source map[string]interface{}
+	if err := json.Unmarshal(*result.Source, &source); err != nil {
+		return errors.New(strings.Join([]string{"unmarshal block error:", err.Error()}, " "))
+	}
+	doc := map[string]interface{}{"total_fees": btcFloat(totalFees)}
+	if blockDoc.ReportedFees != nil {
+		stats := &blockStats{TotalFees: totalFees}
+		reportedFees := decimal.NewFromFloat(*blockDoc.ReportedFees)
+		stats.ReportedFees = &reportedFees
+		doc["fee_mismatch"] = stats.feeMismatch()
+	}
+	for field, value := range doc {
+		source[field] = value
+	}
+	digest, err := blockDigest(source)
+	if err != nil {
+		return errors.New(strings.Join([]string{"Compute digest of block", id, "error:", err.Error()}, " "))
+	}
+	doc["digest"] = digest
+	if _, err := esClient.Update().Index("block").Type("block").Id(id).Doc(doc).Refresh("true").Do(ctx); err != nil {
+		return errors.New(strings.Join([]string{"Update total fees of block", id, "error:", err.Error()}, " "))
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/olivere/elastic"
+)
+
+// addressReusePartitionSize AddressReuse 每个分区预计的地址数，分区数由区间内的地址数 (cardinality) 得到
+const addressReusePartitionSize = 10000
+
+// addressReuseStats 区块区间内的地址复用统计。Reused 为区间内收到不止一个输出的地址数 (同一交易中的多个输出分别计数)，
+// Distribution 的 key 为收到的输出数 n (n > 1)，value 为收到 n 个输出的地址数
+type addressReuseStats struct {
+	From         int32           `json:"from"`
+	To           int32           `json:"to"`
+	Addresses    int64           `json:"addresses"` // 区间内收到过输出的地址数，cardinality 聚合的近似值
+	Reused       int64           `json:"reused"`
+	Distribution map[int64]int64 `json:"distribution"`
+}
+
+// AddressReuse 统计 [from, to] 区块中收到过不止一个输出的地址。全部在 es 中聚合：按 vout 的 addresses 做 min_doc_count 为 2 的 terms 聚合，
+// terms 聚合只返回 size 个桶，所以先用 cardinality 聚合估计地址数，把地址按 hash 分为若干分区逐个聚合，每次只返回一个分区中复用的地址的桶。
+// 分区中的桶超过 size 时 (sum_other_doc_count 不为 0) 结果不完整，返回错误。被回滚标记为 orphaned 的 vout 不计入，
+// 没有记录 height 的旧 vout 不在区间内
+func (esClient *elasticClientAlias) AddressReuse(ctx context.Context, from, to int32) (*addressReuseStats, error) {
+	if from > to {
+		return nil, fmt.Errorf("invalid height range: from %d > to %d", from, to)
+	}
+	q := liveVoutsQuery(elastic.NewRangeQuery("height").Gte(from).Lte(to))
+	stats := &addressReuseStats{From: from, To: to, Distribution: make(map[int64]int64)}
+
+	searchResult, err := esClient.Search().Index("vout").Type("vout").Query(q).Size(0).
+		Aggregation("addresses", elastic.NewCardinalityAggregation().Field("addresses")).Do(ctx)
+	if err != nil {
+		return nil, errors.New(strings.Join([]string{"Count addresses error:", err.Error()}, " "))
+	}
+	if cardinality, found := searchResult.Aggregations.Cardinality("addresses"); found && cardinality.Value != nil {
+		stats.Addresses = int64(*cardinality.Value)
+	}
+
+	partitions := int(stats.Addresses/addressReusePartitionSize) + 1
+	for partition := 0; partition < partitions; partition++ {
+		// 地址按 hash 分区，各分区的地址数不完全相同，size 留出余量
+		reuse := elastic.NewTermsAggregation().Field("addresses").MinDocCount(2).
+			Partition(partition).NumPartitions(partitions).Size(2 * addressReusePartitionSize)
+		searchResult, err := esClient.Search().Index("vout").Type("vout").Query(q).Size(0).
+			Aggregation("reuse", reuse).Do(ctx)
+		if err != nil {
+			return nil, errors.New(strings.Join([]string{"Aggregate address reuse error:", err.Error()}, " "))
+		}
+		if searchResult.Shards != nil && searchResult.Shards.Failed > 0 {
+			return nil, errors.New(strings.Join([]string{"Aggregate address reuse error:", strconv.Itoa(searchResult.Shards.Failed), "shards failed"}, " "))
+		}
+		terms, found := searchResult.Aggregations.Terms("reuse")
+		if !found {
+			continue
+		}
+		if terms.SumOfOtherDocCount > 0 {
+			return nil, fmt.Errorf("address reuse partition %d of %d has more than %d reused addresses", partition, partitions, 2*addressReusePartitionSize)
+		}
+		for _, bucket := range terms.Buckets {
+			stats.Reused++
+			stats.Distribution[bucket.DocCount]++
+		}
+	}
+	return stats, nil
+}
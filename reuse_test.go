@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddressReuse(t *testing.T) {
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	es.put("vout", "a1", map[string]interface{}{"height": 10, "addresses": []string{"A"}})
+	es.put("vout", "a2", map[string]interface{}{"height": 11, "addresses": []string{"A"}})
+	es.put("vout", "a3", map[string]interface{}{"height": 12, "addresses": []string{"A"}})
+	es.put("vout", "b1", map[string]interface{}{"height": 10, "addresses": []string{"B", "C"}})
+	es.put("vout", "b2", map[string]interface{}{"height": 12, "addresses": []string{"B"}})
+	es.put("vout", "d1", map[string]interface{}{"height": 11, "addresses": []string{"D"}})
+	// 区间外和 orphaned 的 vout 不计入
+	es.put("vout", "d2", map[string]interface{}{"height": 13, "addresses": []string{"D"}})
+	es.put("vout", "c2", map[string]interface{}{"height": 11, "addresses": []string{"C"}, "orphaned": true})
+
+	stats, err := client.AddressReuse(context.Background(), 10, 12)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 4, stats.Addresses)
+	assert.EqualValues(t, 2, stats.Reused)
+	assert.Equal(t, map[int64]int64{2: 1, 3: 1}, stats.Distribution)
+
+	_, err = client.AddressReuse(context.Background(), 12, 10)
+	assert.NotNil(t, err)
+}
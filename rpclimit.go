@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/olivere/elastic"
+)
+
+// rpcLimiter 限制同时进行的 rpc 调用数，节点的 rpc 工作队列 (-rpcworkqueue) 已满时按指数退避重试。
+// 区块同步、verify_after_index、verify_block_fees 和 rpc_prevout_fallback 的 getrawtransaction 共用一个 rpcLimiter
+type rpcLimiter struct {
+	slots   chan struct{} // 为 nil 表示不限制并发数
+	backoff elastic.Backoff
+}
+
+// rpcLimit 由 InitConfig 按 rpc_max_concurrency 创建
+var rpcLimit = newRPCLimiter(0, rpcRetryBackoffMin, rpcRetryBackoffMax)
+
+// rpcRetryBackoffMin/rpcRetryBackoffMax 工作队列已满时重试的初始等待时间，等待时间达到 rpcRetryBackoffMax 时放弃并返回错误
+const (
+	rpcRetryBackoffMin = 100 * time.Millisecond
+	rpcRetryBackoffMax = time.Minute
+)
+
+func newRPCLimiter(maxConcurrency int, minBackoff, maxBackoff time.Duration) *rpcLimiter {
+	l := &rpcLimiter{backoff: elastic.NewExponentialBackoff(minBackoff, maxBackoff)}
+	if maxConcurrency > 0 {
+		l.slots = make(chan struct{}, maxConcurrency)
+	}
+	return l
+}
+
+// do 占用一个并发名额执行 call，工作队列已满时释放名额等待后重试，其他错误直接返回
+func (l *rpcLimiter) do(method string, call func() error) error {
+	for retry := 0; ; retry++ {
+		if l.slots != nil {
+			l.slots <- struct{}{}
+		}
+		err := call()
+		if l.slots != nil {
+			<-l.slots
+		}
+		if err == nil || !rpcWorkQueueFull(err) {
+			return err
+		}
+		wait, ok := l.backoff.Next(retry)
+		if !ok {
+			return err
+		}
+		sugar.Warn("bitcoind rpc work queue is full, retry ", method, " in ", wait)
+		time.Sleep(wait)
+	}
+}
+
+// rpcWorkQueueFull bitcoind 的 rpc 工作队列已满时以 503 "Work queue depth exceeded" 拒绝请求
+func rpcWorkQueueFull(err error) bool {
+	return strings.Contains(err.Error(), "Work queue depth exceeded")
+}
+
+// 以下方法覆盖 rpcclient.Client 中同步用到的方法，所有 rpc 调用都经过 rpcLimit
+
+func (btcClient *bitcoinClientAlias) GetBlockHash(height int64) (*chainhash.Hash, error) {
+	var hash *chainhash.Hash
+	err := rpcLimit.do("getblockhash", func() (err error) {
+		hash, err = btcClient.Client.GetBlockHash(height)
+		return err
+	})
+	return hash, err
+}
+
+func (btcClient *bitcoinClientAlias) GetBlockChainInfo() (*btcjson.GetBlockChainInfoResult, error) {
+	var info *btcjson.GetBlockChainInfoResult
+	err := rpcLimit.do("getblockchaininfo", func() (err error) {
+		info, err = btcClient.Client.GetBlockChainInfo()
+		return err
+	})
+	return info, err
+}
+
+func (btcClient *bitcoinClientAlias) GetRawTransactionVerbose(txHash *chainhash.Hash) (*btcjson.TxRawResult, error) {
+	var tx *btcjson.TxRawResult
+	err := rpcLimit.do("getrawtransaction", func() (err error) {
+		tx, err = btcClient.Client.GetRawTransactionVerbose(txHash)
+		return err
+	})
+	return tx, err
+}
+
+func (btcClient *bitcoinClientAlias) RawRequest(method string, params []json.RawMessage) (json.RawMessage, error) {
+	var result json.RawMessage
+	err := rpcLimit.do(method, func() (err error) {
+		result, err = btcClient.Client.RawRequest(method, params)
+		return err
+	})
+	return result, err
+}
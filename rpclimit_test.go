@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var errWorkQueueFull = errors.New("status code: 503, response: \"Work queue depth exceeded\"")
+
+func TestRPCLimiterRetry(t *testing.T) {
+	l := newRPCLimiter(1, time.Millisecond, 10*time.Millisecond)
+
+	// 工作队列已满时退避重试，直到节点接受请求
+	calls := 0
+	err := l.do("getblock", func() error {
+		calls++
+		if calls < 3 {
+			return errWorkQueueFull
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, calls)
+
+	// 其他错误不重试
+	calls = 0
+	errNotFound := errors.New("-5: Block not found")
+	err = l.do("getblock", func() error {
+		calls++
+		return errNotFound
+	})
+	assert.Equal(t, errNotFound, err)
+	assert.Equal(t, 1, calls)
+
+	// 等待时间超过 maxBackoff 后放弃，返回最后一次的错误
+	err = l.do("getblock", func() error { return errWorkQueueFull })
+	assert.Equal(t, errWorkQueueFull, err)
+}
+
+func TestRPCLimiterConcurrency(t *testing.T) {
+	l := newRPCLimiter(2, time.Millisecond, 10*time.Millisecond)
+
+	var running, maxRunning int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l.do("getrawtransaction", func() error {
+				n := atomic.AddInt32(&running, 1)
+				for {
+					max := atomic.LoadInt32(&maxRunning)
+					if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+						break
+					}
+				}
+				time.Sleep(5 * time.Millisecond)
+				atomic.AddInt32(&running, -1)
+				return nil
+			})
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), maxRunning)
+
+	// 不限制并发数
+	unlimited := newRPCLimiter(0, time.Millisecond, 10*time.Millisecond)
+	assert.Nil(t, unlimited.do("getblockhash", func() error { return nil }))
+}
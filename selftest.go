@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/shopspring/decimal"
+)
+
+// selfTestMinerKey/selfTestPayeeKey selftest 使用的固定私钥，每次运行的地址相同，区块和交易 (除时间外) 也相同
+var (
+	selfTestMinerKey = bytes.Repeat([]byte{0x01}, 32)
+	selfTestPayeeKey = bytes.Repeat([]byte{0x02}, 32)
+)
+
+// selfTestFee selftest 花费交易的手续费
+const selfTestFee = btcutil.Amount(100000)
+
+// selfTestScenario selftest 在 regtest 节点上产生的区块和交易: 高度 1 到 Height-1 的出块奖励支付给 Miner，
+// 高度 Height 的区块中 Spend 把高度 1 的 coinbase (SpentCoinbase:0) 扣除 selfTestFee 后支付给 Payee，该区块的出块奖励和手续费也支付给 Miner
+type selfTestScenario struct {
+	Miner         string
+	Payee         string
+	Height        int32
+	SpentCoinbase string
+	Spend         string
+}
+
+// prepareSelfTest 在高度为 0 的 regtest 节点上挖出 coinbase 成熟所需的 101 个区块，广播花费高度 1 的 coinbase 的交易，再挖一个区块打包它
+func (btcClient *bitcoinClientAlias) prepareSelfTest() (*selfTestScenario, error) {
+	count, err := btcClient.GetBlockCount()
+	if err != nil {
+		return nil, err
+	}
+	if count != 0 {
+		return nil, fmt.Errorf("selftest needs a fresh regtest node at height 0, node is at height %d", count)
+	}
+	minerKey, miner, err := selfTestAddress(selfTestMinerKey)
+	if err != nil {
+		return nil, err
+	}
+	_, payee, err := selfTestAddress(selfTestPayeeKey)
+	if err != nil {
+		return nil, err
+	}
+
+	maturity := int32(101)
+	if err := btcClient.generateToAddress(maturity, miner); err != nil {
+		return nil, err
+	}
+	block, err := btcClient.getBlock(1)
+	if err != nil {
+		return nil, err
+	}
+	coinbase := block.Tx[0]
+	coinbaseHash, err := chainhash.NewHashFromStr(coinbase.Txid)
+	if err != nil {
+		return nil, err
+	}
+	coinbaseValue, err := btcutil.NewAmount(coinbase.Vout[0].Value)
+	if err != nil {
+		return nil, err
+	}
+	minerScript, err := txscript.PayToAddrScript(miner)
+	if err != nil {
+		return nil, err
+	}
+	payeeScript, err := txscript.PayToAddrScript(payee)
+	if err != nil {
+		return nil, err
+	}
+
+	spend := wire.NewMsgTx(wire.TxVersion)
+	spend.AddTxIn(wire.NewTxIn(wire.NewOutPoint(coinbaseHash, 0), nil, nil))
+	spend.AddTxOut(wire.NewTxOut(int64(coinbaseValue-selfTestFee), payeeScript))
+	sigScript, err := txscript.SignatureScript(spend, 0, minerScript, txscript.SigHashAll, minerKey, true)
+	if err != nil {
+		return nil, err
+	}
+	spend.TxIn[0].SignatureScript = sigScript
+	if err := btcClient.sendRawTransaction(spend); err != nil {
+		return nil, err
+	}
+	if err := btcClient.generateToAddress(1, miner); err != nil {
+		return nil, err
+	}
+	return &selfTestScenario{
+		Miner:         miner.EncodeAddress(),
+		Payee:         payee.EncodeAddress(),
+		Height:        maturity + 1,
+		SpentCoinbase: coinbase.Txid,
+		Spend:         spend.TxHash().String(),
+	}, nil
+}
+
+// selfTestAddress 私钥及其压缩公钥的 P2PKH 地址
+func selfTestAddress(key []byte) (*btcec.PrivateKey, *btcutil.AddressPubKeyHash, error) {
+	privKey, pubKey := btcec.PrivKeyFromBytes(btcec.S256(), key)
+	address, err := btcutil.NewAddressPubKeyHash(btcutil.Hash160(pubKey.SerializeCompressed()), chain.Params)
+	return privKey, address, err
+}
+
+func (btcClient *bitcoinClientAlias) generateToAddress(blocks int32, address btcutil.Address) error {
+	blocksParam, err := json.Marshal(blocks)
+	if err != nil {
+		return err
+	}
+	addressParam, err := json.Marshal(address.EncodeAddress())
+	if err != nil {
+		return err
+	}
+	if _, err := btcClient.RawRequest("generatetoaddress", []json.RawMessage{blocksParam, addressParam}); err != nil {
+		return errors.New(strings.Join([]string{"generatetoaddress error:", err.Error()}, " "))
+	}
+	return nil
+}
+
+// sendRawTransaction 只传交易的 hex，不依赖 rpcclient 的第二个参数 (新版本 bitcoind 中是 maxfeerate 而不是 allowhighfees)
+func (btcClient *bitcoinClientAlias) sendRawTransaction(tx *wire.MsgTx) error {
+	var buf bytes.Buffer
+	if err := tx.Serialize(&buf); err != nil {
+		return err
+	}
+	hexParam, err := json.Marshal(hex.EncodeToString(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	if _, err := btcClient.RawRequest("sendrawtransaction", []json.RawMessage{hexParam}); err != nil {
+		return errors.New(strings.Join([]string{"sendrawtransaction error:", err.Error()}, " "))
+	}
+	return nil
+}
+
+// selfTestIndices es 中已有的同步 index (包括 monthly_tx_indices 的 tx-YYYY-MM)
+func (esClient *elasticClientAlias) selfTestIndices() ([]string, error) {
+	names, err := esClient.IndexNames()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, index := range syncIndices {
+		known[index] = true
+	}
+	var indices []string
+	for _, name := range names {
+		if known[name] || strings.HasPrefix(name, txIndexPrefix) {
+			indices = append(indices, name)
+		}
+	}
+	return indices, nil
+}
+
+// checkSelfTest 核对 selftest 同步后的文档，返回不符合预期的描述。Miner 的余额为所有出块奖励加上手续费、减去被花费的 coinbase
+func (esClient *elasticClientAlias) checkSelfTest(ctx context.Context, s *selfTestScenario) ([]string, error) {
+	var failures []string
+	expect := func(what string, got, want interface{}) {
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			failures = append(failures, fmt.Sprintf("%s: got %v, want %v", what, got, want))
+		}
+	}
+
+	height, _, err := esClient.LastSyncedHeight(ctx)
+	if err != nil {
+		return nil, err
+	}
+	expect("synced height", height, s.Height)
+
+	fee := decimal.New(int64(selfTestFee), -8)
+	spentValue := chain.subsidy(1)
+	minerBalance := fee.Sub(spentValue)
+	for h := int32(1); h <= s.Height; h++ {
+		minerBalance = minerBalance.Add(chain.subsidy(h))
+	}
+	balances, err := esClient.BulkQueryBalance(ctx, s.Miner, s.Payee)
+	if err != nil {
+		return nil, err
+	}
+	amounts := make(map[string]float64)
+	for _, balance := range balances {
+		amounts[balance.Balance.Address] = balance.Balance.Amount
+	}
+	expect("miner balance", amounts[s.Miner], btcFloat(minerBalance))
+	expect("payee balance", amounts[s.Payee], btcFloat(spentValue.Sub(fee)))
+
+	vouts, err := esClient.QueryVoutWithVinsOrVouts(ctx, []IndexUTXO{{s.SpentCoinbase, 0}, {s.Spend, 0}})
+	if err != nil {
+		return nil, err
+	}
+	byOutpoint := make(map[IndexUTXO]*VoutStream)
+	for _, vout := range vouts {
+		byOutpoint[IndexUTXO{vout.Vout.TxIDBelongTo, vout.Vout.Voutindex}] = vout.Vout
+	}
+	if vout, found := byOutpoint[IndexUTXO{s.SpentCoinbase, 0}]; !found {
+		failures = append(failures, "spent coinbase vout "+s.SpentCoinbase+":0 not indexed")
+	} else {
+		expect("spent coinbase value", vout.Value, btcFloat(spentValue))
+		expect("spent coinbase addresses", vout.Addresses, []string{s.Miner})
+		expect("spent coinbase spent by", vout.spentBy(), s.Spend)
+	}
+	if vout, found := byOutpoint[IndexUTXO{s.Spend, 0}]; !found {
+		failures = append(failures, "payee vout "+s.Spend+":0 not indexed")
+	} else {
+		expect("payee vout value", vout.Value, btcFloat(spentValue.Sub(fee)))
+		expect("payee vout addresses", vout.Addresses, []string{s.Payee})
+		expect("payee vout spent by", vout.spentBy(), "")
+	}
+
+	detail, err := esClient.GetTxWithResolvedInputs(ctx, s.Spend)
+	if errors.Is(err, ErrTxNotFound) {
+		return append(failures, "spend tx "+s.Spend+" not indexed"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	expect("spend tx fee", detail.Tx.Fee, btcFloat(fee))
+	expect("spend tx fee_incomplete", detail.Tx.FeeIncomplete, false)
+	expect("spend tx inputs", len(detail.Inputs), 1)
+	if len(detail.Inputs) == 1 {
+		expect("spend tx input", detail.Inputs[0].PrevTxid, s.SpentCoinbase)
+		expect("spend tx input value", detail.Inputs[0].Value, btcFloat(spentValue))
+	}
+	return failures, nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckSelfTest(t *testing.T) {
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	// 与 prepareSelfTest 相同的结构，只是成熟所需的区块数缩短为 1
+	client.syncTxVoutBalance(ctx, &btcjson.GetBlockVerboseResult{Hash: "block1", Height: 1, Tx: []btcjson.TxRawResult{
+		{Txid: "cb1", Vin: []btcjson.Vin{{Coinbase: "04ffff001d0101"}}, Vout: []btcjson.Vout{testVout(0, 50, "M")}},
+	}})
+	client.syncTxVoutBalance(ctx, &btcjson.GetBlockVerboseResult{Hash: "block2", Height: 2, Tx: []btcjson.TxRawResult{
+		{Txid: "cb2", Vin: []btcjson.Vin{{Coinbase: "04ffff001d0102"}}, Vout: []btcjson.Vout{testVout(0, 50.001, "M")}},
+		{Txid: "spend", Vin: []btcjson.Vin{{Txid: "cb1", Vout: 0}}, Vout: []btcjson.Vout{testVout(0, 49.999, "P")}},
+	}})
+	es.put("block", "1", map[string]interface{}{"hash": "block1", "height": 1})
+	es.put("block", "2", map[string]interface{}{"hash": "block2", "height": 2})
+
+	scenario := &selfTestScenario{Miner: "M", Payee: "P", Height: 2, SpentCoinbase: "cb1", Spend: "spend"}
+	failures, err := client.checkSelfTest(ctx, scenario)
+	assert.Nil(t, err)
+	assert.Empty(t, failures)
+
+	for id, doc := range es.all("balance") {
+		if doc["address"] == "P" {
+			doc["amount"] = 50
+			es.put("balance", id, doc)
+		}
+	}
+	failures, err = client.checkSelfTest(ctx, scenario)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"payee balance: got 50, want 49.999"}, failures)
+
+	scenario.Spend = "missing"
+	failures, err = client.checkSelfTest(ctx, scenario)
+	assert.Nil(t, err)
+	assert.Contains(t, failures, "spend tx missing not indexed")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/hex"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// 输入的签名算法，按 scriptSig 和 witness 的结构判断，不查询花费的 vout 的脚本类型
+const (
+	sigTypeECDSA   = "ecdsa"   // legacy 和 segwit v0 输入的 DER 编码签名
+	sigTypeSchnorr = "schnorr" // taproot 输入的 64 字节 (默认 sighash) 或 65 字节签名
+	sigTypeUnknown = "unknown" // 没有找到签名，如花费 anyone-can-spend 或 hash lock 脚本
+)
+
+// txSigTypes include_scripts 开启时 tx 文档的 sig_types，各签名算法的非 coinbase 输入数
+type txSigTypes struct {
+	ECDSA   int `json:"ecdsa"`
+	Schnorr int `json:"schnorr"`
+	Unknown int `json:"unknown"`
+}
+
+// txSigTypesFun 统计交易输入的签名算法，coinbase 交易的输入不计入
+func txSigTypesFun(tx btcjson.TxRawResult) *txSigTypes {
+	counts := new(txSigTypes)
+	if isCoinbaseTx(tx.Vin) {
+		return counts
+	}
+	for _, vin := range tx.Vin {
+		switch vinSigType(vin) {
+		case sigTypeECDSA:
+			counts.ECDSA++
+		case sigTypeSchnorr:
+			counts.Schnorr++
+		default:
+			counts.Unknown++
+		}
+	}
+	return counts
+}
+
+// vinSigType 输入的签名算法。taproot key path 的 witness 只有一个 64/65 字节的签名，script path 的最后一项为 control block，
+// 其中 64/65 字节的项按 schnorr 签名计算；其余输入在 witness 或 scriptSig 的 push data 中查找 DER 编码的 ecdsa 签名。
+// 按结构判断，一个 64 字节的 P2WSH witness script 等少见的情况会误判
+func vinSigType(vin btcjson.Vin) string {
+	witness := decodeWitness(vin.Witness)
+	// BIP341: 至少两项且最后一项以 0x50 开头时为 annex，不参与判断
+	if len(witness) >= 2 && len(witness[len(witness)-1]) > 0 && witness[len(witness)-1][0] == 0x50 {
+		witness = witness[:len(witness)-1]
+	}
+	if len(witness) == 1 && isSchnorrSig(witness[0]) {
+		return sigTypeSchnorr
+	}
+	if len(witness) >= 2 && isControlBlock(witness[len(witness)-1]) {
+		for _, item := range witness[:len(witness)-2] {
+			if isSchnorrSig(item) {
+				return sigTypeSchnorr
+			}
+		}
+		return sigTypeUnknown
+	}
+	for _, item := range witness {
+		if isDERSig(item) {
+			return sigTypeECDSA
+		}
+	}
+
+	if vin.ScriptSig != nil && vin.ScriptSig.Hex != "" {
+		script, err := hex.DecodeString(vin.ScriptSig.Hex)
+		if err != nil {
+			return sigTypeUnknown
+		}
+		pushes, err := txscript.PushedData(script)
+		if err != nil {
+			return sigTypeUnknown
+		}
+		for _, push := range pushes {
+			if isDERSig(push) {
+				return sigTypeECDSA
+			}
+		}
+	}
+	return sigTypeUnknown
+}
+
+func decodeWitness(witness []string) [][]byte {
+	var items [][]byte
+	for _, item := range witness {
+		b, err := hex.DecodeString(item)
+		if err != nil {
+			return nil
+		}
+		items = append(items, b)
+	}
+	return items
+}
+
+// isDERSig 带 sighash 字节的 DER 编码签名: 0x30 <长度> 0x02 <r> 0x02 <s> <sighash>，最长 73 字节
+func isDERSig(b []byte) bool {
+	return len(b) >= 9 && len(b) <= 73 && b[0] == 0x30 && int(b[1]) == len(b)-3 && b[2] == 0x02
+}
+
+func isSchnorrSig(b []byte) bool {
+	return len(b) == 64 || len(b) == 65
+}
+
+// isControlBlock BIP341 control block: 一个字节的 leaf version 和公钥奇偶位，32 字节的 internal key，以及 0 到 128 个 32 字节的 merkle 路径
+func isControlBlock(b []byte) bool {
+	return len(b) >= 33 && len(b) <= 33+32*128 && (len(b)-33)%32 == 0 && b[0]&0xfe == 0xc0
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDERSig 71 字节的 DER 编码签名 (32 字节的 r 和 s) 加 SIGHASH_ALL
+var testDERSig = "3044" + "0220" + strings.Repeat("11", 32) + "0220" + strings.Repeat("22", 32) + "01"
+
+var testPubKey = "02" + strings.Repeat("33", 32)
+
+func TestVinSigType(t *testing.T) {
+	// P2WPKH: witness 为签名和公钥
+	p2wpkh := btcjson.Vin{Txid: "prev", ScriptSig: &btcjson.ScriptSig{}, Witness: []string{testDERSig, testPubKey}}
+	assert.Equal(t, sigTypeECDSA, vinSigType(p2wpkh))
+
+	// P2TR key path: witness 只有一个 64 字节的签名 (SIGHASH_DEFAULT)，65 字节带 sighash 字节，可以带 annex
+	schnorrSig := strings.Repeat("ab", 64)
+	assert.Equal(t, sigTypeSchnorr, vinSigType(btcjson.Vin{Txid: "prev", Witness: []string{schnorrSig}}))
+	assert.Equal(t, sigTypeSchnorr, vinSigType(btcjson.Vin{Txid: "prev", Witness: []string{schnorrSig + "83"}}))
+	assert.Equal(t, sigTypeSchnorr, vinSigType(btcjson.Vin{Txid: "prev", Witness: []string{schnorrSig, "50aa"}}))
+
+	// P2TR script path: 签名、tapscript、control block
+	controlBlock := "c0" + strings.Repeat("44", 32)
+	tapscript := "20" + strings.Repeat("55", 32) + "ac"
+	assert.Equal(t, sigTypeSchnorr, vinSigType(btcjson.Vin{Txid: "prev", Witness: []string{schnorrSig, tapscript, controlBlock}}))
+	// 没有签名的 tapscript (如 hash lock)
+	assert.Equal(t, sigTypeUnknown, vinSigType(btcjson.Vin{Txid: "prev", Witness: []string{"01", "51", controlBlock}}))
+
+	// P2PKH: scriptSig push 签名和公钥
+	p2pkh := btcjson.Vin{Txid: "prev", ScriptSig: &btcjson.ScriptSig{Hex: "47" + testDERSig + "21" + testPubKey}}
+	assert.Equal(t, sigTypeECDSA, vinSigType(p2pkh))
+
+	// P2SH 包装的 P2WPKH: scriptSig 只 push redeem script，签名在 witness 中
+	p2shP2wpkh := btcjson.Vin{Txid: "prev", ScriptSig: &btcjson.ScriptSig{Hex: "160014" + strings.Repeat("66", 20)},
+		Witness: []string{testDERSig, testPubKey}}
+	assert.Equal(t, sigTypeECDSA, vinSigType(p2shP2wpkh))
+
+	// anyone-can-spend: 没有签名
+	assert.Equal(t, sigTypeUnknown, vinSigType(btcjson.Vin{Txid: "prev", ScriptSig: &btcjson.ScriptSig{Hex: "51"}}))
+}
+
+func TestTxSigTypes(t *testing.T) {
+	tx := btcjson.TxRawResult{Vin: []btcjson.Vin{
+		{Txid: "prev", Vout: 0, Witness: []string{testDERSig, testPubKey}},
+		{Txid: "prev", Vout: 1, Witness: []string{strings.Repeat("ab", 64)}},
+		{Txid: "prev", Vout: 2, Witness: []string{strings.Repeat("cd", 64)}},
+	}}
+	assert.Equal(t, &txSigTypes{ECDSA: 1, Schnorr: 2}, txSigTypesFun(tx))
+
+	// coinbase 输入不计入
+	coinbase := btcjson.TxRawResult{Vin: []btcjson.Vin{{Coinbase: "04ffff001d0104"}}}
+	assert.Equal(t, &txSigTypes{}, txSigTypesFun(coinbase))
+
+	config.IncludeScripts = true
+	defer func() { config.IncludeScripts = false }()
+	doc := esTxFun(tx, &btcjson.GetBlockVerboseResult{Hash: "block"}, 0, false, nil, nil)
+	assert.Equal(t, &txSigTypes{ECDSA: 1, Schnorr: 2}, doc.SigTypes)
+}
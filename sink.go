@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/shopspring/decimal"
+)
+
+// Sink 区块同步结果的写入目标。BTCSyncTx 只通过 Sink 读写数据，区块解析、手续费和余额变化的计算与存储无关，
+// 实现该接口 (如写入 Postgres) 即可复用同步逻辑。stdoutSink 把写入操作输出为 json lines，用于调试。
+// es 只由 sync 命令的 syncTxVoutBalance 和 RollbackTxVoutBalanceByBlock 写入，没有 Sink 实现，避免两份 es 写入逻辑各自变化
+type Sink interface {
+	// SpentVouts 查询 vin 花费的 vout，找不到的 outpoint 不返回
+	SpentVouts(ctx context.Context, outpoints []IndexUTXO) ([]VoutWithID, error)
+	// IndexVout 写入交易创建的 vout
+	IndexVout(ctx context.Context, vout *VoutStream) error
+	// SpendVout 标记 vout 被花费，vout.ID 为空表示 vout 从节点补全，不在 Sink 中
+	SpendVout(ctx context.Context, vout VoutWithID, used voutUsed) error
+	// UpsertBalance 地址余额增加 delta (可以为负)，地址没有余额时新建
+	UpsertBalance(ctx context.Context, address string, delta decimal.Decimal) error
+	IndexTx(ctx context.Context, tx *esTx) error
+	IndexBlock(ctx context.Context, height int32, block map[string]interface{}) error
+	// DeleteByBlock 删除区块写入的数据并回滚涉及地址的余额，重新同步区块前调用
+	DeleteByBlock(ctx context.Context, block *btcjson.GetBlockVerboseResult) error
+	// Flush 区块的所有写入完成后调用，之后的 SpentVouts 必须能查到这个区块写入的 vout
+	Flush(ctx context.Context) error
+}
+
+// BTCSyncTx 解析区块中的交易，通过 sink 写入 vout、tx 文档，标记花费的 vout 并更新地址余额，不写入区块文档。
+// 与 syncTxVoutBalance 相同，vin 花费的 vout 先在区块中前面的交易里查找，再查询 sink，开启 rpc_prevout_fallback 时从节点补全；
+// 余额按地址汇总区块内的净变化后每个地址更新一次。watch 模式、vin 文档、address 文档和余额流水只在 sync 命令的 es 同步中支持
+func BTCSyncTx(ctx context.Context, sink Sink, block *btcjson.GetBlockVerboseResult) (*blockStats, error) {
+	stats := &blockStats{TxCount: len(block.Tx), CoinbaseHeight: checkCoinbaseHeight(block)}
+	genesis := block.Height == 0
+
+	// 区块中创建的 vout 在区块结束时才写入，被后面的交易花费时直接设置 used
+	var created []*VoutStream
+	createdByOutpoint := make(map[IndexUTXO]*VoutStream)
+	deltas := make(map[string]decimal.Decimal)
+	// has_in_block_child 取决于后面的交易，先由整个区块得到区块内的花费关系
+	relations := newInBlockRelations(block)
+
+	for _, tx := range block.Tx {
+		stats.addTxSizes(tx)
+		var (
+			voutAmount       decimal.Decimal
+			vinAmount        decimal.Decimal
+			txTypeVinsField  []AddressWithValueInTx
+			txTypeVoutsField []AddressWithValueInTx
+		)
+
+		var outpoints []IndexUTXO
+		var voutWithIDs []VoutWithID
+		for _, vin := range tx.Vin {
+			if len(vin.Txid) == 0 {
+				continue
+			}
+			outpoint := IndexUTXO{vin.Txid, vin.Vout}
+			if vout, ok := createdByOutpoint[outpoint]; ok {
+				voutWithIDs = append(voutWithIDs, VoutWithID{Vout: vout})
+				continue
+			}
+			outpoints = append(outpoints, outpoint)
+		}
+		if len(outpoints) > 0 {
+			spent, err := sink.SpentVouts(ctx, outpoints)
+			if err != nil {
+				return nil, err
+			}
+			voutWithIDs = append(voutWithIDs, spent...)
+		}
+		if prevouts != nil {
+			voutWithIDs = append(voutWithIDs, fetchMissingPrevouts(tx.Vin, voutWithIDs, nil)...)
+		}
+		stats.VinsSpent += len(voutWithIDs)
+
+		for _, voutWithID := range voutWithIDs {
+			vinAmount = vinAmount.Add(decimal.NewFromFloat(voutWithID.Vout.Value))
+			txTypeVinsFieldTmp, _, vinBalances, _ := parseESVout(voutWithID, tx.Txid)
+			txTypeVinsField = append(txTypeVinsField, txTypeVinsFieldTmp...)
+			// 与 syncTxVoutBalance 相同：重新同步同一区块时 vout 已经被这笔交易花费，余额已经减过；
+			// 被其他交易花费说明数据不一致，覆盖 used 但同样不再减余额
+			spentBy := voutWithID.Vout.spentBy()
+			alreadySpent := spentBy != ""
+			if alreadySpent && spentBy != tx.Txid {
+				sugar.Warn("vout ", voutWithID.Vout.TxIDBelongTo, ":", voutWithID.Vout.Voutindex, " already spent by ", spentBy, ", now spent by ", tx.Txid)
+			}
+
+			used := newVoutUsed(tx.Txid, voutWithID.Vout, block)
+			if _, ok := createdByOutpoint[IndexUTXO{voutWithID.Vout.TxIDBelongTo, voutWithID.Vout.Voutindex}]; ok {
+				voutWithID.Vout.Used = used
+			} else if err := sink.SpendVout(ctx, voutWithID, used); err != nil {
+				return nil, err
+			}
+			if alreadySpent || voutWithID.Vout.Unspendable {
+				continue
+			}
+			for _, balance := range vinBalances {
+				deltas[balance.Address] = deltas[balance.Address].Sub(decimal.NewFromFloat(balance.Amount))
+			}
+		}
+
+		for _, vout := range tx.Vout {
+			stats.TotalOutputValue = stats.TotalOutputValue.Add(decimal.NewFromFloat(vout.Value))
+			voutAmount = voutAmount.Add(decimal.NewFromFloat(vout.Value))
+
+			newVout := newVoutFun(vout, tx.Vin, tx.Txid)
+			newVout.Unspendable = newVout.Unspendable || genesis
+			newVout.Time = txTimeFun(tx, block.Time)
+			newVout.Height = int32(block.Height)
+			created = append(created, newVout)
+			createdByOutpoint[IndexUTXO{tx.Txid, vout.N}] = newVout
+			stats.VoutsCreated++
+
+			txTypeVoutsFieldTmp, _, voutBalances, _ := parseTxVout(vout, tx.Txid)
+			txTypeVoutsField = append(txTypeVoutsField, txTypeVoutsFieldTmp...)
+			if newVout.Unspendable {
+				continue
+			}
+			for _, balance := range voutBalances {
+				deltas[balance.Address] = deltas[balance.Address].Add(decimal.NewFromFloat(balance.Amount))
+			}
+		}
+
+		missingOutpoints := missingVinOutpoints(tx.Vin, voutWithIDs)
+		feeIncomplete := len(missingOutpoints) > 0
+		txTypeVinsField = append(txTypeVinsField, unresolvedVins(missingOutpoints)...)
+		if feeIncomplete {
+			sugar.Error("tx ", tx.Txid, " resolved ", len(tx.Vin)-len(missingOutpoints), " of ", len(tx.Vin),
+				" vins, missing outpoints: ", strings.Join(outpointStrings(missingOutpoints), ","))
+		}
+		fee := txFee(tx, vinAmount, voutAmount, feeIncomplete)
+		stats.TotalFees = stats.TotalFees.Add(fee)
+
+		txDoc := esTxFun(tx, block, btcFloat(fee), feeIncomplete, txTypeVinsField, txTypeVoutsField)
+		relations.setFlags(txDoc)
+		if err := sink.IndexTx(ctx, txDoc); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, vout := range created {
+		if err := sink.IndexVout(ctx, vout); err != nil {
+			return nil, err
+		}
+	}
+
+	addresses := make([]string, 0, len(deltas))
+	for address := range deltas {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		if deltas[address].IsZero() {
+			continue
+		}
+		if err := sink.UpsertBalance(ctx, address, deltas[address]); err != nil {
+			return nil, err
+		}
+	}
+	stats.BalancesTouched = len(addresses)
+	return stats, nil
+}
+
+// SyncToSink 通过 sink 同步 [from, to] 的区块，每个区块写入后 Flush。区块已经同步过时先调用 DeleteByBlock，
+// 不检查 sink 中已同步的高度，调用方需要保证区块按高度顺序且不跳过
+func (btcClient *bitcoinClientAlias) SyncToSink(ctx context.Context, sink Sink, from, to int32, resync bool) error {
+	for height := from; height <= to; height++ {
+		started := time.Now()
+		block, err := btcClient.getBlock(height)
+		if err != nil {
+			return err
+		}
+		header, err := btcClient.getBlockHeader(block.Hash)
+		if err != nil {
+			return err
+		}
+		if resync {
+			if err := sink.DeleteByBlock(ctx, block); err != nil {
+				return err
+			}
+		}
+		stats, err := BTCSyncTx(ctx, sink, block)
+		if err != nil {
+			return err
+		}
+		if err := sink.IndexBlock(ctx, height, blockWithTxDetail(block, header, stats)); err != nil {
+			return err
+		}
+		if err := sink.Flush(ctx); err != nil {
+			return err
+		}
+		logBlockSynced("Sink block", block, stats, time.Since(started))
+	}
+	return nil
+}
+
+// sinkRecord stdoutSink 输出的一行
+type sinkRecord struct {
+	Op      string      `json:"op"`
+	Height  int32       `json:"height,omitempty"`
+	Address string      `json:"address,omitempty"`
+	Delta   float64     `json:"delta,omitempty"`
+	Amount  float64     `json:"amount,omitempty"`
+	Doc     interface{} `json:"doc,omitempty"`
+}
+
+// stdoutSink 把写入操作输出为 json lines 的 Sink，用于调试解析和余额逻辑。
+// 写入的 vout 和余额保存在内存中，vin 只能花费本次运行写入的 vout，从中间高度开始时需要开启 rpc_prevout_fallback
+type stdoutSink struct {
+	w        *bufio.Writer
+	enc      *json.Encoder
+	vouts    map[IndexUTXO]*VoutStream
+	balances map[string]decimal.Decimal
+}
+
+func newStdoutSink(w io.Writer) *stdoutSink {
+	bw := bufio.NewWriter(w)
+	return &stdoutSink{w: bw, enc: json.NewEncoder(bw), vouts: make(map[IndexUTXO]*VoutStream), balances: make(map[string]decimal.Decimal)}
+}
+
+func (s *stdoutSink) SpentVouts(ctx context.Context, outpoints []IndexUTXO) ([]VoutWithID, error) {
+	var voutWithIDs []VoutWithID
+	for _, outpoint := range outpoints {
+		if vout, ok := s.vouts[outpoint]; ok {
+			voutWithIDs = append(voutWithIDs, VoutWithID{ID: outpointStrings([]IndexUTXO{outpoint})[0], Vout: vout})
+		}
+	}
+	return voutWithIDs, nil
+}
+
+func (s *stdoutSink) IndexVout(ctx context.Context, vout *VoutStream) error {
+	s.vouts[IndexUTXO{vout.TxIDBelongTo, vout.Voutindex}] = vout
+	return s.enc.Encode(sinkRecord{Op: "vout", Doc: vout})
+}
+
+func (s *stdoutSink) SpendVout(ctx context.Context, vout VoutWithID, used voutUsed) error {
+	vout.Vout.Used = used
+	return s.enc.Encode(sinkRecord{Op: "spend", Doc: vout.Vout})
+}
+
+func (s *stdoutSink) UpsertBalance(ctx context.Context, address string, delta decimal.Decimal) error {
+	s.balances[address] = s.balances[address].Add(delta)
+	return s.enc.Encode(sinkRecord{Op: "balance", Address: address, Delta: btcFloat(delta), Amount: btcFloat(s.balances[address])})
+}
+
+func (s *stdoutSink) IndexTx(ctx context.Context, tx *esTx) error {
+	return s.enc.Encode(sinkRecord{Op: "tx", Doc: tx})
+}
+
+func (s *stdoutSink) IndexBlock(ctx context.Context, height int32, block map[string]interface{}) error {
+	return s.enc.Encode(sinkRecord{Op: "block", Height: height, Doc: block})
+}
+
+// DeleteByBlock 只删除内存中区块创建的 vout，被区块花费的 vout 和余额不回滚
+func (s *stdoutSink) DeleteByBlock(ctx context.Context, block *btcjson.GetBlockVerboseResult) error {
+	for _, tx := range block.Tx {
+		for _, outpoint := range indexedVoutsFun(tx.Vout, tx.Txid) {
+			delete(s.vouts, outpoint)
+		}
+	}
+	return s.enc.Encode(sinkRecord{Op: "delete_block", Height: int32(block.Height), Doc: block.Hash})
+}
+
+func (s *stdoutSink) Flush(ctx context.Context) error {
+	return s.w.Flush()
+}
+
+// newSink 按 sync-sink 命令的 --sink 参数创建 Sink
+func newSink(name string, w io.Writer) (Sink, error) {
+	switch name {
+	case "stdout":
+		return newStdoutSink(w), nil
+	default:
+		return nil, errors.New(strings.Join([]string{"unknown sink", strconv.Quote(name), ", use stdout"}, " "))
+	}
+}
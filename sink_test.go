@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// BTCSyncTx 与 syncTxVoutBalance 对同一区块得到相同的手续费、统计和余额变化
+func TestBTCSyncTxMatchesSyncTxVoutBalance(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+	before := balancesByAddress(es)
+	esStats := client.syncTxVoutBalance(ctx, testSyncBlock())
+	esDeltas := make(map[string]float64)
+	for address, amount := range balancesByAddress(es) {
+		esDeltas[address] = btcFloat(decimal.NewFromFloat(amount).Sub(decimal.NewFromFloat(before[address])))
+	}
+
+	var out bytes.Buffer
+	sink := newStdoutSink(&out)
+	sink.vouts[IndexUTXO{"tx1", 0}] = &VoutStream{TxIDBelongTo: "tx1", Voutindex: 0, Value: 10, Addresses: []string{"B"}}
+	stats, err := BTCSyncTx(ctx, sink, testSyncBlock())
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Flush(ctx))
+
+	deltas := make(map[string]float64)
+	for address, delta := range sink.balances {
+		deltas[address] = btcFloat(delta)
+	}
+	assert.Equal(t, esDeltas, deltas)
+	assert.Equal(t, btcFloat(esStats.TotalFees), btcFloat(stats.TotalFees))
+	assert.Equal(t, btcFloat(esStats.TotalOutputValue), btcFloat(stats.TotalOutputValue))
+	assert.Equal(t, esStats.VoutsCreated, stats.VoutsCreated)
+	assert.Equal(t, esStats.VinsSpent, stats.VinsSpent)
+	assert.Equal(t, esStats.BalancesTouched, stats.BalancesTouched)
+}
+
+func TestBTCSyncTxStdoutSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := newStdoutSink(&out)
+	ctx := context.Background()
+
+	block1 := &btcjson.GetBlockVerboseResult{Hash: "block1", Height: 1, Tx: []btcjson.TxRawResult{
+		{Txid: "tx1", Vin: []btcjson.Vin{{Coinbase: "04ffff001d0101"}}, Vout: []btcjson.Vout{testVout(0, 10, "B")}},
+	}}
+	_, err := BTCSyncTx(ctx, sink, block1)
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Flush(ctx))
+
+	// 区块内花费前面交易创建的 vout
+	block2 := testSyncBlock()
+	block2.Tx = append(block2.Tx, btcjson.TxRawResult{
+		Txid: "tx3",
+		Vin:  []btcjson.Vin{{Txid: "tx2", Vout: 0}},
+		Vout: []btcjson.Vout{testVout(0, 3.9, "D")},
+	})
+	out.Reset()
+	stats, err := BTCSyncTx(ctx, sink, block2)
+	assert.Nil(t, err)
+	assert.Nil(t, sink.Flush(ctx))
+	assert.Equal(t, 0.2, btcFloat(stats.TotalFees))
+
+	ops := make(map[string]int)
+	balances := make(map[string]float64)
+	spentBy := make(map[string]string)
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		record := new(sinkRecord)
+		assert.Nil(t, json.Unmarshal(scanner.Bytes(), record))
+		ops[record.Op]++
+		switch record.Op {
+		case "balance":
+			balances[record.Address] = record.Amount
+		case "vout":
+			doc := record.Doc.(map[string]interface{})
+			if used, ok := doc["used"].(map[string]interface{}); ok {
+				spentBy[doc["txidbelongto"].(string)] = used["txid"].(string)
+			}
+		}
+	}
+	assert.Equal(t, map[string]int{"spend": 1, "tx": 3, "vout": 4, "balance": 3}, ops)
+	// C 收到 4 又在同一区块花费，余额没有变化
+	assert.Equal(t, map[string]float64{"A": 50, "B": 5.9, "D": 3.9}, balances)
+	assert.Equal(t, map[string]string{"tx2": "tx3"}, spentBy)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/olivere/elastic"
+	"github.com/shopspring/decimal"
+)
+
+// snapshotBatchSize 对比快照时每次从 es 查询的地址数
+const snapshotBatchSize = 500
+
+// balanceMismatch 快照与 es 中不一致的地址余额，InIndex/InSnapshot 为 false 表示地址只出现在另一边
+type balanceMismatch struct {
+	Address    string
+	InIndex    bool
+	InSnapshot bool
+	Indexed    float64
+	Snapshot   float64
+}
+
+// balanceComparison CompareBalancesAgainstFile 的统计，Compared 为快照中的地址数
+type balanceComparison struct {
+	Compared   int
+	Mismatched int
+}
+
+// CompareBalancesAgainstFile 对比 es 中的余额与外部快照 (如其他索引服务导出的余额)，用于验收一次完整的同步
+// 快照为 csv 格式，每行 address,amount，第一列为 address 的行视为表头。文件按行流式读取，每 snapshotBatchSize 个地址查询一次 es，
+// 之后遍历 balance index 找出快照中没有的地址，只需要在内存中保存快照的地址。
+// 差值超过 tolerance 的地址通过 report 逐个返回，只出现在一边的地址余额不超过 tolerance 时视为一致 (快照通常不包含余额为 0 的地址)
+func (esClient *elasticClientAlias) CompareBalancesAgainstFile(ctx context.Context, path string, tolerance float64, report func(*balanceMismatch)) (*balanceComparison, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		comparison = new(balanceComparison)
+		seen       = make(map[string]bool)
+		batch      = make(map[string]float64)
+	)
+	mismatch := func(m *balanceMismatch) {
+		comparison.Mismatched++
+		report(m)
+	}
+	compareBatch := func() error {
+		var addresses []interface{}
+		for address := range batch {
+			addresses = append(addresses, address)
+		}
+		balancesWithIDs, err := esClient.BulkQueryBalance(ctx, addresses...)
+		if err != nil {
+			return err
+		}
+		for address, amount := range batch {
+			balanceWithID, found := findBalanceByAddress(balancesWithIDs, address)
+			switch {
+			case found && exceedsTolerance(balanceWithID.Balance.Amount, amount, tolerance):
+				mismatch(&balanceMismatch{address, true, true, balanceWithID.Balance.Amount, amount})
+			case !found && exceedsTolerance(0, amount, tolerance):
+				mismatch(&balanceMismatch{address, false, true, 0, amount})
+			}
+		}
+		batch = make(map[string]float64)
+		return nil
+	}
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.TrimLeadingSpace = true
+	r.ReuseRecord = true
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.New(strings.Join([]string{"parse balance snapshot", path, "error:", err.Error()}, " "))
+		}
+		if len(record) < 2 || record[0] == "address" {
+			continue
+		}
+		address := strings.TrimSpace(record[0])
+		amount, err := strconv.ParseFloat(strings.TrimSpace(record[1]), 64)
+		if err != nil {
+			return nil, errors.New(strings.Join([]string{"parse balance snapshot amount of", address, "error:", err.Error()}, " "))
+		}
+		if seen[address] {
+			return nil, errors.New(strings.Join([]string{"duplicate address in balance snapshot:", address}, " "))
+		}
+		seen[address] = true
+		batch[address] = amount
+		comparison.Compared++
+		if len(batch) >= snapshotBatchSize {
+			if err := compareBatch(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(batch) > 0 {
+		if err := compareBatch(); err != nil {
+			return nil, err
+		}
+	}
+
+	err = esClient.scanBalances(ctx, snapshotBatchSize, func(balance *BalanceWithID) {
+		if !seen[balance.Balance.Address] && exceedsTolerance(balance.Balance.Amount, 0, tolerance) {
+			mismatch(&balanceMismatch{balance.Balance.Address, true, false, balance.Balance.Amount, 0})
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return comparison, nil
+}
+
+// ExportBalancesAtHeight 把 balance index 中的余额以 address,amount 的 csv 格式 (与 CompareBalancesAgainstFile 的快照格式相同) 写入 w，返回写入的地址数
+// balance 文档只保存当前余额，没有历史余额，所以 es 必须正好同步到 height：同步高度不等于 height 时返回错误。
+// 导出期间同步继续写入会让快照混入之后区块的余额，需要先停止同步，导出结束后再次检查同步高度。
+// 每页写出后调用 checkpoint 保存断点 (为 nil 时不保存)，resume 不为 nil 时从断点的地址之后继续，不再写入表头
+func (esClient *elasticClientAlias) ExportBalancesAtHeight(ctx context.Context, height int32, w io.Writer,
+	resume *exportCheckpoint, checkpoint func(*exportCheckpoint) error) (int, error) {
+	if err := esClient.checkSyncedHeight(ctx, height); err != nil {
+		return 0, err
+	}
+
+	cw := csv.NewWriter(w)
+	cp, after := new(exportCheckpoint), ""
+	if resume != nil {
+		cp = resume
+		if len(cp.After) > 0 {
+			after, _ = cp.After[0].(string)
+		}
+	} else if err := cw.Write([]string{"address", "amount"}); err != nil {
+		return 0, err
+	}
+	var writeErr error
+	err := esClient.scanBalancesAfter(ctx, snapshotBatchSize, after, func(balance *BalanceWithID) {
+		if writeErr != nil {
+			return
+		}
+		writeErr = cw.Write([]string{balance.Balance.Address, strconv.FormatFloat(balance.Balance.Amount, 'f', -1, 64)})
+		cp.Exported++
+	}, func(after string) error {
+		if writeErr != nil {
+			return writeErr
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+		if checkpoint == nil {
+			return nil
+		}
+		cp.After = []interface{}{after}
+		return checkpoint(cp)
+	})
+	if err != nil {
+		return cp.Exported, err
+	}
+
+	if err := esClient.checkSyncedHeight(ctx, height); err != nil {
+		return cp.Exported, errors.New(strings.Join([]string{"sync moved during export:", err.Error()}, " "))
+	}
+	return cp.Exported, nil
+}
+
+// checkSyncedHeight es 中已同步的最大区块高度必须等于 height
+func (esClient *elasticClientAlias) checkSyncedHeight(ctx context.Context, height int32) error {
+	syncedHeight, found, err := esClient.LastSyncedHeight(ctx)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errors.New("block index is empty, no balances to export")
+	}
+	if syncedHeight != height {
+		return errors.New(strings.Join([]string{"balances are only available at the synced height",
+			strconv.FormatInt(int64(syncedHeight), 10), "not at", strconv.FormatInt(int64(height), 10)}, " "))
+	}
+	return nil
+}
+
+// exceedsTolerance 按 decimal 计算差值，避免浮点误差把相等的余额报告为不一致
+func exceedsTolerance(a, b, tolerance float64) bool {
+	return decimal.NewFromFloat(a).Sub(decimal.NewFromFloat(b)).Abs().GreaterThan(decimal.NewFromFloat(tolerance))
+}
+
+// scanBalances 按地址顺序遍历 balance index 的所有文档，用 search_after 翻页，不受 from+size 最大 10000 的限制
+func (esClient *elasticClientAlias) scanBalances(ctx context.Context, batchSize int, fn func(*BalanceWithID)) error {
+	return esClient.scanBalancesAfter(ctx, batchSize, "", fn, func(string) error { return nil })
+}
+
+// scanBalancesAfter 与 scanBalances 相同，从地址 after 之后开始 (为空时从头开始)，每页处理完后以最后一个地址调用 pageDone
+func (esClient *elasticClientAlias) scanBalancesAfter(ctx context.Context, batchSize int, after string, fn func(*BalanceWithID), pageDone func(after string) error) error {
+	for {
+		search := esClient.Search().Index("balance").Type("balance").Query(elastic.NewMatchAllQuery()).
+			Sort("address", true).Size(batchSize)
+		if after != "" {
+			search = search.SearchAfter(after)
+		}
+		searchResult, err := search.Do(ctx)
+		if err != nil {
+			return errors.New(strings.Join([]string{"Scan balances error:", err.Error()}, " "))
+		}
+		if searchResult.Shards != nil && searchResult.Shards.Failed > 0 {
+			return errors.New(strings.Join([]string{"Scan balances error:", strconv.Itoa(searchResult.Shards.Failed), "shards failed"}, " "))
+		}
+		for _, hit := range searchResult.Hits.Hits {
+			b := new(Balance)
+			if err := json.Unmarshal(*hit.Source, b); err != nil {
+				return errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+			}
+			fn(&BalanceWithID{hit.Id, *b})
+			after = b.Address
+		}
+		if err := pageDone(after); err != nil {
+			return err
+		}
+		if len(searchResult.Hits.Hits) < batchSize {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareBalancesAgainstFile(t *testing.T) {
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	es.put("balance", "A", map[string]interface{}{"address": "A", "amount": 50})
+	es.put("balance", "B", map[string]interface{}{"address": "B", "amount": 5.9})
+	es.put("balance", "C", map[string]interface{}{"address": "C", "amount": 4})
+	es.put("balance", "D", map[string]interface{}{"address": "D", "amount": 0})
+	es.put("balance", "E", map[string]interface{}{"address": "E", "amount": 1})
+
+	f, err := ioutil.TempFile("", "snapshot")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	// A 一致，B 在容差内，C 不一致，F 只在快照中，E 只在 es 中，D 余额为 0 不在快照中
+	assert.Nil(t, ioutil.WriteFile(f.Name(), []byte("address,amount\nA,50\nB,5.90000001\nC,3.5\nF,2\n"), 0644))
+
+	var mismatches []*balanceMismatch
+	comparison, err := client.CompareBalancesAgainstFile(context.Background(), f.Name(), 0.00000001, func(m *balanceMismatch) {
+		mismatches = append(mismatches, m)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, &balanceComparison{Compared: 4, Mismatched: 3}, comparison)
+	sort.Slice(mismatches, func(i, j int) bool { return mismatches[i].Address < mismatches[j].Address })
+	assert.Equal(t, []*balanceMismatch{
+		{Address: "C", InIndex: true, InSnapshot: true, Indexed: 4, Snapshot: 3.5},
+		{Address: "E", InIndex: true, InSnapshot: false, Indexed: 1},
+		{Address: "F", InIndex: false, InSnapshot: true, Snapshot: 2},
+	}, mismatches)
+}
+
+func TestScanBalances(t *testing.T) {
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	for _, address := range []string{"C", "A", "E", "B", "D"} {
+		es.put("balance", "id-"+address, map[string]interface{}{"address": address, "amount": 1})
+	}
+
+	// 每页 2 个地址，最后一页不满时结束
+	var addresses []string
+	assert.Nil(t, client.scanBalances(context.Background(), 2, func(balance *BalanceWithID) {
+		addresses = append(addresses, balance.Balance.Address)
+	}))
+	assert.Equal(t, []string{"A", "B", "C", "D", "E"}, addresses)
+}
+
+func TestExportBalancesAtHeight(t *testing.T) {
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+	es.put("block", "2", map[string]interface{}{"height": 2, "hash": "block2"})
+	es.put("balance", "balance-b", map[string]interface{}{"address": "B", "amount": 5.9})
+	es.put("balance", "balance-a", map[string]interface{}{"address": "A", "amount": 50})
+
+	var buf bytes.Buffer
+	exported, err := client.ExportBalancesAtHeight(ctx, 2, &buf, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, exported)
+	assert.Equal(t, "address,amount\nA,50\nB,5.9\n", buf.String())
+
+	// 只有当前余额，不能导出其他高度的余额
+	_, err = client.ExportBalancesAtHeight(ctx, 1, &bytes.Buffer{}, nil, nil)
+	assert.NotNil(t, err)
+}
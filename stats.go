@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/olivere/elastic"
+	"github.com/shopspring/decimal"
+)
+
+// indexStats stats 命令输出的 index 概况，block index 为空时 MinHeight、MaxHeight 为 nil
+type indexStats struct {
+	Blocks       int64
+	MinHeight    *float64
+	MaxHeight    *float64
+	Txs          int64
+	Vouts        int64
+	UnspentVouts int64
+	Balances     int64
+	// Supply 未花费且不是 unspendable 的 vout 之和
+	Supply float64
+}
+
+// IndexStats 统计各 index 的文档数、已同步的高度范围以及 UTXO 总额，同步后用于检查数据是否完整
+func (esClient *elasticClientAlias) IndexStats(ctx context.Context) (*indexStats, error) {
+	var (
+		stats = new(indexStats)
+		err   error
+	)
+	if stats.Blocks, err = esClient.countDocs(ctx, "block", elastic.NewMatchAllQuery()); err != nil {
+		return nil, err
+	}
+	if stats.MinHeight, err = esClient.MinAgg("height", "block", "block"); err != nil {
+		return nil, err
+	}
+	if stats.MaxHeight, err = esClient.MaxAgg("height", "block", "block"); err != nil {
+		return nil, err
+	}
+	if stats.Txs, err = esClient.countDocs(ctx, "tx", elastic.NewMatchAllQuery()); err != nil {
+		return nil, err
+	}
+	if stats.Vouts, err = esClient.countDocs(ctx, "vout", liveVoutsQuery(elastic.NewMatchAllQuery())); err != nil {
+		return nil, err
+	}
+	if stats.UnspentVouts, stats.Supply, err = esClient.UTXOStats(ctx); err != nil {
+		return nil, err
+	}
+	if stats.Balances, err = esClient.countDocs(ctx, "balance", elastic.NewMatchAllQuery()); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// UTXOStats 未花费且不是 unspendable 的 vout 数量及其金额之和
+func (esClient *elasticClientAlias) UTXOStats(ctx context.Context) (int64, float64, error) {
+	searchResult, err := esClient.Search().Index("vout").Type("vout").Query(unspentVoutsQuery()).Size(0).
+		Aggregation("supply", elastic.NewSumAggregation().Field("value")).Do(ctx)
+	if err != nil {
+		return 0, 0, errors.New(strings.Join([]string{"Query utxo stats error:", err.Error()}, " "))
+	}
+	sum, found := searchResult.Aggregations.Sum("supply")
+	if !found || sum.Value == nil {
+		return searchResult.Hits.TotalHits, 0, nil
+	}
+	return searchResult.Hits.TotalHits, btcFloat(decimal.NewFromFloat(*sum.Value)), nil
+}
+
+// countDocs index 中匹配 q 的文档数
+func (esClient *elasticClientAlias) countDocs(ctx context.Context, index string, q elastic.Query) (int64, error) {
+	// tx 可能是 data stream，不指定 type (见 txDocType)
+	searchResult, err := esClient.Search().Index(index).Query(q).Size(0).Do(ctx)
+	if err != nil {
+		return 0, errors.New(strings.Join([]string{"Count", index, "docs error:", err.Error()}, " "))
+	}
+	return searchResult.Hits.TotalHits, nil
+}
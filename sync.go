@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/olivere/elastic"
@@ -15,6 +19,22 @@ import (
 // ROLLBACKHEIGHT 回滚个数
 const ROLLBACKHEIGHT = 5
 
+// syncStopAt sync 命令同步到该高度 (包含) 后停止，-1 表示一直同步 (0 表示只同步到创世区块)
+var syncStopAt int32 = -1
+
+// syncStopHeight 根据 sync 命令的 --limit (同步的区块数，0 表示不限制) 和 --to (目标高度，-1 表示不限制) 计算停止高度，
+// 两者都设置时取较小者，都没有设置时返回 -1
+func syncStopHeight(start, limit, to int32) int32 {
+	stop := int32(-1)
+	if limit > 0 {
+		stop = start + limit - 1
+	}
+	if to >= 0 && (stop < 0 || to < stop) {
+		stop = to
+	}
+	return stop
+}
+
 // Sync dump bitcoin chaindata to es
 func (esClient *elasticClientAlias) Sync(btcClient bitcoinClientAlias) bool {
 	info, err := btcClient.GetBlockChainInfo()
@@ -22,17 +42,16 @@ func (esClient *elasticClientAlias) Sync(btcClient bitcoinClientAlias) bool {
 		sugar.Fatal("Get info error: ", err.Error())
 	}
 
-	var DBCurrentHeight float64
-	agg, err := esClient.MaxAgg("height", "block", "block")
+	lastHeight, found, err := esClient.LastSyncedHeight(context.Background())
 	if err != nil {
-		if err.Error() == "query max agg error" {
-			btcClient.ReSetSync(info.Headers, esClient)
-			return true
-		}
 		sugar.Warn(strings.Join([]string{"Query max aggration error:", err.Error()}, " "))
 		return false
 	}
-	DBCurrentHeight = *agg
+	if !found {
+		btcClient.ReSetSync(info.Headers, esClient)
+		return true
+	}
+	DBCurrentHeight := float64(lastHeight)
 
 	heightGap := info.Headers - int32(DBCurrentHeight)
 	switch {
@@ -58,6 +77,54 @@ func (esClient *elasticClientAlias) Sync(btcClient bitcoinClientAlias) bool {
 	return true
 }
 
+// ResolveStartHeight 启动时根据配置的起始高度、es 中已同步的最大高度以及 sync state 文档决定从哪个高度开始同步:
+// 1. block index 为空时从 configuredFrom 开始，resume 为 false
+// 2. 否则从已同步的最大高度与 sync state 高度中较小者的下一个区块继续 (sync state 落后说明上次在写入 sync state 前退出)。
+// sync state 之后已写入的区块由同步开始时的回滚重新同步，回滚只覆盖最近的 ROLLBACKHEIGHT 个区块，sync state 落后更多时返回错误
+// 3. configuredFrom 落后于已同步的数据时忽略 configuredFrom，重复同步会导致余额重复计算
+// 4. configuredFrom 超前于已同步的数据时同样忽略，跳过区块会导致余额不完整
+func (esClient *elasticClientAlias) ResolveStartHeight(ctx context.Context, configuredFrom int32) (int32, bool, []string, error) {
+	var warnings []string
+	indexedHeight, found, err := esClient.LastSyncedHeight(ctx)
+	if err != nil {
+		return 0, false, nil, err
+	}
+	state, stateFound, err := esClient.QuerySyncState(ctx)
+	if err != nil {
+		return 0, false, nil, err
+	}
+
+	if !found {
+		if stateFound {
+			warnings = append(warnings, strings.Join([]string{"sync state at height", strconv.FormatInt(int64(state.Height), 10),
+				"but block index is empty, ignore sync state"}, " "))
+		}
+		return configuredFrom, false, warnings, nil
+	}
+
+	resumeHeight := indexedHeight
+	if stateFound && indexedHeight-state.Height > ROLLBACKHEIGHT {
+		return 0, false, nil, fmt.Errorf("block index height %d is more than %d blocks ahead of sync state height %d, "+
+			"resuming would sync indexed blocks again without rolling them back", indexedHeight, ROLLBACKHEIGHT, state.Height)
+	}
+	if stateFound && state.Height < indexedHeight {
+		warnings = append(warnings, strings.Join([]string{"block index height", strconv.FormatInt(int64(indexedHeight), 10),
+			"is ahead of sync state height", strconv.FormatInt(int64(state.Height), 10), ", resume from sync state"}, " "))
+		resumeHeight = state.Height
+	}
+
+	start := resumeHeight + 1
+	switch {
+	case configuredFrom > 1 && configuredFrom < start:
+		warnings = append(warnings, strings.Join([]string{"configured sync_from_height", strconv.FormatInt(int64(configuredFrom), 10),
+			"is behind indexed height", strconv.FormatInt(int64(resumeHeight), 10), ", ignore it to avoid double counting balances"}, " "))
+	case configuredFrom > start:
+		warnings = append(warnings, strings.Join([]string{"configured sync_from_height", strconv.FormatInt(int64(configuredFrom), 10),
+			"is ahead of indexed height", strconv.FormatInt(int64(resumeHeight), 10), ", ignore it to avoid missing blocks"}, " "))
+	}
+	return start, true, warnings, nil
+}
+
 func (esClient *elasticClientAlias) RollbackAndSync(from float64, size int, btcClient bitcoinClientAlias) {
 	rollbackIndex := int(from) - size
 	beginSynsIndex := int32(rollbackIndex)
@@ -85,7 +152,11 @@ func (esClient *elasticClientAlias) RollbackAndSync(from float64, size int, btcC
 }
 
 func (btcClient *bitcoinClientAlias) dumpToES(from, end int32, size int, elasticClient *elasticClientAlias) {
+	if syncStopAt >= 0 && end > syncStopAt+1 {
+		end = syncStopAt + 1
+	}
 	for height := from; height < end; height++ {
+		backpressure.wait()
 		dumpBlockTime := time.Now()
 		block, err := btcClient.getBlock(height)
 		if err != nil {
@@ -93,40 +164,200 @@ func (btcClient *bitcoinClientAlias) dumpToES(from, end int32, size int, elastic
 		}
 		// 这个地址交易数据比较明显，
 		// 结合 https://blockchain.info/address/12cbQLTFMXRnSzktFkuoG3eHoMeFtpTu3S 的交易数据测试验证同步逻辑 (该地址上 2009 年的交易数据)
-		elasticClient.RollBackAndSyncTx(from, height, size, block)
-		elasticClient.RollBackAndSyncBlock(from, height, size, block)
-		sugar.Info("Dump block ", block.Height, " ", block.Hash, " dumpBlockTimeElapsed ", time.Since(dumpBlockTime))
+		header, err := btcClient.getBlockHeader(block.Hash)
+		if err != nil {
+			sugar.Fatal("Get block header error: ", err.Error())
+		}
+		labels.reloadIfChanged()
+		stats := elasticClient.RollBackAndSyncTx(from, height, size, block)
+		btcClient.verifyBlockFees(block, stats)
+		elasticClient.RollBackAndSyncBlock(height, block, header, stats)
+		block, stats = btcClient.verifyAfterIndex(elasticClient, height, block, stats)
+		if err := elasticClient.commitSyncState(context.Background(), height, block.Hash); err != nil {
+			sugar.Fatal(err.Error())
+		}
+		elapsed := time.Since(dumpBlockTime)
+		logBlockSynced("Dump block", block, stats, elapsed)
+		if onBlockSynced != nil {
+			onBlockSynced(block, stats, elapsed)
+		}
+	}
+}
+
+// onBlockSynced 不为 nil 时同步每个区块后调用，tail 命令用它输出区块汇总
+var onBlockSynced func(block *btcjson.GetBlockVerboseResult, stats *blockStats, elapsed time.Duration)
+
+// syncFlushIndices 区块同步时写入的 index，不包括 syncstate
+var syncFlushIndices = []string{"block", "tx", "vout", "vin", "balance", "address", "balancejournal", "balance_dlq"}
+
+// commitSyncState 区块写入后记录到 sync state。先写入 balance journal bulk processor 中排队的文档，sync state 不会领先于 balance journal；
+// 开启 flush_before_sync_state 时再 flush 区块写入的 index。写入或 flush 失败时不更新 sync state，重启后从上一个记录的区块恢复
+func (esClient *elasticClientAlias) commitSyncState(ctx context.Context, height int32, hash string) error {
+	if err := esClient.flushBalanceJournal(); err != nil {
+		return err
 	}
+	if config.FlushBeforeSyncState {
+		if _, err := esClient.Flush(syncFlushIndices...).Do(ctx); err != nil {
+			return errors.New(strings.Join([]string{"Flush block", strconv.FormatInt(int64(height), 10), "error:", err.Error()}, " "))
+		}
+	}
+	esClient.UpdateSyncState(ctx, height, hash)
+	return nil
 }
 
-func (esClient *elasticClientAlias) RollBackAndSyncTx(from, height int32, size int, block *btcjson.GetBlockVerboseResult) {
+// FinalizeSync 同步区间 (--limit/--to) 结束时调用一次: 写入 balance journal bulk processor 中剩余的文档并关闭它，
+// refresh 和 flush 一次 syncFlushIndices，按 es 中最高的区块重新记录 sync state。merger 不为 nil 时最后把 bulkLoadIndices
+// 合并到 elastic_forcemerge_max_segments 个 segment，merger 应该是不带 elastic_http_timeout 的 client，见 forcemergeClient
+func (esClient *elasticClientAlias) FinalizeSync(ctx context.Context, merger *elasticClientAlias) error {
+	if err := esClient.closeBalanceJournal(); err != nil {
+		return err
+	}
+	if _, err := esClient.Refresh(syncFlushIndices...).Do(ctx); err != nil {
+		return errors.New(strings.Join([]string{"Refresh synced indices error:", err.Error()}, " "))
+	}
+	if _, err := esClient.Flush(syncFlushIndices...).Do(ctx); err != nil {
+		return errors.New(strings.Join([]string{"Flush synced indices error:", err.Error()}, " "))
+	}
+
+	height, found, err := esClient.LastSyncedHeight(ctx)
+	if err != nil {
+		return errors.New(strings.Join([]string{"Query last synced height error:", err.Error()}, " "))
+	}
+	if found {
+		block, err := esClient.QueryEsBlockByHeight(ctx, height)
+		if err != nil {
+			return errors.New(strings.Join([]string{"Query block", strconv.FormatInt(int64(height), 10), "error:", err.Error()}, " "))
+		}
+		esClient.UpdateSyncState(ctx, height, block.Hash)
+	}
+
+	if merger != nil {
+		start := time.Now()
+		sugar.Info("force merging ", bulkLoadIndices, " to ", config.ElasticForcemergeMaxSegments, " segments")
+		if err := merger.ForceMerge(ctx, config.ElasticForcemergeMaxSegments); err != nil {
+			return err
+		}
+		sugar.Info("force merge done in ", time.Since(start))
+	}
+	return nil
+}
+
+// logBlockSynced 区块同步完成后输出一行汇总日志
+func logBlockSynced(msg string, block *btcjson.GetBlockVerboseResult, stats *blockStats, elapsed time.Duration) {
+	sugar.Infow(msg,
+		"height", block.Height,
+		"hash", block.Hash,
+		"txs", stats.TxCount,
+		"vouts_created", stats.VoutsCreated,
+		"vins_spent", stats.VinsSpent,
+		"balances_touched", stats.BalancesTouched,
+		"total_fees", btcFloat(stats.TotalFees),
+		"elapsed", elapsed.String(),
+		"es_backpressure", backpressure.state())
+}
+
+// blockSummaryLine tail 命令输出的一行区块汇总: 高度、hash、交易数、手续费总额、同步耗时
+func blockSummaryLine(block *btcjson.GetBlockVerboseResult, stats *blockStats, elapsed time.Duration) string {
+	return fmt.Sprintf("%d %s txs=%d fees=%s elapsed=%s", block.Height, block.Hash, stats.TxCount,
+		stats.TotalFees.Round(BTCDecimalPlaces).String(), elapsed.Round(time.Millisecond))
+}
+
+// blockTail tail 命令的区块输出。Sync 每次会回滚并重新同步最近的 ROLLBACKHEIGHT 个区块，
+// 只输出高于启动时同步高度的新区块，以及 hash 变化 (分叉) 的区块，重新同步的同一区块不重复输出
+type blockTail struct {
+	w       io.Writer
+	from    int64
+	printed map[int64]string
+}
+
+func newBlockTail(w io.Writer, from int64) *blockTail {
+	return &blockTail{w: w, from: from, printed: make(map[int64]string)}
+}
+
+func (t *blockTail) blockSynced(block *btcjson.GetBlockVerboseResult, stats *blockStats, elapsed time.Duration) {
+	if block.Height <= t.from || t.printed[block.Height] == block.Hash {
+		return
+	}
+	t.printed[block.Height] = block.Hash
+	delete(t.printed, block.Height-ROLLBACKHEIGHT-1)
+	fmt.Fprintln(t.w, blockSummaryLine(block, stats, elapsed))
+}
+
+func (esClient *elasticClientAlias) RollBackAndSyncTx(from, height int32, size int, block *btcjson.GetBlockVerboseResult) *blockStats {
 	// 回滚时，es 中 best height + 1 中的 vout, balance, tx 都需要回滚。
+	// 回滚的是节点返回的区块，es 中只有同一区块写入的数据，属于例行的重新同步，不是分叉
 	ctx := context.Background()
 	if height <= (from + int32(size+1)) {
-		esClient.RollbackTxVoutBalanceByBlock(ctx, block)
+		esClient.RollbackTxVoutBalanceByBlock(ctx, block, false)
 	}
 
-	esClient.syncTxVoutBalance(ctx, block)
+	return esClient.syncTxVoutBalance(ctx, block)
 }
 
-func (esClient *elasticClientAlias) RollBackAndSyncBlock(from, height int32, size int, block *btcjson.GetBlockVerboseResult) {
+// blockUpsertScript 覆盖区块文档的所有字段，但同一区块重新同步时若节点返回的 nexthash 为空，保留 es 中已有的 nexthash
+// 不同 hash 说明该高度发生了分叉，旧的 nexthash 不再有意义，直接覆盖
+const blockUpsertScript = `
+String nexthash = ctx._source.nexthash;
+boolean sameBlock = ctx._source.hash == params.block.hash;
+ctx._source.putAll(params.block);
+if (sameBlock && (params.block.nexthash == null || params.block.nexthash == '')) {
+  ctx._source.nexthash = nexthash;
+}`
+
+// RollBackAndSyncBlock upsert block document by height, the script keeps the doubly-linked chain (previoushash/nexthash)
+// intact when a block is re-synced during rollback
+func (esClient *elasticClientAlias) RollBackAndSyncBlock(height int32, block *btcjson.GetBlockVerboseResult, header *blockHeaderVerbose, stats *blockStats) {
 	ctx := context.Background()
-	if height <= (from + int32(size)) {
-		_, err := esClient.Delete().Index("block").Type("block").Id(strconv.FormatInt(int64(height), 10)).Refresh("true").Do(ctx)
-		if err != nil && err.Error() != "elastic: Error 404 (Not Found)" {
-			sugar.Fatal("Delete block docutment error: ", err.Error())
-		}
-
+	// 与前一个区块的难度之比，前一个区块不在 es 中 (同步的第一个区块) 时不写入。需要在计算 digest 之前得到
+	prevDifficulty, err := esClient.blockDifficulty(ctx, height-1)
+	switch {
+	case err == nil && prevDifficulty > 0:
+		ratio := block.Difficulty / prevDifficulty
+		stats.DifficultyRatio = &ratio
+	case err != nil && !errors.Is(err, ErrBlockNotFound):
+		sugar.Warn("Query difficulty of block ", height-1, " error: ", err.Error())
+	}
+	bodyParams := blockWithTxDetail(block, header, stats)
+	if err := esClient.upsertBlockDoc(ctx, height, bodyParams); err != nil {
+		sugar.Fatal(err.Error())
 	}
-	bodyParams := blockWithTxDetail(block)
-	_, err := esClient.Index().Index("block").Type("block").Id(strconv.FormatInt(int64(height), 10)).BodyJson(bodyParams).Do(ctx)
+}
+
+// upsertBlockDoc 按高度 upsert 区块文档，见 blockUpsertScript
+func (esClient *elasticClientAlias) upsertBlockDoc(ctx context.Context, height int32, doc map[string]interface{}) error {
+	script := elastic.NewScript(blockUpsertScript).Lang("painless").Param("block", doc)
+	_, err := esClient.Update().Index("block").Type("block").Id(strconv.FormatInt(int64(height), 10)).
+		Script(script).Upsert(doc).Do(ctx)
 	if err != nil {
-		sugar.Fatal(strings.Join([]string{"Dump block docutment error", err.Error()}, " "))
+		return errors.New(strings.Join([]string{"Dump block docutment error", err.Error()}, " "))
 	}
+	return nil
 }
 
-func (esClient *elasticClientAlias) syncTxVoutBalance(ctx context.Context, block *btcjson.GetBlockVerboseResult) {
-	bulkRequest := esClient.Bulk()
+// blockMu 串行化区块的同步和回滚
+// es client 本身可以在多个 goroutine 中使用，但余额更新是先查询再写入的读改写，vout 的 used 字段也依赖前面区块已经写入的 vout，
+// 两个区块同时同步或回滚时，涉及相同地址的余额更新会互相覆盖，新地址也可能被重复插入余额文档。
+// 调用方仍需按高度顺序同步区块，blockMu 只保证同一时间只有一个区块在读改写余额
+var blockMu sync.Mutex
+
+// syncTxVoutBalance 写入区块中交易的 tx、vout 文档并更新涉及地址的余额，可以在多个 goroutine 中调用，同一时间只有一个区块在同步 (见 blockMu)
+func (esClient *elasticClientAlias) syncTxVoutBalance(ctx context.Context, block *btcjson.GetBlockVerboseResult) *blockStats {
+	blockMu.Lock()
+	defer blockMu.Unlock()
+
+	coinbaseHeight := checkCoinbaseHeight(block)
+	relations := newInBlockRelations(block)
+	// watch 模式下只同步涉及关注地址的交易，区块文档仍由完整的区块写入
+	if config.WatchedAddresses != nil {
+		watchedBlock, err := esClient.watchedBlock(ctx, block)
+		if err != nil {
+			sugar.Fatal("Filter watched txs error: ", err.Error())
+		}
+		block = watchedBlock
+	}
+
+	bulkRequest := esClient.bulk()
+	stats := &blockStats{TxCount: len(block.Tx), CoinbaseHeight: coinbaseHeight}
 	var (
 		vinAddressWithAmountSlice         []Balance
 		voutAddressWithAmountSlice        []Balance
@@ -140,8 +371,19 @@ func (esClient *elasticClientAlias) syncTxVoutBalance(ctx context.Context, block
 		UniqueVinAddressesWithSumWithdraw []*AddressWithAmount // 统计区块中所有 vout 涉及到去重后的 vout 地址及其对应的增加余额
 	)
 
+	// 从节点补全的 vout 涉及的地址，这些地址在 es 中可能还没有余额文档
+	prevoutAddresses := make(map[string]bool)
+	// 区块中前面的交易创建的 vout，bulk 请求执行前还不在 es 中，不能从节点补全，否则会重复写入
+	blockOutpoints := make(map[IndexUTXO]bool)
+	// 区块中出现的地址，同步后更新 address 文档
+	seenAddresses := newBlockAddresses()
+
+	// 创世区块的 coinbase 交易不在节点的 utxo 集合中，输出无法花费，只写入 vout 并标记 unspendable，不计入地址余额
+	genesis := block.Height == 0
+
 	// TODO too slow, neet to optimization
 	for _, tx := range block.Tx {
+		stats.addTxSizes(tx)
 		var (
 			voutAmount       decimal.Decimal
 			vinAmount        decimal.Decimal
@@ -151,19 +393,36 @@ func (esClient *elasticClientAlias) syncTxVoutBalance(ctx context.Context, block
 		)
 
 		for _, vout := range tx.Vout {
+			// 区块总输出包括没有地址的 vout
+			stats.TotalOutputValue = stats.TotalOutputValue.Add(decimal.NewFromFloat(vout.Value))
+
 			//  bulk insert vouts
-			newVout, err := newVoutFun(vout, tx.Vin, tx.Txid)
-			if err != nil {
+			newVout := newVoutFun(vout, tx.Vin, tx.Txid)
+			// watch 模式下其他地址的 vout 不写入，金额仍计入手续费和 tx 文档的 vouts
+			if !watched(newVout.Addresses) {
+				voutAmount = voutAmount.Add(decimal.NewFromFloat(vout.Value))
+				txTypeVoutsFieldTmp, _, _, _ := parseTxVout(vout, tx.Txid)
+				txTypeVoutsField = append(txTypeVoutsField, txTypeVoutsFieldTmp...)
 				continue
 			}
+			seenAddresses.addVout(vout, tx.Txid)
+			if genesis {
+				newVout.Unspendable = true
+			}
+			newVout.Time = txTimeFun(tx, block.Time)
+			newVout.Height = int32(block.Height)
 			createdVout := elastic.NewBulkIndexRequest().Index("vout").Type("vout").Doc(newVout)
 			bulkRequest.Add(createdVout).Refresh("true")
+			stats.VoutsCreated++
 
 			// vout amount
 			voutAmount = voutAmount.Add(decimal.NewFromFloat(vout.Value))
 
 			txTypeVoutsFieldTmp, voutAddressesTmp, voutAddressWithAmountSliceTmp, voutAddressWithAmountAndTxidSliceTmp := parseTxVout(vout, tx.Txid)
 			txTypeVoutsField = append(txTypeVoutsField, txTypeVoutsFieldTmp...)
+			if newVout.Unspendable {
+				continue
+			}
 			voutAddresses = append(voutAddresses, voutAddressesTmp...) // vouts field in tx type
 			voutAddressWithAmountSlice = append(voutAddressWithAmountSlice, voutAddressWithAmountSliceTmp...)
 			voutAddressWithAmountAndTxidSlice = append(voutAddressWithAmountAndTxidSlice, voutAddressWithAmountAndTxidSliceTmp...)
@@ -172,32 +431,99 @@ func (esClient *elasticClientAlias) syncTxVoutBalance(ctx context.Context, block
 		// get es vouts with id in elasticsearch by tx vins
 		indexVins := indexedVinsFun(tx.Vin)
 		voutWithIDs := esClient.QueryVoutWithVinsOrVoutsUnlimitSize(ctx, indexVins)
+		if prevouts != nil {
+			voutWithIDs = append(voutWithIDs, fetchMissingPrevouts(tx.Vin, voutWithIDs, blockOutpoints)...)
+		}
+		stats.VinsSpent += len(voutWithIDs)
 
 		for _, voutWithID := range voutWithIDs {
 			// vin amount
 			vinAmount = vinAmount.Add(decimal.NewFromFloat(voutWithID.Vout.Value))
+			// watch 模式下从节点补全的其他地址的 vout 只用于计算手续费和 tx 文档的 vins，不写入 vout，不更新余额
+			if voutWithID.ID == "" && !watched(voutWithID.Vout.Addresses) {
+				txTypeVinsFieldTmp, _, _, _ := parseESVout(voutWithID, tx.Txid)
+				txTypeVinsField = append(txTypeVinsField, txTypeVinsFieldTmp...)
+				continue
+			}
+			// 重新同步同一区块时 vout 已经被这笔交易花费，余额已经减过，只计入手续费和 tx 文档的 vins
+			// 被其他交易花费说明 es 中的数据不一致，覆盖 used 但同样不再减余额
+			spentBy := voutWithID.Vout.spentBy()
+			alreadySpent := spentBy != ""
+			if alreadySpent && spentBy != tx.Txid {
+				sugar.Warn("vout ", voutWithID.Vout.TxIDBelongTo, ":", voutWithID.Vout.Voutindex, " already spent by ", spentBy, ", now spent by ", tx.Txid)
+			}
+			seenAddresses.addVin(voutWithID, tx.Txid)
 			// update vout type used field
-			updateVoutUsedField := elastic.NewBulkUpdateRequest().Index("vout").Type("vout").Id(voutWithID.ID).
-				Doc(map[string]interface{}{"used": voutUsed{Txid: tx.Txid, VinIndex: voutWithID.Vout.Voutindex}})
-			bulkRequest.Add(updateVoutUsedField).Refresh("true")
+			usedDoc := map[string]interface{}{"used": newVoutUsed(tx.Txid, voutWithID.Vout, block)}
+			if config.P2SHDecodeRedeemScript {
+				if redeemAddresses := vinRedeemAddresses(tx.Vin, voutWithID); len(redeemAddresses) > 0 {
+					usedDoc["redeemaddresses"] = redeemAddresses
+				}
+			}
+			if config.P2WSHDecodeWitnessScript {
+				if witnessAddresses := vinWitnessScriptAddresses(tx.Vin, voutWithID); len(witnessAddresses) > 0 {
+					usedDoc["redeemaddresses"] = witnessAddresses
+				}
+			}
+			if voutWithID.ID == "" {
+				// 从节点补全的 vout 不在 es 中，带上 used 字段并标记 recovered 写入，回滚时和其他 vout 一样按 used 字段找回后删除
+				recoveredVout := *voutWithID.Vout
+				recoveredVout.Used = usedDoc["used"]
+				recoveredVout.Recovered = true
+				if redeemAddresses, ok := usedDoc["redeemaddresses"].([]string); ok {
+					recoveredVout.RedeemAddresses = redeemAddresses
+				}
+				bulkRequest.Add(elastic.NewBulkIndexRequest().Index("vout").Type("vout").Doc(recoveredVout)).Refresh("true")
+				for _, address := range recoveredVout.Addresses {
+					prevoutAddresses[address] = true
+				}
+			} else {
+				// used 与 es 中相同 (重新同步同一区块) 时 es 不写入新版本
+				updateVoutUsedField := elastic.NewBulkUpdateRequest().Index("vout").Type("vout").Id(voutWithID.ID).
+					Doc(usedDoc).DetectNoop(true)
+				bulkRequest.Add(updateVoutUsedField).Refresh("true")
+			}
+			if config.VinDocs {
+				if vin, found := newVinDoc(tx, voutWithID.Vout, block); found {
+					bulkRequest.Add(vin.indexRequest()).Refresh("true")
+				}
+			}
 
 			txTypeVinsFieldTmp, vinAddressesTmp, vinAddressWithAmountSliceTmp, vinAddressWithAmountAndTxidSliceTmp := parseESVout(voutWithID, tx.Txid)
 			txTypeVinsField = append(txTypeVinsField, txTypeVinsFieldTmp...)
+			if alreadySpent {
+				continue
+			}
 			vinAddresses = append(vinAddresses, vinAddressesTmp...)
 			vinAddressWithAmountSlice = append(vinAddressWithAmountSlice, vinAddressWithAmountSliceTmp...)
 			vinAddressWithAmountAndTxidSlice = append(vinAddressWithAmountAndTxidSlice, vinAddressWithAmountAndTxidSliceTmp...)
 		}
 
-		// caculate tx fee
-		fee = vinAmount.Sub(voutAmount)
-		if len(tx.Vin) == 1 && len(tx.Vin[0].Coinbase) != 0 && len(tx.Vin[0].Txid) == 0 || vinAmount.Equal(voutAmount) {
-			fee = decimal.NewFromFloat(0)
+		// 所有 vin 都必须在 es vout type 中找到对应的 vout，否则 fee 和 vin 地址余额都不准确
+		missingOutpoints := missingVinOutpoints(tx.Vin, voutWithIDs)
+		feeIncomplete := len(missingOutpoints) > 0
+		txTypeVinsField = append(txTypeVinsField, unresolvedVins(missingOutpoints)...)
+		if feeIncomplete {
+			sugar.Error("tx ", tx.Txid, " resolved ", len(tx.Vin)-len(missingOutpoints), " of ", len(tx.Vin),
+				" vins, missing outpoints: ", strings.Join(outpointStrings(missingOutpoints), ","))
+		}
+
+		// watch 模式下没有写入的 vout 仍然可以从节点补全
+		for _, vout := range tx.Vout {
+			if watched(vout.ScriptPubKey.Addresses) {
+				blockOutpoints[IndexUTXO{tx.Txid, vout.N}] = true
+			}
 		}
 
+		// caculate tx fee
+		fee = txFee(tx, vinAmount, voutAmount, feeIncomplete)
+		stats.TotalFees = stats.TotalFees.Add(fee)
+
 		// bulk insert tx docutment
-		esFee, _ := fee.Float64()
-		txBulk := esTxFun(tx.Txid, block.Hash, esFee, tx.Time, txTypeVinsField, txTypeVoutsField)
-		insertTx := elastic.NewBulkIndexRequest().Index("tx").Type("tx").Doc(txBulk)
+		esFee := btcFloat(fee)
+		txBulk := esTxFun(tx, block, esFee, feeIncomplete, txTypeVinsField, txTypeVoutsField)
+		relations.setFlags(txBulk)
+		insertTx := txIndexRequest(txBulk)
 		bulkRequest.Add(insertTx).Refresh("true")
 	}
 
@@ -210,92 +536,142 @@ func (esClient *elasticClientAlias) syncTxVoutBalance(ctx context.Context, block
 	vinBalancesWithIDs = bulkQueryVinBalance
 
 	// 判断去重后的区块中所有交易的 vin 涉及到的地址数量是否与从 es 数据库中查询得到的 vinBalancesWithIDs 数量是否一致
-	// 不一致则说明 balance type 中存在某个地址重复数据，此时应重新同步数据 TODO
+	// 有 vin 地址没有余额文档说明数据不完整 (从节点补全的 vout 地址除外)，多于地址数量说明 balance type 中存在某个地址重复数据，此时应重新同步数据 TODO
 	UniqueVinAddresses := removeDuplicatesForSlice(vinAddresses...)
-	if len(UniqueVinAddresses) != len(vinBalancesWithIDs) {
+	var missingVinBalances int
+	for _, address := range UniqueVinAddresses {
+		if _, exists := findBalanceByAddress(vinBalancesWithIDs, address); !exists && !prevoutAddresses[address] {
+			missingVinBalances++
+		}
+	}
+	if missingVinBalances > 0 {
+		sugar.Fatal(fmt.Errorf("%d of %d vin addresses: %w", missingVinBalances, len(UniqueVinAddresses), ErrBalanceNotFound).Error())
+	}
+	if len(UniqueVinAddresses) < len(vinBalancesWithIDs) {
 		sugar.Fatal("There are duplicate records in balances type")
 	}
 
-	bulkUpdateVinBalanceRequest := esClient.Bulk()
+	// balance_bulk_actions 开启时余额更新不加入下面的 bulk 请求，由 balances 分批写入
+	var balances *balanceBatch
+	if config.BalanceBulkActions > 0 {
+		balances = esClient.newBalanceBatch(ctx, block)
+	}
+
+	bulkUpdateVinBalanceRequest := esClient.bulk()
+	vinBalanceDeltas := make(balanceDeltas)
+	vinTxids := addressTxids(vinAddressWithAmountAndTxidSlice)
 	// update(sub)  balances related to vins addresses
 	// len(vinAddressWithSumWithdraw) == len(vinBalancesWithIDs)
 	for _, vinAddressWithSumWithdraw := range UniqueVinAddressesWithSumWithdraw {
-		for _, vinBalanceWithID := range vinBalancesWithIDs {
-			if vinAddressWithSumWithdraw.Address == vinBalanceWithID.Balance.Address {
-				balance := decimal.NewFromFloat(vinBalanceWithID.Balance.Amount).Sub(vinAddressWithSumWithdraw.Amount)
-				amount, _ := balance.Float64()
-				updateVinBalcne := elastic.NewBulkUpdateRequest().Index("balance").Type("balance").Id(vinBalanceWithID.ID).
-					Doc(map[string]interface{}{"amount": amount})
-				bulkUpdateVinBalanceRequest.Add(updateVinBalcne).Refresh("true")
-				break
-			}
+		vinBalanceWithID, exists := findBalanceByAddress(vinBalancesWithIDs, vinAddressWithSumWithdraw.Address)
+		if balances != nil {
+			balances.add(vinAddressWithSumWithdraw.Address, vinBalanceWithID, vinAddressWithSumWithdraw.Amount.Neg(), vinTxids[vinAddressWithSumWithdraw.Address])
+			continue
 		}
+		if !exists {
+			// 从节点补全的 vout 地址在同步起始高度之前收到的金额没有计入余额，余额为同步范围内的净变化，可能为负数
+			newBalance := withBalanceLabel(map[string]interface{}{
+				"address": vinAddressWithSumWithdraw.Address,
+				"amount":  btcFloat(vinAddressWithSumWithdraw.Amount.Neg()),
+			}, vinAddressWithSumWithdraw.Address)
+			// 新建的 balance 文档不记录到 balance_dlq，写入失败时退出 (见 checkBalanceBulkResponse)
+			insertBalance := elastic.NewBulkIndexRequest().Index("balance").Type("balance").Routing(balanceRouting(vinAddressWithSumWithdraw.Address)).Doc(newBalance)
+			bulkUpdateVinBalanceRequest.Add(insertBalance)
+			continue
+		}
+		balance := decimal.NewFromFloat(vinBalanceWithID.Balance.Amount).Sub(vinAddressWithSumWithdraw.Amount)
+		amount := btcFloat(balance)
+		updateVinBalcne := elastic.NewBulkUpdateRequest().Index("balance").Type("balance").Id(vinBalanceWithID.ID).Routing(balanceRouting(vinBalanceWithID.Balance.Address)).
+			Doc(withBalanceLabel(map[string]interface{}{"amount": amount}, vinBalanceWithID.Balance.Address))
+		vinBalanceDeltas.add(bulkUpdateVinBalanceRequest, updateVinBalcne, newBalanceDelta(vinBalanceWithID.Balance.Address, vinAddressWithSumWithdraw.Amount.Neg(), block, vinTxids))
 	}
 	// vin 涉及到的地址余额必须在 vout 涉及到的地址余额之前更新，原因如下：
 	// 但一笔交易中的 vins 里面的地址同时出现在 vout 中（就是常见的找零），那么对于这个地址而言，必须先减去 vin 的余额，再加上 vout 的余额
 	if bulkUpdateVinBalanceRequest.NumberOfActions() != 0 {
-		bulkUpdateVinBalanceResp, e := bulkUpdateVinBalanceRequest.Refresh("true").Do(ctx)
+		bulkUpdateVinBalanceResp, e := bulkUpdateVinBalanceRequest.do(ctx, "true")
 		if e != nil {
-			sugar.Fatal("update vin balance error: ", err.Error())
+			sugar.Fatal("update vin balance error: ", e.Error())
 		}
-		bulkUpdateVinBalanceResp.Updated()
+		esClient.checkBalanceBulkResponse(ctx, "update vin balance", bulkUpdateVinBalanceResp, vinBalanceDeltas)
 	}
 
+	stats.BalancesTouched = len(removeDuplicatesForSlice(append(append([]interface{}{}, vinAddresses...), voutAddresses...)...))
+
 	// 统计区块中所有 vout 涉及到去重后的 vout 地址及其对应的增加余额
+	// 同一地址在一笔交易或一个区块中多次收款时先在内存中累加，每个地址只读改写一次余额文档，不会读到 bulk 未生效的旧余额
 	UniqueVoutAddressesWithSumDeposit = calculateUniqueAddressWithSumForVinOrVout(voutAddresses, voutAddressWithAmountSlice)
 	bulkQueryVoutBalance, err := esClient.BulkQueryBalanceUnlimitSize(ctx, voutAddresses...)
 	if err != nil {
 		sugar.Fatal("Query balance related with vouts address error: ", err.Error())
 	}
 	voutBalancesWithIDs = bulkQueryVoutBalance
+	voutBalanceDeltas := make(balanceDeltas)
+	voutTxids := addressTxids(voutAddressWithAmountAndTxidSlice)
 	// update(add) or insert balances related to vouts addresses
 	// len(voutAddressWithSumDeposit) >= len(voutBalanceWithID)
+	// 查询失败 (包括部分分片失败) 时已经退出，这里 exists 为 false 只表示新地址
 	for _, voutAddressWithSumDeposit := range UniqueVoutAddressesWithSumDeposit {
-		var isNewBalance bool
-		isNewBalance = true
-		for _, voutBalanceWithID := range voutBalancesWithIDs {
-			// update balance
-			if voutAddressWithSumDeposit.Address == voutBalanceWithID.Balance.Address {
-				balance := voutAddressWithSumDeposit.Amount.Add(decimal.NewFromFloat(voutBalanceWithID.Balance.Amount))
-				amount, _ := balance.Float64()
-				updateVoutBalcne := elastic.NewBulkUpdateRequest().Index("balance").Type("balance").Id(voutBalanceWithID.ID).
-					Doc(map[string]interface{}{"amount": amount})
-				bulkRequest.Add(updateVoutBalcne)
-				isNewBalance = false
-				break
-			}
+		if balances != nil {
+			voutBalanceWithID, _ := findBalanceByAddress(voutBalancesWithIDs, voutAddressWithSumDeposit.Address)
+			balances.add(voutAddressWithSumDeposit.Address, voutBalanceWithID, voutAddressWithSumDeposit.Amount, voutTxids[voutAddressWithSumDeposit.Address])
+			continue
 		}
-
-		// if voutAddressWithSumDeposit not exist in balance ES Type, insert a docutment
-		if isNewBalance {
-			amount, _ := voutAddressWithSumDeposit.Amount.Float64()
-			newBalance := &Balance{
-				Address: voutAddressWithSumDeposit.Address,
-				Amount:  amount,
-			}
+		// update balance
+		if voutBalanceWithID, exists := findBalanceByAddress(voutBalancesWithIDs, voutAddressWithSumDeposit.Address); exists {
+			balance := voutAddressWithSumDeposit.Amount.Add(decimal.NewFromFloat(voutBalanceWithID.Balance.Amount))
+			amount := btcFloat(balance)
+			updateVoutBalcne := elastic.NewBulkUpdateRequest().Index("balance").Type("balance").Id(voutBalanceWithID.ID).Routing(balanceRouting(voutBalanceWithID.Balance.Address)).
+				Doc(withBalanceLabel(map[string]interface{}{"amount": amount}, voutBalanceWithID.Balance.Address))
+			voutBalanceDeltas.add(bulkRequest, updateVoutBalcne, newBalanceDelta(voutBalanceWithID.Balance.Address, voutAddressWithSumDeposit.Amount, block, voutTxids))
+		} else {
+			// if voutAddressWithSumDeposit not exist in balance ES Type, insert a docutment
+			amount := btcFloat(voutAddressWithSumDeposit.Amount)
+			newBalance := withBalanceLabel(map[string]interface{}{
+				"address": voutAddressWithSumDeposit.Address,
+				"amount":  amount,
+			}, voutAddressWithSumDeposit.Address)
 			//  bulk insert balance
-			insertBalance := elastic.NewBulkIndexRequest().Index("balance").Type("balance").Doc(newBalance)
-			bulkRequest.Add(insertBalance).Refresh("true")
+			insertBalance := elastic.NewBulkIndexRequest().Index("balance").Type("balance").Routing(balanceRouting(voutAddressWithSumDeposit.Address)).Doc(newBalance)
+			bulkRequest.Add(insertBalance)
 		}
 	}
 
-	bulkResp, err := bulkRequest.Refresh("true").Do(ctx)
+	for _, upsertAddress := range seenAddresses.addressUpsertRequests(int32(block.Height)) {
+		bulkRequest.Add(upsertAddress)
+	}
+
+	bulkResp, err := bulkRequest.do(ctx, "true")
 	if err != nil {
 		sugar.Fatal("bulk request error: ", err.Error())
 	}
 
-	bulkResp.Created()
-	bulkResp.Updated()
-	bulkResp.Indexed()
+	esClient.checkBalanceBulkResponse(ctx, "sync block", bulkResp, voutBalanceDeltas)
+	if balances != nil {
+		balances.flush()
+	}
 
 	// bulk add balancejournal doc (sync vout: add balance)
 	esClient.BulkInsertBalanceJournal(ctx, voutAddressWithAmountAndTxidSlice, "sync+")
 	// bulk add balancejournal doc (sync vin: sub balance)
 	esClient.BulkInsertBalanceJournal(ctx, vinAddressWithAmountAndTxidSlice, "sync-")
+	return stats
 }
 
-func (esClient *elasticClientAlias) RollbackTxVoutBalanceByBlock(ctx context.Context, block *btcjson.GetBlockVerboseResult) error {
-	bulkRequest := esClient.Bulk()
+// rollbackRefresh 回滚中写入请求的 refresh 参数，开启 rollback_refresh_once 时每个请求不再等待 refresh，回滚结束后统一 refresh 一次
+func rollbackRefresh() string {
+	if config.RollbackRefreshOnce {
+		return "false"
+	}
+	return "true"
+}
+
+// RollbackTxVoutBalanceByBlock 删除区块的 tx、vout 文档并回滚涉及地址的余额，与 syncTxVoutBalance 共用 blockMu。
+// reorg 为 true 表示节点在该高度已经换成了其他区块 (分叉)，见 rollbackVoutRequest
+func (esClient *elasticClientAlias) RollbackTxVoutBalanceByBlock(ctx context.Context, block *btcjson.GetBlockVerboseResult, reorg bool) error {
+	blockMu.Lock()
+	defer blockMu.Unlock()
+
+	bulkRequest := esClient.bulk()
 	var (
 		vinAddresses                      []interface{} // All addresses related with vins in a block
 		voutAddresses                     []interface{} // All addresses related with vouts in a block
@@ -313,41 +689,74 @@ func (esClient *elasticClientAlias) RollbackTxVoutBalanceByBlock(ctx context.Con
 	if e := esClient.DeleteEsTxsByBlockHash(ctx, block.Hash); e != nil {
 		sugar.Fatal("rollback block err: ", block.Hash, " fail to delete")
 	}
+	if e := esClient.DeleteAddressesFirstSeenAt(ctx, int32(block.Height)); e != nil {
+		sugar.Fatal(e.Error())
+	}
+	if config.VinDocs {
+		if e := esClient.DeleteVinsAt(ctx, int32(block.Height)); e != nil {
+			sugar.Fatal(e.Error())
+		}
+	}
 
+	// 块中所有交易的 vins 花费的 vouts 及所有交易的 vouts，按 rollback_batch_size 分批查询，避免逐笔交易查询
+	var (
+		spentOutpoints []spentOutpoint
+		indexVouts     []IndexUTXO
+	)
+	spentBy := make(map[IndexUTXO]string)
+	// 区块中涉及的地址，与同步时相同按交易去重，回滚 address 文档的 tx_count
+	rolledBackAddresses := newBlockAddresses()
 	for _, tx := range block.Tx {
-		// es 中 vout 的 used 字段为 nil 涉及到的 vins 地址余额不用回滚
-		voutWithIDSliceForVins, _ := esClient.QueryVoutsByUsedFieldAndBelongTxID(ctx, tx.Vin, tx.Txid)
+		for _, outpoint := range spentOutpointsFun(tx.Vin, tx.Txid) {
+			spentOutpoints = append(spentOutpoints, outpoint)
+			spentBy[outpoint.IndexUTXO] = outpoint.SpentBy
+		}
+		indexVouts = append(indexVouts, indexedVoutsFun(tx.Vout, tx.Txid)...)
+	}
 
-		// 如果 len(voutWithIDSliceForVins) 为 0 ，则表面已经回滚过了，
-		for _, voutWithID := range voutWithIDSliceForVins {
-			// rollback: update vout's used to nil
+	// es 中 vout 的 used 字段为 nil 涉及到的 vins 地址余额不用回滚
+	// 如果 len(voutWithIDSliceForVins) 为 0 ，则表面已经回滚过了，
+	voutWithIDSliceForVins, err := esClient.QueryVoutsUsedByInBatches(ctx, spentOutpoints, config.RollbackBatchSize)
+	if err != nil {
+		sugar.Fatal("Rollback: query vouts used by vins error: ", err.Error())
+	}
+	for _, voutWithID := range voutWithIDSliceForVins {
+		if voutWithID.Vout.Recovered {
+			// rollback: 从节点补全的 vout 由花费它的区块写入，一并删除
+			bulkRequest.Add(elastic.NewBulkDeleteRequest().Index("vout").Type("vout").Id(voutWithID.ID))
+		} else {
+			// rollback: update vout's used to nil, redeemaddresses 由花费该 vout 的 vin 解析得到，一并清除
 			updateVoutUsedField := elastic.NewBulkUpdateRequest().Index("vout").Type("vout").Id(voutWithID.ID).
-				Doc(map[string]interface{}{"used": nil})
-			bulkRequest.Add(updateVoutUsedField).Refresh("true")
-
-			_, vinAddressesTmp, vinAddressWithAmountSliceTmp, vinAddressWithAmountAndTxidSliceTmp := parseESVout(voutWithID, tx.Txid)
-			vinAddresses = append(vinAddresses, vinAddressesTmp...)
-			vinAddressWithAmountSlice = append(vinAddressWithAmountSlice, vinAddressWithAmountSliceTmp...)
-			vinAddressWithAmountAndTxidSlice = append(vinAddressWithAmountAndTxidSlice, vinAddressWithAmountAndTxidSliceTmp...)
+				Doc(map[string]interface{}{"used": nil, "redeemaddresses": nil})
+			bulkRequest.Add(updateVoutUsedField)
 		}
 
-		// get es vouts with id in elasticsearch by tx vouts
-		indexVouts := indexedVoutsFun(tx.Vout, tx.Txid)
-		// 没有被删除的 vouts 涉及到的 vout 地址才需要回滚余额
-		voutWithIDSliceForVouts, e := esClient.QueryVoutWithVinsOrVouts(ctx, indexVouts)
-		if e != nil {
-			sugar.Fatal(strings.Join([]string{"QueryVoutWithVinsOrVouts error: vout not found", e.Error()}, " "))
-		}
-		for _, voutWithID := range voutWithIDSliceForVouts {
-			// rollback: delete vout
-			deleteVout := elastic.NewBulkDeleteRequest().Index("vout").Type("vout").Id(voutWithID.ID)
-			bulkRequest.Add(deleteVout).Refresh("true")
+		txid := spentBy[IndexUTXO{voutWithID.Vout.TxIDBelongTo, voutWithID.Vout.Voutindex}]
+		rolledBackAddresses.addVin(voutWithID, txid)
+		_, vinAddressesTmp, vinAddressWithAmountSliceTmp, vinAddressWithAmountAndTxidSliceTmp := parseESVout(voutWithID, txid)
+		vinAddresses = append(vinAddresses, vinAddressesTmp...)
+		vinAddressWithAmountSlice = append(vinAddressWithAmountSlice, vinAddressWithAmountSliceTmp...)
+		vinAddressWithAmountAndTxidSlice = append(vinAddressWithAmountAndTxidSlice, vinAddressWithAmountAndTxidSliceTmp...)
+	}
 
-			_, voutAddressesTmp, voutAddressWithAmountSliceTmp, voutAddressWithAmountAndTxidSliceTmp := parseESVout(voutWithID, tx.Txid)
-			voutAddresses = append(voutAddresses, voutAddressesTmp...)
-			voutAddressWithAmountSlice = append(voutAddressWithAmountSlice, voutAddressWithAmountSliceTmp...)
-			voutAddressWithAmountAndTxidSlice = append(voutAddressWithAmountAndTxidSlice, voutAddressWithAmountAndTxidSliceTmp...)
+	// 没有被删除的 vouts 涉及到的 vout 地址才需要回滚余额
+	voutWithIDSliceForVouts, err := esClient.QueryVoutWithVinsOrVoutsInBatches(ctx, indexVouts, config.RollbackBatchSize)
+	if err != nil {
+		sugar.Fatal(strings.Join([]string{"QueryVoutWithVinsOrVouts error: vout not found", err.Error()}, " "))
+	}
+	for _, voutWithID := range voutWithIDSliceForVouts {
+		// rollback: delete vout，开启 soft_delete_vouts 且发生分叉时只标记为 orphaned
+		bulkRequest.Add(rollbackVoutRequest(voutWithID.ID, int32(block.Height), reorg))
+		rolledBackAddresses.addVin(voutWithID, voutWithID.Vout.TxIDBelongTo)
+		// unspendable vout 同步时没有计入余额
+		if voutWithID.Vout.Unspendable {
+			continue
 		}
+
+		_, voutAddressesTmp, voutAddressWithAmountSliceTmp, voutAddressWithAmountAndTxidSliceTmp := parseESVout(voutWithID, voutWithID.Vout.TxIDBelongTo)
+		voutAddresses = append(voutAddresses, voutAddressesTmp...)
+		voutAddressWithAmountSlice = append(voutAddressWithAmountSlice, voutAddressWithAmountSliceTmp...)
+		voutAddressWithAmountAndTxidSlice = append(voutAddressWithAmountAndTxidSlice, voutAddressWithAmountAndTxidSliceTmp...)
 	}
 
 	// 统计块中所有交易 vin 涉及到的地址及其对应的提现余额 (balance type)
@@ -358,63 +767,76 @@ func (esClient *elasticClientAlias) RollbackTxVoutBalanceByBlock(ctx context.Con
 	}
 	vinBalancesWithIDs = bulkQueryVinBalance
 
-	// 统计块中所有交易 vout 涉及到的地址及其对应的提现余额 (balance type)
-	UniqueVoutAddressesWithSumDeposit = calculateUniqueAddressWithSumForVinOrVout(voutAddresses, voutAddressWithAmountSlice)
-	bulkQueryVoutBalance, err := esClient.BulkQueryBalance(ctx, voutAddresses...)
-	if err != nil {
-		sugar.Fatal("Rollback: query vout balance error: ", err.Error())
-	}
-	voutBalancesWithIDs = bulkQueryVoutBalance
-
 	// rollback: add to addresses related to vins addresses
 	// 通过 vin 在 vout type 的 used 字段查出来(不为 nil)的地址余额才回滚
-	bulkUpdateVinBalanceRequest := esClient.Bulk()
+	bulkUpdateVinBalanceRequest := esClient.bulk()
+	// vin 地址回滚后的余额，rollback_refresh_once 开启时下面查询 vout 地址余额读不到这次更新，同一地址以这里的余额为准
+	vinRolledBack := make(map[string]float64)
 	// update(sub)  balances related to vins addresses
 	// len(vinAddressWithSumWithdraw) == len(vinBalancesWithIDs)
 	for _, vinAddressWithSumWithdraw := range UniqueVinAddressesWithSumWithdraw {
-		for _, vinBalanceWithID := range vinBalancesWithIDs {
-			if vinAddressWithSumWithdraw.Address == vinBalanceWithID.Balance.Address {
-				balance := decimal.NewFromFloat(vinBalanceWithID.Balance.Amount).Add(vinAddressWithSumWithdraw.Amount)
-				amount, _ := balance.Float64()
-				updateVinBalance := elastic.NewBulkUpdateRequest().Index("balance").Type("balance").Id(vinBalanceWithID.ID).
-					Doc(map[string]interface{}{"amount": amount})
-				bulkUpdateVinBalanceRequest.Add(updateVinBalance).Refresh("true")
-				break
-			}
+		vinBalanceWithID, exists := findBalanceByAddress(vinBalancesWithIDs, vinAddressWithSumWithdraw.Address)
+		if !exists {
+			continue
 		}
+		balance := decimal.NewFromFloat(vinBalanceWithID.Balance.Amount).Add(vinAddressWithSumWithdraw.Amount)
+		amount := btcFloat(balance)
+		vinRolledBack[vinBalanceWithID.Balance.Address] = amount
+		updateVinBalance := elastic.NewBulkUpdateRequest().Index("balance").Type("balance").Id(vinBalanceWithID.ID).Routing(balanceRouting(vinBalanceWithID.Balance.Address)).
+			Doc(withBalanceLabel(map[string]interface{}{"amount": amount}, vinBalanceWithID.Balance.Address))
+		bulkUpdateVinBalanceRequest.Add(updateVinBalance)
 	}
 	if bulkUpdateVinBalanceRequest.NumberOfActions() != 0 {
-		bulkUpdateVinBalanceResp, e := bulkUpdateVinBalanceRequest.Refresh("true").Do(ctx)
+		bulkUpdateVinBalanceResp, e := bulkUpdateVinBalanceRequest.do(ctx, rollbackRefresh())
 		if e != nil {
-			sugar.Fatal("Rollback: update vin balance error: ", err.Error())
+			sugar.Fatal("Rollback: update vin balance error: ", e.Error())
 		}
-		bulkUpdateVinBalanceResp.Updated()
+		checkBulkResponse("Rollback: update vin balance", bulkUpdateVinBalanceResp)
 	}
 
+	// 统计块中所有交易 vout 涉及到的地址及其对应的提现余额 (balance type)
+	// vin 地址余额更新后再查询，同一地址同时出现在 vin 和 vout 时才能拿到最新余额
+	UniqueVoutAddressesWithSumDeposit = calculateUniqueAddressWithSumForVinOrVout(voutAddresses, voutAddressWithAmountSlice)
+	bulkQueryVoutBalance, err := esClient.BulkQueryBalance(ctx, voutAddresses...)
+	if err != nil {
+		sugar.Fatal("Rollback: query vout balance error: ", err.Error())
+	}
+	voutBalancesWithIDs = bulkQueryVoutBalance
+
 	// update(sub) balances related to vouts addresses
 	// len(voutAddressWithSumDeposit) >= len(voutBalanceWithID)
 	// 没有被删除的 vouts 涉及到的 vout 地址才需要回滚余额
 	for _, voutAddressWithSumDeposit := range UniqueVoutAddressesWithSumDeposit {
-		for _, voutBalanceWithID := range voutBalancesWithIDs {
-			if voutAddressWithSumDeposit.Address == voutBalanceWithID.Balance.Address {
-				balance := decimal.NewFromFloat(voutBalanceWithID.Balance.Amount).Sub(voutAddressWithSumDeposit.Amount)
-				amount, _ := balance.Float64()
-				updateVinBalance := elastic.NewBulkUpdateRequest().Index("balance").Type("balance").Id(voutBalanceWithID.ID).
-					Doc(map[string]interface{}{"amount": amount})
-				bulkRequest.Add(updateVinBalance).Refresh("true")
-				break
-			}
+		voutBalanceWithID, exists := findBalanceByAddress(voutBalancesWithIDs, voutAddressWithSumDeposit.Address)
+		if !exists {
+			continue
 		}
+		current := voutBalanceWithID.Balance.Amount
+		if amount, ok := vinRolledBack[voutBalanceWithID.Balance.Address]; ok {
+			current = amount
+		}
+		balance := decimal.NewFromFloat(current).Sub(voutAddressWithSumDeposit.Amount)
+		amount := btcFloat(balance)
+		updateVinBalance := elastic.NewBulkUpdateRequest().Index("balance").Type("balance").Id(voutBalanceWithID.ID).Routing(balanceRouting(voutBalanceWithID.Balance.Address)).
+			Doc(withBalanceLabel(map[string]interface{}{"amount": amount}, voutBalanceWithID.Balance.Address))
+		bulkRequest.Add(updateVinBalance)
 	}
 
 	if bulkRequest.NumberOfActions() != 0 {
-		bulkResp, err := bulkRequest.Refresh("true").Do(ctx)
+		bulkResp, err := bulkRequest.do(ctx, rollbackRefresh())
 		if err != nil {
 			sugar.Fatal("Rollback: bulkRequest do error: ", err.Error())
 		}
-		bulkResp.Updated()
-		bulkResp.Deleted()
-		bulkResp.Indexed()
+		checkBulkResponse("Rollback: bulkRequest", bulkResp)
+	}
+	if err := esClient.RollbackAddressTxCounts(ctx, rolledBackAddresses); err != nil {
+		sugar.Fatal(err.Error())
+	}
+	if config.RollbackRefreshOnce {
+		// 重新同步区块时查询 vout、balance，必须先看到回滚后的数据
+		if _, err := esClient.Refresh(syncFlushIndices...).Do(ctx); err != nil {
+			sugar.Fatal("Rollback: refresh error: ", err.Error())
+		}
 	}
 
 	// bulk add balancejournal doc (rollback vout: sub balance)
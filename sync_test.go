@@ -0,0 +1,1424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+// 区块 2: coinbase 奖励 50 给 A，tx2 花费 B 在 tx1:0 的 10，支付 C 4，找零 B 5.9，fee 0.1
+func testSyncBlock() *btcjson.GetBlockVerboseResult {
+	return &btcjson.GetBlockVerboseResult{
+		Hash:       "block2",
+		Height:     2,
+		Difficulty: 1,
+		Tx: []btcjson.TxRawResult{
+			{
+				Txid: "coinbase2",
+				Vin:  []btcjson.Vin{{Coinbase: "04ffff001d0102"}},
+				Vout: []btcjson.Vout{testVout(0, 50, "A")},
+			},
+			{
+				Txid: "tx2",
+				Vin:  []btcjson.Vin{{Txid: "tx1", Vout: 0}},
+				Vout: []btcjson.Vout{testVout(0, 4, "C"), testVout(1, 5.9, "B")},
+			},
+		},
+	}
+}
+
+func testVout(n uint32, value float64, addresses ...string) btcjson.Vout {
+	return btcjson.Vout{
+		Value:        value,
+		N:            n,
+		ScriptPubKey: btcjson.ScriptPubKeyResult{Type: "pubkeyhash", Addresses: addresses},
+	}
+}
+
+// 区块 2 同步前的状态: B 在 tx1:0 有一个 10 的 utxo
+func newTestSyncES() *fakeES {
+	es := newFakeES()
+	es.put("vout", "vout-tx1-0", map[string]interface{}{"txidbelongto": "tx1", "voutindex": 0, "value": 10, "coinbase": false, "addresses": []string{"B"}, "used": nil})
+	es.put("balance", "balance-b", map[string]interface{}{"address": "B", "amount": 10})
+	return es
+}
+
+func balancesByAddress(es *fakeES) map[string]float64 {
+	balances := make(map[string]float64)
+	for _, doc := range es.all("balance") {
+		balances[doc["address"].(string)] = doc["amount"].(float64)
+	}
+	return balances
+}
+
+func TestSyncStopHeight(t *testing.T) {
+	assert.EqualValues(t, -1, syncStopHeight(101, 0, -1))
+	assert.EqualValues(t, 200, syncStopHeight(101, 100, -1))
+	assert.EqualValues(t, 150, syncStopHeight(101, 0, 150))
+	// --to 0 只同步创世区块，不是不限制
+	assert.EqualValues(t, 0, syncStopHeight(0, 0, 0))
+	assert.EqualValues(t, 0, syncStopHeight(0, 100, 0))
+	assert.EqualValues(t, 150, syncStopHeight(101, 100, 150))
+	assert.EqualValues(t, 200, syncStopHeight(101, 100, 300))
+}
+
+func TestSyncTxVoutBalance(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+
+	stats := client.syncTxVoutBalance(context.Background(), testSyncBlock())
+
+	// vin 地址先减后 vout 地址再加: B = 10 - 10 + 5.9
+	assert.Equal(t, map[string]float64{"A": 50, "B": 5.9, "C": 4}, balancesByAddress(es))
+
+	spent := es.all("vout")["vout-tx1-0"]
+	assert.Equal(t, map[string]interface{}{"txid": "tx2", "vinindex": float64(0), "height": float64(2)}, spent["used"])
+	assert.Len(t, es.all("vout"), 4)
+
+	fees := make(map[string]float64)
+	for _, doc := range es.all("tx") {
+		fees[doc["txid"].(string)] = doc["fee"].(float64)
+	}
+	assert.Equal(t, map[string]float64{"coinbase2": 0, "tx2": 0.1}, fees)
+
+	assert.Equal(t, 2, stats.TxCount)
+	assert.Equal(t, 0.1, btcFloat(stats.TotalFees))
+	assert.Equal(t, 59.9, btcFloat(stats.TotalOutputValue))
+	assert.Equal(t, 3, stats.VoutsCreated)
+	assert.Equal(t, 1, stats.VinsSpent)
+	assert.Equal(t, 3, stats.BalancesTouched)
+}
+
+// voutindex 超过 short 的最大值 32767 的输出可以写入和花费，mapping 中的 outpoint 索引字段都是 integer
+func TestSyncTxWithMoreThanShortOutputs(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	const outputs = math.MaxInt16 + 2
+	block := testSyncBlock()
+	block.Tx[1].Vout = nil
+	for n := 0; n < outputs; n++ {
+		block.Tx[1].Vout = append(block.Tx[1].Vout, testVout(uint32(n), 0.0001, "C"))
+	}
+	stats := client.syncTxVoutBalance(ctx, block)
+	assert.Equal(t, outputs+1, stats.VoutsCreated)
+
+	spend := &btcjson.GetBlockVerboseResult{Hash: "block3", Height: 3, Tx: []btcjson.TxRawResult{{
+		Txid: "tx3",
+		Vin:  []btcjson.Vin{{Txid: "tx2", Vout: outputs - 1}},
+		Vout: []btcjson.Vout{testVout(0, 0.0001, "D")},
+	}}}
+	stats = client.syncTxVoutBalance(ctx, spend)
+	assert.Equal(t, 1, stats.VinsSpent)
+	for _, vout := range es.all("vout") {
+		if vout["txidbelongto"] == "tx2" && vout["voutindex"] == float64(outputs-1) {
+			assert.Equal(t, "tx3", vout["used"].(map[string]interface{})["txid"])
+			assert.Equal(t, float64(outputs-1), vout["used"].(map[string]interface{})["vinindex"])
+		}
+	}
+
+	assert.Equal(t, "integer", mappingType(t, blockMapping, "block", "tx", "vin", "vout"))
+	assert.Equal(t, "integer", mappingType(t, blockMapping, "block", "tx", "vout", "n"))
+	assert.Equal(t, "integer", mappingType(t, voutMapping, "vout", "voutindex"))
+	assert.Equal(t, "integer", mappingType(t, voutMapping, "vout", "used", "vinindex"))
+	assert.Equal(t, "integer", mappingType(t, vinMapping, "vin", "vinindex"))
+	assert.Equal(t, "integer", mappingType(t, vinMapping, "vin", "prev_vout"))
+}
+
+// mappingType mapping 中 type 下按 path 嵌套的字段类型
+func mappingType(t *testing.T, mapping, docType string, path ...string) string {
+	var m map[string]interface{}
+	if err := json.Unmarshal([]byte(mapping), &m); err != nil {
+		t.Fatal(err)
+	}
+	field := m["mappings"].(map[string]interface{})[docType].(map[string]interface{})
+	for _, name := range path {
+		field = field["properties"].(map[string]interface{})[name].(map[string]interface{})
+	}
+	return field["type"].(string)
+}
+
+func TestResyncSpentVoutIsIdempotent(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	// tx2 花费 B 的 10，输出没有地址，不影响余额
+	block := testSyncBlock()
+	block.Tx = block.Tx[1:]
+	block.Tx[0].Vout = []btcjson.Vout{testVout(0, 9.9)}
+	for i := 0; i < 2; i++ {
+		stats := client.syncTxVoutBalance(ctx, block)
+		assert.Equal(t, 0.1, btcFloat(stats.TotalFees))
+		assert.Equal(t, map[string]float64{"B": 0}, balancesByAddress(es))
+	}
+	assert.Equal(t, "tx2", es.all("vout")["vout-tx1-0"]["used"].(map[string]interface{})["txid"])
+
+	// 已经被其他交易花费的 vout 不再减余额
+	es.put("vout", "vout-tx1-1", map[string]interface{}{"txidbelongto": "tx1", "voutindex": 1, "value": 1, "addresses": []string{"B"},
+		"used": map[string]interface{}{"txid": "txX", "vinindex": 0}})
+	block.Tx[0].Vin = []btcjson.Vin{{Txid: "tx1", Vout: 1}}
+	client.syncTxVoutBalance(ctx, block)
+	assert.Equal(t, map[string]float64{"B": 0}, balancesByAddress(es))
+	assert.Equal(t, "tx2", es.all("vout")["vout-tx1-1"]["used"].(map[string]interface{})["txid"])
+}
+
+func TestSyncTxVinsCoverAllInputs(t *testing.T) {
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+	// M2 只出现在一个 1-of-2 裸多签输出中，从来不是单独的收款地址
+	es.put("vout", "vout-tx0-0", map[string]interface{}{"txidbelongto": "tx0", "voutindex": 0, "value": 2, "addresses": []string{"M1", "M2"}, "used": nil})
+	es.put("vout", "vout-tx0-1", map[string]interface{}{"txidbelongto": "tx0", "voutindex": 1, "value": 0.5, "addresses": []string{}, "used": nil})
+	es.put("balance", "balance-m1", map[string]interface{}{"address": "M1", "amount": 2})
+	es.put("balance", "balance-m2", map[string]interface{}{"address": "M2", "amount": 2})
+
+	block := &btcjson.GetBlockVerboseResult{Hash: "block3", Height: 3, Tx: []btcjson.TxRawResult{{
+		Txid: "spend",
+		Vin:  []btcjson.Vin{{Txid: "tx0", Vout: 0}, {Txid: "tx0", Vout: 1}, {Txid: "unknown", Vout: 7}},
+		Vout: []btcjson.Vout{testVout(0, 2.4, "D")},
+	}}}
+	client.syncTxVoutBalance(ctx, block)
+
+	var vins []interface{}
+	for _, doc := range es.all("tx") {
+		vins = doc["vins"].([]interface{})
+		assert.Equal(t, true, doc["fee_incomplete"])
+	}
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"address": "M1", "value": 2.0, "outpoint": "tx0:0"},
+		map[string]interface{}{"address": "M2", "value": 2.0, "outpoint": "tx0:0"},
+		map[string]interface{}{"value": 0.5, "outpoint": "tx0:1"},
+		map[string]interface{}{"value": 0.0, "outpoint": "unknown:7", "unresolved": true},
+	}, vins)
+
+	txs, total, err := client.FindAddressSpends(ctx, "M2", 0, 10)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, total)
+	assert.Equal(t, "spend", txs[0].Txid)
+	_, total, err = client.FindAddressSpends(ctx, "D", 0, 10)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, total)
+}
+
+func TestSyncBalanceBatches(t *testing.T) {
+	defer func() { config.BalanceBulkActions = 0 }()
+	// 每个地址单独一批，以及所有地址一批 (B 的 vin、vout 变化合并)
+	for _, actions := range []int{1, 100} {
+		es := newTestSyncES()
+		client := es.client(t)
+		config.BalanceBulkActions = actions
+
+		block := testSyncBlock()
+		block.Tx[1].Vout = append(block.Tx[1].Vout, testVout(2, 0.05, "D"))
+		stats := client.syncTxVoutBalance(context.Background(), block)
+		es.close()
+
+		assert.Equal(t, map[string]float64{"A": 50, "B": 5.9, "C": 4, "D": 0.05}, balancesByAddress(es), actions)
+		assert.Len(t, es.all("balance"), 4)
+		assert.Equal(t, 0.05, btcFloat(stats.TotalFees))
+	}
+}
+
+func TestBalanceBatchMergesAddress(t *testing.T) {
+	config.BalanceBulkActions = 100
+	defer func() { config.BalanceBulkActions = 0 }()
+	block := testSyncBlock()
+	batch := (&elasticClientAlias{}).newBalanceBatch(context.Background(), block)
+
+	batch.add("B", &BalanceWithID{ID: "balance-b"}, decimal.NewFromFloat(-10), []string{"tx2"})
+	batch.add("B", nil, decimal.NewFromFloat(5.9), []string{"tx2"})
+	batch.add("C", nil, decimal.NewFromFloat(4), []string{"tx2"})
+	assert.Equal(t, []string{"B", "C"}, batch.addresses)
+	assert.Equal(t, "balance-b", batch.pending["B"].ID)
+	assert.Equal(t, -4.1, btcFloat(batch.pending["B"].Delta))
+	assert.Equal(t, []string{"tx2"}, batch.pending["B"].Txids)
+	assert.Equal(t, "", batch.pending["C"].ID)
+}
+
+// 两个区块在不同 goroutine 中同步，涉及相同的地址 B、C，余额不能互相覆盖，C 也不能插入两个余额文档
+// go test -race 检查共享状态的访问
+func TestSyncTxVoutBalanceConcurrentBlocks(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	other := &btcjson.GetBlockVerboseResult{
+		Hash:   "block3",
+		Height: 3,
+		Tx: []btcjson.TxRawResult{{
+			Txid: "coinbase3",
+			Vin:  []btcjson.Vin{{Coinbase: "04ffff001d0103"}},
+			Vout: []btcjson.Vout{testVout(0, 49, "B"), testVout(1, 1, "C")},
+		}},
+	}
+
+	var wg sync.WaitGroup
+	for _, block := range []*btcjson.GetBlockVerboseResult{testSyncBlock(), other} {
+		wg.Add(1)
+		go func(block *btcjson.GetBlockVerboseResult) {
+			defer wg.Done()
+			client.syncTxVoutBalance(ctx, block)
+		}(block)
+	}
+	wg.Wait()
+
+	assert.Equal(t, map[string]float64{"A": 50, "B": 54.9, "C": 5}, balancesByAddress(es))
+	assert.Len(t, es.all("balance"), 3)
+}
+
+// fakePrevouts 模拟节点返回的 vout
+type fakePrevouts map[IndexUTXO]*VoutStream
+
+func (f fakePrevouts) prevout(outpoint IndexUTXO) (*VoutStream, error) {
+	if vout, ok := f[outpoint]; ok {
+		return vout, nil
+	}
+	return nil, ErrVoutNotFound
+}
+
+// tx2 还花费了同步起始高度之前的 tx0:1 (D 的 2)，es 中没有该 vout，由节点补全
+func TestSyncTxVoutBalancePrevoutFallback(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	prevouts = fakePrevouts{{"tx0", 1}: {TxIDBelongTo: "tx0", Value: 2, Voutindex: 1, Addresses: []string{"D"}}}
+	defer func() { prevouts = nil }()
+
+	block := testSyncBlock()
+	block.Tx[1].Vin = append(block.Tx[1].Vin, btcjson.Vin{Txid: "tx0", Vout: 1})
+	client.syncTxVoutBalance(ctx, block)
+
+	// D 的余额为同步范围内的净变化
+	assert.Equal(t, map[string]float64{"A": 50, "B": 5.9, "C": 4, "D": -2}, balancesByAddress(es))
+	for _, doc := range es.all("tx") {
+		if doc["txid"] == "tx2" {
+			assert.Equal(t, 2.1, doc["fee"])
+			assert.Equal(t, false, doc["fee_incomplete"])
+		}
+	}
+	var recovered map[string]interface{}
+	for _, doc := range es.all("vout") {
+		if doc["txidbelongto"] == "tx0" {
+			recovered = doc
+		}
+	}
+	assert.Equal(t, map[string]interface{}{"txid": "tx2", "vinindex": float64(1), "height": float64(2)}, recovered["used"])
+	assert.Equal(t, true, recovered["recovered"])
+
+	// 回滚时补全的 vout 和 es 中的 vout 一样加回余额，补全的 vout 被删除
+	assert.Nil(t, client.RollbackTxVoutBalanceByBlock(ctx, block, false))
+	assert.Equal(t, map[string]float64{"A": 0, "B": 10, "C": 0, "D": 0}, balancesByAddress(es))
+	for _, doc := range es.all("vout") {
+		assert.NotEqual(t, "tx0", doc["txidbelongto"])
+	}
+}
+
+// recordingPrevouts 记录向节点查询的 outpoint
+type recordingPrevouts struct {
+	fakePrevouts
+	queried []IndexUTXO
+}
+
+func (r *recordingPrevouts) prevout(outpoint IndexUTXO) (*VoutStream, error) {
+	r.queried = append(r.queried, outpoint)
+	return r.fakePrevouts.prevout(outpoint)
+}
+
+// tx2 还花费了同一区块中 coinbase2 创建的 vout，它在 bulk 写入前不在 es 中，但不能从节点补全
+func TestSyncTxVoutBalancePrevoutFallbackSameBlock(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+
+	recorder := &recordingPrevouts{fakePrevouts: fakePrevouts{{"coinbase2", 0}: {TxIDBelongTo: "coinbase2", Value: 50, Voutindex: 0, Addresses: []string{"A"}}}}
+	prevouts = recorder
+	defer func() { prevouts = nil }()
+
+	block := testSyncBlock()
+	block.Tx[1].Vin = append(block.Tx[1].Vin, btcjson.Vin{Txid: "coinbase2", Vout: 0})
+	client.syncTxVoutBalance(context.Background(), block)
+
+	assert.Empty(t, recorder.queried)
+	assert.Equal(t, 50.0, balancesByAddress(es)["A"])
+	created := 0
+	for _, doc := range es.all("vout") {
+		if doc["txidbelongto"] == "coinbase2" {
+			created++
+		}
+	}
+	assert.Equal(t, 1, created)
+}
+
+// watch 模式只关注 C: coinbase2 不涉及 C，tx2 支付 C 4，B 的 tx1:0 不在 es 中，由节点补全
+func TestSyncWatchedAddresses(t *testing.T) {
+	config.WatchedAddresses = map[string]bool{"C": true}
+	defer func() { config.WatchedAddresses = nil }()
+	prevouts = fakePrevouts{{"tx1", 0}: {TxIDBelongTo: "tx1", Value: 10, Voutindex: 0, Addresses: []string{"B"}}}
+	defer func() { prevouts = nil }()
+
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	stats := client.syncTxVoutBalance(ctx, testSyncBlock())
+	assert.Equal(t, 1, stats.TxCount)
+	assert.Equal(t, map[string]float64{"C": 4}, balancesByAddress(es))
+	txs := es.all("tx")
+	assert.Len(t, txs, 1)
+	for _, doc := range txs {
+		assert.Equal(t, "tx2", doc["txid"])
+		assert.Equal(t, 0.1, doc["fee"])
+		assert.Equal(t, false, doc["fee_incomplete"])
+	}
+	vouts := es.all("vout")
+	assert.Len(t, vouts, 1)
+	for _, doc := range vouts {
+		assert.Equal(t, []interface{}{"C"}, doc["addresses"])
+	}
+
+	// 区块 3: C 花费 tx2:0 支付 D，花费了 es 中关注地址的 vout，同步该交易
+	block3 := &btcjson.GetBlockVerboseResult{
+		Hash:   "block3",
+		Height: 3,
+		Tx: []btcjson.TxRawResult{
+			{Txid: "coinbase3", Vin: []btcjson.Vin{{Coinbase: "04ffff001d0103"}}, Vout: []btcjson.Vout{testVout(0, 50, "A")}},
+			{Txid: "tx3", Vin: []btcjson.Vin{{Txid: "tx2", Vout: 0}}, Vout: []btcjson.Vout{testVout(0, 3.9, "D")}},
+		},
+	}
+	client.syncTxVoutBalance(ctx, block3)
+	assert.Equal(t, map[string]float64{"C": 0}, balancesByAddress(es))
+	assert.Len(t, es.all("tx"), 2)
+	assert.Len(t, es.all("vout"), 1)
+}
+
+// tx2 的输出中有没有地址的 pubkey、nonstandard 和 nulldata 输出，都写入 vout，金额计入手续费
+func TestSyncVoutsWithoutAddress(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	noAddress := func(n uint32, value float64, scriptType string) btcjson.Vout {
+		return btcjson.Vout{Value: value, N: n, ScriptPubKey: btcjson.ScriptPubKeyResult{Type: scriptType}}
+	}
+	block := testSyncBlock()
+	block.Tx[1].Vout = []btcjson.Vout{testVout(0, 4, "C"), noAddress(1, 3, "pubkey"), noAddress(2, 2.9, "nonstandard"), noAddress(3, 0, "nulldata")}
+	client.syncTxVoutBalance(ctx, block)
+
+	assert.Equal(t, map[string]float64{"A": 50, "B": 0, "C": 4}, balancesByAddress(es))
+	scriptTypes := make(map[string]interface{})
+	for _, doc := range es.all("vout") {
+		if doc["txidbelongto"] == "tx2" {
+			scriptTypes[doc["script_type"].(string)] = doc["unspendable"]
+			if doc["script_type"] != "pubkeyhash" {
+				assert.Equal(t, []interface{}{}, doc["addresses"])
+			}
+		}
+	}
+	assert.Equal(t, map[string]interface{}{"pubkeyhash": nil, "pubkey": nil, "nonstandard": nil, "nulldata": true}, scriptTypes)
+	for _, doc := range es.all("tx") {
+		if doc["txid"] == "tx2" {
+			assert.Equal(t, 0.1, doc["fee"])
+		}
+	}
+
+	// 花费没有地址的输出时 vin 可以在 es 中找到，手续费完整
+	block3 := &btcjson.GetBlockVerboseResult{
+		Hash:   "block3",
+		Height: 3,
+		Tx: []btcjson.TxRawResult{
+			{Txid: "coinbase3", Vin: []btcjson.Vin{{Coinbase: "04ffff001d0103"}}, Vout: []btcjson.Vout{testVout(0, 50, "A")}},
+			{Txid: "tx3", Vin: []btcjson.Vin{{Txid: "tx2", Vout: 1}}, Vout: []btcjson.Vout{testVout(0, 2.9, "D")}},
+		},
+	}
+	client.syncTxVoutBalance(ctx, block3)
+	for _, doc := range es.all("tx") {
+		if doc["txid"] == "tx3" {
+			assert.Equal(t, 0.1, doc["fee"])
+			assert.Equal(t, false, doc["fee_incomplete"])
+		}
+	}
+}
+
+func TestSyncTxTimeFallback(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+
+	block := testSyncBlock()
+	block.Time = 1500000000
+	block.Tx[1].Time = 1499999990
+	client.syncTxVoutBalance(context.Background(), block)
+
+	// coinbase2 的 time 为 0，tx 和 vout 都使用区块时间
+	times := make(map[string]float64)
+	for _, doc := range es.all("tx") {
+		times[doc["txid"].(string)] = doc["time"].(float64)
+	}
+	assert.Equal(t, map[string]float64{"coinbase2": 1500000000, "tx2": 1499999990}, times)
+	for _, doc := range es.all("vout") {
+		switch doc["txidbelongto"] {
+		case "coinbase2":
+			assert.Equal(t, float64(1500000000), doc["time"])
+		case "tx2":
+			assert.Equal(t, float64(1499999990), doc["time"])
+		}
+	}
+}
+
+func TestSyncVoutCoinDays(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	// tx1:0 在区块 2 之前 1.5 天创建
+	es.put("vout", "vout-tx1-0", map[string]interface{}{"txidbelongto": "tx1", "voutindex": 0, "value": 10, "coinbase": false, "addresses": []string{"B"}, "used": nil,
+		"time": 1500000000 - 129600, "height": 1})
+	block := testSyncBlock()
+	block.Time = 1500000000
+	client.syncTxVoutBalance(ctx, block)
+
+	spent := es.all("vout")["vout-tx1-0"]
+	assert.Equal(t, map[string]interface{}{"txid": "tx2", "vinindex": float64(0), "height": float64(2), "time": float64(1500000000), "coindays": float64(15)}, spent["used"])
+	for id, doc := range es.all("vout") {
+		if id != "vout-tx1-0" {
+			assert.Equal(t, float64(2), doc["height"])
+		}
+	}
+
+	coinDays, err := client.CoinDaysDestroyed(ctx, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(15), coinDays)
+	coinDays, err = client.CoinDaysDestroyed(ctx, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(0), coinDays)
+}
+
+func TestCommitSyncStateAfterFlush(t *testing.T) {
+	config.FlushBeforeSyncState = true
+	defer func() { config.FlushBeforeSyncState = false }()
+
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	es.put("block", "1", map[string]interface{}{"height": 1, "hash": "block1"})
+	assert.Nil(t, client.commitSyncState(ctx, 1, "block1"))
+	assert.Equal(t, syncFlushIndices, es.flushed)
+
+	// 区块 2 写入后 flush 失败 (进程在两个区块之间崩溃)，sync state 仍然是区块 1，重启后回滚并重新同步区块 2
+	es.put("block", "2", map[string]interface{}{"height": 2, "hash": "block2"})
+	es.failFlush = true
+	assert.NotNil(t, client.commitSyncState(ctx, 2, "block2"))
+	state, found, err := client.QuerySyncState(ctx)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, &syncState{Height: 1, Hash: "block1"}, state)
+	start, resume, _, err := client.ResolveStartHeight(ctx, 0)
+	assert.Nil(t, err)
+	assert.True(t, resume)
+	assert.EqualValues(t, 2, start)
+
+	es.failFlush = false
+	assert.Nil(t, client.commitSyncState(ctx, 2, "block2"))
+	state, _, err = client.QuerySyncState(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, &syncState{Height: 2, Hash: "block2"}, state)
+}
+
+// sync state 落后超过 ROLLBACKHEIGHT 个区块时同步开始的回滚覆盖不了已写入的区块，不能继续同步
+func TestResolveStartHeightStateTooFarBehind(t *testing.T) {
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	client.UpdateSyncState(ctx, 1, "block1")
+	for height := 1; height <= 1+ROLLBACKHEIGHT; height++ {
+		es.put("block", strconv.Itoa(height), map[string]interface{}{"height": height, "hash": "block" + strconv.Itoa(height)})
+	}
+	start, resume, warnings, err := client.ResolveStartHeight(ctx, 0)
+	assert.Nil(t, err)
+	assert.True(t, resume)
+	assert.EqualValues(t, 2, start)
+	assert.Len(t, warnings, 1)
+
+	es.put("block", strconv.Itoa(2+ROLLBACKHEIGHT), map[string]interface{}{"height": 2 + ROLLBACKHEIGHT, "hash": "block" + strconv.Itoa(2+ROLLBACKHEIGHT)})
+	_, _, _, err = client.ResolveStartHeight(ctx, 0)
+	assert.NotNil(t, err)
+}
+
+func TestCommitSyncStateWritesBalanceJournal(t *testing.T) {
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	// 没有开启 flush_before_sync_state 时同样先写入排队的 balance journal，再记录 sync state
+	assert.Nil(t, client.StartBalanceJournal(ctx))
+	defer client.closeBalanceJournal()
+	client.BulkInsertBalanceJournal(ctx, []AddressWithAmountAndTxid{{Address: "addr1", Amount: 1, Txid: "tx1"}}, "sync+")
+	assert.Len(t, es.all("balancejournal"), 0)
+	assert.Nil(t, client.commitSyncState(ctx, 1, "block1"))
+	assert.Len(t, es.all("balancejournal"), 1)
+	assert.Empty(t, es.flushed)
+	state, found, err := client.QuerySyncState(ctx)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, &syncState{Height: 1, Hash: "block1"}, state)
+}
+
+func TestFinalizeSync(t *testing.T) {
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	// 同步区间时 balance journal 留在 bulk processor 中，不再每个区块写入一次
+	assert.Nil(t, client.StartBalanceJournal(ctx))
+	client.BulkInsertBalanceJournal(ctx, []AddressWithAmountAndTxid{{Address: "addr1", Amount: 1, Txid: "tx1"}}, "sync+")
+	client.BulkInsertBalanceJournal(ctx, []AddressWithAmountAndTxid{{Address: "addr2", Amount: 2, Txid: "tx2"}}, "sync+")
+	assert.Len(t, es.all("balancejournal"), 0)
+
+	es.put("block", "1", map[string]interface{}{"height": 1, "hash": "block1"})
+	es.put("block", "2", map[string]interface{}{"height": 2, "hash": "block2"})
+	refreshes := es.refreshes
+	assert.Nil(t, client.FinalizeSync(ctx, client))
+	assert.Nil(t, client.journal)
+	assert.Len(t, es.all("balancejournal"), 2)
+	// 一次 _refresh，加上查询区块 hash 的 get 带的 refresh=true
+	assert.Equal(t, refreshes+2, es.refreshes)
+	assert.Equal(t, syncFlushIndices, es.flushed)
+	state, found, err := client.QuerySyncState(ctx)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, &syncState{Height: 2, Hash: "block2"}, state)
+	assert.Equal(t, "1", es.forcemerged["block"])
+
+	// 没有 StartBalanceJournal 时每次写入后 flush
+	client.BulkInsertBalanceJournal(ctx, []AddressWithAmountAndTxid{{Address: "addr3", Amount: 3, Txid: "tx3"}}, "sync+")
+	assert.Len(t, es.all("balancejournal"), 3)
+}
+
+func TestSyncBalanceDLQ(t *testing.T) {
+	balanceDLQ := config.BalanceDLQ
+	config.BalanceDLQ = true
+	defer func() { config.BalanceDLQ = balanceDLQ }()
+
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	// 已有的 balance 文档全部更新失败，同步继续，余额变化记录到 balance_dlq。新建 balance 文档失败时会退出，所以 A、C 预先有余额文档
+	es.put("balance", "balance-a", map[string]interface{}{"address": "A", "amount": 0})
+	es.put("balance", "balance-c", map[string]interface{}{"address": "C", "amount": 0})
+	es.failBulkIndex = "balance"
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+	assert.Equal(t, map[string]float64{"A": 0, "B": 10, "C": 0}, balancesByAddress(es))
+	deltas := make(map[string]float64)
+	for _, doc := range es.all("balance_dlq") {
+		deltas[doc["address"].(string)] += doc["delta"].(float64)
+		assert.Equal(t, "block2", doc["blockhash"])
+	}
+	assert.Equal(t, map[string]float64{"A": 50, "B": -4.1, "C": 4}, deltas)
+
+	es.failBulkIndex = ""
+	replayed, err := client.ReplayBalanceDLQ(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, replayed)
+	assert.Equal(t, map[string]float64{"A": 50, "B": 5.9, "C": 4}, balancesByAddress(es))
+	assert.Len(t, es.all("balance_dlq"), 0)
+}
+
+func TestSyncIncludeScripts(t *testing.T) {
+	config.IncludeScripts = true
+	defer func() { config.IncludeScripts = false }()
+
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	block := testSyncBlock()
+	block.Tx[1].Vin[0].ScriptSig = &btcjson.ScriptSig{Asm: "0 3044[ALL] 5121aa51ae", Hex: "00473044"}
+	block.Tx[1].Vin[0].Witness = []string{"3044", "5121aa51ae"}
+	client.syncTxVoutBalance(ctx, block)
+
+	txs, total, err := client.FindTxsByScriptAsm(ctx, "3044[ALL]", 0, 10)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, total)
+	assert.Equal(t, "tx2", txs[0].Txid)
+	assert.Equal(t, []txVinScript{{Txid: "tx1", Vout: 0, Asm: "0 3044[ALL] 5121aa51ae", Hex: "00473044", Witness: []string{"3044", "5121aa51ae"}}}, txs[0].Scripts)
+
+	// coinbase 交易没有 scriptSig
+	for _, doc := range es.all("tx") {
+		if doc["txid"] == "coinbase2" {
+			assert.Nil(t, doc["scripts"])
+		}
+	}
+}
+
+func TestSyncAddressDocs(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+	block3 := &btcjson.GetBlockVerboseResult{
+		Hash:   "block3",
+		Height: 3,
+		Tx: []btcjson.TxRawResult{{
+			Txid: "coinbase3",
+			Vin:  []btcjson.Vin{{Coinbase: "04ffff001d0103"}},
+			Vout: []btcjson.Vout{testVout(0, 49, "C"), {Value: 1, N: 1, ScriptPubKey: btcjson.ScriptPubKeyResult{Type: "witness_v0_keyhash", Addresses: []string{"E"}}}},
+		}},
+	}
+	client.syncTxVoutBalance(ctx, block3)
+
+	addresses := es.all("address")
+	assert.Len(t, addresses, 4)
+	assert.Equal(t, map[string]interface{}{"address": "C", "script_type": "pubkeyhash", "first_height": float64(2), "last_height": float64(3), "tx_count": float64(2)}, addresses["C"])
+	assert.Equal(t, float64(2), addresses["B"]["last_height"])
+	assert.Equal(t, "witness_v0_keyhash", addresses["E"]["script_type"])
+
+	// 回滚后删除在该区块第一次出现的地址
+	assert.Nil(t, client.RollbackTxVoutBalanceByBlock(ctx, block3, false))
+	addresses = es.all("address")
+	assert.Len(t, addresses, 3)
+	assert.Nil(t, addresses["E"])
+	assert.Equal(t, float64(2), addresses["C"]["first_height"])
+	assert.Equal(t, float64(1), addresses["C"]["tx_count"])
+}
+
+func TestAddressTxCountRollback(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	txCounts := func() map[string]float64 {
+		counts := make(map[string]float64)
+		for address, doc := range es.all("address") {
+			counts[address] = doc["tx_count"].(float64)
+		}
+		return counts
+	}
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+	baseline := txCounts()
+	assert.Equal(t, map[string]float64{"A": 1, "B": 1, "C": 1}, baseline)
+
+	// 区块 3: coinbase 奖励给新地址 D，tx3 花费 B 在 tx2:1 的 5.9，支付 C 2，找零 B 3.8，B 在同一交易中作为输入和输出只计一次
+	block3 := &btcjson.GetBlockVerboseResult{
+		Hash:   "block3",
+		Height: 3,
+		Tx: []btcjson.TxRawResult{
+			{Txid: "coinbase3", Vin: []btcjson.Vin{{Coinbase: "04ffff001d0103"}}, Vout: []btcjson.Vout{testVout(0, 50.1, "D")}},
+			{Txid: "tx3", Vin: []btcjson.Vin{{Txid: "tx2", Vout: 1}}, Vout: []btcjson.Vout{testVout(0, 2, "C"), testVout(1, 3.8, "B")}},
+		},
+	}
+	client.syncTxVoutBalance(ctx, block3)
+	assert.Equal(t, map[string]float64{"A": 1, "B": 2, "C": 2, "D": 1}, txCounts())
+
+	// 回滚后计数回到同步区块 3 之前，在区块 3 第一次出现的 D 被删除
+	assert.Nil(t, client.RollbackTxVoutBalanceByBlock(ctx, block3, false))
+	assert.Equal(t, baseline, txCounts())
+
+	// 重新同步后与第一次同步相同
+	client.syncTxVoutBalance(ctx, block3)
+	assert.Equal(t, map[string]float64{"A": 1, "B": 2, "C": 2, "D": 1}, txCounts())
+}
+
+func TestAddressEverUsed(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+	// 区块 3: tx3 花费 C 在 tx2:0 的全部 4，C 的余额为 0
+	client.syncTxVoutBalance(ctx, &btcjson.GetBlockVerboseResult{
+		Hash:   "block3",
+		Height: 3,
+		Tx: []btcjson.TxRawResult{
+			{Txid: "coinbase3", Vin: []btcjson.Vin{{Coinbase: "04ffff001d0103"}}, Vout: []btcjson.Vout{testVout(0, 50, "A")}},
+			{Txid: "tx3", Vin: []btcjson.Vin{{Txid: "tx2", Vout: 0}}, Vout: []btcjson.Vout{testVout(0, 4, "D")}},
+		},
+	})
+
+	// 余额花完后 balance 文档保留 amount 为 0
+	var spent map[string]interface{}
+	for _, doc := range es.all("balance") {
+		if doc["address"] == "C" {
+			spent = doc
+		}
+	}
+	assert.NotNil(t, spent)
+	assert.Equal(t, float64(0), spent["amount"])
+
+	for _, address := range []string{"C", "D"} {
+		used, err := client.AddressEverUsed(ctx, address)
+		assert.Nil(t, err)
+		assert.True(t, used, address)
+	}
+	// 之前版本同步的地址没有 address 文档，按 balance 文档判断
+	es.mu.Lock()
+	delete(es.docs["address"], "C")
+	es.mu.Unlock()
+	used, err := client.AddressEverUsed(ctx, "C")
+	assert.Nil(t, err)
+	assert.True(t, used)
+
+	used, err = client.AddressEverUsed(ctx, "unknown")
+	assert.Nil(t, err)
+	assert.False(t, used)
+}
+
+func TestSyncVinDocs(t *testing.T) {
+	config.VinDocs = true
+	defer func() { config.VinDocs = false }()
+
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	block := testSyncBlock()
+	block.Time = 1500000000
+	client.syncTxVoutBalance(ctx, block)
+
+	// coinbase 的输入不花费 vout，没有 vin 文档
+	vins := es.all("vin")
+	assert.Len(t, vins, 1)
+	assert.Equal(t, map[string]interface{}{"txid": "tx2", "vinindex": float64(0), "prev_txid": "tx1", "prev_vout": float64(0),
+		"value": float64(10), "addresses": []interface{}{"B"}, "height": float64(2), "time": float64(1500000000)}, vins["tx2:0"])
+
+	detail, err := client.GetTxWithResolvedInputs(ctx, "tx2")
+	assert.Nil(t, err)
+	assert.Equal(t, []*resolvedInput{{PrevTxid: "tx1", PrevVout: 0, Value: 10, Addresses: []string{"B"}}}, detail.Inputs)
+
+	assert.Nil(t, client.RollbackTxVoutBalanceByBlock(ctx, block, false))
+	assert.Len(t, es.all("vin"), 0)
+}
+
+func TestGetTxWithResolvedInputs(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+
+	detail, err := client.GetTxWithResolvedInputs(ctx, "tx2")
+	assert.Nil(t, err)
+	assert.Equal(t, "tx2", detail.Tx.Txid)
+	assert.Equal(t, []*resolvedInput{{PrevTxid: "tx1", PrevVout: 0, Value: 10, Addresses: []string{"B"}}}, detail.Inputs)
+	assert.Len(t, detail.Outputs, 2)
+	assert.Equal(t, []string{"C"}, detail.Outputs[0].Addresses)
+	assert.Equal(t, 5.9, detail.Outputs[1].Value)
+
+	detail, err = client.GetTxWithResolvedInputs(ctx, "coinbase2")
+	assert.Nil(t, err)
+	assert.Empty(t, detail.Inputs)
+
+	_, err = client.GetTxWithResolvedInputs(ctx, "tx3")
+	assert.True(t, errors.Is(err, ErrTxNotFound))
+}
+
+func TestBlockTargetAndDifficultyRatio(t *testing.T) {
+	target, err := blockTarget("1d00ffff")
+	assert.Nil(t, err)
+	assert.Equal(t, math.Ldexp(0xffff, 208), target)
+	_, err = blockTarget("")
+	assert.NotNil(t, err)
+
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	es.put("block", "1", map[string]interface{}{"height": 1, "difficulty": 2})
+
+	block := testSyncBlock()
+	block.Bits, block.Difficulty = "1d00ffff", 3
+	client.RollBackAndSyncBlock(2, block, &blockHeaderVerbose{}, &blockStats{})
+	doc := es.all("block")["2"]
+	assert.Equal(t, 1.5, doc["difficulty_ratio"])
+	assert.Equal(t, target, doc["target"])
+
+	// 前一个区块不在 es 中
+	block.Height = 4
+	client.RollBackAndSyncBlock(4, block, &blockHeaderVerbose{}, &blockStats{})
+	assert.Nil(t, es.all("block")["4"]["difficulty_ratio"])
+}
+
+func TestReconcileBalances(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	block := testSyncBlock()
+	stats := client.syncTxVoutBalance(ctx, block)
+	client.RollBackAndSyncBlock(2, block, &blockHeaderVerbose{}, stats)
+
+	// C 的余额被错误修改，D 不在区块中，不会被修正
+	for id, doc := range es.all("balance") {
+		if doc["address"] == "C" {
+			doc["amount"] = 1
+			es.put("balance", id, doc)
+		}
+	}
+	es.put("balance", "balance-d", map[string]interface{}{"address": "D", "amount": 3})
+
+	corrections, err := client.ReconcileBalances(ctx, 2, 2, true)
+	assert.Nil(t, err)
+	assert.Equal(t, []*balanceCorrection{{"C", true, 1, 4}}, corrections)
+	assert.Equal(t, 1.0, balancesByAddress(es)["C"])
+
+	corrections, err = client.ReconcileBalances(ctx, 2, 2, false)
+	assert.Nil(t, err)
+	assert.Len(t, corrections, 1)
+	assert.Equal(t, map[string]float64{"A": 50, "B": 5.9, "C": 4, "D": 3}, balancesByAddress(es))
+}
+
+// 区块中的 vout 超过一页时翻页读取全部地址
+func TestBlockVoutAddressesPages(t *testing.T) {
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	vouts := txGraphPageSize + 5
+	for i := 0; i < vouts; i++ {
+		es.put("vout", fmt.Sprint("v", i), map[string]interface{}{"txidbelongto": "tx", "voutindex": i, "height": 7, "addresses": []string{fmt.Sprint("A", i)}})
+	}
+
+	addresses, err := client.blockVoutAddresses(context.Background(), 7, "height", "created")
+	assert.Nil(t, err)
+	assert.Len(t, addresses, vouts)
+}
+
+func TestBlockTail(t *testing.T) {
+	var out bytes.Buffer
+	tail := newBlockTail(&out, 1)
+	stats := &blockStats{TxCount: 2, TotalFees: decimal.NewFromFloat(0.1)}
+	block := testSyncBlock()
+
+	// 启动时已同步的区块不输出，重新同步的同一区块只输出一次，分叉后 hash 变化的区块再次输出
+	tail.blockSynced(&btcjson.GetBlockVerboseResult{Hash: "block1", Height: 1}, stats, time.Second)
+	tail.blockSynced(block, stats, 1500*time.Millisecond)
+	tail.blockSynced(block, stats, time.Second)
+	tail.blockSynced(&btcjson.GetBlockVerboseResult{Hash: "block2b", Height: 2}, &blockStats{}, 1234567*time.Microsecond)
+	assert.Equal(t, "2 block2 txs=2 fees=0.1 elapsed=1.5s\n2 block2b txs=0 fees=0 elapsed=1.235s\n", out.String())
+}
+
+func TestRepairUTXOConsistency(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	block := testSyncBlock()
+	client.syncTxVoutBalance(ctx, block)
+	getBlock := func(height int32) (*btcjson.GetBlockVerboseResult, error) { return block, nil }
+
+	// tx2 花费 tx1:0 没有写入 used 和 B 的余额；tx0:0 被记录为在区块 2 花费，但区块中没有花费它的交易
+	vout := es.all("vout")["vout-tx1-0"]
+	vout["used"] = nil
+	es.put("vout", "vout-tx1-0", vout)
+	es.put("balance", "balance-b", map[string]interface{}{"address": "B", "amount": 15.9})
+	es.put("vout", "vout-tx0-0", map[string]interface{}{"txidbelongto": "tx0", "voutindex": 0, "value": 2, "addresses": []string{"D"},
+		"used": map[string]interface{}{"txid": "txX", "vinindex": 0, "height": 2}})
+	es.put("balance", "balance-d", map[string]interface{}{"address": "D", "amount": 0})
+
+	expected := []*utxoRepair{{2, "tx1", 0, "", "tx2"}, {2, "tx0", 0, "txX", ""}}
+	repairs, err := client.RepairUTXOConsistency(ctx, 2, 2, getBlock, true)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, repairs)
+	assert.Nil(t, es.all("vout")["vout-tx1-0"]["used"])
+
+	repairs, err = client.RepairUTXOConsistency(ctx, 2, 2, getBlock, false)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, repairs)
+	assert.Equal(t, "tx2", es.all("vout")["vout-tx1-0"]["used"].(map[string]interface{})["txid"])
+	assert.Nil(t, es.all("vout")["vout-tx0-0"]["used"])
+	assert.Equal(t, map[string]float64{"A": 50, "B": 5.9, "C": 4, "D": 2}, balancesByAddress(es))
+
+	// 修正后再次执行没有需要修正的 vout
+	repairs, err = client.RepairUTXOConsistency(ctx, 2, 2, getBlock, false)
+	assert.Nil(t, err)
+	assert.Len(t, repairs, 0)
+}
+
+// 区块花费的 vout 超过一页时翻页读取全部，相同 outpoint 的 orphaned vout 也不会被跳过
+func TestVoutsSpentAtPages(t *testing.T) {
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+	vouts := txGraphPageSize + 5
+	for i := 0; i < vouts; i++ {
+		es.put("vout", fmt.Sprint("v", i), map[string]interface{}{"txidbelongto": "tx", "voutindex": i % (vouts - 1),
+			"used": map[string]interface{}{"txid": "spender", "vinindex": i, "height": 7}})
+	}
+
+	spent, err := client.voutsSpentAt(context.Background(), 7)
+	assert.Nil(t, err)
+	assert.Len(t, spent, vouts)
+}
+
+func TestRecomputeFees(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	block := testSyncBlock()
+	block.Tx[1].Vsize = 200
+	client.syncTxVoutBalance(ctx, block)
+	getBlock := func(height int32) (*btcjson.GetBlockVerboseResult, error) { return block, nil }
+	txDocID := func(txid string) string {
+		for id, doc := range es.all("tx") {
+			if doc["txid"] == txid {
+				return id
+			}
+		}
+		return ""
+	}
+	txDoc := func(txid string) map[string]interface{} { return es.all("tx")[txDocID(txid)] }
+
+	// tx2 的 fee 计算有误，区块的 total_fees 与节点统计的不一致
+	tx2 := txDoc("tx2")
+	tx2["fee"], tx2["feerate"] = 0.2, 100000.0
+	es.put("tx", txDocID("tx2"), tx2)
+	es.put("block", "2", map[string]interface{}{"hash": "block2", "height": 2, "total_fees": 0.2, "reported_fees": 0.1, "fee_mismatch": true})
+
+	expected := []*feeRepair{{2, "tx2", 0.2, 0.1, false, false}}
+	repairs, err := client.RecomputeFees(ctx, 2, 2, getBlock, true)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, repairs)
+	assert.Equal(t, 0.2, txDoc("tx2")["fee"])
+
+	repairs, err = client.RecomputeFees(ctx, 2, 2, getBlock, false)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, repairs)
+	assert.Equal(t, 0.1, txDoc("tx2")["fee"])
+	assert.Equal(t, 50000.0, txDoc("tx2")["feerate"])
+	assert.Equal(t, 0.0, txDoc("coinbase2")["fee"])
+	assert.Equal(t, 0.1, es.all("block")["2"]["total_fees"])
+	assert.Equal(t, false, es.all("block")["2"]["fee_mismatch"])
+	// 修正后的区块文档 digest 仍然一致
+	assert.NotNil(t, es.all("block")["2"]["digest"])
+	mismatched, err := client.VerifyBlockDigests(ctx, 2, 2)
+	assert.Nil(t, err)
+	assert.Empty(t, mismatched)
+
+	// 修正后再次执行没有需要修正的 tx
+	repairs, err = client.RecomputeFees(ctx, 2, 2, getBlock, false)
+	assert.Nil(t, err)
+	assert.Len(t, repairs, 0)
+
+	// tx2 花费的 vout 不在 es 中时与同步相同，fee 为 0 并标记 fee_incomplete，vins 记录未找到的 outpoint
+	delete(es.docs["vout"], "vout-tx1-0")
+	repairs, err = client.RecomputeFees(ctx, 2, 2, getBlock, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []*feeRepair{{2, "tx2", 0.1, 0, false, true}}, repairs)
+	assert.Equal(t, true, txDoc("tx2")["fee_incomplete"])
+	assert.Equal(t, []interface{}{map[string]interface{}{"value": 0.0, "outpoint": "tx1:0", "unresolved": true}}, txDoc("tx2")["vins"])
+	assert.Equal(t, 0.0, es.all("block")["2"]["total_fees"])
+	assert.Equal(t, true, es.all("block")["2"]["fee_mismatch"])
+}
+
+func TestRollbackTxVoutBalanceByBlock(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+	assert.Nil(t, client.RollbackTxVoutBalanceByBlock(ctx, testSyncBlock(), false))
+
+	// 回滚后 vin 地址加回花费的金额，vout 地址减去收到的金额
+	assert.Equal(t, map[string]float64{"A": 0, "B": 10, "C": 0}, balancesByAddress(es))
+
+	vouts := es.all("vout")
+	assert.Len(t, vouts, 1)
+	assert.Nil(t, vouts["vout-tx1-0"]["used"])
+	assert.Len(t, es.all("tx"), 0)
+}
+
+func TestRollbackSoftDeleteVouts(t *testing.T) {
+	config.SoftDeleteVouts = true
+	defer func() { config.SoftDeleteVouts = false }()
+
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+	assert.Nil(t, client.RollbackTxVoutBalanceByBlock(ctx, testSyncBlock(), true))
+	assert.Equal(t, map[string]float64{"A": 0, "B": 10, "C": 0}, balancesByAddress(es))
+
+	// 区块创建的 vout 保留，标记为 orphaned
+	orphaned := func() int {
+		n := 0
+		for id, vout := range es.all("vout") {
+			if vout["orphaned"] == true {
+				assert.Equal(t, float64(2), vout["reorg_height"], id)
+				assert.Nil(t, vout["used"], id)
+				n++
+			}
+		}
+		return n
+	}
+	assert.Len(t, es.all("vout"), 4)
+	assert.Equal(t, 3, orphaned())
+	balance, err := client.UTXOBalance(ctx, "C")
+	assert.Nil(t, err)
+	assert.Equal(t, float64(0), balance)
+
+	// 重新同步写入新的 vout，再次回滚只标记新的 vout，余额与第一次回滚相同
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+	assert.Equal(t, map[string]float64{"A": 50, "B": 5.9, "C": 4}, balancesByAddress(es))
+	balance, err = client.UTXOBalance(ctx, "C")
+	assert.Nil(t, err)
+	assert.Equal(t, float64(4), balance)
+	assert.Nil(t, client.RollbackTxVoutBalanceByBlock(ctx, testSyncBlock(), true))
+	assert.Equal(t, map[string]float64{"A": 0, "B": 10, "C": 0}, balancesByAddress(es))
+	assert.Equal(t, 6, orphaned())
+
+	// prune-spent-vouts 删除回滚高度低于 --before 的 orphaned vout
+	count, err := client.CountSpentVouts(ctx, 2)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 0, count)
+	deleted, err := client.PruneSpentVouts(ctx, 3)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 6, deleted)
+	assert.Len(t, es.all("vout"), 1)
+}
+
+// 例行重新同步 (不是分叉) 时即使开启 soft_delete_vouts 也直接删除区块创建的 vout
+func TestRollbackResyncDeletesVouts(t *testing.T) {
+	config.SoftDeleteVouts = true
+	defer func() { config.SoftDeleteVouts = false }()
+
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+	assert.Nil(t, client.RollbackTxVoutBalanceByBlock(ctx, testSyncBlock(), false))
+	assert.Equal(t, map[string]float64{"A": 0, "B": 10, "C": 0}, balancesByAddress(es))
+	vouts := es.all("vout")
+	assert.Len(t, vouts, 1)
+	assert.Nil(t, vouts["vout-tx1-0"]["orphaned"])
+}
+
+// syncSnapshot 回滚前后对比的 es 状态: vout、tx 文档，非 0 的余额和地址的 tx_count。
+// 值为 null 的字段与没有该字段等价 (回滚把 used 和 redeemaddresses 置为 null)，
+// 回滚后在该区块第一次出现的地址仍保留余额为 0 的 balance 文档，重新同步时原地更新，不计入对比
+func syncSnapshot(es *fakeES) map[string]interface{} {
+	docs := func(index string) map[string]interface{} {
+		snapshot := make(map[string]interface{})
+		for _, doc := range es.all(index) {
+			for k, v := range doc {
+				if v == nil {
+					delete(doc, k)
+				}
+			}
+			raw, _ := json.Marshal(doc)
+			snapshot[string(raw)] = doc
+		}
+		return snapshot
+	}
+	balances := make(map[string]float64)
+	for address, amount := range balancesByAddress(es) {
+		if amount != 0 {
+			balances[address] = amount
+		}
+	}
+	txCounts := make(map[string]interface{})
+	for address, doc := range es.all("address") {
+		txCounts[address] = doc["tx_count"]
+	}
+	return map[string]interface{}{"vout": docs("vout"), "tx": docs("tx"), "balance": balances, "tx_count": txCounts}
+}
+
+func TestSyncRollbackRoundTrip(t *testing.T) {
+	// 区块 3: coinbase 奖励给新地址 D 并带一个 OP_RETURN 输出，tx3 花费 C 的 4 和 B 的 5.9，支付 C 2，找零 B 7.8
+	block3 := func() *btcjson.GetBlockVerboseResult {
+		return &btcjson.GetBlockVerboseResult{
+			Hash:   "block3",
+			Height: 3,
+			Tx: []btcjson.TxRawResult{
+				{
+					Txid: "coinbase3",
+					Vin:  []btcjson.Vin{{Coinbase: "04ffff001d0103"}},
+					Vout: []btcjson.Vout{testVout(0, 50.1, "D"), {Value: 0, N: 1, ScriptPubKey: btcjson.ScriptPubKeyResult{Type: "nulldata"}}},
+				},
+				{
+					Txid: "tx3",
+					Vin:  []btcjson.Vin{{Txid: "tx2", Vout: 0}, {Txid: "tx2", Vout: 1}},
+					Vout: []btcjson.Vout{testVout(0, 2, "C"), testVout(1, 7.8, "B")},
+				},
+			},
+		}
+	}
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+	before := syncSnapshot(es)
+
+	client.syncTxVoutBalance(ctx, block3())
+	synced := syncSnapshot(es)
+	assert.NotEqual(t, before, synced)
+	assert.Equal(t, map[string]float64{"A": 50, "B": 7.8, "C": 2, "D": 50.1}, synced["balance"])
+
+	assert.Nil(t, client.RollbackTxVoutBalanceByBlock(ctx, block3(), false))
+	assert.Equal(t, before, syncSnapshot(es))
+
+	// 回滚后重新同步与第一次同步相同
+	client.syncTxVoutBalance(ctx, block3())
+	assert.Equal(t, synced, syncSnapshot(es))
+}
+
+// 包含 n 笔交易的区块: txi 花费 previ:0 (地址 Pi%10 的 1)，支付 Qi%10 0.9；同步前 previ:0 写入 es
+func newTestLargeBlockES(n int) (*fakeES, *btcjson.GetBlockVerboseResult) {
+	es := newFakeES()
+	block := &btcjson.GetBlockVerboseResult{Hash: "block3", Height: 3}
+	for i := 0; i < n; i++ {
+		prev, owner := fmt.Sprintf("prev%d", i), fmt.Sprintf("P%d", i%10)
+		es.put("vout", "vout-"+prev, map[string]interface{}{"txidbelongto": prev, "voutindex": 0, "value": 1, "coinbase": false, "addresses": []string{owner}, "used": nil})
+		block.Tx = append(block.Tx, btcjson.TxRawResult{
+			Txid: fmt.Sprintf("tx%d", i),
+			Vin:  []btcjson.Vin{{Txid: prev, Vout: 0}},
+			Vout: []btcjson.Vout{testVout(0, 0.9, fmt.Sprintf("Q%d", i%10))},
+		})
+	}
+	for i := 0; i < 10; i++ {
+		es.put("balance", fmt.Sprintf("balance-p%d", i), map[string]interface{}{"address": fmt.Sprintf("P%d", i), "amount": float64(n / 10)})
+	}
+	return es, block
+}
+
+// 一笔交易花费 newTestLargeBlockES 中的 n 个 previ:0 (共 n)，支付 Q0 n-1
+func newTestHighInputTxES(n int) (*fakeES, *btcjson.GetBlockVerboseResult) {
+	es, block := newTestLargeBlockES(n)
+	tx := btcjson.TxRawResult{Txid: "consolidate", Vout: []btcjson.Vout{testVout(0, float64(n-1), "Q0")}}
+	for _, spend := range block.Tx {
+		tx.Vin = append(tx.Vin, spend.Vin...)
+	}
+	block.Tx = []btcjson.TxRawResult{tx}
+	return es, block
+}
+
+func TestSyncHighInputTxConcurrentVinQueries(t *testing.T) {
+	es, block := newTestHighInputTxES(1050)
+	client := es.client(t)
+	defer es.close()
+	config.VinQueryBatchSize, config.VinQueryConcurrency = 100, 4
+	defer func() { config.VinQueryBatchSize, config.VinQueryConcurrency = 0, 0 }()
+
+	stats := client.syncTxVoutBalance(context.Background(), block)
+	assert.Equal(t, 1050, stats.VinsSpent)
+	assert.Equal(t, 1.0, btcFloat(stats.TotalFees))
+	balances := balancesByAddress(es)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 0.0, balances[fmt.Sprintf("P%d", i)])
+	}
+	assert.Equal(t, 1049.0, balances["Q0"])
+}
+
+// 每个查询模拟 2ms 的往返时间，比较一笔 3000 个输入的交易在不同并发数下的同步耗时
+func BenchmarkSyncHighInputTx(b *testing.B) {
+	defer func() { config.VinQueryBatchSize, config.VinQueryConcurrency = 0, 0 }()
+	for _, concurrency := range []int{1, 4, 16} {
+		config.VinQueryBatchSize, config.VinQueryConcurrency = 100, concurrency
+		b.Run(fmt.Sprintf("concurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				es, block := newTestHighInputTxES(3000)
+				es.searchLatency = 2 * time.Millisecond
+				esClient := es.client(b)
+				b.StartTimer()
+
+				esClient.syncTxVoutBalance(context.Background(), block)
+				es.close()
+			}
+		})
+	}
+}
+
+func TestRollbackLargeBlockBatchesQueries(t *testing.T) {
+	es, block := newTestLargeBlockES(1200)
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	before := balancesByAddress(es)
+	client.syncTxVoutBalance(ctx, block)
+	es.requests = 0
+	assert.Nil(t, client.RollbackTxVoutBalanceByBlock(ctx, block, false))
+
+	// 每 500 个 outpoint 一次查询，而不是每笔交易两次查询
+	assert.True(t, es.requests < 20, "rollback requests: %d", es.requests)
+	for address, amount := range balancesByAddress(es) {
+		if _, ok := before[address]; ok {
+			assert.Equal(t, before[address], amount, address)
+		} else {
+			assert.Equal(t, 0.0, btcFloat(decimal.NewFromFloat(amount)), address)
+		}
+	}
+	assert.Len(t, es.all("vout"), 1200)
+	for _, vout := range es.all("vout") {
+		assert.Nil(t, vout["used"])
+	}
+}
+
+func TestRollbackRefreshOnce(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+	config.RollbackRefreshOnce = true
+	defer func() { config.RollbackRefreshOnce = false }()
+
+	client.syncTxVoutBalance(ctx, testSyncBlock())
+	es.refreshes = 0
+	assert.Nil(t, client.RollbackTxVoutBalanceByBlock(ctx, testSyncBlock(), false))
+
+	// B 同时是 vin 和 vout 地址，vout 阶段使用 vin 阶段回滚后的余额
+	assert.Equal(t, map[string]float64{"A": 0, "B": 10, "C": 0}, balancesByAddress(es))
+	assert.Equal(t, 1, es.refreshes)
+}
+
+// 模拟 es 没有 refresh 的开销，refreshes/op 为每次回滚等待 refresh 的请求数，真实集群上每次 refresh 需要等待一个 refresh 周期
+func BenchmarkRollbackTxVoutBalanceByBlock(b *testing.B) {
+	defer func() { config.RollbackRefreshOnce = false }()
+	for _, once := range []bool{false, true} {
+		config.RollbackRefreshOnce = once
+		b.Run(fmt.Sprintf("refresh_once=%v", once), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				es, block := newTestLargeBlockES(3000)
+				esClient := es.client(b)
+				esClient.syncTxVoutBalance(context.Background(), block)
+				es.requests, es.refreshes = 0, 0
+				b.StartTimer()
+
+				esClient.RollbackTxVoutBalanceByBlock(context.Background(), block, false)
+				b.ReportMetric(float64(es.requests), "requests/op")
+				b.ReportMetric(float64(es.refreshes), "refreshes/op")
+				es.close()
+			}
+		})
+	}
+}
+
+func TestSyncTxVoutBalanceRepeatedAddress(t *testing.T) {
+	es := newTestSyncES()
+	es.put("balance", "balance-a", map[string]interface{}{"address": "A", "amount": 0.5})
+	client := es.client(t)
+	defer es.close()
+
+	// tx2 的两个 vout 都支付给 A，另外两个 vout 都支付给还没有余额文档的 D
+	block := testSyncBlock()
+	block.Tx[1].Vout = []btcjson.Vout{testVout(0, 1, "A"), testVout(1, 2, "A"), testVout(2, 3, "D"), testVout(3, 3.9, "D")}
+	client.syncTxVoutBalance(context.Background(), block)
+
+	// coinbase 50 + 1 + 2，D 只插入一个余额文档
+	assert.Equal(t, map[string]float64{"A": 53.5, "B": 0, "D": 6.9}, balancesByAddress(es))
+	assert.Len(t, es.all("balance"), 3)
+}
+
+func TestSyncGenesisBlock(t *testing.T) {
+	es := newFakeES()
+	// 之后其他交易转入创世区块 coinbase 地址的余额
+	es.put("balance", "balance-genesis", map[string]interface{}{"address": "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", "amount": 1})
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	block := &btcjson.GetBlockVerboseResult{
+		Hash:   "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+		Height: 0,
+		Tx: []btcjson.TxRawResult{{
+			Txid: "4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b",
+			Vin:  []btcjson.Vin{{Coinbase: "04ffff001d0104"}},
+			Vout: []btcjson.Vout{testVout(0, 50, "1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa")},
+		}},
+	}
+	stats := client.syncTxVoutBalance(ctx, block)
+
+	// vout 写入但标记为 unspendable，余额不变
+	vouts := es.all("vout")
+	assert.Len(t, vouts, 1)
+	for _, vout := range vouts {
+		assert.Equal(t, true, vout["unspendable"])
+	}
+	assert.Equal(t, map[string]float64{"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa": 1}, balancesByAddress(es))
+	assert.Equal(t, 50.0, btcFloat(stats.TotalOutputValue))
+
+	// 回滚时也不从余额中减去
+	assert.Nil(t, client.RollbackTxVoutBalanceByBlock(ctx, block, false))
+	assert.Len(t, es.all("vout"), 0)
+	assert.Equal(t, map[string]float64{"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa": 1}, balancesByAddress(es))
+}
+
+func TestSyncSkipsZeroValueBalances(t *testing.T) {
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+	ctx := context.Background()
+
+	// tx2 另有一个带地址的 OP_RETURN 输出和一个金额为 0 的普通输出
+	block2 := testSyncBlock()
+	opReturn := btcjson.Vout{N: 2, ScriptPubKey: btcjson.ScriptPubKeyResult{Type: "nulldata", Addresses: []string{"N"}}}
+	block2.Tx[1].Vout = append(block2.Tx[1].Vout, opReturn, testVout(3, 0, "Z"))
+	client.syncTxVoutBalance(ctx, block2)
+	assert.Equal(t, map[string]float64{"A": 50, "B": 5.9, "C": 4}, balancesByAddress(es))
+
+	// 花费金额为 0 的输出时同样不查询、不更新 Z 的余额
+	client.syncTxVoutBalance(ctx, &btcjson.GetBlockVerboseResult{
+		Hash:   "block3",
+		Height: 3,
+		Tx: []btcjson.TxRawResult{
+			{Txid: "coinbase3", Vin: []btcjson.Vin{{Coinbase: "04ffff001d0103"}}, Vout: []btcjson.Vout{testVout(0, 50, "A")}},
+			{Txid: "tx3", Vin: []btcjson.Vin{{Txid: "tx2", Vout: 0}, {Txid: "tx2", Vout: 3}}, Vout: []btcjson.Vout{testVout(0, 3.9, "D")}},
+		},
+	})
+	assert.Equal(t, map[string]float64{"A": 100, "B": 5.9, "C": 0, "D": 3.9}, balancesByAddress(es))
+
+	// 两个输出仍然写入 vout index
+	voutsByOutpoint := make(map[string]map[string]interface{})
+	for _, doc := range es.all("vout") {
+		voutsByOutpoint[fmt.Sprintf("%s:%v", doc["txidbelongto"], doc["voutindex"])] = doc
+	}
+	assert.Equal(t, true, voutsByOutpoint["tx2:2"]["unspendable"])
+	assert.Equal(t, "tx3", voutsByOutpoint["tx2:3"]["used"].(map[string]interface{})["txid"])
+}
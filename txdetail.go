@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/olivere/elastic"
+)
+
+// txDetailMaxInputsOutputs GetTxWithResolvedInputs 最多返回的输入、输出数
+const txDetailMaxInputsOutputs = 10000
+
+// resolvedInput 交易输入及其花费的 vout
+type resolvedInput struct {
+	PrevTxid  string   `json:"prev_txid"`
+	PrevVout  uint32   `json:"prev_vout"`
+	Value     float64  `json:"value"`
+	Addresses []string `json:"addresses"`
+}
+
+// txDetail 交易详情页需要的数据: tx 文档，从 vout index 解析的输入和输出
+type txDetail struct {
+	Tx      *esTx            `json:"tx"`
+	Inputs  []*resolvedInput `json:"inputs"`
+	Outputs []*VoutStream    `json:"outputs"`
+}
+
+// GetTxWithResolvedInputs 查询 txid 对应的交易，并解析每个输入花费的 vout 的地址和金额。
+// 开启 vin_docs 时输入从 vin index 读取，按输入在交易中的顺序返回；否则从 vout index 按 used.txid 查询，vout 不记录输入的位置，按花费的 outpoint 排序。
+// 被 prune-spent-vouts 删除的 vout 无法解析，coinbase 交易没有输入
+func (esClient *elasticClientAlias) GetTxWithResolvedInputs(ctx context.Context, txid string) (*txDetail, error) {
+	searchResult, err := esClient.Search().Index("tx").Query(elastic.NewTermQuery("txid", txid)).Size(1).Do(ctx)
+	if err != nil {
+		return nil, errors.New(strings.Join([]string{"Get tx error:", err.Error()}, " "))
+	}
+	if len(searchResult.Hits.Hits) == 0 {
+		return nil, fmt.Errorf("tx %s: %w", txid, ErrTxNotFound)
+	}
+	detail := &txDetail{Tx: new(esTx)}
+	if err := json.Unmarshal(*searchResult.Hits.Hits[0].Source, detail.Tx); err != nil {
+		return nil, errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+	}
+
+	if config.VinDocs {
+		detail.Inputs, err = esClient.txInputsFromVins(ctx, txid)
+	} else {
+		detail.Inputs, err = esClient.txInputsFromVouts(ctx, txid)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	outputs, err := esClient.searchVouts(ctx, elastic.NewTermQuery("txidbelongto", txid))
+	if err != nil {
+		return nil, err
+	}
+	// 旧版本创建的 vout index 中 voutindex 为 keyword，按字符串排序的结果不是数值顺序
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i].Voutindex < outputs[j].Voutindex })
+	detail.Outputs = outputs
+	return detail, nil
+}
+
+// txInputsFromVins 由 vin index 得到交易的输入，按输入的位置排序
+func (esClient *elasticClientAlias) txInputsFromVins(ctx context.Context, txid string) ([]*resolvedInput, error) {
+	searchResult, err := esClient.Search().Index("vin").Type("vin").Query(elastic.NewTermQuery("txid", txid)).
+		Sort("vinindex", true).Size(txDetailMaxInputsOutputs).Do(ctx)
+	if err != nil {
+		return nil, errors.New(strings.Join([]string{"Query tx vins error:", err.Error()}, " "))
+	}
+	var inputs []*resolvedInput
+	for _, hit := range searchResult.Hits.Hits {
+		vin := new(vinDoc)
+		if err := json.Unmarshal(*hit.Source, vin); err != nil {
+			return nil, errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+		}
+		inputs = append(inputs, &resolvedInput{PrevTxid: vin.PrevTxid, PrevVout: vin.PrevVout, Value: vin.Value, Addresses: vin.Addresses})
+	}
+	return inputs, nil
+}
+
+// txInputsFromVouts 由 vout index 中被该交易花费的 vout 得到交易的输入，按 outpoint 排序
+func (esClient *elasticClientAlias) txInputsFromVouts(ctx context.Context, txid string) ([]*resolvedInput, error) {
+	spent, err := esClient.searchVouts(ctx, elastic.NewTermQuery("used.txid", txid))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(spent, func(i, j int) bool {
+		if spent[i].TxIDBelongTo != spent[j].TxIDBelongTo {
+			return spent[i].TxIDBelongTo < spent[j].TxIDBelongTo
+		}
+		return spent[i].Voutindex < spent[j].Voutindex
+	})
+	var inputs []*resolvedInput
+	for _, vout := range spent {
+		inputs = append(inputs, &resolvedInput{PrevTxid: vout.TxIDBelongTo, PrevVout: vout.Voutindex, Value: vout.Value, Addresses: vout.Addresses})
+	}
+	return inputs, nil
+}
+
+func (esClient *elasticClientAlias) searchVouts(ctx context.Context, q elastic.Query) ([]*VoutStream, error) {
+	searchResult, err := esClient.Search().Index("vout").Type("vout").Query(liveVoutsQuery(q)).Size(txDetailMaxInputsOutputs).Do(ctx)
+	if err != nil {
+		return nil, errors.New(strings.Join([]string{"Query tx vouts error:", err.Error()}, " "))
+	}
+	var vouts []*VoutStream
+	for _, hit := range searchResult.Hits.Hits {
+		vout := new(VoutStream)
+		if err := json.Unmarshal(*hit.Source, vout); err != nil {
+			return nil, errors.New(strings.Join([]string{"unmarshal error:", err.Error()}, " "))
+		}
+		vouts = append(vouts, vout)
+	}
+	return vouts, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/olivere/elastic"
+)
+
+// txAlias tx 文档查询使用的 index 名。开启 monthly_tx_indices 时 tx 是所有按月 index 的别名，
+// 查询、delete by query 通过别名读写所有月份，写入和按 id 更新需要具体的 index (见 txIndex 和搜索结果的 _index)
+const txAlias = "tx"
+
+// txIndexPrefix 按月 index 的名字前缀，也是 index template 的 index_patterns
+const txIndexPrefix = "tx-"
+
+// txIndex tx 文档写入的 index。开启 monthly_tx_indices 时按交易时间 (即区块时间，UTC) 写入 tx-YYYY-MM，否则写入 tx
+func txIndex(txTime int64) string {
+	if !config.MonthlyTxIndices {
+		return txAlias
+	}
+	return txIndexPrefix + time.Unix(txTime, 0).UTC().Format("2006-01")
+}
+
+// createMonthlyTxIndices 开启 monthly_tx_indices 时代替创建 tx index：写入 tx-* 的 index template (mapping、codec 以及别名 tx)，
+// 新的月份在第一次写入时由 es 按 template 创建。同时创建当前月份的 index，保证还没有写入 tx 文档时别名 tx 已经存在，查询不会因为 index 不存在而失败。
+// 已有的月份按 mappingVersion 检查 mapping，与 createIndices 相同只输出警告；已经存在名为 tx 的 index 时别名无法创建，返回错误
+func (esClient *elasticClientAlias) createMonthlyTxIndices(ctx context.Context) error {
+	existing, err := esClient.GetMapping().Index(txAlias).Type("tx").Do(ctx)
+	if err != nil && !elastic.IsNotFound(err) {
+		return errors.New(strings.Join([]string{"Get tx mapping error:", err.Error()}, " "))
+	}
+	if _, found := existing[txAlias]; found {
+		return errors.New("monthly_tx_indices is on but tx is an index, not an alias of monthly indices: reindex the txs into tx-YYYY-MM indices and delete the tx index first")
+	}
+
+	body, typeMapping, err := versionedMapping("tx", indexMapping("tx"))
+	if err != nil {
+		return errors.New(strings.Join([]string{"Parse tx mapping error:", err.Error()}, " "))
+	}
+	withIndexCodec(body, config.ElasticIndexCodecs["tx"])
+	body["index_patterns"] = []string{txIndexPrefix + "*"}
+	body["aliases"] = map[string]interface{}{txAlias: map[string]interface{}{}}
+	if _, err := esClient.IndexPutTemplate(txAlias).BodyJson(body).Do(ctx); err != nil {
+		return errors.New(strings.Join([]string{"Put tx index template error:", err.Error()}, " "))
+	}
+
+	current := txIndex(time.Now().Unix())
+	if result, err := esClient.CreateIndex(current).Do(ctx); err == nil && result.Acknowledged {
+		sugar.Info(strings.Join([]string{"Create index:", result.Index}, ""))
+	}
+
+	indices := make([]string, 0, len(existing))
+	for index := range existing {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	for _, index := range indices {
+		if err := esClient.updateIndexMapping(ctx, index, "tx", storedMappingVersion(existing, index, "tx"), typeMapping); err != nil {
+			sugar.Warn(err.Error())
+		}
+	}
+	return nil
+}
+
+// txILMPolicy 开启 tx_data_stream 时 tx data stream 使用的 ILM policy 名
+const txILMPolicy = "tx"
+
+// txDocType tx 文档的 mapping type。开启 tx_data_stream 时 tx 是 ES7 的 data stream，backing index 是 typeless 的，type 为 _doc。
+// 只有写入和按 id 更新需要 type，查询和 delete by query 不指定 type，在 ES6 只有一个 type 的 tx index 和 data stream 上都适用
+func txDocType() string {
+	if config.TxDataStream {
+		return "_doc"
+	}
+	return "tx"
+}
+
+// txStreamDoc 写入 data stream 的 tx 文档，data stream 要求文档有 @timestamp，取交易时间
+type txStreamDoc struct {
+	*esTx
+	Timestamp int64 `json:"@timestamp"`
+}
+
+// txIndexRequest 写入 tx 文档的 bulk 请求。data stream 是只追加的，只接受 op_type 为 create 的写入
+func txIndexRequest(tx *esTx) elastic.BulkableRequest {
+	request := elastic.NewBulkIndexRequest().Index(txIndex(tx.Time)).Type(txDocType())
+	if config.TxDataStream {
+		return request.OpType("create").Doc(txStreamDoc{tx, tx.Time})
+	}
+	return request.Doc(tx)
+}
+
+// createTxDataStream 开启 tx_data_stream 时代替创建 tx index：写入 ILM policy 和 tx 的 index template (typeless 的 tx mapping 加上 @timestamp、codec 以及 ILM policy)，
+// tx data stream 不存在时创建。policy 和 template 每次启动时覆盖，修改 tx_ilm_* 后重启即可生效，新的 mapping 从下一次 rollover 的 backing index 开始生效。
+// 已经存在名为 tx 的 index 时 data stream 无法创建，返回错误
+func (esClient *elasticClientAlias) createTxDataStream(ctx context.Context) error {
+	if _, err := esClient.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodPut,
+		Path:   "/_ilm/policy/" + txILMPolicy,
+		Body:   txILMPolicyBody(),
+	}); err != nil {
+		return errors.New(strings.Join([]string{"Put tx ilm policy error:", err.Error()}, " "))
+	}
+
+	body, typeMapping, err := versionedMapping("tx", indexMapping("tx"))
+	if err != nil {
+		return errors.New(strings.Join([]string{"Parse tx mapping error:", err.Error()}, " "))
+	}
+	properties := typeMapping["properties"].(map[string]interface{})
+	properties["@timestamp"] = map[string]interface{}{"type": "date", "format": "epoch_second"}
+	settings, ok := body["settings"].(map[string]interface{})
+	if !ok {
+		settings = make(map[string]interface{})
+	}
+	settings["index.lifecycle.name"] = txILMPolicy
+	if codec := config.ElasticIndexCodecs["tx"]; codec != "" {
+		settings["codec"] = codec
+	}
+	template := map[string]interface{}{
+		"index_patterns": []string{txAlias},
+		"data_stream":    map[string]interface{}{},
+		"priority":       200,
+		"template":       map[string]interface{}{"settings": settings, "mappings": typeMapping},
+	}
+	if _, err := esClient.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodPut,
+		Path:   "/_index_template/" + txAlias,
+		Body:   template,
+	}); err != nil {
+		return errors.New(strings.Join([]string{"Put tx index template error:", err.Error()}, " "))
+	}
+
+	existing, err := esClient.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method:       http.MethodGet,
+		Path:         "/_data_stream/" + txAlias,
+		IgnoreErrors: []int{http.StatusNotFound},
+	})
+	if err != nil {
+		return errors.New(strings.Join([]string{"Get tx data stream error:", err.Error()}, " "))
+	}
+	if existing.StatusCode == http.StatusOK {
+		return nil
+	}
+	if _, err := esClient.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method: http.MethodPut,
+		Path:   "/_data_stream/" + txAlias,
+	}); err != nil {
+		return errors.New(strings.Join([]string{"tx_data_stream is on but the tx data stream can't be created, delete or reindex an existing tx index first:", err.Error()}, " "))
+	}
+	sugar.Info("Create data stream: ", txAlias)
+	return nil
+}
+
+// txILMPolicyBody tx data stream 的 ILM policy：写入的 backing index 达到 tx_ilm_rollover_max_age 或 tx_ilm_rollover_max_size 时 rollover，
+// 设置了 tx_ilm_delete_after 时 rollover 之后经过该时间删除 backing index
+func txILMPolicyBody() map[string]interface{} {
+	rollover := make(map[string]interface{})
+	if config.TxILMRolloverMaxAge != "" {
+		rollover["max_age"] = config.TxILMRolloverMaxAge
+	}
+	if config.TxILMRolloverMaxSize != "" {
+		rollover["max_size"] = config.TxILMRolloverMaxSize
+	}
+	phases := map[string]interface{}{
+		"hot": map[string]interface{}{"actions": map[string]interface{}{"rollover": rollover}},
+	}
+	if config.TxILMDeleteAfter != "" {
+		phases["delete"] = map[string]interface{}{"min_age": config.TxILMDeleteAfter, "actions": map[string]interface{}{"delete": map[string]interface{}{}}}
+	}
+	return map[string]interface{}{"policy": map[string]interface{}{"phases": phases}}
+}
+
+// deleteTxDataStream 删除 tx data stream 及其 backing index，data stream 的 backing index 不能直接删除
+func (esClient *elasticClientAlias) deleteTxDataStream(ctx context.Context) error {
+	if _, err := esClient.PerformRequest(ctx, elastic.PerformRequestOptions{
+		Method:       http.MethodDelete,
+		Path:         "/_data_stream/" + txAlias,
+		IgnoreErrors: []int{http.StatusNotFound},
+	}); err != nil {
+		return errors.New(strings.Join([]string{"Delete tx data stream error:", err.Error()}, " "))
+	}
+	return nil
+}
+
+// es7Transport 开启 tx_data_stream 时连接的是 ES 7.9+，elastic v6 的客户端仍然使用带 type 的 API。
+// 创建 index、读写 mapping 和 legacy template 时加上 include_type_name，search 时加上 rest_total_hits_as_int，
+// 让 ES7 按 ES6 的格式接受 mapping、返回 hits.total
+type es7Transport struct {
+	base http.RoundTripper
+}
+
+func (t *es7Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	var param string
+	switch {
+	case parts[len(parts)-1] == "_search":
+		param = "rest_total_hits_as_int"
+	case parts[0] == "_template", len(parts) > 1 && parts[1] == "_mapping",
+		len(parts) == 1 && !strings.HasPrefix(parts[0], "_") && req.Method == http.MethodPut:
+		param = "include_type_name"
+	default:
+		return t.base.RoundTrip(req)
+	}
+	// RoundTripper 不能修改传入的请求
+	req = req.Clone(req.Context())
+	query := req.URL.Query()
+	query.Set(param, "true")
+	req.URL.RawQuery = query.Encode()
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTxIndex(t *testing.T) {
+	// 2017-08-01 00:00:00 UTC，按 UTC 划分月份，前一秒 (北京时间已经是 8 月) 仍属于 7 月
+	august := int64(1501545600)
+	assert.Equal(t, "tx", txIndex(august))
+
+	config.MonthlyTxIndices = true
+	defer func() { config.MonthlyTxIndices = false }()
+	assert.Equal(t, "tx-2017-08", txIndex(august))
+	assert.Equal(t, "tx-2017-07", txIndex(august-1))
+}
+
+func TestCreateMonthlyTxIndices(t *testing.T) {
+	config.MonthlyTxIndices = true
+	defer func() { config.MonthlyTxIndices = false }()
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+
+	client.createIndices()
+	_, created := es.mappings["tx"]
+	assert.False(t, created)
+	_, created = es.mappings[txIndex(time.Now().Unix())]
+	assert.True(t, created)
+	template := es.templates["tx"]
+	assert.Equal(t, []interface{}{"tx-*"}, template["index_patterns"])
+	assert.Equal(t, map[string]interface{}{"tx": map[string]interface{}{}}, template["aliases"])
+	txType := template["mappings"].(map[string]interface{})["tx"].(map[string]interface{})
+	assert.EqualValues(t, mappingVersion, txType["_meta"].(map[string]interface{})["mapping_version"])
+	assert.NotNil(t, txType["properties"].(map[string]interface{})["feerate"])
+
+	// 已经有名为 tx 的 index 时不能创建别名
+	es.mappings["tx"] = map[string]interface{}{"properties": map[string]interface{}{}}
+	assert.NotNil(t, client.createMonthlyTxIndices(context.Background()))
+}
+
+func TestSyncMonthlyTxIndices(t *testing.T) {
+	config.MonthlyTxIndices = true
+	defer func() { config.MonthlyTxIndices = false }()
+	es := newTestSyncES()
+	client := es.client(t)
+	defer es.close()
+
+	block := testSyncBlock()
+	block.Time = 1501545600
+	client.syncTxVoutBalance(context.Background(), block)
+	assert.Empty(t, es.all("tx"))
+	assert.Len(t, es.all("tx-2017-08"), 2)
+}
+
+func TestCreateTxDataStream(t *testing.T) {
+	config.TxDataStream = true
+	config.TxILMRolloverMaxAge = "30d"
+	config.TxILMDeleteAfter = "365d"
+	defer func() { config.TxDataStream, config.TxILMRolloverMaxAge, config.TxILMDeleteAfter = false, "", "" }()
+	es := newFakeES()
+	client := es.client(t)
+	defer es.close()
+
+	client.createIndices()
+	_, created := es.mappings["tx"]
+	assert.False(t, created)
+	assert.True(t, es.dataStreams["tx"])
+	phases := es.ilmPolicies[txILMPolicy]["policy"].(map[string]interface{})["phases"].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"max_age": "30d"}, phases["hot"].(map[string]interface{})["actions"].(map[string]interface{})["rollover"])
+	assert.Equal(t, "365d", phases["delete"].(map[string]interface{})["min_age"])
+	template := es.indexTemplates["tx"]
+	assert.Equal(t, []interface{}{"tx"}, template["index_patterns"])
+	assert.NotNil(t, template["data_stream"])
+	settings := template["template"].(map[string]interface{})["settings"].(map[string]interface{})
+	assert.Equal(t, txILMPolicy, settings["index.lifecycle.name"])
+	properties := template["template"].(map[string]interface{})["mappings"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.NotNil(t, properties["@timestamp"])
+	assert.NotNil(t, properties["feerate"])
+
+	// data stream 已存在时不重复创建
+	assert.Nil(t, client.createTxDataStream(context.Background()))
+	// 已经有名为 tx 的 index 时不能创建 data stream
+	delete(es.dataStreams, "tx")
+	es.mappings["tx"] = map[string]interface{}{"properties": map[string]interface{}{}}
+	assert.NotNil(t, client.createTxDataStream(context.Background()))
+}
+
+func TestSyncTxDataStream(t *testing.T) {
+	config.TxDataStream = true
+	defer func() { config.TxDataStream = false }()
+	es := newTestSyncES()
+	es.dataStreams["tx"] = true
+	client := es.client(t)
+	defer es.close()
+
+	block := testSyncBlock()
+	block.Time = 1501545600
+	client.syncTxVoutBalance(context.Background(), block)
+	txs := es.all("tx")
+	assert.Len(t, txs, 2)
+	for _, tx := range txs {
+		assert.EqualValues(t, block.Time, tx["@timestamp"])
+		assert.Equal(t, tx["time"], tx["@timestamp"])
+	}
+}
+
+func TestES7Transport(t *testing.T) {
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Method+" "+r.URL.Path+"?"+r.URL.RawQuery)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: &es7Transport{http.DefaultTransport}}
+	for _, r := range []struct{ method, path string }{
+		{http.MethodPost, "/tx/_search"},
+		{http.MethodPut, "/vout"},
+		{http.MethodGet, "/vout/_mapping/vout"},
+		{http.MethodPut, "/_template/tx"},
+		{http.MethodPost, "/_bulk"},
+		{http.MethodPut, "/_data_stream/tx"},
+	} {
+		req, _ := http.NewRequest(r.method, server.URL+r.path, nil)
+		resp, err := client.Do(req)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		// 不修改传入的请求
+		assert.Empty(t, req.URL.RawQuery)
+	}
+	assert.Equal(t, []string{
+		"POST /tx/_search?rest_total_hits_as_int=true",
+		"PUT /vout?include_type_name=true",
+		"GET /vout/_mapping/vout?include_type_name=true",
+		"PUT /_template/tx?include_type_name=true",
+		"POST /_bulk?",
+		"PUT /_data_stream/tx?",
+	}, got)
+}
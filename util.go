@@ -2,8 +2,12 @@ package main
 
 import (
 	homedir "github.com/mitchellh/go-homedir"
+	"github.com/shopspring/decimal"
 )
 
+// BTCDecimalPlaces 比特币最小单位 1 satoshi = 0.00000001 BTC
+const BTCDecimalPlaces = 8
+
 // HomeDir 获取服务器当前用户目录路径
 func HomeDir() string {
 	home, err := homedir.Dir()
@@ -24,3 +28,9 @@ func removeDuplicatesForSlice(slice ...interface{}) []string {
 	}
 	return result
 }
+
+// btcFloat 保留 8 位小数 (satoshi 精度) 后转换为 float64，所有写入 es 的金额都应经过该函数
+func btcFloat(amount decimal.Decimal) float64 {
+	f, _ := amount.Round(BTCDecimalPlaces).Float64()
+	return f
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBtcFloatSatoshiRoundTrip(t *testing.T) {
+	satoshi := decimal.NewFromFloat(0.00000001)
+	assert.Equal(t, 0.00000001, btcFloat(satoshi))
+
+	balance := decimal.NewFromFloat(1).Add(satoshi)
+	assert.Equal(t, 1.00000001, btcFloat(balance))
+	assert.Equal(t, float64(1), btcFloat(decimal.NewFromFloat(btcFloat(balance)).Sub(satoshi)))
+
+	// 超过 8 位小数的部分按 satoshi 精度舍入
+	assert.Equal(t, 0.00000001, btcFloat(decimal.NewFromFloat(0.000000014)))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/olivere/elastic"
+)
+
+// vinDoc vin index 中的文档，每个被花费的 vout 对应一个文档，记录花费它的交易输入，文档 id 为 txid:vinindex
+// 与 vout 文档的 used 字段对称，开启 vin_docs 时写入，可以直接按输入查询而不用遍历 tx 文档的 vins
+type vinDoc struct {
+	Txid      string   `json:"txid"`      // 花费 vout 的交易 id
+	VinIndex  uint32   `json:"vinindex"`  // 输入在交易中的位置
+	PrevTxid  string   `json:"prev_txid"` // 被花费的 vout 所在交易 id
+	PrevVout  uint32   `json:"prev_vout"` // 被花费的 vout 的 voutindex
+	Value     float64  `json:"value"`
+	Addresses []string `json:"addresses"`
+	Height    int32    `json:"height"` // 花费所在区块高度
+	Time      int64    `json:"time"`   // 花费所在区块时间
+}
+
+// newVinDoc tx 中花费 vout 的输入，tx 中没有花费该 vout 的输入时 found 为 false
+func newVinDoc(tx btcjson.TxRawResult, vout *VoutStream, block *btcjson.GetBlockVerboseResult) (*vinDoc, bool) {
+	for i, vin := range tx.Vin {
+		if vin.Txid != vout.TxIDBelongTo || vin.Vout != vout.Voutindex {
+			continue
+		}
+		return &vinDoc{
+			Txid:      tx.Txid,
+			VinIndex:  uint32(i),
+			PrevTxid:  vout.TxIDBelongTo,
+			PrevVout:  vout.Voutindex,
+			Value:     vout.Value,
+			Addresses: vout.Addresses,
+			Height:    int32(block.Height),
+			Time:      block.Time,
+		}, true
+	}
+	return nil, false
+}
+
+// indexRequest vin 文档的 bulk 请求，id 固定，重新同步同一区块时覆盖之前的文档
+func (doc *vinDoc) indexRequest() elastic.BulkableRequest {
+	id := strings.Join([]string{doc.Txid, strconv.FormatUint(uint64(doc.VinIndex), 10)}, ":")
+	return elastic.NewBulkIndexRequest().Index("vin").Type("vin").Id(id).Doc(doc)
+}
+
+// DeleteVinsAt 回滚区块时删除该高度的 vin 文档
+func (esClient *elasticClientAlias) DeleteVinsAt(ctx context.Context, height int32) error {
+	q := elastic.NewTermQuery("height", height)
+	if _, err := esClient.DeleteByQuery().Index("vin").Type("vin").Query(q).Refresh(rollbackRefresh()).Do(ctx); err != nil {
+		return errors.New(strings.Join([]string{"Delete vins in rollback block error:", err.Error()}, " "))
+	}
+	return nil
+}
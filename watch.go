@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+// watched 地址中是否有 watched_addresses 中的地址，没有配置 watched_addresses 时索引所有地址
+func watched(addresses []string) bool {
+	if config.WatchedAddresses == nil {
+		return true
+	}
+	for _, address := range addresses {
+		if config.WatchedAddresses[address] {
+			return true
+		}
+	}
+	return false
+}
+
+// watchedBlock 只保留区块中涉及 watched_addresses 的交易：输出支付给关注的地址，或者花费了 vout index 中的 vout
+// (watch 模式下 vout index 只有关注地址的 vout)，区块中前面保留的交易创建的关注地址的 vout 同样算在内
+func (esClient *elasticClientAlias) watchedBlock(ctx context.Context, block *btcjson.GetBlockVerboseResult) (*btcjson.GetBlockVerboseResult, error) {
+	var vins []IndexUTXO
+	for _, tx := range block.Tx {
+		vins = append(vins, indexedVinsFun(tx.Vin)...)
+	}
+	indexed, err := esClient.QueryVoutWithVinsOrVoutsInBatches(ctx, vins, config.RollbackBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	watchedOutpoints := make(map[IndexUTXO]bool)
+	for _, voutWithID := range indexed {
+		watchedOutpoints[IndexUTXO{voutWithID.Vout.TxIDBelongTo, voutWithID.Vout.Voutindex}] = true
+	}
+
+	filtered := *block
+	filtered.Tx = nil
+	for _, tx := range block.Tx {
+		keep := false
+		for _, vin := range tx.Vin {
+			if watchedOutpoints[IndexUTXO{vin.Txid, vin.Vout}] {
+				keep = true
+			}
+		}
+		for _, vout := range tx.Vout {
+			if watched(vout.ScriptPubKey.Addresses) {
+				keep = true
+				watchedOutpoints[IndexUTXO{tx.Txid, vout.N}] = true
+			}
+		}
+		if keep {
+			filtered.Tx = append(filtered.Tx, tx)
+		}
+	}
+	return &filtered, nil
+}